@@ -0,0 +1,422 @@
+package audit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+)
+
+var (
+	// ArchiveBucket is the bucket archived traces are written to
+	ArchiveBucket = "covalence-audit-archives"
+	// ArchiveCompression is how new archives are compressed. Existing archives keep the
+	// encoding they were written with.
+	ArchiveCompression = CompressionGzip
+)
+
+// Compression is the content encoding of an archived trace
+type Compression string
+
+const (
+	CompressionNone Compression = "identity"
+	CompressionGzip Compression = "gzip"
+)
+
+var (
+	// ErrNotArchived is returned by RestoreTrace for a request that was never archived
+	ErrNotArchived = errors.New("request has not been archived")
+	// ErrArchiveMissing is returned when an archive is recorded but its object is gone
+	ErrArchiveMissing = errors.New("archive object is missing")
+
+	// errAlreadyArchived is returned when another worker archived a request first
+	errAlreadyArchived = errors.New("request is already archived")
+)
+
+// ObjectStore is the subset of the S3 client used for archiving, so it can be faked in
+// tests. DownloadObject's error wraps fs.ErrNotExist for a missing object.
+type ObjectStore interface {
+	UploadObject(bucketName, objectName string, data []byte, contentType string) error
+	DownloadObject(bucketName, objectName string) ([]byte, error)
+}
+
+// ArchiveTrace uploads the full trace for a request to cold storage, compressed with
+// ArchiveCompression, records the sha256 hash of the uncompressed trace and marks the
+// request as archived. It returns the archive ID.
+func ArchiveTrace(ctx context.Context, requestID string, db *postgres.DB, store ObjectStore) (string, error) {
+	return archiveTrace(ctx, requestID, db, store, false)
+}
+
+// archiveTrace archives a request's trace. The request is marked before the upload and
+// the archive recorded in the same transaction, so the row stays locked while the
+// object is written: another worker's claim waits for this one to commit or roll back,
+// and a failed upload or a crash leaves the request to be archived again under the same
+// object name rather than half-recorded. With once, a request already marked archived
+// is left alone, before anything is uploaded, and errAlreadyArchived returned.
+func archiveTrace(ctx context.Context, requestID string, db *postgres.DB, store ObjectStore, once bool) (string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	trace, err := GetTrace(ctx, requestID, db)
+	if err != nil {
+		return "", fmt.Errorf("failed to load trace: %w", err)
+	}
+
+	data, err := json.Marshal(trace)
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize trace: %w", err)
+	}
+
+	payload, err := compressArchive(data, ArchiveCompression)
+	if err != nil {
+		return "", fmt.Errorf("failed to compress trace: %w", err)
+	}
+
+	objectName := fmt.Sprintf("traces/%s.json", requestID)
+	contentType := "application/json"
+	if ArchiveCompression == CompressionGzip {
+		objectName += ".gz"
+		contentType = "application/gzip"
+	}
+	var reqUUID pgtype.UUID
+	if err := reqUUID.Scan(requestID); err != nil {
+		return "", fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback(ctx)
+
+	q := db.Queries.WithTx(tx)
+	if once {
+		claimed, err := q.ClaimRequestArchived(ctx, reqUUID)
+		if err != nil {
+			return "", fmt.Errorf("failed to mark request archived: %w", err)
+		}
+		if claimed == 0 {
+			return "", errAlreadyArchived
+		}
+	} else if err := q.MarkRequestArchived(ctx, reqUUID); err != nil {
+		return "", fmt.Errorf("failed to mark request archived: %w", err)
+	}
+
+	if err := store.UploadObject(ArchiveBucket, objectName, payload, contentType); err != nil {
+		return "", err
+	}
+
+	archive, err := q.InsertAuditArchive(ctx, sqlc.InsertAuditArchiveParams{
+		RequestID:       reqUUID,
+		S3Path:          archivePath(ArchiveBucket, objectName),
+		ArchiveHash:     pgtype.Text{String: hashArchive(data), Valid: true},
+		ContentEncoding: string(ArchiveCompression),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to record archive: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("failed to record archive: %w", err)
+	}
+
+	return archive.ArchiveID.String(), nil
+}
+
+// VerifyArchive re-downloads an archived trace and checks it against the stored hash
+func VerifyArchive(ctx context.Context, archiveID string, db *postgres.DB, store ObjectStore) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var archiveUUID pgtype.UUID
+	if err := archiveUUID.Scan(archiveID); err != nil {
+		return fmt.Errorf("invalid archive ID: %w", err)
+	}
+
+	archive, err := db.Queries.GetAuditArchive(ctx, archiveUUID)
+	if err != nil {
+		return fmt.Errorf("failed to load archive: %w", err)
+	}
+
+	_, err = downloadArchive(archive, store)
+	return err
+}
+
+// RestoreTrace reads a request's most recent archive back into a Trace, verifying it
+// against the stored hash. With reinsert, the request's rows are written back too so
+// GetTrace works again; a request whose rows were never purged is left untouched.
+// It returns ErrNotArchived if the request has no archive and ErrArchiveMissing if
+// the archive's object is gone from the store.
+func RestoreTrace(ctx context.Context, requestID string, db *postgres.DB, store ObjectStore, reinsert bool) (Trace, error) {
+
+	if err := ctx.Err(); err != nil {
+		return Trace{}, err
+	}
+
+	var reqUUID pgtype.UUID
+	if err := reqUUID.Scan(requestID); err != nil {
+		return Trace{}, fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	archive, err := db.Queries.GetLatestAuditArchive(ctx, reqUUID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Trace{}, ErrNotArchived
+	}
+	if err != nil {
+		return Trace{}, fmt.Errorf("failed to load archive: %w", err)
+	}
+
+	data, err := downloadArchive(archive, store)
+	if err != nil {
+		return Trace{}, err
+	}
+
+	var trace Trace
+	if err := json.Unmarshal(data, &trace); err != nil {
+		return Trace{}, fmt.Errorf("archive %s is not a trace: %w", archive.ArchiveID.String(), err)
+	}
+
+	if reinsert {
+		if err := reinsertTrace(ctx, trace, db); err != nil {
+			return Trace{}, fmt.Errorf("failed to reinsert trace: %w", err)
+		}
+	}
+
+	return trace, nil
+}
+
+// downloadArchive fetches and decompresses an archived trace, checking it against the
+// stored hash
+func downloadArchive(archive sqlc.AuditArchive, store ObjectStore) ([]byte, error) {
+	archiveID := archive.ArchiveID.String()
+	if !archive.ArchiveHash.Valid || archive.ArchiveHash.String == "" {
+		return nil, fmt.Errorf("archive %s has no stored hash", archiveID)
+	}
+
+	bucketName, objectName, err := parseArchivePath(archive.S3Path)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := store.DownloadObject(bucketName, objectName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: archive %s at %s", ErrArchiveMissing, archiveID, archive.S3Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := decompressArchive(payload, Compression(archive.ContentEncoding))
+	if err != nil {
+		return nil, fmt.Errorf("archive %s: %w", archiveID, err)
+	}
+
+	if got := hashArchive(data); got != archive.ArchiveHash.String {
+		return nil, fmt.Errorf("archive %s hash mismatch: stored %s, computed %s", archiveID, archive.ArchiveHash.String, got)
+	}
+
+	return data, nil
+}
+
+// reinsertTrace writes a restored trace's request, response, chunks and firewall
+// events back in one transaction. The request is marked archived, as it still is.
+func reinsertTrace(ctx context.Context, trace Trace, db *postgres.DB) error {
+	var reqUUID, userUUID, mirrorOf pgtype.UUID
+	if err := reqUUID.Scan(trace.RequestID); err != nil {
+		return fmt.Errorf("invalid request ID: %w", err)
+	}
+	if err := userUUID.Scan(trace.UserID); err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+	if trace.MirrorOf != "" {
+		if err := mirrorOf.Scan(trace.MirrorOf); err != nil {
+			return fmt.Errorf("invalid mirrored request ID: %w", err)
+		}
+	}
+
+	inputs := make([][]byte, 0, len(trace.Inputs))
+	for i, input := range trace.Inputs {
+		data, err := json.Marshal(input)
+		if err != nil {
+			return fmt.Errorf("invalid inputs[%d]: %w", i, err)
+		}
+		inputs = append(inputs, data)
+	}
+
+	var params []byte
+	if trace.RequestParameters != nil {
+		var err error
+		if params, err = json.Marshal(trace.RequestParameters); err != nil {
+			return fmt.Errorf("invalid parameters: %w", err)
+		}
+	}
+
+	var metadata []byte
+	if len(trace.Metadata) > 0 {
+		var err error
+		if metadata, err = json.Marshal(trace.Metadata); err != nil {
+			return fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
+
+	var clientIP *netip.Addr
+	if addr, err := netip.ParseAddr(trace.ClientIP); err == nil {
+		clientIP = &addr
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback(ctx)
+
+	q := db.Queries.WithTx(tx)
+	restored, err := q.RestoreRequestLog(ctx, sqlc.RestoreRequestLogParams{
+		RequestID:     reqUUID,
+		UserID:        userUUID,
+		Model:         trace.Model,
+		TargetUrl:     "", // Not part of a trace
+		Inputs:        inputs,
+		Parameters:    params,
+		ReceivedAt:    pgtype.Timestamptz{Time: trace.ReceivedAt, Valid: true},
+		ClientIp:      clientIP,
+		Sampled:       trace.Sampled,
+		MirrorOf:      mirrorOf,
+		SchemaVersion: restoredSchemaVersion(trace.RequestSchemaVersion),
+		Metadata:      metadata,
+	})
+	if err != nil {
+		return err
+	}
+	if restored == 0 {
+		return nil
+	}
+
+	if trace.Response != nil {
+		response, err := responseParams(Response{
+			RequestID:         trace.RequestID,
+			Response:          trace.Response,
+			LatencyMs:         trace.LatencyMs,
+			UpstreamLatencyMs: trace.UpstreamLatencyMs,
+			GatewayOverheadMs: trace.GatewayOverheadMs,
+			ServedBy:          trace.ServedBy,
+			Attempts:          trace.Attempts,
+			CacheHit:          trace.CacheHit,
+			Partial:           trace.Partial,
+			UpstreamError:     trace.UpstreamError,
+			UpstreamStatus:    trace.UpstreamStatus,
+			UpstreamHeaders:   restoredHeaders(trace.UpstreamHeaders),
+		})
+		if err != nil {
+			return err
+		}
+		// The response is restored as it was archived, not in the current version
+		response.SchemaVersion = restoredSchemaVersion(trace.ResponseSchemaVersion)
+		if _, err := q.UpsertResponseLog(ctx, response); err != nil {
+			return err
+		}
+	}
+
+	for _, chunk := range trace.Chunks {
+		params, err := chunkParams(trace.RequestID, chunk.Chunk, chunk.Seq)
+		if err != nil {
+			return err
+		}
+		if err := q.InsertResponseChunk(ctx, params); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range trace.FirewallInfo {
+		params, err := firewallEventParams(event)
+		if err != nil {
+			return err
+		}
+		if _, err := q.InsertFirewallEvent(ctx, params); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// restoredSchemaVersion stores a restored row's archived version. Traces archived
+// before versioning have none, so the row is left for detection and the backfill.
+func restoredSchemaVersion(version int32) pgtype.Int4 {
+	return pgtype.Int4{Int32: version, Valid: version != 0}
+}
+
+// compressArchive encodes a serialized trace for upload
+func compressArchive(data []byte, compression Compression) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// decompressArchive decodes a downloaded archive back to the serialized trace
+func decompressArchive(payload []byte, compression Compression) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return payload, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", compression)
+	}
+}
+
+// hashArchive returns the hex-encoded sha256 of an archive payload
+func hashArchive(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func archivePath(bucketName, objectName string) string {
+	return fmt.Sprintf("s3://%s/%s", bucketName, objectName)
+}
+
+func parseArchivePath(path string) (string, string, error) {
+	bucketName, objectName, ok := strings.Cut(strings.TrimPrefix(path, "s3://"), "/")
+	if !ok || bucketName == "" || objectName == "" {
+		return "", "", fmt.Errorf("invalid archive path: %s", path)
+	}
+	return bucketName, objectName, nil
+}
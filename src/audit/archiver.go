@@ -0,0 +1,237 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+)
+
+// ArchiveWorkerOptions controls how old traces are archived in the background
+type ArchiveWorkerOptions struct {
+	// OlderThan is how long after a request is received it is archived, leaving time
+	// for its response and firewall events to be logged
+	OlderThan time.Duration
+	// BatchSize is how many requests are listed at once. The next batch isn't listed
+	// until this one is archived, so a slow store slows the scan rather than piling up work.
+	BatchSize int
+	// Concurrency caps the traces archived at once
+	Concurrency int
+	// Interval is how long to wait between passes
+	Interval time.Duration
+}
+
+// DefaultArchiveWorkerOptions archives requests ten minutes after they are received
+func DefaultArchiveWorkerOptions() ArchiveWorkerOptions {
+	return ArchiveWorkerOptions{
+		OlderThan:   10 * time.Minute,
+		BatchSize:   100,
+		Concurrency: 4,
+		Interval:    time.Minute,
+	}
+}
+
+// ArchiveProgress is what an ArchiveWorker has done since it was created
+type ArchiveProgress struct {
+	Archived int64     // Traces archived
+	Skipped  int64     // Requests another worker archived first
+	Failed   int64     // Traces that failed to archive; they are retried on the next pass
+	Backlog  int64     // Requests old enough to archive that aren't yet, as of the current pass
+	LastPass time.Time // When the last pass over the backlog finished, zero before the first
+}
+
+// ArchiveWorker archives the traces of old requests to cold storage in batches. Each
+// pass lists the requests not yet marked archived, so a worker restarted after a crash
+// picks up where it left off, and a request is only ever recorded once even if several
+// workers run.
+type ArchiveWorker struct {
+	db    *postgres.DB
+	store ObjectStore
+	opts  ArchiveWorkerOptions
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	archived atomic.Int64
+	skipped  atomic.Int64
+	failed   atomic.Int64
+	backlog  atomic.Int64
+	lastPass atomic.Int64 // Unix nanoseconds
+}
+
+// NewArchiveWorker creates a worker; Start begins archiving in the background
+func NewArchiveWorker(db *postgres.DB, store ObjectStore, opts ArchiveWorkerOptions) *ArchiveWorker {
+	defaults := DefaultArchiveWorkerOptions()
+	if opts.OlderThan <= 0 {
+		opts.OlderThan = defaults.OlderThan
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaults.Concurrency
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaults.Interval
+	}
+
+	return &ArchiveWorker{db: db, store: store, opts: opts}
+}
+
+// Start runs a pass over the backlog every Interval until Close is called
+func (w *ArchiveWorker) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.done = make(chan struct{})
+
+	go func() {
+		defer close(w.done)
+		for {
+			archived, err := w.RunOnce(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("archive pass failed after %d traces: %v", archived, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.opts.Interval):
+			}
+		}
+	}()
+}
+
+// Close stops the worker and waits for the traces being archived to finish until ctx
+// is done
+func (w *ArchiveWorker) Close(ctx context.Context) error {
+	if w.cancel == nil {
+		return nil
+	}
+	w.cancel()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("archive worker still running: %w", ctx.Err())
+	}
+}
+
+// Progress reports what the worker has done, for metrics
+func (w *ArchiveWorker) Progress() ArchiveProgress {
+	progress := ArchiveProgress{
+		Archived: w.archived.Load(),
+		Skipped:  w.skipped.Load(),
+		Failed:   w.failed.Load(),
+		Backlog:  w.backlog.Load(),
+	}
+	if lastPass := w.lastPass.Load(); lastPass > 0 {
+		progress.LastPass = time.Unix(0, lastPass)
+	}
+	return progress
+}
+
+// RunOnce makes one pass over the requests old enough to archive, oldest first, and
+// returns how many it archived. A trace that fails is logged, counted and skipped until
+// the next pass; the pass carries on past it, so a run of failing traces at the front
+// of the backlog doesn't hold back the newer ones behind it. The pass returns an error
+// if any trace failed.
+func (w *ArchiveWorker) RunOnce(ctx context.Context) (int64, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	cutoff := pgtype.Timestamptz{Time: time.Now().Add(-w.opts.OlderThan), Valid: true}
+	backlog, err := w.db.Queries.CountUnarchivedRequests(ctx, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count unarchived requests: %w", err)
+	}
+	w.backlog.Store(backlog)
+
+	// Nothing sorts before the zero UUID, so the oldest request is included
+	params := sqlc.ListUnarchivedRequestsParams{
+		ReceivedTo:      cutoff,
+		AfterReceivedAt: pgtype.Timestamptz{InfinityModifier: pgtype.NegativeInfinity, Valid: true},
+		AfterRequestID:  pgtype.UUID{Valid: true},
+		BatchSize:       int32(w.opts.BatchSize),
+	}
+
+	var total int64
+	var failed int
+	for {
+		// Stop between batches if the worker is closing
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		rows, err := w.db.Queries.ListUnarchivedRequests(ctx, params)
+		if err != nil {
+			return total, fmt.Errorf("failed to list unarchived requests: %w", err)
+		}
+
+		archived, batchFailed := w.archiveBatch(ctx, rows)
+		total += archived
+		failed += batchFailed
+
+		if len(rows) < w.opts.BatchSize {
+			w.lastPass.Store(time.Now().UnixNano())
+			if failed > 0 {
+				return total, fmt.Errorf("%d traces failed to archive", failed)
+			}
+			return total, nil
+		}
+		// Failed rows are behind the cursor too; they are picked up again next pass
+		last := rows[len(rows)-1]
+		params.AfterReceivedAt, params.AfterRequestID = last.ReceivedAt, last.RequestID
+	}
+}
+
+// archiveBatch archives a batch of requests, at most Concurrency at once, and returns
+// how many were archived and how many failed
+func (w *ArchiveWorker) archiveBatch(ctx context.Context, rows []sqlc.ListUnarchivedRequestsRow) (int64, int) {
+	var archived atomic.Int64
+	var failed atomic.Int32
+
+	slots := make(chan struct{}, w.opts.Concurrency)
+	var wg sync.WaitGroup
+	for _, row := range rows {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(requestID string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			_, err := archiveTrace(ctx, requestID, w.db, w.store, true)
+			switch {
+			case err == nil:
+				archived.Add(1)
+				w.archived.Add(1)
+				w.backlog.Add(-1)
+			case errors.Is(err, errAlreadyArchived):
+				w.skipped.Add(1)
+				w.backlog.Add(-1)
+			case errors.Is(err, ErrTraceNotFound):
+				// Purged since the batch was listed
+				w.backlog.Add(-1)
+			default:
+				failed.Add(1)
+				w.failed.Add(1)
+				if ctx.Err() == nil {
+					log.Printf("failed to archive trace %s: %v", requestID, err)
+				}
+			}
+		}(row.RequestID.String())
+	}
+	wg.Wait()
+
+	return archived.Load(), int(failed.Load())
+}
@@ -1,31 +1,92 @@
 package audit
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"net/http"
 	"net/netip"
+	"strconv"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 
 	"covalence/src/db/postgres"
 	"covalence/src/db/postgres/sqlc"
+	"covalence/src/types"
 )
 
+// ErrTraceNotFound is returned by GetTrace for an unknown request ID
+var ErrTraceNotFound = errors.New("request not found")
+
 // Trace represents a full request trace with all related data
 type Trace struct {
 	RequestID         string
 	UserID            string
 	Model             string
+	ReceivedAt        time.Time
 	Inputs            []map[string]interface{}
 	Response          map[string]interface{}
+	Chunks            []ResponseChunk // Ordered by Seq; only set for streamed responses
+	LatencyMs         int64
+	UpstreamLatencyMs int64 // Time spent waiting on the provider
+	GatewayOverheadMs int64 // Time spent in the gateway itself
+	ServedBy          string
+	Attempts          []Attempt // Upstream calls in order; more than one means fallbacks were used
+	CacheHit          bool      // Served from the response cache rather than the provider
+	Partial           bool      // The upstream failed mid-stream, so Response is truncated
+	Sampled           bool      // False if only metadata was kept; Inputs and Response content were dropped
+	UpstreamError     string    // Why the upstream failed, if it did
+	UpstreamStatus    int       // The status of the provider's final response, zero if none arrived
+	InputTokens       int64     // Token usage reported in the response, zero if it has none
+	OutputTokens      int64
+	TotalTokens       int64
 	RequestParameters map[string]interface{}
 	FirewallInfo      []FirewallEvent
 	ClientIP          string
 	RiskScore         float64
 	Blocked           bool
 	BlockedReason     string
+	ParseErrors       []string // Fields that could not be decoded; the rest of the trace is still usable
+	MirrorOf          string   // The client request this one shadowed, empty for client requests
+	Metadata          map[string]string
+
+	// The provider's rate-limit and request ID headers, keyed by lowercase name
+	UpstreamHeaders map[string]string
+
+	// The schema versions the inputs and response were stored in, zero for rows logged
+	// before versioning whose version was detected when read
+	RequestSchemaVersion  int32
+	ResponseSchemaVersion int32
+}
+
+// RawTrace is a request's stored bytes, for comparing what was received with what was
+// sent upstream without a round-trip through maps reordering keys or rounding numbers.
+// The columns are JSONB, so the bytes are as Postgres normalised them.
+type RawTrace struct {
+	RequestID     string
+	UserID        string
+	Model         string
+	TargetURL     string
+	ReceivedAt    time.Time
+	Inputs        [][]byte
+	Parameters    []byte
+	Response      []byte   // Nil until the request completes
+	Chunks        [][]byte // Ordered by seq; only set for streamed responses
+	ServedBy      string
+	Sampled       bool
+	Partial       bool
+	UpstreamError string
+
+	// Zero for rows logged before versioning; see BackfillSchemaVersions
+	RequestSchemaVersion  int32
+	ResponseSchemaVersion int32
 }
 
 type FirewallEvent struct {
@@ -35,6 +96,92 @@ type FirewallEvent struct {
 	Blocked       bool
 	BlockedReason string
 	RiskScore     float64
+	Cached        bool // The decision was served from the firewall cache
+	Enforced      bool // False for a firewall in monitor mode, whose block was not applied
+	Replay        bool // Recorded by replaying the request offline; never affected the request
+	// Hex sha256 of the evaluated messages, so a decision can be matched to an input
+	// without the input being kept. Empty unless the firewall config enables it.
+	ContentHash string
+	// How this decision was combined with the other firewalls'; nil for events logged
+	// before aggregation policies
+	Aggregation *Aggregation
+	// The score the firewall blocked above; zero for firewalls without one
+	Threshold float64
+	// The evaluation that logged the event, one of the Phase constants; empty for events
+	// logged before phases were recorded
+	Phase  string
+	Window int // The stream window evaluated, counted from 1; zero outside PhaseStream
+	Seq    int // The event's place within its evaluation
+	// Set when read back; the database stamps it on insert, the same for every event
+	// logged together, so Phase, Window and Seq give their order
+	EvaluatedAt time.Time
+}
+
+// Phases of a request that firewalls are evaluated in, in the order they happen
+const (
+	PhaseInput  = "input"
+	PhaseStream = "stream" // Once per window of a streamed response
+	PhaseOutput = "output"
+)
+
+// phaseOrder ranks a phase by when it happens. Events without one sort last.
+func phaseOrder(phase string) int {
+	switch phase {
+	case PhaseInput:
+		return 0
+	case PhaseStream:
+		return 1
+	case PhaseOutput:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// compareEvents orders firewall events as they were evaluated: by phase, stream window
+// and place within the evaluation. Events logged before phases fall back to when they
+// were logged.
+func compareEvents(a, b FirewallEvent) int {
+	return cmp.Or(
+		cmp.Compare(phaseOrder(a.Phase), phaseOrder(b.Phase)),
+		cmp.Compare(a.Window, b.Window),
+		cmp.Compare(a.Seq, b.Seq),
+		a.EvaluatedAt.Compare(b.EvaluatedAt),
+	)
+}
+
+// sameEvaluation reports whether two events were logged by the same evaluation, and so
+// were combined into one decision
+func sameEvaluation(a, b FirewallEvent) bool {
+	return a.Phase == b.Phase && a.Window == b.Window
+}
+
+// Aggregation records the policy that combined a set of firewall decisions, and what
+// it decided
+type Aggregation struct {
+	Policy    string  `json:"policy"`              // any, all or weighted
+	Blocked   bool    `json:"blocked"`             // The combined decision
+	Weight    float64 `json:"weight,omitempty"`    // This firewall's weight; weighted policy only
+	Threshold float64 `json:"threshold,omitempty"` // Weighted policy only
+	Score     float64 `json:"score,omitempty"`     // The weighted mean risk score; weighted policy only
+}
+
+// blockedRequest reports whether an event took part in blocking its request. Under the
+// weighted policy every enforced firewall did, whatever it decided alone. Events logged
+// before aggregation policies blocked on their own.
+func (e FirewallEvent) blockedRequest() bool {
+	if !e.Enforced {
+		return false
+	}
+	if e.Aggregation == nil {
+		return e.Blocked
+	}
+	return e.Aggregation.Blocked && (e.Blocked || e.Aggregation.Policy == "weighted")
+}
+
+// WeightedReason describes a weighted decision
+func (a Aggregation) WeightedReason() string {
+	return fmt.Sprintf("weighted risk score %.2f reached threshold %.2f", a.Score, a.Threshold)
 }
 
 type Request struct {
@@ -45,21 +192,103 @@ type Request struct {
 	Inputs     []map[string]interface{}
 	Parameters map[string]interface{}
 	ClientIP   string
+	// ClientRequestID is the client's idempotency key; a repeated ID updates the existing log
+	ClientRequestID string
+	// MirrorOf is the request this one copies to a shadow model. Mirrors are never billed.
+	MirrorOf string
+	// Metadata is the client's own tags for the request, stored as sent
+	Metadata map[string]string
+}
+
+// Options controls how audit entries are written. The zero value logs everything as-is.
+type Options struct {
+	// Redactor, when set, scrubs each input before it is persisted
+	Redactor Redactor
+	// Sampling, when set, keeps only a fraction of successful requests in full
+	Sampling *SamplingPolicy
 }
 
-// LogRequest creates a request log entry
-func LogRequest(ctx context.Context, r Request, db *postgres.DB) (string, error) {
+// LogRequest creates a request log entry. Every input must be a valid message.
+func LogRequest(ctx context.Context, r Request, db *postgres.DB, opts Options) (string, error) {
+
+	// Bail out before touching the database if the caller has already given up
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 
-	db.Mu.Lock()
-	defer db.Mu.Unlock()
+	messages := make([]types.Message, 0, len(r.Inputs))
+	for i, input := range r.Inputs {
+		message, err := types.NewMessageFromJson(input)
+		if err != nil {
+			return "", fmt.Errorf("invalid input %d: %w", i, err)
+		}
+		messages = append(messages, message)
+	}
+
+	return LogRequestTyped(ctx, r, messages, db, opts)
+}
+
+// LogRequestTyped creates a request log entry from typed messages. r.Inputs is ignored.
+func LogRequestTyped(ctx context.Context, r Request, messages []types.Message, db *postgres.DB, opts Options) (string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	params, err := requestParams(r, messages, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// A client-supplied ID makes retries update the original row
+	if r.ClientRequestID != "" {
+		req, err := db.Queries.UpsertRequestLog(ctx, sqlc.UpsertRequestLogParams{
+			UserID:          params.UserID,
+			ApiKeyID:        params.ApiKeyID,
+			Model:           params.Model,
+			TargetUrl:       params.TargetUrl,
+			Inputs:          params.Inputs,
+			Parameters:      params.Parameters,
+			ClientIp:        params.ClientIp,
+			ClientRequestID: pgtype.Text{String: r.ClientRequestID, Valid: true},
+			SchemaVersion:   params.SchemaVersion,
+			Metadata:        params.Metadata,
+		})
+		if err != nil {
+			return "", err
+		}
+		return req.RequestID.String(), nil
+	}
+
+	// Execute insert
+	req, err := db.Queries.InsertRequestLog(ctx, params)
+
+	if err != nil {
+		return "", err
+	}
+
+	return req.RequestID.String(), nil
+}
+
+// requestParams validates and encodes a request log entry
+func requestParams(r Request, messages []types.Message, opts Options) (sqlc.InsertRequestLogParams, error) {
 
 	// Messages parameters to JSON
 	// Convert each message to JSON and store in a list
 	var inputBytesList [][]byte
-	for _, input := range r.Inputs {
+	for i, message := range messages {
+		if _, err := types.NewMessageFromJson(message.ToMap()); err != nil {
+			return sqlc.InsertRequestLogParams{}, fmt.Errorf("invalid message %d: %w", i, err)
+		}
+
+		input := message.ToMap()
+
+		if opts.Redactor != nil {
+			input = opts.Redactor.Redact(input)
+		}
 		inputBytes, err := json.Marshal(input)
 		if err != nil {
-			return "", fmt.Errorf("invalid messages: %w", err)
+			return sqlc.InsertRequestLogParams{}, fmt.Errorf("invalid messages: %w", err)
 		}
 		inputBytesList = append(inputBytesList, inputBytes)
 	}
@@ -67,7 +296,7 @@ func LogRequest(ctx context.Context, r Request, db *postgres.DB) (string, error)
 	// Convert parameters to JSON
 	paramsBytes, err := json.Marshal(r.Parameters)
 	if err != nil {
-		return "", fmt.Errorf("invalid parameters: %w", err)
+		return sqlc.InsertRequestLogParams{}, fmt.Errorf("invalid parameters: %w", err)
 	}
 
 	// Parse IP if provided
@@ -75,114 +304,405 @@ func LogRequest(ctx context.Context, r Request, db *postgres.DB) (string, error)
 	if r.ClientIP != "" {
 		ip, err := netip.ParseAddr(r.ClientIP)
 		if err != nil {
-			return "", fmt.Errorf("invalid IP: %w", err)
+			return sqlc.InsertRequestLogParams{}, fmt.Errorf("invalid IP: %w", err)
 		}
 		clientIP = &ip
 	}
 
-	// Prepare pgtype values
-	var userUUID, apiKeyUUID pgtype.UUID
-	userUUID.Scan(r.UserID)
-	apiKeyUUID.Scan(r.APIKeyID)
+	// Prepare pgtype values. Every request belongs to a user; a missing API key is
+	// stored as NULL, but malformed IDs are rejected rather than silently becoming NULL.
+	var userUUID, apiKeyUUID, mirrorOf pgtype.UUID
+	if r.UserID == "" {
+		return sqlc.InsertRequestLogParams{}, errors.New("missing user ID")
+	}
+	if err := userUUID.Scan(r.UserID); err != nil {
+		return sqlc.InsertRequestLogParams{}, fmt.Errorf("invalid user ID %q: %w", r.UserID, err)
+	}
+	if r.APIKeyID != "" {
+		if err := apiKeyUUID.Scan(r.APIKeyID); err != nil {
+			return sqlc.InsertRequestLogParams{}, fmt.Errorf("invalid API key ID %q: %w", r.APIKeyID, err)
+		}
+	}
+	if r.MirrorOf != "" {
+		if err := mirrorOf.Scan(r.MirrorOf); err != nil {
+			return sqlc.InsertRequestLogParams{}, fmt.Errorf("invalid mirrored request ID %q: %w", r.MirrorOf, err)
+		}
+	}
+
+	var metadata []byte
+	if len(r.Metadata) > 0 {
+		if metadata, err = json.Marshal(r.Metadata); err != nil {
+			return sqlc.InsertRequestLogParams{}, fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
 
-	// Execute insert
-	req, err := db.Queries.InsertRequestLog(ctx, sqlc.InsertRequestLogParams{
-		UserID:     userUUID,
-		ApiKeyID:   apiKeyUUID,
-		Model:      r.Model,
-		TargetUrl:  r.TargetURL,
-		Inputs:     inputBytesList,
-		Parameters: paramsBytes,
-		ClientIp:   clientIP,
-	})
+	return sqlc.InsertRequestLogParams{
+		UserID:        userUUID,
+		ApiKeyID:      apiKeyUUID,
+		Model:         r.Model,
+		TargetUrl:     r.TargetURL,
+		Inputs:        inputBytesList,
+		Parameters:    paramsBytes,
+		ClientIp:      clientIP,
+		MirrorOf:      mirrorOf,
+		SchemaVersion: pgtype.Int4{Int32: CurrentRequestSchema, Valid: true},
+		Metadata:      metadata,
+	}, nil
+}
+
+// CompletedRequest is a request whose response can be replayed to a retry
+type CompletedRequest struct {
+	RequestID string
+	Body      json.RawMessage // What the client was sent
+	Status    int
+}
+
+// FindCompletedRequest looks up a user's request by its client-supplied ID. It returns
+// false if there is no such request or it has no response that can be replayed, such as
+// a failed, blocked or sampled-out one.
+func FindCompletedRequest(ctx context.Context, userID, clientRequestID string, db *postgres.DB) (CompletedRequest, bool, error) {
+
+	if err := ctx.Err(); err != nil {
+		return CompletedRequest{}, false, err
+	}
+
+	var userUUID pgtype.UUID
+	if err := userUUID.Scan(userID); err != nil {
+		return CompletedRequest{}, false, fmt.Errorf("invalid user ID: %w", err)
+	}
 
+	row, err := db.Queries.GetCompletedRequest(ctx, sqlc.GetCompletedRequestParams{
+		UserID:          userUUID,
+		ClientRequestID: pgtype.Text{String: clientRequestID, Valid: true},
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return CompletedRequest{}, false, nil
+	}
 	if err != nil {
-		return "", err
+		return CompletedRequest{}, false, err
 	}
 
-	return req.RequestID.String(), nil
+	return CompletedRequest{
+		RequestID: row.RequestID.String(),
+		Body:      row.ClientResponse,
+		Status:    int(row.ClientStatus.Int32),
+	}, true, nil
 }
 
 type Response struct {
 	RequestID string
 	Response  map[string]interface{}
-	LatencyMs int64
+	// LatencyMs is the total time the gateway took to serve the request. Rows logged
+	// before upstream_latency_ms was added hold only the provider's latency here, so
+	// compare those rows' latency against upstream_latency_ms of newer ones.
+	LatencyMs         int64
+	UpstreamLatencyMs int64
+	GatewayOverheadMs int64
+	ServedBy          string    // The registered model that produced the response
+	Attempts          []Attempt // Every upstream call made, including failed fallbacks
+	CacheHit          bool      // Served from the response cache; no upstream call was made
+	Partial           bool      // The upstream failed mid-stream; Response holds what arrived first
+	UpstreamError     string    // Why the upstream failed, if it did
+	UpstreamStatus    int       // The status of the provider's final response, zero if none arrived
+	// The provider's response headers. Only rate-limit and request ID headers are
+	// logged; credentials and everything else are dropped.
+	UpstreamHeaders http.Header
+	// SampledOut drops the request's inputs and streamed chunks once the response is
+	// logged, and keeps only the response's metadata
+	SampledOut bool
+	// ClientResponse is what the client was sent, set only for a successful response the
+	// output firewalls let through, so that it can be replayed to a retry with the same
+	// client request ID. It is dropped along with the content of a sampled-out response.
+	ClientResponse json.RawMessage
+	ClientStatus   int
+	// CountedUsage is the gateway's own token count for a provider that reported none.
+	// It is stored as the response's usage, so usage totals and quotas include it.
+	CountedUsage *TokenUsage
 }
 
-// LogResponse records a response to an existing request
+// Attempt is a single upstream call made while serving a request
+type Attempt struct {
+	Model     string `json:"model"`
+	Backend   string `json:"backend"`          // The provider URL the call was sent to
+	Status    int    `json:"status,omitempty"` // Zero if no response was received
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+	// The provider key slot used, user.KeyCurrent or user.KeyNext; nil if the gateway has no key
+	KeyIndex *int `json:"key_index,omitempty"`
+	// Which call to the same model this was after a transient error; zero for the first
+	Retry int `json:"retry,omitempty"`
+}
+
+// LogResponse records a response to an existing request. A request has a single
+// response, so logging another replaces it.
 func LogResponse(ctx context.Context, r Response, db *postgres.DB) error {
 
-	db.Mu.Lock()
-	defer db.Mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	params, err := responseParams(r)
+	if err != nil {
+		return err
+	}
+
+	if !r.SampledOut {
+		_, err = db.Queries.UpsertResponseLog(ctx, params)
+		return err
+	}
+
+	// The response and the dropped content go together, so a trace is never half sampled
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback(ctx)
+
+	q := db.Queries.WithTx(tx)
+	if _, err := q.UpsertResponseLog(ctx, params); err != nil {
+		return err
+	}
+	if err := sampleOut(ctx, q, params.RequestID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// sampleOut drops the content logged for a request, keeping its metadata
+func sampleOut(ctx context.Context, q *sqlc.Queries, requestID pgtype.UUID) error {
+	if err := q.SampleOutRequestLog(ctx, requestID); err != nil {
+		return fmt.Errorf("failed to drop sampled-out inputs: %w", err)
+	}
+	if err := q.DeleteResponseChunks(ctx, requestID); err != nil {
+		return fmt.Errorf("failed to drop sampled-out chunks: %w", err)
+	}
+	return nil
+}
+
+// withCountedUsage adds the gateway's token count to a response as its usage block,
+// unless the provider reported usage itself. The response is copied rather than
+// changed, since it may also be what the client is sent.
+func withCountedUsage(response map[string]interface{}, counted *TokenUsage) map[string]interface{} {
+	if counted == nil {
+		return response
+	}
+	if _, ok := response["usage"].(map[string]interface{}); ok {
+		return response
+	}
+
+	withUsage := maps.Clone(response)
+	if withUsage == nil {
+		withUsage = map[string]interface{}{}
+	}
+	withUsage["usage"] = map[string]interface{}{
+		"prompt_tokens":     counted.InputTokens,
+		"completion_tokens": counted.OutputTokens,
+		"total_tokens":      counted.TotalTokens,
+		"counted":           true, // Counted by the gateway, not reported by the provider
+	}
+	return withUsage
+}
+
+// responseParams encodes a response log entry
+func responseParams(r Response) (sqlc.UpsertResponseLogParams, error) {
 
 	var reqUUID pgtype.UUID
 	reqUUID.Scan(r.RequestID)
 
-	var pgLatency pgtype.Int4
+	var pgLatency, pgUpstreamLatency, pgGatewayOverhead pgtype.Int4
 	pgLatency.Scan(r.LatencyMs)
+	pgUpstreamLatency.Scan(r.UpstreamLatencyMs)
+	pgGatewayOverhead.Scan(r.GatewayOverheadMs)
+
+	response, clientResponse := withCountedUsage(r.Response, r.CountedUsage), r.ClientResponse
+	if r.SampledOut {
+		response, clientResponse = responseMetadata(response), nil
+	}
 
 	// Turn Parameters into bytes json
-	responseBytes, err := json.Marshal(r.Response)
+	responseBytes, err := json.Marshal(response)
 	if err != nil {
-		return fmt.Errorf("invalid response: %w", err)
+		return sqlc.UpsertResponseLogParams{}, fmt.Errorf("invalid response: %w", err)
 	}
 
-	_, err = db.Queries.InsertResponseLog(ctx, sqlc.InsertResponseLogParams{
-		RequestID: reqUUID,
-		Response:  responseBytes,
-		LatencyMs: pgLatency,
-	})
+	var attemptsBytes []byte
+	if len(r.Attempts) > 0 {
+		attemptsBytes, err = json.Marshal(r.Attempts)
+		if err != nil {
+			return sqlc.UpsertResponseLogParams{}, fmt.Errorf("invalid attempts: %w", err)
+		}
+	}
 
-	return err
-}
+	var headersBytes []byte
+	if headers := loggableHeaders(r.UpstreamHeaders); len(headers) > 0 {
+		headersBytes, err = json.Marshal(headers)
+		if err != nil {
+			return sqlc.UpsertResponseLogParams{}, fmt.Errorf("invalid upstream headers: %w", err)
+		}
+	}
 
-// LogFirewall records a firewall event for a request
-func LogFirewallEvent(ctx context.Context, fe FirewallEvent, db *postgres.DB) error {
+	return sqlc.UpsertResponseLogParams{
+		RequestID:         reqUUID,
+		Response:          responseBytes,
+		LatencyMs:         pgLatency,
+		UpstreamLatencyMs: pgUpstreamLatency,
+		GatewayOverheadMs: pgGatewayOverhead,
+		ServedBy:          pgtype.Text{String: r.ServedBy, Valid: r.ServedBy != ""},
+		Attempts:          attemptsBytes,
+		CacheHit:          r.CacheHit,
+		Partial:           r.Partial,
+		UpstreamError:     pgtype.Text{String: r.UpstreamError, Valid: r.UpstreamError != ""},
+		SchemaVersion:     pgtype.Int4{Int32: CurrentResponseSchema, Valid: true},
+		UpstreamStatus:    pgtype.Int4{Int32: int32(r.UpstreamStatus), Valid: r.UpstreamStatus != 0},
+		UpstreamHeaders:   headersBytes,
+		ClientResponse:    clientResponse,
+		ClientStatus:      pgtype.Int4{Int32: int32(r.ClientStatus), Valid: clientResponse != nil},
+	}, nil
+}
 
-	db.Mu.Lock()
-	defer db.Mu.Unlock()
+// firewallEventParams converts a firewall event into insert parameters
+func firewallEventParams(fe FirewallEvent) (sqlc.InsertFirewallEventParams, error) {
 
 	// Convert request ID
 	var reqUUID pgtype.UUID
 	err := reqUUID.Scan(fe.RequestID)
 	if err != nil {
-		return fmt.Errorf("invalid request ID: %w", err)
+		return sqlc.InsertFirewallEventParams{}, fmt.Errorf("invalid request ID: %w", err)
 	}
 
 	var blocked pgtype.Bool
 	err = blocked.Scan(fe.Blocked)
 	if err != nil {
-		return fmt.Errorf("invalid blocked value: %w", err)
+		return sqlc.InsertFirewallEventParams{}, fmt.Errorf("invalid blocked value: %w", err)
 	}
 
 	var blockedReason pgtype.Text
 	err = blockedReason.Scan(fe.BlockedReason)
 	if err != nil {
-		return fmt.Errorf("invalid blocked reason: %w", err)
+		return sqlc.InsertFirewallEventParams{}, fmt.Errorf("invalid blocked reason: %w", err)
 	}
 
-	var riskScore pgtype.Numeric
-	err = riskScore.Scan(fmt.Sprintf("%f", fe.RiskScore))
+	riskScore, err := numericFromFloat(fe.RiskScore)
 	if err != nil {
-		return fmt.Errorf("invalid risk score: %w", err)
+		return sqlc.InsertFirewallEventParams{}, fmt.Errorf("invalid risk score: %w", err)
 	}
 
-	_, err = db.Queries.InsertFirewallEvent(ctx, sqlc.InsertFirewallEventParams{
-		RequestID:     reqUUID,
-		FirewallID:    fe.FirewallID,
-		FirewallType:  fe.FirewallType,
-		Blocked:       blocked,
-		BlockedReason: blockedReason,
-		RiskScore:     riskScore,
-	})
+	var threshold pgtype.Numeric
+	if fe.Threshold > 0 {
+		threshold, err = numericFromFloat(fe.Threshold)
+		if err != nil {
+			return sqlc.InsertFirewallEventParams{}, fmt.Errorf("invalid blocking threshold: %w", err)
+		}
+	}
 
-	return err
+	var aggregation []byte
+	if fe.Aggregation != nil {
+		aggregation, err = json.Marshal(fe.Aggregation)
+		if err != nil {
+			return sqlc.InsertFirewallEventParams{}, fmt.Errorf("invalid aggregation: %w", err)
+		}
+	}
+
+	return sqlc.InsertFirewallEventParams{
+		RequestID:         reqUUID,
+		FirewallID:        fe.FirewallID,
+		FirewallType:      fe.FirewallType,
+		Blocked:           blocked,
+		BlockedReason:     blockedReason,
+		RiskScore:         riskScore,
+		Cached:            fe.Cached,
+		Enforced:          fe.Enforced,
+		Replay:            fe.Replay,
+		ContentHash:       pgtype.Text{String: fe.ContentHash, Valid: fe.ContentHash != ""},
+		Aggregation:       aggregation,
+		BlockingThreshold: threshold,
+		Phase:             pgtype.Text{String: fe.Phase, Valid: fe.Phase != ""},
+		StreamWindow:      pgtype.Int4{Int32: int32(fe.Window), Valid: fe.Phase == PhaseStream},
+		Seq:               pgtype.Int4{Int32: int32(fe.Seq), Valid: fe.Phase != ""},
+	}, nil
+}
+
+// numericFromFloat converts f using the shortest decimal that round-trips, so small
+// scores keep every significant digit
+func numericFromFloat(f float64) (pgtype.Numeric, error) {
+	if math.IsNaN(f) {
+		return pgtype.Numeric{NaN: true, Valid: true}, nil
+	}
+	if math.IsInf(f, 0) {
+		return pgtype.Numeric{}, fmt.Errorf("%v is not a finite number", f)
+	}
+
+	var n pgtype.Numeric
+	err := n.Scan(strconv.FormatFloat(f, 'f', -1, 64))
+	return n, err
+}
+
+// LogFirewall records a firewall event for a request and returns its generated ID
+func LogFirewallEvent(ctx context.Context, fe FirewallEvent, db *postgres.DB) (string, error) {
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	params, err := firewallEventParams(fe)
+	if err != nil {
+		return "", err
+	}
+
+	event, err := db.Queries.InsertFirewallEvent(ctx, params)
+	if err != nil {
+		return "", err
+	}
+
+	return event.FirewallEventID.String(), nil
+}
+
+// LogFirewallEvents records a batch of firewall events in a single transaction.
+// Either every event is persisted or none are.
+func LogFirewallEvents(ctx context.Context, events []FirewallEvent, db *postgres.DB) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	// Convert all events up front so a bad event never opens a transaction
+	rows := make([]sqlc.InsertFirewallEventsParams, 0, len(events))
+	for i, fe := range events {
+		params, err := firewallEventParams(fe)
+		if err != nil {
+			return fmt.Errorf("firewall event %d: %w", i, err)
+		}
+		rows = append(rows, sqlc.InsertFirewallEventsParams(params))
+	}
+
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback(ctx)
+
+	n, err := db.Queries.WithTx(tx).InsertFirewallEvents(ctx, rows)
+	if err != nil {
+		return fmt.Errorf("failed to insert firewall events: %w", err)
+	}
+	if n != int64(len(rows)) {
+		return fmt.Errorf("inserted %d of %d firewall events", n, len(rows))
+	}
+
+	return tx.Commit(ctx)
 }
 
 // GetTrace retrieves the full trace for a request
 func GetTrace(ctx context.Context, requestID string, db *postgres.DB) (Trace, error) {
-	db.Mu.Lock()
-	defer db.Mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return Trace{}, err
+	}
 
 	var reqUUID pgtype.UUID
 	reqUUID.Scan(requestID)
@@ -193,44 +713,187 @@ func GetTrace(ctx context.Context, requestID string, db *postgres.DB) (Trace, er
 	}
 
 	if len(rows) == 0 {
-		return Trace{}, fmt.Errorf("request not found")
+		return Trace{}, ErrTraceNotFound
+	}
+
+	// Add streamed chunks if any were logged. Only chunks that can't be decoded are
+	// reported in ParseErrors; failing to load them fails the trace.
+	chunkRows, err := db.Queries.GetResponseChunks(ctx, reqUUID)
+	if err != nil {
+		return Trace{}, fmt.Errorf("failed to load response chunks: %w", err)
+	}
+	chunks, chunksErr := decodeChunks(chunkRows)
+
+	return traceFromRows(rows, chunks, chunksErr), nil
+}
+
+// GetTraces retrieves the full traces for several requests in one query, keyed by
+// request ID. IDs with no logged request are absent from the map.
+func GetTraces(ctx context.Context, requestIDs []string, db *postgres.DB) (map[string]Trace, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	reqUUIDs := make([]pgtype.UUID, 0, len(requestIDs))
+	for _, requestID := range requestIDs {
+		var reqUUID pgtype.UUID
+		if err := reqUUID.Scan(requestID); err != nil {
+			return nil, fmt.Errorf("invalid request ID %q: %w", requestID, err)
+		}
+		reqUUIDs = append(reqUUIDs, reqUUID)
+	}
+
+	traces := map[string]Trace{}
+	if len(reqUUIDs) == 0 {
+		return traces, nil
+	}
+
+	rows, err := db.Queries.GetRequestFullTraces(ctx, reqUUIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkRows, err := db.Queries.GetResponseChunksForRequests(ctx, reqUUIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load response chunks: %w", err)
+	}
+
+	// Each request has a row per firewall event
+	byRequest := map[string][]sqlc.GetRequestFullTraceRow{}
+	for _, row := range rows {
+		requestID := row.RequestID.String()
+		byRequest[requestID] = append(byRequest[requestID], sqlc.GetRequestFullTraceRow(row))
+	}
+
+	chunksByRequest := map[string][]sqlc.ResponseChunk{}
+	for _, row := range chunkRows {
+		requestID := row.RequestID.String()
+		chunksByRequest[requestID] = append(chunksByRequest[requestID], row)
+	}
+
+	for requestID, traceRows := range byRequest {
+		chunks, chunksErr := decodeChunks(chunksByRequest[requestID])
+		traces[requestID] = traceFromRows(traceRows, chunks, chunksErr)
+	}
+
+	return traces, nil
+}
+
+// GetRawTrace retrieves a request's inputs and response as stored, undecoded
+func GetRawTrace(ctx context.Context, requestID string, db *postgres.DB) (RawTrace, error) {
+	if err := ctx.Err(); err != nil {
+		return RawTrace{}, err
+	}
+
+	var reqUUID pgtype.UUID
+	if err := reqUUID.Scan(requestID); err != nil {
+		return RawTrace{}, fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	rows, err := db.Queries.GetRequestFullTrace(ctx, reqUUID)
+	if err != nil {
+		return RawTrace{}, err
+	}
+
+	if len(rows) == 0 {
+		return RawTrace{}, ErrTraceNotFound
+	}
+
+	chunkRows, err := db.Queries.GetResponseChunks(ctx, reqUUID)
+	if err != nil {
+		return RawTrace{}, err
+	}
+
+	// Request and response columns repeat on every firewall event row
+	row := rows[0]
+	trace := RawTrace{
+		RequestID:     row.RequestID.String(),
+		UserID:        row.UserID.String(),
+		Model:         row.Model,
+		TargetURL:     row.TargetUrl,
+		ReceivedAt:    row.ReceivedAt.Time,
+		Inputs:        row.Inputs,
+		Parameters:    row.Parameters,
+		Response:      row.Response,
+		ServedBy:      row.ServedBy.String,
+		Sampled:       row.Sampled,
+		Partial:       row.Partial.Bool,
+		UpstreamError: row.UpstreamError.String,
+
+		RequestSchemaVersion:  schemaVersion(row.SchemaVersion),
+		ResponseSchemaVersion: schemaVersion(row.ResponseSchemaVersion),
+	}
+	for _, chunk := range chunkRows {
+		trace.Chunks = append(trace.Chunks, chunk.Chunk)
 	}
 
+	return trace, nil
+}
+
+// traceFromRows builds a trace from its full-trace rows, one per firewall event, and
+// its streamed chunks. A chunksErr from decoding the chunks is reported in ParseErrors.
+func traceFromRows(rows []sqlc.GetRequestFullTraceRow, chunks []ResponseChunk, chunksErr error) Trace {
 	// Create basic trace from first row
 	row := rows[0]
 
-	// Parse parameters
-	var params map[string]interface{}
-	json.Unmarshal(row.Parameters, &params) // Ignoring error, empty map is fine
+	// Decoding failures are collected rather than returned so that rows written by
+	// older code remain readable
+	var parseErrors []string
 
 	// Parse parameters
-	var inputs []map[string]interface{}
-	for _, input := range row.Inputs {
-		var msg map[string]interface{}
-		err := json.Unmarshal(input, &msg)
-		if err != nil {
-			return Trace{}, fmt.Errorf("invalid messages: %w", err)
+	var params map[string]interface{}
+	if len(row.Parameters) > 0 {
+		if err := json.Unmarshal(row.Parameters, &params); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("parameters: %v", err))
 		}
-		inputs = append(inputs, msg)
 	}
 
+	// Parse inputs by the version they were written in, keeping the raw string for any
+	// that can't be decoded
+	inputs, inputErrors := parseInputs(schemaVersion(row.SchemaVersion), row.Inputs)
+	parseErrors = append(parseErrors, inputErrors...)
+
+	// Parse response (absent until the request completes)
 	var response map[string]interface{}
-	err = json.Unmarshal(row.Response, &response)
-	if err != nil {
-		return Trace{}, fmt.Errorf("invalid response: %w", err)
+	if len(row.Response) > 0 {
+		if err := json.Unmarshal(row.Response, &response); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("response: %v", err))
+			response = nil
+		}
 	}
 
 	trace := Trace{
 		RequestID:         row.RequestID.String(),
 		UserID:            row.UserID.String(),
 		Model:             row.Model,
+		ReceivedAt:        row.ReceivedAt.Time,
 		Inputs:            inputs,
 		Response:          response,
 		RequestParameters: params,
+		LatencyMs:         int64(row.LatencyMs.Int32),
+		UpstreamLatencyMs: int64(row.UpstreamLatencyMs.Int32),
+		GatewayOverheadMs: int64(row.GatewayOverheadMs.Int32),
+		ServedBy:          row.ServedBy.String,
+		CacheHit:          row.CacheHit.Bool,
+		Partial:           row.Partial.Bool,
+		Sampled:           row.Sampled,
+		UpstreamError:     row.UpstreamError.String,
+		UpstreamStatus:    int(row.UpstreamStatus.Int32),
 		ClientIP:          "", // Will be populated if client IP exists
 		RiskScore:         0,  // Will be populated if risk score exists
 		Blocked:           row.Blocked.Bool,
 		BlockedReason:     row.BlockedReason.String,
+
+		RequestSchemaVersion:  schemaVersion(row.SchemaVersion),
+		ResponseSchemaVersion: schemaVersion(row.ResponseSchemaVersion),
+	}
+
+	if response != nil {
+		input, output, total, err := responseTokens(trace.ResponseSchemaVersion, response)
+		if err != nil {
+			parseErrors = append(parseErrors, err.Error())
+		}
+		trace.InputTokens, trace.OutputTokens, trace.TotalTokens = input, output, total
 	}
 
 	// Add optional fields if they exist
@@ -238,38 +901,108 @@ func GetTrace(ctx context.Context, requestID string, db *postgres.DB) (Trace, er
 		trace.ClientIP = row.ClientIp.String()
 	}
 
+	if row.MirrorOf.Valid {
+		trace.MirrorOf = row.MirrorOf.String()
+	}
+
+	if len(row.Metadata) > 0 {
+		if err := json.Unmarshal(row.Metadata, &trace.Metadata); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("metadata: %v", err))
+		}
+	}
+
+	if len(row.Attempts) > 0 {
+		if err := json.Unmarshal(row.Attempts, &trace.Attempts); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("attempts: %v", err))
+		}
+	}
+
+	if len(row.UpstreamHeaders) > 0 {
+		if err := json.Unmarshal(row.UpstreamHeaders, &trace.UpstreamHeaders); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("upstream_headers: %v", err))
+		}
+	}
+
 	// Add risk score if valid
 	if row.RiskScore.Valid {
 		score, err := row.RiskScore.Float64Value()
 		if err != nil {
-			return Trace{}, fmt.Errorf("invalid risk score: %w", err)
+			parseErrors = append(parseErrors, fmt.Sprintf("risk_score: %v", err))
 		}
 		trace.RiskScore = score.Float64
 	}
 
-	// Add firewall events
+	// Add firewall events. The join repeats each event for every response a request
+	// has, and requests logged before responses were unique can have several, so
+	// events already seen are skipped.
 	events := []FirewallEvent{}
+	seen := map[[16]byte]bool{}
 	for _, r := range rows {
-		if r.FirewallID.Valid {
+		if r.FirewallID.Valid && !seen[r.FirewallEventID.Bytes] {
+			seen[r.FirewallEventID.Bytes] = true
 
 			riskScore, err := r.RiskScore.Float64Value()
 			if err != nil {
-				return Trace{}, fmt.Errorf("invalid risk score: %w", err)
+				parseErrors = append(parseErrors, fmt.Sprintf("firewall %s risk_score: %v", r.FirewallID.String, err))
+			}
+			threshold, err := r.BlockingThreshold.Float64Value()
+			if err != nil {
+				parseErrors = append(parseErrors, fmt.Sprintf("firewall %s blocking_threshold: %v", r.FirewallID.String, err))
 			}
 
-			events = append(events, FirewallEvent{
+			event := FirewallEvent{
 				RequestID:     r.RequestID.String(),
 				FirewallID:    r.FirewallID.String,
 				FirewallType:  r.FirewallType.String,
 				Blocked:       r.Blocked.Bool,
 				BlockedReason: r.BlockedReason.String,
 				RiskScore:     riskScore.Float64,
-			})
+				Cached:        r.Cached.Bool,
+				Enforced:      r.Enforced.Bool,
+				Replay:        r.Replay.Bool,
+				ContentHash:   r.ContentHash.String,
+				Threshold:     threshold.Float64,
+				Phase:         r.Phase.String,
+				Window:        int(r.StreamWindow.Int32),
+				Seq:           int(r.Seq.Int32),
+				EvaluatedAt:   r.EvaluatedAt.Time,
+			}
+			if len(r.Aggregation) > 0 {
+				if err := json.Unmarshal(r.Aggregation, &event.Aggregation); err != nil {
+					parseErrors = append(parseErrors, fmt.Sprintf("firewall %s aggregation: %v", r.FirewallID.String, err))
+				}
+			}
+			events = append(events, event)
 		}
 	}
 	trace.FirewallInfo = events
 
-	return trace, nil
+	// Only enforced blocks rejected the request; monitored and replayed ones stay visible in FirewallInfo
+	if len(events) > 0 {
+		trace.Blocked = false
+		trace.BlockedReason = ""
+		for _, event := range events {
+			if event.blockedRequest() && !event.Replay {
+				trace.Blocked = true
+				trace.BlockedReason = event.BlockedReason
+				if event.Aggregation != nil && event.Aggregation.Policy == "weighted" {
+					trace.BlockedReason = event.Aggregation.WeightedReason()
+				}
+				break
+			}
+		}
+	}
+
+	if chunksErr != nil {
+		parseErrors = append(parseErrors, fmt.Sprintf("chunks: %v", chunksErr))
+	}
+	if len(chunks) > 0 {
+		trace.Chunks = chunks
+	}
+
+	trace.ParseErrors = parseErrors
+
+	return trace
 }
 
 // NewUUID generates a new UUID string
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Explanation is why a request was or wasn't blocked, rebuilt from its firewall events
+type Explanation struct {
+	RequestID   string       `json:"request_id"`
+	Blocked     bool         `json:"blocked"`
+	Policy      string       `json:"policy"`          // The aggregation policy; "any" for events logged before policies
+	Decision    string       `json:"deciding_factor"` // What blocked the request, or why nothing did
+	Evaluations []Evaluation `json:"evaluations"`     // In the order they were evaluated
+}
+
+// Evaluation is one firewall's part in a decision
+type Evaluation struct {
+	FirewallID   string    `json:"firewall_id"`
+	FirewallType string    `json:"firewall_type"`
+	Phase        string    `json:"phase,omitempty"`  // Empty for events logged before phases were recorded
+	Window       int       `json:"window,omitempty"` // The stream window, for the stream phase
+	RiskScore    float64   `json:"risk_score"`
+	Threshold    *float64  `json:"threshold"` // Nil for firewalls without one, or events logged before thresholds were
+	Weight       float64   `json:"weight,omitempty"`
+	Blocked      bool      `json:"blocked"` // What the firewall decided on its own
+	Reason       string    `json:"reason,omitempty"`
+	Enforced     bool      `json:"enforced"`
+	Cached       bool      `json:"cached"`
+	Deciding     bool      `json:"deciding"` // This evaluation decided the request was blocked
+	EvaluatedAt  time.Time `json:"evaluated_at"`
+}
+
+// Explain rebuilds the decision made about a trace's request from its firewall events.
+// Each evaluation, of the input, a stream window or the output, combined its events
+// into a decision of its own, and the first of them to block decides the request.
+// Replayed events never affected the request, so they are left out.
+func Explain(trace Trace) Explanation {
+	events := []FirewallEvent{}
+	for _, event := range trace.FirewallInfo {
+		if !event.Replay {
+			events = append(events, event)
+		}
+	}
+	slices.SortStableFunc(events, compareEvents)
+
+	// Sorted events of one evaluation are adjacent
+	groups := [][]FirewallEvent{}
+	for i, event := range events {
+		if i == 0 || !sameEvaluation(events[i-1], event) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], event)
+	}
+
+	explanation := Explanation{
+		RequestID:   trace.RequestID,
+		Policy:      "any",
+		Evaluations: make([]Evaluation, 0, len(events)),
+	}
+
+	deciding := slices.IndexFunc(groups, func(group []FirewallEvent) bool {
+		return slices.ContainsFunc(group, FirewallEvent.blockedRequest)
+	})
+	explanation.Blocked = deciding >= 0
+
+	// The deciding evaluation's policy is the one reported; otherwise the first recorded
+	policyEvents := events
+	if deciding >= 0 {
+		policyEvents = groups[deciding]
+	}
+	for _, event := range policyEvents {
+		if event.Aggregation != nil {
+			explanation.Policy = event.Aggregation.Policy
+			break
+		}
+	}
+
+	for g, group := range groups {
+		decided := false
+		for _, event := range group {
+			evaluation := Evaluation{
+				FirewallID:   event.FirewallID,
+				FirewallType: event.FirewallType,
+				Phase:        event.Phase,
+				Window:       event.Window,
+				RiskScore:    event.RiskScore,
+				Blocked:      event.Blocked,
+				Reason:       event.BlockedReason,
+				Enforced:     event.Enforced,
+				Cached:       event.Cached,
+				EvaluatedAt:  event.EvaluatedAt,
+			}
+			if event.Threshold > 0 {
+				threshold := event.Threshold
+				evaluation.Threshold = &threshold
+			}
+			if event.Aggregation != nil {
+				evaluation.Weight = event.Aggregation.Weight
+			}
+			// The first block of the deciding evaluation decided the request, except under
+			// the weighted policy, where every enforced firewall decided together
+			if g == deciding && event.blockedRequest() {
+				weighted := event.Aggregation != nil && event.Aggregation.Policy == "weighted"
+				evaluation.Deciding = weighted || !decided
+				decided = true
+			}
+			explanation.Evaluations = append(explanation.Evaluations, evaluation)
+		}
+	}
+
+	if deciding >= 0 {
+		group := groups[deciding]
+		explanation.Decision = blockingFactor(group[slices.IndexFunc(group, FirewallEvent.blockedRequest)])
+	} else {
+		explanation.Decision = passingFactor(events)
+	}
+	return explanation
+}
+
+// blockingFactor describes the first event of the deciding evaluation that blocked
+func blockingFactor(event FirewallEvent) string {
+	switch {
+	case event.Aggregation != nil && event.Aggregation.Policy == "weighted":
+		return event.Aggregation.WeightedReason()
+	case event.Aggregation != nil && event.Aggregation.Policy == "all":
+		return "every enforced firewall blocked the request"
+	case event.Threshold > 0:
+		return fmt.Sprintf("the %s firewall blocked %s: risk score %.2f over threshold %.2f", event.FirewallType, event.BlockedReason, event.RiskScore, event.Threshold)
+	default:
+		return fmt.Sprintf("the %s firewall blocked %s", event.FirewallType, event.BlockedReason)
+	}
+}
+
+// passingFactor explains why no evaluation blocked the request, naming what came closest:
+// a monitored block, a block the all policy outvoted, or the highest weighted score
+func passingFactor(events []FirewallEvent) string {
+	if len(events) == 0 {
+		return "no firewalls evaluated the request"
+	}
+
+	var closest *Aggregation
+	for _, event := range events {
+		if event.Blocked && !event.Enforced {
+			return fmt.Sprintf("not blocked; the %s firewall would have blocked it but is in monitor mode", event.FirewallType)
+		}
+		if event.Blocked && event.Aggregation != nil && event.Aggregation.Policy == "all" {
+			return fmt.Sprintf("not blocked; the %s firewall blocked but the all policy needs every firewall to", event.FirewallType)
+		}
+		if event.Aggregation != nil && event.Aggregation.Policy == "weighted" && (closest == nil || event.Aggregation.Score > closest.Score) {
+			closest = event.Aggregation
+		}
+	}
+	if closest != nil {
+		return fmt.Sprintf("not blocked; weighted risk score %.2f stayed under threshold %.2f", closest.Score, closest.Threshold)
+	}
+	return "not blocked; no firewall blocked the request"
+}
@@ -0,0 +1,171 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+)
+
+const exportBatchSize = 500
+
+// exportLag keeps an export behind the request rows still being written. A batched row
+// is stamped with received_at when its transaction starts, which can be up to
+// flushTimeout before the row commits, so a cursor closer to now than that could pass
+// a row that becomes visible later. The extra second covers clock drift between the
+// gateway and the database.
+const exportLag = flushTimeout + time.Second
+
+// ExportCursor marks the last trace written by an export. Requests are exported in
+// (ReceivedAt, RequestID) order, so requests sharing a timestamp are neither skipped
+// nor repeated when an export is resumed.
+type ExportCursor struct {
+	ReceivedAt time.Time
+	RequestID  string
+}
+
+// exportStart is the cursor before every trace. Nothing sorts before the zero UUID.
+var exportStart = ExportCursor{ReceivedAt: time.Unix(0, 0).UTC(), RequestID: "00000000-0000-0000-0000-000000000000"}
+
+// String encodes the cursor as an opaque token for clients to resume an export from
+func (c ExportCursor) String() string {
+	raw := c.ReceivedAt.UTC().Format(time.RFC3339Nano) + "/" + c.RequestID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseExportCursor decodes a token from ExportCursor.String. An empty token is the
+// cursor before every trace.
+func ParseExportCursor(token string) (ExportCursor, error) {
+	if token == "" {
+		return exportStart, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ExportCursor{}, fmt.Errorf("invalid export cursor: %w", err)
+	}
+	receivedAt, requestID, ok := strings.Cut(string(raw), "/")
+	if !ok {
+		return ExportCursor{}, errors.New("invalid export cursor")
+	}
+
+	cursor := ExportCursor{RequestID: requestID}
+	if cursor.ReceivedAt, err = time.Parse(time.RFC3339Nano, receivedAt); err != nil {
+		return ExportCursor{}, fmt.Errorf("invalid export cursor time: %w", err)
+	}
+	if err := uuid.Validate(requestID); err != nil {
+		return ExportCursor{}, fmt.Errorf("invalid export cursor request ID: %w", err)
+	}
+	return cursor, nil
+}
+
+// ExportTraces writes every trace received in [from, to) to w as newline-delimited JSON,
+// oldest first. Requests are paged through in batches so the export is never held in
+// memory. It returns the cursor of the last trace written, which can be passed to
+// ResumeExportTraces to continue after a failure without duplicating lines.
+func ExportTraces(ctx context.Context, from, to time.Time, w io.Writer, db *postgres.DB) (ExportCursor, error) {
+	// Requests received exactly at from are included
+	return ResumeExportTraces(ctx, ExportCursor{ReceivedAt: from, RequestID: exportStart.RequestID}, to, w, db)
+}
+
+// SettledBefore returns the time before which every request after cursor has had its
+// response logged, so an export up to it sends each trace complete and its cursor never
+// passes one that is still in flight. Requests received longer than abandonAfter ago
+// are taken to have been abandoned, by a crash or a client that went away, so they
+// don't hold an export back forever. It returns now if nothing is pending.
+func SettledBefore(ctx context.Context, cursor ExportCursor, abandonAfter time.Duration, db *postgres.DB) (time.Time, error) {
+
+	now := time.Now()
+
+	var afterUUID pgtype.UUID
+	if err := afterUUID.Scan(cursor.RequestID); err != nil {
+		return time.Time{}, fmt.Errorf("invalid cursor request ID: %w", err)
+	}
+
+	pending, err := db.Queries.OldestPendingRequest(ctx, sqlc.OldestPendingRequestParams{
+		AfterReceivedAt: pgtype.Timestamptz{Time: cursor.ReceivedAt, Valid: true},
+		AfterRequestID:  afterUUID,
+		PendingFrom:     pgtype.Timestamptz{Time: now.Add(-abandonAfter), Valid: true},
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to find pending requests: %w", err)
+	}
+	if !pending.Valid {
+		return now, nil
+	}
+	return pending.Time, nil
+}
+
+// ResumeExportTraces continues an export with the traces after cursor and before to.
+// Requests received within exportLag of now are left for a later export, so the
+// cursor never passes a row that hasn't committed yet.
+func ResumeExportTraces(ctx context.Context, cursor ExportCursor, to time.Time, w io.Writer, db *postgres.DB) (ExportCursor, error) {
+
+	if !cursor.ReceivedAt.Before(to) {
+		return cursor, fmt.Errorf("invalid export range: %s is not before %s", cursor.ReceivedAt.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	if committed := time.Now().Add(-exportLag); to.After(committed) {
+		to = committed
+	}
+	if !cursor.ReceivedAt.Before(to) {
+		return cursor, nil
+	}
+
+	var afterUUID pgtype.UUID
+	if err := afterUUID.Scan(cursor.RequestID); err != nil {
+		return cursor, fmt.Errorf("invalid cursor request ID: %w", err)
+	}
+
+	encoder := json.NewEncoder(w)
+	for {
+		if err := ctx.Err(); err != nil {
+			return cursor, err
+		}
+
+		rows, err := db.Queries.ListRequestsForExport(ctx, sqlc.ListRequestsForExportParams{
+			ReceivedTo:      pgtype.Timestamptz{Time: to, Valid: true},
+			AfterReceivedAt: pgtype.Timestamptz{Time: cursor.ReceivedAt, Valid: true},
+			AfterRequestID:  afterUUID,
+			BatchSize:       exportBatchSize,
+		})
+		if err != nil {
+			return cursor, fmt.Errorf("failed to list requests: %w", err)
+		}
+
+		for _, row := range rows {
+			next := ExportCursor{ReceivedAt: row.ReceivedAt.Time, RequestID: row.RequestID.String()}
+
+			trace, err := GetTrace(ctx, row.RequestID.String(), db)
+			if errors.Is(err, ErrTraceNotFound) {
+				// Purged since the batch was listed
+				cursor, afterUUID = next, row.RequestID
+				continue
+			}
+			if err != nil {
+				return cursor, fmt.Errorf("failed to load trace %s: %w", row.RequestID.String(), err)
+			}
+
+			// Encode terminates each trace with a newline
+			if err := encoder.Encode(trace); err != nil {
+				return cursor, fmt.Errorf("failed to write trace %s: %w", row.RequestID.String(), err)
+			}
+
+			cursor, afterUUID = next, row.RequestID
+		}
+
+		if len(rows) < exportBatchSize {
+			return cursor, nil
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package audit
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// loggedHeaders are the provider response headers kept with a response: its request ID,
+// for support tickets with the provider, and how long to back off
+var loggedHeaders = []string{"x-request-id", "request-id", "retry-after"}
+
+// loggedHeaderPrefixes cover the rate-limit headers, which providers name differently
+var loggedHeaderPrefixes = []string{"x-ratelimit-", "ratelimit-", "anthropic-ratelimit-"}
+
+// sensitiveHeaders are never logged, even if a provider sends one under a logged name
+var sensitiveHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key", "api-key"}
+
+// loggableHeaders selects the headers worth logging from a provider response, keyed by
+// lowercase name. Multiple values of a header are joined with commas.
+func loggableHeaders(header http.Header) map[string]string {
+	logged := map[string]string{}
+	for name, values := range header {
+		name = strings.ToLower(name)
+		if slices.Contains(sensitiveHeaders, name) || !isLoggedHeader(name) {
+			continue
+		}
+		logged[name] = strings.Join(values, ", ")
+	}
+	return logged
+}
+
+func isLoggedHeader(name string) bool {
+	if slices.Contains(loggedHeaders, name) {
+		return true
+	}
+	for _, prefix := range loggedHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoredHeaders turns logged headers back into a header set, for restoring a trace
+func restoredHeaders(logged map[string]string) http.Header {
+	if len(logged) == 0 {
+		return nil
+	}
+	header := http.Header{}
+	for name, value := range logged {
+		header.Set(name, value)
+	}
+	return header
+}
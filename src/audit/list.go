@@ -0,0 +1,219 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+// ListTracesParams filters a trace listing. Zero values mean "no constraint".
+type ListTracesParams struct {
+	UserID       string
+	Model        string
+	From         time.Time // Inclusive lower bound on ReceivedAt
+	To           time.Time // Exclusive upper bound on ReceivedAt
+	Blocked      *bool
+	MinRiskScore *float64
+	Limit        int
+	Offset       int
+
+	// MetadataKey matches requests the client tagged with that key set to MetadataValue
+	MetadataKey   string
+	MetadataValue string
+}
+
+// TraceSummary is a lightweight view of a request used when browsing history
+type TraceSummary struct {
+	RequestID  string
+	UserID     string
+	Model      string
+	ReceivedAt time.Time
+	ClientIP   string
+	Blocked    bool
+	RiskScore  float64
+	Metadata   map[string]string
+}
+
+// ListTraces returns a page of trace summaries, newest first, plus the total number of matches
+func ListTraces(ctx context.Context, p ListTracesParams, db *postgres.DB) ([]TraceSummary, int64, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	filters, err := traceFilters(p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	limit := p.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	if p.Offset < 0 {
+		return nil, 0, fmt.Errorf("invalid offset: %d", p.Offset)
+	}
+
+	rows, err := db.Queries.ListTraces(ctx, sqlc.ListTracesParams{
+		UserID:       filters.UserID,
+		Model:        filters.Model,
+		ReceivedFrom: filters.ReceivedFrom,
+		ReceivedTo:   filters.ReceivedTo,
+		Blocked:      filters.Blocked,
+		MinRiskScore: filters.MinRiskScore,
+		Metadata:     filters.Metadata,
+		Limit:        int32(limit),
+		Offset:       int32(p.Offset),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := db.Queries.CountTraces(ctx, filters)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	summaries := make([]TraceSummary, 0, len(rows))
+	for _, row := range rows {
+		summary, err := newTraceSummary(row)
+		if err != nil {
+			return nil, 0, err
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, total, nil
+}
+
+// traceFilters converts listing filters into query parameters, leaving unset fields NULL
+func traceFilters(p ListTracesParams) (sqlc.CountTracesParams, error) {
+	var f sqlc.CountTracesParams
+
+	if p.UserID != "" {
+		if err := f.UserID.Scan(p.UserID); err != nil {
+			return f, fmt.Errorf("invalid user ID: %w", err)
+		}
+	}
+
+	if p.Model != "" {
+		f.Model = pgtype.Text{String: p.Model, Valid: true}
+	}
+
+	if !p.From.IsZero() {
+		f.ReceivedFrom = pgtype.Timestamptz{Time: p.From, Valid: true}
+	}
+
+	if !p.To.IsZero() {
+		f.ReceivedTo = pgtype.Timestamptz{Time: p.To, Valid: true}
+	}
+
+	if p.Blocked != nil {
+		f.Blocked = pgtype.Bool{Bool: *p.Blocked, Valid: true}
+	}
+
+	if p.MinRiskScore != nil {
+		minRiskScore, err := numericFromFloat(*p.MinRiskScore)
+		if err != nil {
+			return f, fmt.Errorf("invalid risk score: %w", err)
+		}
+		f.MinRiskScore = minRiskScore
+	}
+
+	if p.MetadataKey != "" || p.MetadataValue != "" {
+		if p.MetadataKey == "" {
+			return f, fmt.Errorf("a metadata value needs a metadata key")
+		}
+		metadata, err := json.Marshal(map[string]string{p.MetadataKey: p.MetadataValue})
+		if err != nil {
+			return f, fmt.Errorf("invalid metadata filter: %w", err)
+		}
+		f.Metadata = metadata
+	}
+
+	return f, nil
+}
+
+// ListTracesByFirewall returns summaries of requests evaluated by a firewall in [from, to),
+// newest first. Blocked and RiskScore on each summary are that firewall's decision.
+// Zero times leave the range open on that side.
+func ListTracesByFirewall(ctx context.Context, firewallID string, blockedOnly bool, from, to time.Time, db *postgres.DB) ([]TraceSummary, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if firewallID == "" {
+		return nil, fmt.Errorf("firewall ID cannot be empty")
+	}
+
+	params := sqlc.ListTracesByFirewallParams{
+		FirewallID:  firewallID,
+		BlockedOnly: blockedOnly,
+	}
+	if !from.IsZero() {
+		params.ReceivedFrom = pgtype.Timestamptz{Time: from, Valid: true}
+	}
+	if !to.IsZero() {
+		params.ReceivedTo = pgtype.Timestamptz{Time: to, Valid: true}
+	}
+
+	rows, err := db.Queries.ListTracesByFirewall(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]TraceSummary, 0, len(rows))
+	for _, row := range rows {
+		summary, err := newTraceSummary(sqlc.ListTracesRow(row))
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+// newTraceSummary converts a listing row into a TraceSummary
+func newTraceSummary(row sqlc.ListTracesRow) (TraceSummary, error) {
+	summary := TraceSummary{
+		RequestID:  row.RequestID.String(),
+		UserID:     row.UserID.String(),
+		Model:      row.Model,
+		ReceivedAt: row.ReceivedAt.Time,
+		Blocked:    row.Blocked,
+	}
+
+	if row.ClientIp != nil {
+		summary.ClientIP = row.ClientIp.String()
+	}
+
+	score, err := row.RiskScore.Float64Value()
+	if err != nil {
+		return TraceSummary{}, fmt.Errorf("invalid risk score: %w", err)
+	}
+	summary.RiskScore = score.Float64
+
+	if len(row.Metadata) > 0 {
+		if err := json.Unmarshal(row.Metadata, &summary.Metadata); err != nil {
+			return TraceSummary{}, fmt.Errorf("invalid metadata: %w", err)
+		}
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,60 @@
+package audit
+
+import "covalence/src/entities"
+
+// Redactor scrubs sensitive values from an input before it is persisted
+type Redactor interface {
+	Redact(input map[string]interface{}) map[string]interface{}
+}
+
+// RegexRedactor replaces emails, E.164 phone numbers and Luhn-valid card numbers
+// with a typed placeholder such as [REDACTED:email]
+type RegexRedactor struct {
+	detector *entities.Detector
+}
+
+// NewRegexRedactor creates a redactor with the default set of entities
+func NewRegexRedactor() *RegexRedactor {
+	return &RegexRedactor{
+		detector: entities.MustNewDetector(entities.Email, entities.Card, entities.Phone),
+	}
+}
+
+// Redact returns a copy of input with sensitive values replaced. Nested maps and
+// slices are walked recursively; non-string values are left untouched.
+func (r *RegexRedactor) Redact(input map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(input))
+	for k, v := range input {
+		out[k] = r.redactValue(v)
+	}
+	return out
+}
+
+func (r *RegexRedactor) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.redactString(v)
+	case map[string]interface{}:
+		return r.Redact(v)
+	case map[string]string:
+		out := make(map[string]string, len(v))
+		for k, s := range v {
+			out[k] = r.redactString(s)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = r.redactValue(item)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+func (r *RegexRedactor) redactString(s string) string {
+	return r.detector.Replace(s, func(kind string) string {
+		return "[REDACTED:" + kind + "]"
+	})
+}
@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+)
+
+const defaultPurgeBatchSize = 10000
+
+// PurgeOptions controls how old request logs are removed
+type PurgeOptions struct {
+	// ForceArchived also deletes requests that have already been archived
+	ForceArchived bool
+	// BatchSize caps the rows deleted per statement. Defaults to 10k.
+	BatchSize int
+}
+
+// PurgeOlderThan deletes request logs received before cutoff, along with their
+// responses, chunks and firewall events. Rows are deleted in bounded batches so no
+// single statement holds locks for long. It returns the number of requests removed.
+func PurgeOlderThan(ctx context.Context, cutoff time.Time, db *postgres.DB, opts PurgeOptions) (int64, error) {
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultPurgeBatchSize
+	}
+
+	params := sqlc.PurgeRequestLogsParams{
+		Cutoff:        pgtype.Timestamptz{Time: cutoff, Valid: true},
+		ForceArchived: opts.ForceArchived,
+		BatchSize:     int32(batchSize),
+	}
+
+	var total int64
+	for {
+		// Stop between batches if the caller gave up
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		n, err := db.Queries.PurgeRequestLogs(ctx, params)
+		if err != nil {
+			return total, fmt.Errorf("failed to purge request logs after %d rows: %w", total, err)
+		}
+		total += n
+
+		if n < int64(batchSize) {
+			return total, nil
+		}
+	}
+}
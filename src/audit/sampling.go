@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// sampleBuckets is the resolution of a sampling rate
+const sampleBuckets = 10000
+
+// SamplingPolicy keeps the full inputs and response of only a fraction of successful
+// requests. The rest keep their metadata: model, timings, usage and firewall events.
+// Blocked and failed requests are always logged in full.
+type SamplingPolicy struct {
+	Rate float64 // Fraction of successful requests logged in full, from 0 to 1
+}
+
+// NewSamplingPolicy creates a policy that logs rate of successful requests in full
+func NewSamplingPolicy(rate float64) (*SamplingPolicy, error) {
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid sampling rate %v: must be between 0 and 1", rate)
+	}
+	return &SamplingPolicy{Rate: rate}, nil
+}
+
+// Keep reports whether a successful request is logged in full. The decision is a hash
+// of the request ID, so it is the same wherever the request or its response is logged.
+// A nil policy keeps everything.
+func (p *SamplingPolicy) Keep(requestID string) bool {
+	if p == nil {
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(requestID))
+	return float64(h.Sum32()%sampleBuckets) < p.Rate*sampleBuckets
+}
+
+// metadataKeys are the response fields kept for a sampled-out request
+var metadataKeys = []string{"id", "object", "created", "model", "usage", "stop_reason", "streamed", "chunk_count"}
+
+// responseMetadata strips a response down to the fields that carry no generated content
+func responseMetadata(response map[string]interface{}) map[string]interface{} {
+	metadata := map[string]interface{}{}
+	for _, key := range metadataKeys {
+		if value, ok := response[key]; ok {
+			metadata[key] = value
+		}
+	}
+	return metadata
+}
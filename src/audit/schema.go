@@ -0,0 +1,246 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/types"
+)
+
+// Versions of the JSON shapes stored in request_logs.inputs and response_logs.response.
+// Each row records the version it was written in and is read with that version's
+// parser, so the format can change without breaking historical reads. Rows written
+// before versioning have no version; it is detected from their structure.
+const (
+	// Inputs stored as clients sent them, before they were validated as messages
+	RequestSchemaV1 int32 = 1
+	// Validated messages: a role and either string content or an array of parts
+	RequestSchemaV2 int32 = 2
+
+	// Token counts under the gateway's own metrics object
+	ResponseSchemaV1 int32 = 1
+	// The provider's response as returned, with token counts under usage
+	ResponseSchemaV2 int32 = 2
+
+	// The versions the writer stores new rows in
+	CurrentRequestSchema  = RequestSchemaV2
+	CurrentResponseSchema = ResponseSchemaV2
+)
+
+const defaultBackfillBatchSize = 10000
+
+// inputParsers decode a single logged input by the request schema version it was written in
+var inputParsers = map[int32]func(data []byte) (map[string]interface{}, error){
+	RequestSchemaV1: parseInputV1,
+	RequestSchemaV2: parseInputV2,
+}
+
+// responseTokenReaders read the token usage of a logged response by its schema version
+var responseTokenReaders = map[int32]func(response map[string]interface{}) (input, output, total int64){
+	ResponseSchemaV1: responseTokensV1,
+	ResponseSchemaV2: responseTokensV2,
+}
+
+// schemaVersion returns a row's stored version, or zero if it predates versioning
+func schemaVersion(version pgtype.Int4) int32 {
+	if !version.Valid {
+		return 0
+	}
+	return version.Int32
+}
+
+// parseInputs decodes a request's logged inputs with the parser for version, detecting
+// the version from the inputs if it is zero. Inputs that can't be decoded are kept as
+// their raw string and reported in the returned errors.
+func parseInputs(version int32, data [][]byte) ([]map[string]interface{}, []string) {
+	if version == 0 {
+		version = detectRequestSchema(data)
+	}
+	parse, ok := inputParsers[version]
+	if !ok {
+		return rawInputs(data), []string{fmt.Sprintf("inputs: unknown schema version %d", version)}
+	}
+
+	var errs []string
+	var inputs []map[string]interface{}
+	for i, input := range data {
+		msg, err := parse(input)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("inputs[%d]: %v", i, err))
+			msg = map[string]interface{}{"raw": string(input)}
+		}
+		inputs = append(inputs, msg)
+	}
+	return inputs, errs
+}
+
+func rawInputs(data [][]byte) []map[string]interface{} {
+	inputs := make([]map[string]interface{}, 0, len(data))
+	for _, input := range data {
+		inputs = append(inputs, map[string]interface{}{"raw": string(input)})
+	}
+	return inputs
+}
+
+// detectRequestSchema recognises inputs written before versioning, by the same rule as
+// the BackfillRequestSchemaVersions query
+func detectRequestSchema(data [][]byte) int32 {
+	for _, input := range data {
+		var msg map[string]interface{}
+		if err := json.Unmarshal(input, &msg); err != nil || !isMessageShape(msg) {
+			return RequestSchemaV1
+		}
+	}
+	return RequestSchemaV2
+}
+
+// isMessageShape reports whether an input is exactly a known role and string or array content
+func isMessageShape(msg map[string]interface{}) bool {
+	if len(msg) != 2 {
+		return false
+	}
+	role, _ := msg["role"].(string)
+	normalized, err := types.NewRole(role)
+	if err != nil || normalized.String() != role {
+		return false
+	}
+	switch msg["content"].(type) {
+	case string, []interface{}:
+		return true
+	}
+	return false
+}
+
+// parseInputV1 keeps an input as the client sent it, whatever its shape
+func parseInputV1(data []byte) (map[string]interface{}, error) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseInputV2 decodes a validated message, rejecting any that lost its shape
+func parseInputV2(data []byte) (map[string]interface{}, error) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	if _, ok := msg["role"].(string); !ok {
+		return nil, fmt.Errorf("message role must be a string")
+	}
+	switch msg["content"].(type) {
+	case string, []interface{}:
+	default:
+		return nil, fmt.Errorf("message content must be a string or an array of parts")
+	}
+	return msg, nil
+}
+
+// detectResponseSchema recognises a response written before versioning, by the same
+// rule as the BackfillResponseSchemaVersions query
+func detectResponseSchema(response map[string]interface{}) int32 {
+	if _, ok := response["metrics"].(map[string]interface{}); ok {
+		return ResponseSchemaV1
+	}
+	return ResponseSchemaV2
+}
+
+// responseTokens reads the token usage of a logged response with the reader for
+// version, detecting the version from the response if it is zero
+func responseTokens(version int32, response map[string]interface{}) (input, output, total int64, err error) {
+	if version == 0 {
+		version = detectResponseSchema(response)
+	}
+	read, ok := responseTokenReaders[version]
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("response: unknown schema version %d", version)
+	}
+	input, output, total = read(response)
+	return input, output, total, nil
+}
+
+// responseTokensV1 reads the gateway's metrics object
+func responseTokensV1(response map[string]interface{}) (input, output, total int64) {
+	metrics, _ := response["metrics"].(map[string]interface{})
+	return tokenCounts(
+		[]interface{}{metrics["input_tokens"]},
+		[]interface{}{metrics["output_tokens"]},
+		[]interface{}{metrics["total_tokens"]},
+	)
+}
+
+// responseTokensV2 reads the provider's usage object: OpenAI's fields, then Anthropic's
+func responseTokensV2(response map[string]interface{}) (input, output, total int64) {
+	usage, _ := response["usage"].(map[string]interface{})
+	return tokenCounts(
+		[]interface{}{usage["prompt_tokens"], usage["input_tokens"]},
+		[]interface{}{usage["completion_tokens"], usage["output_tokens"]},
+		[]interface{}{usage["total_tokens"]},
+	)
+}
+
+// tokenCounts takes the first number among each list of candidates. A missing total is
+// the sum of the other two.
+func tokenCounts(inputs, outputs, totals []interface{}) (input, output, total int64) {
+	first := func(values []interface{}) (int64, bool) {
+		for _, v := range values {
+			if n, ok := v.(float64); ok {
+				return int64(n), true
+			}
+		}
+		return 0, false
+	}
+
+	input, _ = first(inputs)
+	output, _ = first(outputs)
+	total, ok := first(totals)
+	if !ok {
+		total = input + output
+	}
+	return input, output, total
+}
+
+// BackfillSchemaVersions sets the schema version of request and response rows logged
+// before versioning, detecting each from the stored JSON's structure. Rows are updated
+// in bounded batches, like PurgeOlderThan, and the helper can be rerun safely: rows that
+// already have a version are left alone. It returns the number of rows updated.
+func BackfillSchemaVersions(ctx context.Context, db *postgres.DB, batchSize int) (requests, responses int64, err error) {
+	if batchSize <= 0 {
+		batchSize = defaultBackfillBatchSize
+	}
+
+	backfill := func(query func(context.Context, int32) (int64, error)) (int64, error) {
+		var total int64
+		for {
+			// Stop between batches if the caller gave up
+			if err := ctx.Err(); err != nil {
+				return total, err
+			}
+
+			n, err := query(ctx, int32(batchSize))
+			if err != nil {
+				return total, err
+			}
+			total += n
+
+			if n < int64(batchSize) {
+				return total, nil
+			}
+		}
+	}
+
+	requests, err = backfill(db.Queries.BackfillRequestSchemaVersions)
+	if err != nil {
+		return requests, 0, fmt.Errorf("failed to backfill request schema versions after %d rows: %w", requests, err)
+	}
+	responses, err = backfill(db.Queries.BackfillResponseSchemaVersions)
+	if err != nil {
+		return requests, responses, fmt.Errorf("failed to backfill response schema versions after %d rows: %w", responses, err)
+	}
+	return requests, responses, nil
+}
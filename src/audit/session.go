@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+)
+
+// SessionTurn links a logged request to the WebSocket session it was made over
+type SessionTurn struct {
+	SessionID string
+	Turn      int
+	RequestID string
+	StartedAt time.Time
+}
+
+// LogSessionTurn records that a request was the given turn of a session
+func LogSessionTurn(ctx context.Context, sessionID string, turn int, requestID string, db *postgres.DB) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var sessionUUID, reqUUID pgtype.UUID
+	if err := sessionUUID.Scan(sessionID); err != nil {
+		return fmt.Errorf("invalid session ID: %w", err)
+	}
+	if err := reqUUID.Scan(requestID); err != nil {
+		return fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	return db.Queries.InsertSessionTurn(ctx, sqlc.InsertSessionTurnParams{
+		SessionID: sessionUUID,
+		Turn:      int32(turn),
+		RequestID: reqUUID,
+	})
+}
+
+// GetSessionTurns lists the turns of a session in order; their traces can be loaded
+// with GetTraces
+func GetSessionTurns(ctx context.Context, sessionID string, db *postgres.DB) ([]SessionTurn, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var sessionUUID pgtype.UUID
+	if err := sessionUUID.Scan(sessionID); err != nil {
+		return nil, fmt.Errorf("invalid session ID: %w", err)
+	}
+
+	rows, err := db.Queries.ListSessionTurns(ctx, sessionUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	turns := make([]SessionTurn, 0, len(rows))
+	for _, row := range rows {
+		turns = append(turns, SessionTurn{
+			SessionID: row.SessionID.String(),
+			Turn:      int(row.Turn),
+			RequestID: row.RequestID.String(),
+			StartedAt: row.StartedAt.Time,
+		})
+	}
+	return turns, nil
+}
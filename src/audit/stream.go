@@ -0,0 +1,199 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+)
+
+// ResponseChunk is a single streamed chunk as received from the upstream provider
+type ResponseChunk struct {
+	Seq        int
+	Chunk      map[string]interface{}
+	ReceivedAt time.Time
+}
+
+// LogResponseChunk appends a streamed chunk to a request's response
+func LogResponseChunk(ctx context.Context, requestID string, chunk map[string]interface{}, seq int, db *postgres.DB) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	params, err := chunkParams(requestID, chunk, seq)
+	if err != nil {
+		return err
+	}
+
+	return db.Queries.InsertResponseChunk(ctx, params)
+}
+
+// chunkParams encodes a streamed chunk
+func chunkParams(requestID string, chunk map[string]interface{}, seq int) (sqlc.InsertResponseChunkParams, error) {
+
+	var reqUUID pgtype.UUID
+	if err := reqUUID.Scan(requestID); err != nil {
+		return sqlc.InsertResponseChunkParams{}, fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	chunkBytes, err := json.Marshal(chunk)
+	if err != nil {
+		return sqlc.InsertResponseChunkParams{}, fmt.Errorf("invalid chunk: %w", err)
+	}
+
+	return sqlc.InsertResponseChunkParams{
+		RequestID: reqUUID,
+		Seq:       int32(seq),
+		Chunk:     chunkBytes,
+	}, nil
+}
+
+// FinalizeStreamingResponse stitches the logged chunks of a streamed request into a
+// single response and records it along with its latencies. Any Response map set on r
+// is replaced by the stitched content.
+func FinalizeStreamingResponse(ctx context.Context, r Response, db *postgres.DB) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	chunks, err := getResponseChunks(ctx, r.RequestID, db)
+	if err != nil {
+		return err
+	}
+
+	r.Response = stitchChunks(chunks)
+
+	return LogResponse(ctx, r, db)
+}
+
+// getResponseChunks loads the chunks for a request ordered by sequence number
+func getResponseChunks(ctx context.Context, requestID string, db *postgres.DB) ([]ResponseChunk, error) {
+
+	var reqUUID pgtype.UUID
+	if err := reqUUID.Scan(requestID); err != nil {
+		return nil, fmt.Errorf("invalid request ID: %w", err)
+	}
+
+	rows, err := db.Queries.GetResponseChunks(ctx, reqUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeChunks(rows)
+}
+
+// decodeChunks decodes the chunk rows of a single request, ordered by sequence number
+func decodeChunks(rows []sqlc.ResponseChunk) ([]ResponseChunk, error) {
+	chunks := make([]ResponseChunk, 0, len(rows))
+	for _, row := range rows {
+		var chunk map[string]interface{}
+		if err := json.Unmarshal(row.Chunk, &chunk); err != nil {
+			return nil, fmt.Errorf("invalid chunk %d: %w", row.Seq, err)
+		}
+		chunks = append(chunks, ResponseChunk{
+			Seq:        int(row.Seq),
+			Chunk:      chunk,
+			ReceivedAt: row.ReceivedAt.Time,
+		})
+	}
+
+	// Chunks may have been written out of order
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].Seq < chunks[j].Seq
+	})
+
+	return chunks, nil
+}
+
+// stitchChunks rebuilds a complete response from OpenAI-style delta chunks or
+// Anthropic-style content_block_delta events
+func stitchChunks(chunks []ResponseChunk) map[string]interface{} {
+	response := map[string]interface{}{
+		"object":      "chat.completion",
+		"streamed":    true,
+		"chunk_count": len(chunks),
+	}
+
+	contents := map[int]*strings.Builder{}
+	finishReasons := map[int]interface{}{}
+
+	appendContent := func(index int, text string) {
+		if _, ok := contents[index]; !ok {
+			contents[index] = &strings.Builder{}
+		}
+		contents[index].WriteString(text)
+	}
+
+	for _, c := range chunks {
+		if id, ok := c.Chunk["id"].(string); ok {
+			response["id"] = id
+		}
+		if model, ok := c.Chunk["model"].(string); ok {
+			response["model"] = model
+		}
+		if usage, ok := c.Chunk["usage"].(map[string]interface{}); ok {
+			response["usage"] = usage
+		}
+
+		// OpenAI: choices[].delta.content
+		if choices, ok := c.Chunk["choices"].([]interface{}); ok {
+			for _, raw := range choices {
+				choice, ok := raw.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				index := 0
+				if i, ok := choice["index"].(float64); ok {
+					index = int(i)
+				}
+				if delta, ok := choice["delta"].(map[string]interface{}); ok {
+					if text, ok := delta["content"].(string); ok {
+						appendContent(index, text)
+					}
+				}
+				if reason, ok := choice["finish_reason"]; ok && reason != nil {
+					finishReasons[index] = reason
+				}
+			}
+		}
+
+		// Anthropic: content_block_delta with delta.text
+		if c.Chunk["type"] == "content_block_delta" {
+			if delta, ok := c.Chunk["delta"].(map[string]interface{}); ok {
+				if text, ok := delta["text"].(string); ok {
+					appendContent(0, text)
+				}
+			}
+		}
+	}
+
+	indexes := make([]int, 0, len(contents))
+	for index := range contents {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	choices := make([]interface{}, 0, len(indexes))
+	for _, index := range indexes {
+		choices = append(choices, map[string]interface{}{
+			"index": index,
+			"message": map[string]interface{}{
+				"role":    "assistant",
+				"content": contents[index].String(),
+			},
+			"finish_reason": finishReasons[index],
+		})
+	}
+	response["choices"] = choices
+
+	return response
+}
@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+	"covalence/src/types"
+)
+
+// TokenUsage is the summed token consumption of a user over a period
+type TokenUsage struct {
+	RequestCount int64
+	InputTokens  int64
+	OutputTokens int64
+	TotalTokens  int64
+}
+
+// GetTokenUsage totals the tokens recorded in a user's responses received in [from, to).
+// Responses without token metrics count as zero.
+func GetTokenUsage(ctx context.Context, userID string, from, to time.Time, db *postgres.DB) (TokenUsage, error) {
+
+	if err := ctx.Err(); err != nil {
+		return TokenUsage{}, err
+	}
+
+	var userUUID pgtype.UUID
+	if err := userUUID.Scan(userID); err != nil {
+		return TokenUsage{}, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	if !to.After(from) {
+		return TokenUsage{}, fmt.Errorf("invalid range: %s is not after %s", to.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+
+	row, err := db.Queries.GetTokenUsage(ctx, sqlc.GetTokenUsageParams{
+		UserID:       userUUID,
+		ReceivedFrom: pgtype.Timestamptz{Time: from, Valid: true},
+		ReceivedTo:   pgtype.Timestamptz{Time: to, Valid: true},
+	})
+	if err != nil {
+		return TokenUsage{}, err
+	}
+
+	return TokenUsage{
+		RequestCount: row.RequestCount,
+		InputTokens:  row.InputTokens,
+		OutputTokens: row.OutputTokens,
+		TotalTokens:  row.TotalTokens,
+	}, nil
+}
+
+// Price is the cost of a model in dollars per thousand tokens
+type Price struct {
+	InputPer1K  float64 `yaml:"input_per_1k"`
+	OutputPer1K float64 `yaml:"output_per_1k"`
+}
+
+// PriceBook maps models to their prices
+type PriceBook map[types.ModelID]Price
+
+// ModelCost is the usage and cost attributed to a single model
+type ModelCost struct {
+	Model types.ModelID
+	Usage TokenUsage
+	Cost  float64
+}
+
+// Cost is a user's estimated spend over a period
+type Cost struct {
+	Total   float64
+	ByModel []ModelCost
+	// UnpricedModels lists models with usage but no entry in the PriceBook; their
+	// tokens are not included in Total
+	UnpricedModels []types.ModelID
+}
+
+// GetCost estimates what a user's usage in [from, to) costs according to prices
+func GetCost(ctx context.Context, userID string, from, to time.Time, db *postgres.DB, prices PriceBook) (Cost, error) {
+
+	if err := ctx.Err(); err != nil {
+		return Cost{}, err
+	}
+
+	var userUUID pgtype.UUID
+	if err := userUUID.Scan(userID); err != nil {
+		return Cost{}, fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	if !to.After(from) {
+		return Cost{}, fmt.Errorf("invalid range: %s is not after %s", to.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+
+	rows, err := db.Queries.GetTokenUsageByModel(ctx, sqlc.GetTokenUsageByModelParams{
+		UserID:       userUUID,
+		ReceivedFrom: pgtype.Timestamptz{Time: from, Valid: true},
+		ReceivedTo:   pgtype.Timestamptz{Time: to, Valid: true},
+	})
+	if err != nil {
+		return Cost{}, err
+	}
+
+	var cost Cost
+	for _, row := range rows {
+		model, err := types.NewModelID(row.Model)
+		if err != nil {
+			return Cost{}, fmt.Errorf("invalid model: %w", err)
+		}
+
+		usage := TokenUsage{
+			RequestCount: row.RequestCount,
+			InputTokens:  row.InputTokens,
+			OutputTokens: row.OutputTokens,
+			TotalTokens:  row.TotalTokens,
+		}
+
+		price, ok := prices[model]
+		if !ok {
+			cost.UnpricedModels = append(cost.UnpricedModels, model)
+			cost.ByModel = append(cost.ByModel, ModelCost{Model: model, Usage: usage})
+			continue
+		}
+
+		modelCost := float64(usage.InputTokens)/1000*price.InputPer1K +
+			float64(usage.OutputTokens)/1000*price.OutputPer1K
+
+		cost.ByModel = append(cost.ByModel, ModelCost{Model: model, Usage: usage, Cost: modelCost})
+		cost.Total += modelCost
+	}
+
+	return cost, nil
+}
@@ -0,0 +1,398 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+	"covalence/src/types"
+)
+
+// flushTimeout bounds a single batch write
+const flushTimeout = 10 * time.Second
+
+// WriterOptions controls how a Writer buffers audit entries
+type WriterOptions struct {
+	BufferSize    int           // Entries queued before the buffer counts as full
+	BatchSize     int           // Flush once this many entries are queued
+	FlushInterval time.Duration // Flush queued entries at least this often
+	// BlockWhenFull makes writes wait for buffer space. By default entries are dropped
+	// instead, so a slow database never holds up serving.
+	BlockWhenFull bool
+	// Synchronous writes every entry immediately, as the package functions do
+	Synchronous bool
+}
+
+// DefaultWriterOptions suit a single gateway instance under moderate load
+func DefaultWriterOptions() WriterOptions {
+	return WriterOptions{
+		BufferSize:    10000,
+		BatchSize:     500,
+		FlushInterval: 200 * time.Millisecond,
+	}
+}
+
+// entry is one queued write. Exactly one field is set.
+type entry struct {
+	request  *sqlc.InsertRequestLogsParams
+	chunk    *sqlc.InsertResponseChunksParams
+	events   []sqlc.InsertFirewallEventsParams
+	response *sqlc.UpsertResponseLogParams
+	finalize *Response // Stitched from its chunks once they are written
+
+	sampledOut bool // Set with response to drop the request's content once it is written
+}
+
+// Writer batches audit inserts in the background. Request IDs are assigned up front so
+// later entries can reference a request before it reaches the database. Requests with
+// a ClientRequestID are still written immediately, since they may resolve to an
+// existing row.
+type Writer struct {
+	db   *postgres.DB
+	opts WriterOptions
+
+	mu      sync.RWMutex // Held for writing only to close entries
+	closed  bool
+	entries chan entry
+	done    chan struct{}
+
+	dropped atomic.Int64
+}
+
+// NewWriter creates a writer and, unless it is synchronous, starts flushing in the background
+func NewWriter(db *postgres.DB, opts WriterOptions) *Writer {
+	defaults := DefaultWriterOptions()
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaults.BufferSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaults.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaults.FlushInterval
+	}
+
+	w := &Writer{db: db, opts: opts, done: make(chan struct{})}
+	if opts.Synchronous {
+		close(w.done)
+		return w
+	}
+
+	w.entries = make(chan entry, opts.BufferSize)
+	go w.run()
+	return w
+}
+
+// Dropped is the number of entries discarded because the buffer was full
+func (w *Writer) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// LogRequestTyped queues a request log entry and returns its ID
+func (w *Writer) LogRequestTyped(ctx context.Context, r Request, messages []types.Message, opts Options) (string, error) {
+	if w.opts.Synchronous || r.ClientRequestID != "" {
+		return LogRequestTyped(ctx, r, messages, w.db, opts)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	params, err := requestParams(r, messages, opts)
+	if err != nil {
+		return "", err
+	}
+
+	requestID := uuid.New()
+	row := sqlc.InsertRequestLogsParams{
+		RequestID:     pgtype.UUID{Bytes: requestID, Valid: true},
+		UserID:        params.UserID,
+		ApiKeyID:      params.ApiKeyID,
+		Model:         params.Model,
+		TargetUrl:     params.TargetUrl,
+		Inputs:        params.Inputs,
+		Parameters:    params.Parameters,
+		ClientIp:      params.ClientIp,
+		MirrorOf:      params.MirrorOf,
+		SchemaVersion: params.SchemaVersion,
+		Metadata:      params.Metadata,
+	}
+	if !w.enqueue(ctx, entry{request: &row}) {
+		return requestID.String(), w.write(ctx, []entry{{request: &row}})
+	}
+	return requestID.String(), nil
+}
+
+// LogResponse queues a response to a request
+func (w *Writer) LogResponse(ctx context.Context, r Response) error {
+	if w.opts.Synchronous {
+		return LogResponse(ctx, r, w.db)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	params, err := responseParams(r)
+	if err != nil {
+		return err
+	}
+
+	e := entry{response: &params, sampledOut: r.SampledOut}
+	if !w.enqueue(ctx, e) {
+		return w.write(ctx, []entry{e})
+	}
+	return nil
+}
+
+// LogResponseChunk queues a streamed chunk
+func (w *Writer) LogResponseChunk(ctx context.Context, requestID string, chunk map[string]interface{}, seq int) error {
+	if w.opts.Synchronous {
+		return LogResponseChunk(ctx, requestID, chunk, seq, w.db)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	params, err := chunkParams(requestID, chunk, seq)
+	if err != nil {
+		return err
+	}
+
+	row := sqlc.InsertResponseChunksParams(params)
+	if !w.enqueue(ctx, entry{chunk: &row}) {
+		return w.write(ctx, []entry{{chunk: &row}})
+	}
+	return nil
+}
+
+// FinalizeStreamingResponse queues the stitching of a streamed response. It runs after
+// the request's chunks have been written.
+func (w *Writer) FinalizeStreamingResponse(ctx context.Context, r Response) error {
+	if w.opts.Synchronous {
+		return FinalizeStreamingResponse(ctx, r, w.db)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !w.enqueue(ctx, entry{finalize: &r}) {
+		return FinalizeStreamingResponse(ctx, r, w.db)
+	}
+	return nil
+}
+
+// LogFirewallEvents queues a request's firewall events, which are written together
+func (w *Writer) LogFirewallEvents(ctx context.Context, events []FirewallEvent) error {
+	if w.opts.Synchronous {
+		return LogFirewallEvents(ctx, events, w.db)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	rows := make([]sqlc.InsertFirewallEventsParams, 0, len(events))
+	for i, fe := range events {
+		params, err := firewallEventParams(fe)
+		if err != nil {
+			return fmt.Errorf("firewall event %d: %w", i, err)
+		}
+		rows = append(rows, sqlc.InsertFirewallEventsParams(params))
+	}
+
+	if !w.enqueue(ctx, entry{events: rows}) {
+		return w.write(ctx, []entry{{events: rows}})
+	}
+	return nil
+}
+
+// Close flushes queued entries, waiting until ctx is done. Writes made afterwards go
+// straight to the database.
+func (w *Writer) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		if w.entries != nil {
+			close(w.entries)
+		}
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("audit entries still queued: %w", ctx.Err())
+	}
+}
+
+// enqueue queues e, reporting false if the writer is closed and the caller should write
+// it directly. A full buffer drops e unless the writer blocks when full.
+func (w *Writer) enqueue(ctx context.Context, e entry) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return false
+	}
+
+	if w.opts.BlockWhenFull {
+		select {
+		case w.entries <- e:
+		case <-ctx.Done():
+			w.dropped.Add(1)
+		}
+		return true
+	}
+
+	select {
+	case w.entries <- e:
+	default:
+		if w.dropped.Add(1)%1000 == 1 {
+			log.Printf("audit buffer full, dropped %d entries so far", w.dropped.Load())
+		}
+	}
+	return true
+}
+
+// run flushes queued entries every BatchSize entries or FlushInterval
+func (w *Writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]entry, 0, w.opts.BatchSize)
+	for {
+		select {
+		case e, ok := <-w.entries:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= w.opts.BatchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes a batch in one transaction. If that fails, e.g. because an entry
+// references a request that was dropped, each entry is retried on its own so one bad
+// row doesn't lose the rest.
+func (w *Writer) flush(batch []entry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	if err := w.write(ctx, batch); err != nil {
+		log.Printf("audit batch of %d entries failed, retrying individually: %v", len(batch), err)
+		for _, e := range batch {
+			if err := w.write(ctx, []entry{e}); err != nil {
+				log.Printf("failed to write audit entry: %v", err)
+			}
+		}
+	}
+}
+
+// write inserts entries in one transaction, parents before children, then stitches
+// any streamed responses from the committed chunks. Only the transaction's error is returned.
+func (w *Writer) write(ctx context.Context, entries []entry) error {
+	var requests []sqlc.InsertRequestLogsParams
+	var chunks []sqlc.InsertResponseChunksParams
+	var events []sqlc.InsertFirewallEventsParams
+	var responses []sqlc.UpsertResponseLogParams
+	var sampledOut []pgtype.UUID
+	var finalize []Response
+	for _, e := range entries {
+		switch {
+		case e.request != nil:
+			requests = append(requests, *e.request)
+		case e.chunk != nil:
+			chunks = append(chunks, *e.chunk)
+		case e.events != nil:
+			events = append(events, e.events...)
+		case e.response != nil:
+			responses = append(responses, *e.response)
+			if e.sampledOut {
+				sampledOut = append(sampledOut, e.response.RequestID)
+			}
+		case e.finalize != nil:
+			finalize = append(finalize, *e.finalize)
+		}
+	}
+
+	if len(requests)+len(chunks)+len(events)+len(responses) > 0 {
+		tx, err := w.db.Pool.Begin(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		// Rollback is a no-op once the transaction has been committed
+		defer tx.Rollback(ctx)
+
+		q := w.db.Queries.WithTx(tx)
+		if len(requests) > 0 {
+			if _, err := q.InsertRequestLogs(ctx, requests); err != nil {
+				return fmt.Errorf("failed to insert request logs: %w", err)
+			}
+		}
+		if len(chunks) > 0 {
+			if _, err := q.InsertResponseChunks(ctx, chunks); err != nil {
+				return fmt.Errorf("failed to insert response chunks: %w", err)
+			}
+		}
+		if len(events) > 0 {
+			if _, err := q.InsertFirewallEvents(ctx, events); err != nil {
+				return fmt.Errorf("failed to insert firewall events: %w", err)
+			}
+		}
+		// Upserted one by one rather than copied, so a response logged twice replaces
+		// the first; each request has only one, so there are few of them
+		for _, response := range responses {
+			if _, err := q.UpsertResponseLog(ctx, response); err != nil {
+				return fmt.Errorf("failed to upsert response log: %w", err)
+			}
+		}
+		// After the inserts, so the request and its chunks are there to drop
+		for _, requestID := range sampledOut {
+			if err := sampleOut(ctx, q, requestID); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Logged rather than returned, since retrying would insert the rows above again
+	for _, r := range finalize {
+		if err := FinalizeStreamingResponse(ctx, r, w.db); err != nil {
+			log.Printf("failed to finalize streamed response for request %s: %v", r.RequestID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PoolConfig sizes the connection pool. A nil field is left as the connection string
+// sets it, with pool_max_conns and the like, or at pgx's default if it doesn't.
+type PoolConfig struct {
+	MaxConns          *int32
+	MinConns          *int32         // Kept open even when idle, so a burst doesn't wait on new connections
+	MaxConnLifetime   *time.Duration // Connections are replaced after this, to follow failovers and rebalancing
+	MaxConnIdleTime   *time.Duration
+	HealthCheckPeriod *time.Duration // How often idle connections are checked and the minimum restored
+}
+
+// DefaultPoolConfig suits a single gateway instance in front of a shared database. Every
+// field is set, so it overrides the connection string's pool settings.
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxConns:          ptr[int32](20),
+		MinConns:          ptr[int32](2),
+		MaxConnLifetime:   ptr(time.Hour),
+		MaxConnIdleTime:   ptr(30 * time.Minute),
+		HealthCheckPeriod: ptr(time.Minute),
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Validate rejects set fields that could never hand out a connection or would never
+// recycle one
+func (c PoolConfig) Validate() error {
+	if c.MaxConns != nil && *c.MaxConns < 1 {
+		return fmt.Errorf("invalid max conns %d: must be at least 1", *c.MaxConns)
+	}
+	if c.MinConns != nil && *c.MinConns < 0 {
+		return fmt.Errorf("invalid min conns %d: must not be negative", *c.MinConns)
+	}
+	for _, d := range []*time.Duration{c.MaxConnLifetime, c.MaxConnIdleTime, c.HealthCheckPeriod} {
+		if d != nil && *d < 0 {
+			return fmt.Errorf("invalid pool durations: must not be negative")
+		}
+	}
+	return nil
+}
+
+// apply sets the fields of c that are set on a parsed pool config, leaving the rest as
+// the connection string gave them. The minimum is checked against the resulting
+// maximum, since either may have come from the connection string.
+func (c PoolConfig) apply(config *pgxpool.Config) error {
+	if c.MaxConns != nil {
+		config.MaxConns = *c.MaxConns
+	}
+	if c.MinConns != nil {
+		config.MinConns = *c.MinConns
+	}
+	if c.MaxConnLifetime != nil {
+		config.MaxConnLifetime = *c.MaxConnLifetime
+	}
+	if c.MaxConnIdleTime != nil {
+		config.MaxConnIdleTime = *c.MaxConnIdleTime
+	}
+	if c.HealthCheckPeriod != nil {
+		config.HealthCheckPeriod = *c.HealthCheckPeriod
+	}
+
+	if config.MinConns > config.MaxConns {
+		return fmt.Errorf("invalid min conns %d: must not exceed max conns %d", config.MinConns, config.MaxConns)
+	}
+	return nil
+}
+
+// PoolStats is a snapshot of the connection pool. A pool is starved when Acquired
+// stays at Max while Waits keeps rising.
+type PoolStats struct {
+	Acquired     int32 // Connections in use by a query or transaction
+	Idle         int32
+	Constructing int32 // Connections being opened
+	Total        int32
+	Max          int32
+
+	// Cumulative counts since the pool was created. pgx doesn't report how many
+	// callers are waiting right now, only how many ever had to.
+	Waits            int64         // Acquires that found no idle connection and had to wait
+	WaitDuration     time.Duration // Total time spent in those waits
+	CanceledAcquires int64         // Acquires given up on, such as by a request timing out
+}
+
+// Stats returns a snapshot of the pool, for metrics
+func (db *DB) Stats() PoolStats {
+	stat := db.Pool.Stat()
+	return PoolStats{
+		Acquired:         stat.AcquiredConns(),
+		Idle:             stat.IdleConns(),
+		Constructing:     stat.ConstructingConns(),
+		Total:            stat.TotalConns(),
+		Max:              stat.MaxConns(),
+		Waits:            stat.EmptyAcquireCount(),
+		WaitDuration:     stat.EmptyAcquireWaitTime(),
+		CanceledAcquires: stat.CanceledAcquireCount(),
+	}
+}
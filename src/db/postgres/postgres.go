@@ -4,21 +4,32 @@ import (
 	"context"
 	"covalence/src/db/postgres/sqlc"
 	"fmt"
-	"sync"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// Store handles database operations with a simplified interface
+// Store handles database operations with a simplified interface.
+// The underlying pool is safe for concurrent use, so no extra locking is needed.
 type DB struct {
 	Pool    *pgxpool.Pool
 	Queries *sqlc.Queries
-	Mu      sync.Mutex
 }
 
-// New creates a database store with connection pooling
-func New(ctx context.Context, connString string) (*DB, error) {
-	pool, err := pgxpool.New(ctx, connString)
+// New creates a database store with connection pooling, sized by poolConfig
+func New(ctx context.Context, connString string, poolConfig PoolConfig) (*DB, error) {
+	if err := poolConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid pool config: %w", err)
+	}
+
+	config, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection string: %w", err)
+	}
+	if err := poolConfig.apply(config); err != nil {
+		return nil, fmt.Errorf("invalid pool config: %w", err)
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
 		return nil, fmt.Errorf("database connection failed: %w", err)
 	}
@@ -1,44 +1,370 @@
 -- name: InsertRequestLog :one
 INSERT INTO request_logs (
-  user_id, api_key_id, model, target_url, inputs, parameters, client_ip
+  user_id, api_key_id, model, target_url, inputs, parameters, client_ip, mirror_of, schema_version, metadata
 )
-VALUES ($1, $2, $3, $4, $5, $6, $7)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 RETURNING *;
 
--- name: InsertResponseLog :one
+-- name: InsertRequestLogs :copyfrom
+INSERT INTO request_logs (
+  request_id, user_id, api_key_id, model, target_url, inputs, parameters, client_ip, mirror_of, schema_version, metadata
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
+
+-- name: UpsertRequestLog :one
+INSERT INTO request_logs (
+  user_id, api_key_id, model, target_url, inputs, parameters, client_ip, client_request_id, schema_version, metadata
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (user_id, client_request_id) DO UPDATE
+SET api_key_id = EXCLUDED.api_key_id,
+  model = EXCLUDED.model,
+  target_url = EXCLUDED.target_url,
+  inputs = EXCLUDED.inputs,
+  parameters = EXCLUDED.parameters,
+  client_ip = EXCLUDED.client_ip,
+  schema_version = EXCLUDED.schema_version,
+  metadata = EXCLUDED.metadata,
+  sampled = TRUE,
+  received_at = now()
+RETURNING *;
+
+-- name: UpsertResponseLog :one
+-- A request has one response; logging it again, such as from a retry after a timeout
+-- that actually succeeded, replaces the first
 INSERT INTO response_logs (
-  request_id, response, latency_ms
+  request_id, response, latency_ms, upstream_latency_ms, gateway_overhead_ms, served_by, attempts, cache_hit, partial, upstream_error, schema_version, upstream_status, upstream_headers, client_response, client_status
 )
-VALUES ($1, $2, $3)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+ON CONFLICT (request_id) DO UPDATE
+SET response = EXCLUDED.response,
+  created_at = now(),
+  latency_ms = EXCLUDED.latency_ms,
+  upstream_latency_ms = EXCLUDED.upstream_latency_ms,
+  gateway_overhead_ms = EXCLUDED.gateway_overhead_ms,
+  served_by = EXCLUDED.served_by,
+  attempts = EXCLUDED.attempts,
+  cache_hit = EXCLUDED.cache_hit,
+  partial = EXCLUDED.partial,
+  upstream_error = EXCLUDED.upstream_error,
+  schema_version = EXCLUDED.schema_version,
+  upstream_status = EXCLUDED.upstream_status,
+  upstream_headers = EXCLUDED.upstream_headers,
+  client_response = EXCLUDED.client_response,
+  client_status = EXCLUDED.client_status
 RETURNING *;
 
+-- name: GetCompletedRequest :one
+-- Only responses that can be replayed to the client store what it was sent
+SELECT rl.request_id, res.client_response, res.client_status
+FROM request_logs rl
+JOIN response_logs res ON rl.request_id = res.request_id
+WHERE rl.user_id = $1 AND rl.client_request_id = $2
+AND res.client_response IS NOT NULL
+ORDER BY res.created_at DESC
+LIMIT 1;
+
+-- name: InsertResponseChunk :exec
+INSERT INTO response_chunks (
+  request_id, seq, chunk
+)
+VALUES ($1, $2, $3);
+
+-- name: InsertResponseChunks :copyfrom
+INSERT INTO response_chunks (
+  request_id, seq, chunk
+)
+VALUES ($1, $2, $3);
+
+-- name: GetResponseChunks :many
+SELECT * FROM response_chunks
+WHERE request_id = $1
+ORDER BY seq;
+
+-- name: GetResponseChunksForRequests :many
+SELECT * FROM response_chunks
+WHERE request_id = ANY(sqlc.arg('request_ids')::uuid[])
+ORDER BY request_id, seq;
+
+-- name: InsertSessionTurn :exec
+INSERT INTO session_turns (
+  session_id, turn, request_id
+)
+VALUES ($1, $2, $3);
+
+-- name: ListSessionTurns :many
+SELECT * FROM session_turns
+WHERE session_id = $1
+ORDER BY turn;
+
 -- name: InsertFirewallEvent :one
 INSERT INTO firewall_events (
-  request_id, firewall_id, firewall_type, blocked, blocked_reason, risk_score
+  request_id, firewall_id, firewall_type, blocked, blocked_reason, risk_score, cached, enforced, replay, content_hash, aggregation, blocking_threshold, phase, stream_window, seq
 )
-VALUES ($1, $2, $3, $4, $5, $6)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 RETURNING *;
 
+-- name: InsertFirewallEvents :copyfrom
+INSERT INTO firewall_events (
+  request_id, firewall_id, firewall_type, blocked, blocked_reason, risk_score, cached, enforced, replay, content_hash, aggregation, blocking_threshold, phase, stream_window, seq
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15);
+
 -- name: InsertAuditArchive :one
 INSERT INTO audit_archives (
-  request_id, s3_path, archive_hash
+  request_id, s3_path, archive_hash, content_encoding
 )
-VALUES ($1, $2, $3)
+VALUES ($1, $2, $3, $4)
 RETURNING *;
 
+-- name: GetAuditArchive :one
+SELECT * FROM audit_archives
+WHERE archive_id = $1;
+
+-- name: GetLatestAuditArchive :one
+SELECT * FROM audit_archives
+WHERE request_id = $1
+ORDER BY archived_at DESC
+LIMIT 1;
+
+-- name: RestoreRequestLog :execrows
+INSERT INTO request_logs (
+  request_id, user_id, model, target_url, inputs, parameters, received_at, client_ip, archived, sampled, mirror_of, schema_version, metadata
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, TRUE, $9, $10, $11, $12)
+ON CONFLICT (request_id) DO NOTHING;
+
 -- name: MarkRequestArchived :exec
 UPDATE request_logs
 SET archived = TRUE
 WHERE request_id = $1;
 
+-- name: ClaimRequestArchived :execrows
+-- Marks a request archived unless it already is, so when two workers archive the same
+-- request only the first records its archive
+UPDATE request_logs
+SET archived = TRUE
+WHERE request_id = $1 AND archived IS NOT TRUE;
+
+-- name: ListUnarchivedRequests :many
+SELECT request_id, received_at FROM request_logs
+WHERE archived IS NOT TRUE
+AND received_at < sqlc.arg('received_to')
+AND (received_at, request_id) > (sqlc.arg('after_received_at')::timestamptz, sqlc.arg('after_request_id')::uuid)
+ORDER BY received_at, request_id
+LIMIT sqlc.arg('batch_size');
+
+-- name: CountUnarchivedRequests :one
+SELECT COUNT(*) FROM request_logs
+WHERE archived IS NOT TRUE
+AND received_at < sqlc.arg('received_to');
+
 -- name: GetUnarchivedRequests :many
 SELECT * FROM request_logs
 WHERE archived = FALSE
 AND received_at < now() - interval '10 minutes';
 
+-- name: SampleOutRequestLog :exec
+UPDATE request_logs
+SET inputs = '{}', sampled = FALSE
+WHERE request_id = $1;
+
+-- name: DeleteResponseChunks :exec
+DELETE FROM response_chunks
+WHERE request_id = $1;
+
+-- name: PurgeRequestLogs :execrows
+DELETE FROM request_logs
+WHERE request_id IN (
+  SELECT request_id FROM request_logs
+  WHERE received_at < sqlc.arg('cutoff')
+  AND (sqlc.arg('force_archived')::boolean OR archived IS NOT TRUE)
+  ORDER BY received_at
+  LIMIT sqlc.arg('batch_size')
+);
+
+-- name: BackfillRequestSchemaVersions :execrows
+-- Inputs logged as clients sent them, before they were validated as messages, are
+-- version 1: any input that isn't exactly a known role and string or array content.
+UPDATE request_logs
+SET schema_version = CASE
+  WHEN EXISTS (
+    SELECT 1 FROM unnest(inputs) AS input
+    WHERE CASE WHEN jsonb_typeof(input) = 'object'
+      THEN input - 'role' - 'content' <> '{}'::jsonb
+        OR COALESCE(input->>'role', '') NOT IN ('system', 'user', 'assistant', 'tool')
+        OR COALESCE(jsonb_typeof(input->'content'), '') NOT IN ('string', 'array')
+      ELSE TRUE
+    END
+  ) THEN 1
+  ELSE 2
+END
+WHERE request_id IN (
+  SELECT request_id FROM request_logs
+  WHERE schema_version IS NULL
+  LIMIT sqlc.arg('batch_size')
+);
+
+-- name: BackfillResponseSchemaVersions :execrows
+-- Responses carrying the gateway's own metrics object are version 1
+UPDATE response_logs
+SET schema_version = CASE WHEN jsonb_typeof(response->'metrics') = 'object' THEN 1 ELSE 2 END
+WHERE response_id IN (
+  SELECT response_id FROM response_logs
+  WHERE schema_version IS NULL
+  LIMIT sqlc.arg('batch_size')
+);
+
 -- name: GetRequestFullTrace :many
-SELECT rl.*, res.response, res.latency_ms, pe.*
+SELECT rl.*, res.response, res.latency_ms, res.upstream_latency_ms, res.gateway_overhead_ms, res.served_by, res.attempts, res.cache_hit, res.partial, res.upstream_error, res.schema_version AS response_schema_version, res.upstream_status, res.upstream_headers, pe.*
+FROM request_logs rl
+LEFT JOIN response_logs res ON rl.request_id = res.request_id
+LEFT JOIN firewall_events pe ON rl.request_id = pe.request_id
+WHERE rl.request_id = $1
+-- Events in the order they were evaluated, replays after the request's own
+ORDER BY pe.replay, CASE pe.phase WHEN 'input' THEN 0 WHEN 'stream' THEN 1 WHEN 'output' THEN 2 END, pe.stream_window, pe.seq, pe.evaluated_at;
+
+-- name: GetRequestFullTraces :many
+SELECT rl.*, res.response, res.latency_ms, res.upstream_latency_ms, res.gateway_overhead_ms, res.served_by, res.attempts, res.cache_hit, res.partial, res.upstream_error, res.schema_version AS response_schema_version, res.upstream_status, res.upstream_headers, pe.*
 FROM request_logs rl
 LEFT JOIN response_logs res ON rl.request_id = res.request_id
 LEFT JOIN firewall_events pe ON rl.request_id = pe.request_id
-WHERE rl.request_id = $1;
+WHERE rl.request_id = ANY(sqlc.arg('request_ids')::uuid[])
+ORDER BY rl.request_id, pe.replay, CASE pe.phase WHEN 'input' THEN 0 WHEN 'stream' THEN 1 WHEN 'output' THEN 2 END, pe.stream_window, pe.seq, pe.evaluated_at;
+
+-- name: ListRequestsForExport :many
+SELECT request_id, received_at FROM request_logs
+WHERE received_at < sqlc.arg('received_to')
+AND (received_at, request_id) > (sqlc.arg('after_received_at')::timestamptz, sqlc.arg('after_request_id')::uuid)
+ORDER BY received_at, request_id
+LIMIT sqlc.arg('batch_size');
+
+-- name: OldestPendingRequest :one
+-- The oldest request after the cursor still waiting for its response, ignoring those
+-- received before pending_from, which are taken to have been abandoned
+SELECT MIN(rl.received_at)::timestamptz AS received_at FROM request_logs rl
+WHERE (rl.received_at, rl.request_id) > (sqlc.arg('after_received_at')::timestamptz, sqlc.arg('after_request_id')::uuid)
+AND rl.received_at >= sqlc.arg('pending_from')
+AND NOT EXISTS (SELECT 1 FROM response_logs rs WHERE rs.request_id = rl.request_id);
+
+-- name: ListTraces :many
+SELECT rl.request_id, rl.user_id, rl.model, rl.received_at, rl.client_ip, rl.metadata,
+  COALESCE(fe.blocked, FALSE)::boolean AS blocked,
+  COALESCE(fe.risk_score, 0)::numeric AS risk_score
+FROM request_logs rl
+LEFT JOIN (
+  SELECT request_id, bool_or(blocked AND enforced) AS blocked, MAX(risk_score) AS risk_score
+  FROM firewall_events
+  WHERE NOT replay
+  GROUP BY request_id
+) fe ON rl.request_id = fe.request_id
+WHERE (sqlc.narg('user_id')::uuid IS NULL OR rl.user_id = sqlc.narg('user_id'))
+AND (sqlc.narg('model')::text IS NULL OR rl.model = sqlc.narg('model'))
+AND (sqlc.narg('received_from')::timestamptz IS NULL OR rl.received_at >= sqlc.narg('received_from'))
+AND (sqlc.narg('received_to')::timestamptz IS NULL OR rl.received_at < sqlc.narg('received_to'))
+AND (sqlc.narg('blocked')::boolean IS NULL OR COALESCE(fe.blocked, FALSE) = sqlc.narg('blocked'))
+AND (sqlc.narg('min_risk_score')::numeric IS NULL OR COALESCE(fe.risk_score, 0) >= sqlc.narg('min_risk_score'))
+AND (sqlc.narg('metadata')::jsonb IS NULL OR rl.metadata @> sqlc.narg('metadata'))
+ORDER BY rl.received_at DESC
+LIMIT sqlc.arg('limit') OFFSET sqlc.arg('offset');
+
+-- name: ListTracesByFirewall :many
+SELECT rl.request_id, rl.user_id, rl.model, rl.received_at, rl.client_ip, rl.metadata,
+  COALESCE(fe.blocked, FALSE)::boolean AS blocked,
+  COALESCE(fe.risk_score, 0)::numeric AS risk_score
+FROM firewall_events fe
+JOIN request_logs rl ON rl.request_id = fe.request_id
+WHERE fe.firewall_id = sqlc.arg('firewall_id')
+AND NOT fe.replay
+AND (NOT sqlc.arg('blocked_only')::boolean OR fe.blocked)
+AND (sqlc.narg('received_from')::timestamptz IS NULL OR rl.received_at >= sqlc.narg('received_from'))
+AND (sqlc.narg('received_to')::timestamptz IS NULL OR rl.received_at < sqlc.narg('received_to'))
+ORDER BY rl.received_at DESC;
+
+-- name: CountTraces :one
+SELECT COUNT(*)
+FROM request_logs rl
+LEFT JOIN (
+  SELECT request_id, bool_or(blocked AND enforced) AS blocked, MAX(risk_score) AS risk_score
+  FROM firewall_events
+  WHERE NOT replay
+  GROUP BY request_id
+) fe ON rl.request_id = fe.request_id
+WHERE (sqlc.narg('user_id')::uuid IS NULL OR rl.user_id = sqlc.narg('user_id'))
+AND (sqlc.narg('model')::text IS NULL OR rl.model = sqlc.narg('model'))
+AND (sqlc.narg('received_from')::timestamptz IS NULL OR rl.received_at >= sqlc.narg('received_from'))
+AND (sqlc.narg('received_to')::timestamptz IS NULL OR rl.received_at < sqlc.narg('received_to'))
+AND (sqlc.narg('blocked')::boolean IS NULL OR COALESCE(fe.blocked, FALSE) = sqlc.narg('blocked'))
+AND (sqlc.narg('min_risk_score')::numeric IS NULL OR COALESCE(fe.risk_score, 0) >= sqlc.narg('min_risk_score'))
+AND (sqlc.narg('metadata')::jsonb IS NULL OR rl.metadata @> sqlc.narg('metadata'));
+
+-- name: GetTokenUsage :one
+SELECT
+  COUNT(*)::bigint AS request_count,
+  COALESCE(SUM(u.input_tokens), 0)::bigint AS input_tokens,
+  COALESCE(SUM(u.output_tokens), 0)::bigint AS output_tokens,
+  COALESCE(SUM(u.total_tokens), 0)::bigint AS total_tokens
+FROM (
+  SELECT
+    COALESCE((res.response->'metrics'->>'input_tokens')::bigint, (res.response->'usage'->>'prompt_tokens')::bigint, (res.response->'usage'->>'input_tokens')::bigint, 0) AS input_tokens,
+    COALESCE((res.response->'metrics'->>'output_tokens')::bigint, (res.response->'usage'->>'completion_tokens')::bigint, (res.response->'usage'->>'output_tokens')::bigint, 0) AS output_tokens,
+    COALESCE((res.response->'metrics'->>'total_tokens')::bigint, (res.response->'usage'->>'total_tokens')::bigint,
+      COALESCE((res.response->'metrics'->>'input_tokens')::bigint, (res.response->'usage'->>'prompt_tokens')::bigint, (res.response->'usage'->>'input_tokens')::bigint, 0)
+      + COALESCE((res.response->'metrics'->>'output_tokens')::bigint, (res.response->'usage'->>'completion_tokens')::bigint, (res.response->'usage'->>'output_tokens')::bigint, 0)) AS total_tokens
+  FROM request_logs rl
+  LEFT JOIN response_logs res ON rl.request_id = res.request_id AND NOT res.cache_hit
+  WHERE rl.user_id = sqlc.arg('user_id')
+  AND rl.received_at >= sqlc.arg('received_from')
+  AND rl.received_at < sqlc.arg('received_to')
+  AND rl.mirror_of IS NULL
+) u;
+
+-- name: GetTokenUsageByModel :many
+SELECT
+  u.model,
+  COUNT(*)::bigint AS request_count,
+  COALESCE(SUM(u.input_tokens), 0)::bigint AS input_tokens,
+  COALESCE(SUM(u.output_tokens), 0)::bigint AS output_tokens,
+  COALESCE(SUM(u.total_tokens), 0)::bigint AS total_tokens
+FROM (
+  SELECT
+    rl.model,
+    COALESCE((res.response->'metrics'->>'input_tokens')::bigint, (res.response->'usage'->>'prompt_tokens')::bigint, (res.response->'usage'->>'input_tokens')::bigint, 0) AS input_tokens,
+    COALESCE((res.response->'metrics'->>'output_tokens')::bigint, (res.response->'usage'->>'completion_tokens')::bigint, (res.response->'usage'->>'output_tokens')::bigint, 0) AS output_tokens,
+    COALESCE((res.response->'metrics'->>'total_tokens')::bigint, (res.response->'usage'->>'total_tokens')::bigint,
+      COALESCE((res.response->'metrics'->>'input_tokens')::bigint, (res.response->'usage'->>'prompt_tokens')::bigint, (res.response->'usage'->>'input_tokens')::bigint, 0)
+      + COALESCE((res.response->'metrics'->>'output_tokens')::bigint, (res.response->'usage'->>'completion_tokens')::bigint, (res.response->'usage'->>'output_tokens')::bigint, 0)) AS total_tokens
+  FROM request_logs rl
+  LEFT JOIN response_logs res ON rl.request_id = res.request_id AND NOT res.cache_hit
+  WHERE rl.user_id = sqlc.arg('user_id')
+  AND rl.received_at >= sqlc.arg('received_from')
+  AND rl.received_at < sqlc.arg('received_to')
+  AND rl.mirror_of IS NULL
+) u
+GROUP BY u.model
+ORDER BY u.model;
+
+-- name: InsertAPIKey :one
+INSERT INTO api_keys (
+  user_id, key_hash, scopes, allowed_models
+)
+VALUES ($1, $2, $3, $4)
+RETURNING *;
+
+-- name: SeedAPIKey :execrows
+-- Adds a key configured outside the database, leaving it alone if it already exists so
+-- a key revoked since is not brought back
+INSERT INTO api_keys (
+  user_id, key_hash, scopes
+)
+VALUES ($1, $2, $3)
+ON CONFLICT (key_hash) DO NOTHING;
+
+-- name: GetAPIKeyByHash :one
+SELECT * FROM api_keys
+WHERE key_hash = $1;
+
+-- name: RevokeAPIKey :execrows
+UPDATE api_keys
+SET revoked = TRUE
+WHERE api_key_id = $1;
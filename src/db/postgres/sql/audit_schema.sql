@@ -13,7 +13,18 @@ CREATE TABLE request_logs (
     parameters JSONB,
     received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     client_ip INET,
-    archived BOOLEAN DEFAULT FALSE
+    archived BOOLEAN DEFAULT FALSE,
+    -- Client-supplied X-Request-Id, so retries update the same row instead of duplicating it
+    client_request_id TEXT,
+    -- False once a sampled-out request has had its inputs dropped, keeping only metadata
+    sampled BOOLEAN NOT NULL DEFAULT TRUE,
+    -- Set on a copy of a client's request sent to a shadow model; mirrors are never billed
+    mirror_of UUID,
+    -- Version of the stored inputs' JSON shape, NULL for rows logged before versioning
+    schema_version INTEGER,
+    -- The client's own tags for the request, such as a tenant or experiment, stored as sent
+    metadata JSONB,
+    UNIQUE (user_id, client_request_id)
 );
 
 CREATE TABLE response_logs (
@@ -21,7 +32,37 @@ CREATE TABLE response_logs (
     request_id UUID REFERENCES request_logs(request_id) ON DELETE CASCADE,
     response JSONB NOT NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-    latency_ms INTEGER
+    -- Total time to serve the request. Rows without upstream_latency_ms predate it and
+    -- hold only the provider's latency.
+    latency_ms INTEGER,
+    upstream_latency_ms INTEGER,
+    gateway_overhead_ms INTEGER,
+    -- The registered model that produced the response, and every model tried on the way
+    served_by TEXT,
+    attempts JSONB,
+    -- Served from the response cache without calling the provider, so no tokens were spent
+    cache_hit BOOLEAN NOT NULL DEFAULT FALSE,
+    -- The upstream failed mid-stream, so the response holds only what arrived before it did
+    partial BOOLEAN NOT NULL DEFAULT FALSE,
+    upstream_error TEXT,
+    -- Version of the stored response's JSON shape, NULL for rows logged before versioning
+    schema_version INTEGER,
+    -- The provider's status and the headers worth keeping for debugging, such as its rate
+    -- limits and request ID. Credentials are never stored.
+    upstream_status INTEGER,
+    upstream_headers JSONB,
+    -- What the client was sent, after output firewalls and reshaping, and its status. Only
+    -- set for successful responses kept in full, which can be replayed to a retry.
+    client_response JSONB,
+    client_status INTEGER
+);
+
+CREATE TABLE response_chunks (
+    request_id UUID NOT NULL REFERENCES request_logs(request_id) ON DELETE CASCADE,
+    seq INTEGER NOT NULL,
+    chunk JSONB NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (request_id, seq)
 );
 
 CREATE TABLE firewall_events (
@@ -31,20 +72,72 @@ CREATE TABLE firewall_events (
     firewall_type TEXT NOT NULL,
     blocked BOOLEAN DEFAULT FALSE,
     blocked_reason TEXT,
-    risk_score NUMERIC(3, 2),
-    evaluated_at TIMESTAMPTZ DEFAULT now()
+    risk_score NUMERIC, -- Unconstrained so fine-grained scores are stored exactly
+    evaluated_at TIMESTAMPTZ DEFAULT now(),
+    cached BOOLEAN NOT NULL DEFAULT FALSE,
+    -- False for firewalls in monitor mode, whose blocks are recorded but not applied
+    enforced BOOLEAN NOT NULL DEFAULT TRUE,
+    -- Recorded by replaying a stored request offline, not while serving it
+    replay BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Hex sha256 of the evaluated messages, recorded in place of their content when
+    -- the firewall config asks for it
+    content_hash TEXT,
+    -- The policy that combined this decision with the other firewalls', and its outcome
+    aggregation JSONB,
+    -- The score the firewall blocked above, NULL for firewalls that don't use one
+    blocking_threshold NUMERIC,
+    -- The evaluation that logged the event: 'input', 'output' or 'stream', with the window
+    -- for a stream, and the event's place within it. Events logged together share
+    -- evaluated_at, so these give their order. NULL for events logged before them.
+    phase TEXT,
+    stream_window INTEGER,
+    seq INTEGER
 );
 
+-- Archives deliberately outlive their request rows so purged traces can still be located
 CREATE TABLE audit_archives (
     archive_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    request_id UUID REFERENCES request_logs(request_id) ON DELETE CASCADE,
+    request_id UUID NOT NULL,
     s3_path TEXT NOT NULL,
     archived_at TIMESTAMPTZ DEFAULT now(),
-    archive_hash TEXT
+    archive_hash TEXT, -- Of the uncompressed trace, whatever the encoding
+    -- How the object is compressed: 'gzip' or 'identity'
+    content_encoding TEXT NOT NULL DEFAULT 'identity'
+);
+
+-- The turns of a WebSocket session, each logged as its own request. Like archives, rows
+-- have no foreign key, since batched request rows may be written after their turn.
+CREATE TABLE session_turns (
+    session_id UUID NOT NULL,
+    turn INTEGER NOT NULL,
+    request_id UUID NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (session_id, turn)
+);
+
+-- Only a sha256 of each key is stored; the plaintext is returned once when it is created
+CREATE TABLE api_keys (
+    api_key_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- Extra permissions such as 'admin', granted when the key is created
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    -- Registered model names the key may call, empty for all, set when the key is created
+    allowed_models TEXT[] NOT NULL DEFAULT '{}'
 );
 
 -- Indexes
 CREATE INDEX idx_request_user ON request_logs(user_id);
 CREATE INDEX idx_request_time ON request_logs(received_at);
+CREATE INDEX idx_request_user_time ON request_logs(user_id, received_at);
+CREATE INDEX idx_request_unarchived ON request_logs(received_at, request_id) WHERE archived IS NOT TRUE;
+CREATE INDEX idx_request_metadata ON request_logs USING GIN (metadata jsonb_path_ops);
 CREATE INDEX idx_firewall_request ON firewall_events(request_id);
-CREATE INDEX idx_response_request ON response_logs(request_id);
+-- Unique so a response logged twice replaces the first rather than duplicating it.
+-- Databases created before it was unique need migrations/001_unique_response_request.sql.
+CREATE UNIQUE INDEX idx_response_request ON response_logs(request_id);
+CREATE INDEX idx_archive_request ON audit_archives(request_id);
+CREATE INDEX idx_api_key_user ON api_keys(user_id);
+CREATE INDEX idx_session_turn_request ON session_turns(request_id);
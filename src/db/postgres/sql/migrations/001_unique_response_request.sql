@@ -0,0 +1,16 @@
+-- Migrations bring a database created from the original audit_schema.sql up to date.
+-- Each runs once, in order, in its own transaction:
+--   for f in migrations/*.sql; do psql -v ON_ERROR_STOP=1 -1 -f "$f" || break; done
+-- A database created from the current audit_schema.sql needs none of them.
+
+-- idx_response_request became unique so a response logged twice replaces the first.
+-- Requests already logged with several responses would fail the index, so all but the
+-- latest of each are deleted first, which is the one an upsert would have kept.
+DELETE FROM response_logs r
+USING response_logs newer
+WHERE r.request_id = newer.request_id
+AND (r.created_at, r.response_id) < (newer.created_at, newer.response_id);
+
+DROP INDEX IF EXISTS idx_response_request;
+-- Unique so a response logged twice replaces the first rather than duplicating it
+CREATE UNIQUE INDEX idx_response_request ON response_logs(request_id);
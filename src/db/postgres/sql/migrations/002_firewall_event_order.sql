@@ -0,0 +1,7 @@
+-- Firewall events logged together share evaluated_at, so it can't order them. Each
+-- event records the evaluation that logged it and its place within it instead. Events
+-- logged before this stay NULL and are ordered by evaluated_at.
+ALTER TABLE firewall_events
+    ADD COLUMN phase TEXT,
+    ADD COLUMN stream_window INTEGER,
+    ADD COLUMN seq INTEGER;
@@ -0,0 +1,14 @@
+-- request_logs gained columns for retries, sampling, mirroring, versioning and client
+-- metadata. Existing rows were logged in full, so sampled defaults to TRUE, and the
+-- rest stay NULL.
+ALTER TABLE request_logs
+    ADD COLUMN client_request_id TEXT,
+    ADD COLUMN sampled BOOLEAN NOT NULL DEFAULT TRUE,
+    ADD COLUMN mirror_of UUID,
+    ADD COLUMN schema_version INTEGER,
+    ADD COLUMN metadata JSONB,
+    ADD UNIQUE (user_id, client_request_id);
+
+CREATE INDEX idx_request_user_time ON request_logs(user_id, received_at);
+CREATE INDEX idx_request_unarchived ON request_logs(received_at, request_id) WHERE archived IS NOT TRUE;
+CREATE INDEX idx_request_metadata ON request_logs USING GIN (metadata jsonb_path_ops);
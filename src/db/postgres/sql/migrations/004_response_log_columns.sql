@@ -0,0 +1,25 @@
+-- response_logs gained the latency split, the backends tried, how the response ended
+-- and what the client was sent. Existing rows keep latency_ms as the provider's
+-- latency, and read as neither cached nor partial.
+ALTER TABLE response_logs
+    ADD COLUMN upstream_latency_ms INTEGER,
+    ADD COLUMN gateway_overhead_ms INTEGER,
+    ADD COLUMN served_by TEXT,
+    ADD COLUMN attempts JSONB,
+    ADD COLUMN cache_hit BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN partial BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN upstream_error TEXT,
+    ADD COLUMN schema_version INTEGER,
+    ADD COLUMN upstream_status INTEGER,
+    ADD COLUMN upstream_headers JSONB,
+    ADD COLUMN client_response JSONB,
+    ADD COLUMN client_status INTEGER;
+
+-- Streamed responses are logged chunk by chunk
+CREATE TABLE response_chunks (
+    request_id UUID NOT NULL REFERENCES request_logs(request_id) ON DELETE CASCADE,
+    seq INTEGER NOT NULL,
+    chunk JSONB NOT NULL,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (request_id, seq)
+);
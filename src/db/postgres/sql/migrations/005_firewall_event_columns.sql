@@ -0,0 +1,11 @@
+-- firewall_events gained caching, monitor mode, replays, content hashes and the
+-- aggregation policy. risk_score was NUMERIC(3, 2), which rounded fine-grained scores
+-- to two places; widening it keeps every existing value as it is.
+ALTER TABLE firewall_events
+    ALTER COLUMN risk_score TYPE NUMERIC,
+    ADD COLUMN cached BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN enforced BOOLEAN NOT NULL DEFAULT TRUE,
+    ADD COLUMN replay BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN content_hash TEXT,
+    ADD COLUMN aggregation JSONB,
+    ADD COLUMN blocking_threshold NUMERIC;
@@ -0,0 +1,9 @@
+-- Archives record how they are compressed, and outlive their request rows so purged
+-- traces can still be located, so the foreign key that deleted them with the request
+-- goes. Every archive written before compression is uncompressed.
+ALTER TABLE audit_archives
+    DROP CONSTRAINT IF EXISTS audit_archives_request_id_fkey,
+    ALTER COLUMN request_id SET NOT NULL,
+    ADD COLUMN content_encoding TEXT NOT NULL DEFAULT 'identity';
+
+CREATE INDEX idx_archive_request ON audit_archives(request_id);
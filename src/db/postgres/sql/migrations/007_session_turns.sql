@@ -0,0 +1,10 @@
+-- The turns of a WebSocket session, each logged as its own request
+CREATE TABLE session_turns (
+    session_id UUID NOT NULL,
+    turn INTEGER NOT NULL,
+    request_id UUID NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (session_id, turn)
+);
+
+CREATE INDEX idx_session_turn_request ON session_turns(request_id);
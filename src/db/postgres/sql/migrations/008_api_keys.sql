@@ -0,0 +1,12 @@
+-- API keys moved into the database, stored as a sha256 of each key
+CREATE TABLE api_keys (
+    api_key_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    allowed_models TEXT[] NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX idx_api_key_user ON api_keys(user_id);
@@ -12,35 +12,281 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const backfillRequestSchemaVersions = `-- name: BackfillRequestSchemaVersions :execrows
+UPDATE request_logs
+SET schema_version = CASE
+  WHEN EXISTS (
+    SELECT 1 FROM unnest(inputs) AS input
+    WHERE CASE WHEN jsonb_typeof(input) = 'object'
+      THEN input - 'role' - 'content' <> '{}'::jsonb
+        OR COALESCE(input->>'role', '') NOT IN ('system', 'user', 'assistant', 'tool')
+        OR COALESCE(jsonb_typeof(input->'content'), '') NOT IN ('string', 'array')
+      ELSE TRUE
+    END
+  ) THEN 1
+  ELSE 2
+END
+WHERE request_id IN (
+  SELECT request_id FROM request_logs
+  WHERE schema_version IS NULL
+  LIMIT $1
+)
+`
+
+// Inputs logged as clients sent them, before they were validated as messages, are
+// version 1: any input that isn't exactly a known role and string or array content.
+func (q *Queries) BackfillRequestSchemaVersions(ctx context.Context, batchSize int32) (int64, error) {
+	result, err := q.db.Exec(ctx, backfillRequestSchemaVersions, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const backfillResponseSchemaVersions = `-- name: BackfillResponseSchemaVersions :execrows
+UPDATE response_logs
+SET schema_version = CASE WHEN jsonb_typeof(response->'metrics') = 'object' THEN 1 ELSE 2 END
+WHERE response_id IN (
+  SELECT response_id FROM response_logs
+  WHERE schema_version IS NULL
+  LIMIT $1
+)
+`
+
+// Responses carrying the gateway's own metrics object are version 1
+func (q *Queries) BackfillResponseSchemaVersions(ctx context.Context, batchSize int32) (int64, error) {
+	result, err := q.db.Exec(ctx, backfillResponseSchemaVersions, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const claimRequestArchived = `-- name: ClaimRequestArchived :execrows
+UPDATE request_logs
+SET archived = TRUE
+WHERE request_id = $1 AND archived IS NOT TRUE
+`
+
+// Marks a request archived unless it already is, so when two workers archive the same
+// request only the first records its archive
+func (q *Queries) ClaimRequestArchived(ctx context.Context, requestID pgtype.UUID) (int64, error) {
+	result, err := q.db.Exec(ctx, claimRequestArchived, requestID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const countTraces = `-- name: CountTraces :one
+SELECT COUNT(*)
+FROM request_logs rl
+LEFT JOIN (
+  SELECT request_id, bool_or(blocked AND enforced) AS blocked, MAX(risk_score) AS risk_score
+  FROM firewall_events
+  WHERE NOT replay
+  GROUP BY request_id
+) fe ON rl.request_id = fe.request_id
+WHERE ($1::uuid IS NULL OR rl.user_id = $1)
+AND ($2::text IS NULL OR rl.model = $2)
+AND ($3::timestamptz IS NULL OR rl.received_at >= $3)
+AND ($4::timestamptz IS NULL OR rl.received_at < $4)
+AND ($5::boolean IS NULL OR COALESCE(fe.blocked, FALSE) = $5)
+AND ($6::numeric IS NULL OR COALESCE(fe.risk_score, 0) >= $6)
+AND ($7::jsonb IS NULL OR rl.metadata @> $7)
+`
+
+type CountTracesParams struct {
+	UserID       pgtype.UUID
+	Model        pgtype.Text
+	ReceivedFrom pgtype.Timestamptz
+	ReceivedTo   pgtype.Timestamptz
+	Blocked      pgtype.Bool
+	MinRiskScore pgtype.Numeric
+	Metadata     []byte
+}
+
+func (q *Queries) CountTraces(ctx context.Context, arg CountTracesParams) (int64, error) {
+	row := q.db.QueryRow(ctx, countTraces,
+		arg.UserID,
+		arg.Model,
+		arg.ReceivedFrom,
+		arg.ReceivedTo,
+		arg.Blocked,
+		arg.MinRiskScore,
+		arg.Metadata,
+	)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const countUnarchivedRequests = `-- name: CountUnarchivedRequests :one
+SELECT COUNT(*) FROM request_logs
+WHERE archived IS NOT TRUE
+AND received_at < $1
+`
+
+func (q *Queries) CountUnarchivedRequests(ctx context.Context, receivedTo pgtype.Timestamptz) (int64, error) {
+	row := q.db.QueryRow(ctx, countUnarchivedRequests, receivedTo)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const deleteResponseChunks = `-- name: DeleteResponseChunks :exec
+DELETE FROM response_chunks
+WHERE request_id = $1
+`
+
+func (q *Queries) DeleteResponseChunks(ctx context.Context, requestID pgtype.UUID) error {
+	_, err := q.db.Exec(ctx, deleteResponseChunks, requestID)
+	return err
+}
+
+const getAPIKeyByHash = `-- name: GetAPIKeyByHash :one
+SELECT api_key_id, user_id, key_hash, revoked, created_at, scopes, allowed_models FROM api_keys
+WHERE key_hash = $1
+`
+
+func (q *Queries) GetAPIKeyByHash(ctx context.Context, keyHash string) (ApiKey, error) {
+	row := q.db.QueryRow(ctx, getAPIKeyByHash, keyHash)
+	var i ApiKey
+	err := row.Scan(
+		&i.ApiKeyID,
+		&i.UserID,
+		&i.KeyHash,
+		&i.Revoked,
+		&i.CreatedAt,
+		&i.Scopes,
+		&i.AllowedModels,
+	)
+	return i, err
+}
+
+const getAuditArchive = `-- name: GetAuditArchive :one
+SELECT archive_id, request_id, s3_path, archived_at, archive_hash, content_encoding FROM audit_archives
+WHERE archive_id = $1
+`
+
+func (q *Queries) GetAuditArchive(ctx context.Context, archiveID pgtype.UUID) (AuditArchive, error) {
+	row := q.db.QueryRow(ctx, getAuditArchive, archiveID)
+	var i AuditArchive
+	err := row.Scan(
+		&i.ArchiveID,
+		&i.RequestID,
+		&i.S3Path,
+		&i.ArchivedAt,
+		&i.ArchiveHash,
+		&i.ContentEncoding,
+	)
+	return i, err
+}
+
+const getLatestAuditArchive = `-- name: GetLatestAuditArchive :one
+SELECT archive_id, request_id, s3_path, archived_at, archive_hash, content_encoding FROM audit_archives
+WHERE request_id = $1
+ORDER BY archived_at DESC
+LIMIT 1
+`
+
+func (q *Queries) GetLatestAuditArchive(ctx context.Context, requestID pgtype.UUID) (AuditArchive, error) {
+	row := q.db.QueryRow(ctx, getLatestAuditArchive, requestID)
+	var i AuditArchive
+	err := row.Scan(
+		&i.ArchiveID,
+		&i.RequestID,
+		&i.S3Path,
+		&i.ArchivedAt,
+		&i.ArchiveHash,
+		&i.ContentEncoding,
+	)
+	return i, err
+}
+
+const getCompletedRequest = `-- name: GetCompletedRequest :one
+SELECT rl.request_id, res.client_response, res.client_status
+FROM request_logs rl
+JOIN response_logs res ON rl.request_id = res.request_id
+WHERE rl.user_id = $1 AND rl.client_request_id = $2
+AND res.client_response IS NOT NULL
+ORDER BY res.created_at DESC
+LIMIT 1
+`
+
+type GetCompletedRequestParams struct {
+	UserID          pgtype.UUID
+	ClientRequestID pgtype.Text
+}
+
+type GetCompletedRequestRow struct {
+	RequestID      pgtype.UUID
+	ClientResponse []byte
+	ClientStatus   pgtype.Int4
+}
+
+// Only responses that can be replayed to the client store what it was sent
+func (q *Queries) GetCompletedRequest(ctx context.Context, arg GetCompletedRequestParams) (GetCompletedRequestRow, error) {
+	row := q.db.QueryRow(ctx, getCompletedRequest, arg.UserID, arg.ClientRequestID)
+	var i GetCompletedRequestRow
+	err := row.Scan(&i.RequestID, &i.ClientResponse, &i.ClientStatus)
+	return i, err
+}
+
 const getRequestFullTrace = `-- name: GetRequestFullTrace :many
-SELECT rl.request_id, rl.user_id, rl.api_key_id, rl.model, rl.target_url, rl.inputs, rl.parameters, rl.received_at, rl.client_ip, rl.archived, res.response, res.latency_ms, pe.firewall_event_id, pe.request_id, pe.firewall_id, pe.firewall_type, pe.blocked, pe.blocked_reason, pe.risk_score, pe.evaluated_at
+SELECT rl.request_id, rl.user_id, rl.api_key_id, rl.model, rl.target_url, rl.inputs, rl.parameters, rl.received_at, rl.client_ip, rl.archived, rl.client_request_id, rl.sampled, rl.mirror_of, rl.schema_version, rl.metadata, res.response, res.latency_ms, res.upstream_latency_ms, res.gateway_overhead_ms, res.served_by, res.attempts, res.cache_hit, res.partial, res.upstream_error, res.schema_version AS response_schema_version, res.upstream_status, res.upstream_headers, pe.firewall_event_id, pe.request_id, pe.firewall_id, pe.firewall_type, pe.blocked, pe.blocked_reason, pe.risk_score, pe.evaluated_at, pe.cached, pe.enforced, pe.replay, pe.content_hash, pe.aggregation, pe.blocking_threshold, pe.phase, pe.stream_window, pe.seq
 FROM request_logs rl
 LEFT JOIN response_logs res ON rl.request_id = res.request_id
 LEFT JOIN firewall_events pe ON rl.request_id = pe.request_id
 WHERE rl.request_id = $1
+ORDER BY pe.replay, CASE pe.phase WHEN 'input' THEN 0 WHEN 'stream' THEN 1 WHEN 'output' THEN 2 END, pe.stream_window, pe.seq, pe.evaluated_at
 `
 
 type GetRequestFullTraceRow struct {
-	RequestID       pgtype.UUID
-	UserID          pgtype.UUID
-	ApiKeyID        pgtype.UUID
-	Model           string
-	TargetUrl       string
-	Inputs          [][]byte
-	Parameters      []byte
-	ReceivedAt      pgtype.Timestamptz
-	ClientIp        *netip.Addr
-	Archived        pgtype.Bool
-	Response        []byte
-	LatencyMs       pgtype.Int4
-	FirewallEventID pgtype.UUID
-	RequestID_2     pgtype.UUID
-	FirewallID      pgtype.Text
-	FirewallType    pgtype.Text
-	Blocked         pgtype.Bool
-	BlockedReason   pgtype.Text
-	RiskScore       pgtype.Numeric
-	EvaluatedAt     pgtype.Timestamptz
+	RequestID             pgtype.UUID
+	UserID                pgtype.UUID
+	ApiKeyID              pgtype.UUID
+	Model                 string
+	TargetUrl             string
+	Inputs                [][]byte
+	Parameters            []byte
+	ReceivedAt            pgtype.Timestamptz
+	ClientIp              *netip.Addr
+	Archived              pgtype.Bool
+	ClientRequestID       pgtype.Text
+	Sampled               bool
+	MirrorOf              pgtype.UUID
+	SchemaVersion         pgtype.Int4
+	Metadata              []byte
+	Response              []byte
+	LatencyMs             pgtype.Int4
+	UpstreamLatencyMs     pgtype.Int4
+	GatewayOverheadMs     pgtype.Int4
+	ServedBy              pgtype.Text
+	Attempts              []byte
+	CacheHit              pgtype.Bool
+	Partial               pgtype.Bool
+	UpstreamError         pgtype.Text
+	ResponseSchemaVersion pgtype.Int4
+	UpstreamStatus        pgtype.Int4
+	UpstreamHeaders       []byte
+	FirewallEventID       pgtype.UUID
+	RequestID_2           pgtype.UUID
+	FirewallID            pgtype.Text
+	FirewallType          pgtype.Text
+	Blocked               pgtype.Bool
+	BlockedReason         pgtype.Text
+	RiskScore             pgtype.Numeric
+	EvaluatedAt           pgtype.Timestamptz
+	Cached                pgtype.Bool
+	Enforced              pgtype.Bool
+	Replay                pgtype.Bool
+	ContentHash           pgtype.Text
+	Aggregation           []byte
+	BlockingThreshold     pgtype.Numeric
+	Phase                 pgtype.Text
+	StreamWindow          pgtype.Int4
+	Seq                   pgtype.Int4
 }
 
 func (q *Queries) GetRequestFullTrace(ctx context.Context, requestID pgtype.UUID) ([]GetRequestFullTraceRow, error) {
@@ -63,8 +309,144 @@ func (q *Queries) GetRequestFullTrace(ctx context.Context, requestID pgtype.UUID
 			&i.ReceivedAt,
 			&i.ClientIp,
 			&i.Archived,
+			&i.ClientRequestID,
+			&i.Sampled,
+			&i.MirrorOf,
+			&i.SchemaVersion,
+			&i.Metadata,
+			&i.Response,
+			&i.LatencyMs,
+			&i.UpstreamLatencyMs,
+			&i.GatewayOverheadMs,
+			&i.ServedBy,
+			&i.Attempts,
+			&i.CacheHit,
+			&i.Partial,
+			&i.UpstreamError,
+			&i.ResponseSchemaVersion,
+			&i.UpstreamStatus,
+			&i.UpstreamHeaders,
+			&i.FirewallEventID,
+			&i.RequestID_2,
+			&i.FirewallID,
+			&i.FirewallType,
+			&i.Blocked,
+			&i.BlockedReason,
+			&i.RiskScore,
+			&i.EvaluatedAt,
+			&i.Cached,
+			&i.Enforced,
+			&i.Replay,
+			&i.ContentHash,
+			&i.Aggregation,
+			&i.BlockingThreshold,
+			&i.Phase,
+			&i.StreamWindow,
+			&i.Seq,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getRequestFullTraces = `-- name: GetRequestFullTraces :many
+SELECT rl.request_id, rl.user_id, rl.api_key_id, rl.model, rl.target_url, rl.inputs, rl.parameters, rl.received_at, rl.client_ip, rl.archived, rl.client_request_id, rl.sampled, rl.mirror_of, rl.schema_version, rl.metadata, res.response, res.latency_ms, res.upstream_latency_ms, res.gateway_overhead_ms, res.served_by, res.attempts, res.cache_hit, res.partial, res.upstream_error, res.schema_version AS response_schema_version, res.upstream_status, res.upstream_headers, pe.firewall_event_id, pe.request_id, pe.firewall_id, pe.firewall_type, pe.blocked, pe.blocked_reason, pe.risk_score, pe.evaluated_at, pe.cached, pe.enforced, pe.replay, pe.content_hash, pe.aggregation, pe.blocking_threshold, pe.phase, pe.stream_window, pe.seq
+FROM request_logs rl
+LEFT JOIN response_logs res ON rl.request_id = res.request_id
+LEFT JOIN firewall_events pe ON rl.request_id = pe.request_id
+WHERE rl.request_id = ANY($1::uuid[])
+ORDER BY rl.request_id, pe.replay, CASE pe.phase WHEN 'input' THEN 0 WHEN 'stream' THEN 1 WHEN 'output' THEN 2 END, pe.stream_window, pe.seq, pe.evaluated_at
+`
+
+type GetRequestFullTracesRow struct {
+	RequestID             pgtype.UUID
+	UserID                pgtype.UUID
+	ApiKeyID              pgtype.UUID
+	Model                 string
+	TargetUrl             string
+	Inputs                [][]byte
+	Parameters            []byte
+	ReceivedAt            pgtype.Timestamptz
+	ClientIp              *netip.Addr
+	Archived              pgtype.Bool
+	ClientRequestID       pgtype.Text
+	Sampled               bool
+	MirrorOf              pgtype.UUID
+	SchemaVersion         pgtype.Int4
+	Metadata              []byte
+	Response              []byte
+	LatencyMs             pgtype.Int4
+	UpstreamLatencyMs     pgtype.Int4
+	GatewayOverheadMs     pgtype.Int4
+	ServedBy              pgtype.Text
+	Attempts              []byte
+	CacheHit              pgtype.Bool
+	Partial               pgtype.Bool
+	UpstreamError         pgtype.Text
+	ResponseSchemaVersion pgtype.Int4
+	UpstreamStatus        pgtype.Int4
+	UpstreamHeaders       []byte
+	FirewallEventID       pgtype.UUID
+	RequestID_2           pgtype.UUID
+	FirewallID            pgtype.Text
+	FirewallType          pgtype.Text
+	Blocked               pgtype.Bool
+	BlockedReason         pgtype.Text
+	RiskScore             pgtype.Numeric
+	EvaluatedAt           pgtype.Timestamptz
+	Cached                pgtype.Bool
+	Enforced              pgtype.Bool
+	Replay                pgtype.Bool
+	ContentHash           pgtype.Text
+	Aggregation           []byte
+	BlockingThreshold     pgtype.Numeric
+	Phase                 pgtype.Text
+	StreamWindow          pgtype.Int4
+	Seq                   pgtype.Int4
+}
+
+func (q *Queries) GetRequestFullTraces(ctx context.Context, requestIds []pgtype.UUID) ([]GetRequestFullTracesRow, error) {
+	rows, err := q.db.Query(ctx, getRequestFullTraces, requestIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetRequestFullTracesRow
+	for rows.Next() {
+		var i GetRequestFullTracesRow
+		if err := rows.Scan(
+			&i.RequestID,
+			&i.UserID,
+			&i.ApiKeyID,
+			&i.Model,
+			&i.TargetUrl,
+			&i.Inputs,
+			&i.Parameters,
+			&i.ReceivedAt,
+			&i.ClientIp,
+			&i.Archived,
+			&i.ClientRequestID,
+			&i.Sampled,
+			&i.MirrorOf,
+			&i.SchemaVersion,
+			&i.Metadata,
 			&i.Response,
 			&i.LatencyMs,
+			&i.UpstreamLatencyMs,
+			&i.GatewayOverheadMs,
+			&i.ServedBy,
+			&i.Attempts,
+			&i.CacheHit,
+			&i.Partial,
+			&i.UpstreamError,
+			&i.ResponseSchemaVersion,
+			&i.UpstreamStatus,
+			&i.UpstreamHeaders,
 			&i.FirewallEventID,
 			&i.RequestID_2,
 			&i.FirewallID,
@@ -73,6 +455,190 @@ func (q *Queries) GetRequestFullTrace(ctx context.Context, requestID pgtype.UUID
 			&i.BlockedReason,
 			&i.RiskScore,
 			&i.EvaluatedAt,
+			&i.Cached,
+			&i.Enforced,
+			&i.Replay,
+			&i.ContentHash,
+			&i.Aggregation,
+			&i.BlockingThreshold,
+			&i.Phase,
+			&i.StreamWindow,
+			&i.Seq,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getResponseChunks = `-- name: GetResponseChunks :many
+SELECT request_id, seq, chunk, received_at FROM response_chunks
+WHERE request_id = $1
+ORDER BY seq
+`
+
+func (q *Queries) GetResponseChunks(ctx context.Context, requestID pgtype.UUID) ([]ResponseChunk, error) {
+	rows, err := q.db.Query(ctx, getResponseChunks, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ResponseChunk
+	for rows.Next() {
+		var i ResponseChunk
+		if err := rows.Scan(
+			&i.RequestID,
+			&i.Seq,
+			&i.Chunk,
+			&i.ReceivedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getResponseChunksForRequests = `-- name: GetResponseChunksForRequests :many
+SELECT request_id, seq, chunk, received_at FROM response_chunks
+WHERE request_id = ANY($1::uuid[])
+ORDER BY request_id, seq
+`
+
+func (q *Queries) GetResponseChunksForRequests(ctx context.Context, requestIds []pgtype.UUID) ([]ResponseChunk, error) {
+	rows, err := q.db.Query(ctx, getResponseChunksForRequests, requestIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ResponseChunk
+	for rows.Next() {
+		var i ResponseChunk
+		if err := rows.Scan(
+			&i.RequestID,
+			&i.Seq,
+			&i.Chunk,
+			&i.ReceivedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getTokenUsage = `-- name: GetTokenUsage :one
+SELECT
+  COUNT(*)::bigint AS request_count,
+  COALESCE(SUM(u.input_tokens), 0)::bigint AS input_tokens,
+  COALESCE(SUM(u.output_tokens), 0)::bigint AS output_tokens,
+  COALESCE(SUM(u.total_tokens), 0)::bigint AS total_tokens
+FROM (
+  SELECT
+    COALESCE((res.response->'metrics'->>'input_tokens')::bigint, (res.response->'usage'->>'prompt_tokens')::bigint, (res.response->'usage'->>'input_tokens')::bigint, 0) AS input_tokens,
+    COALESCE((res.response->'metrics'->>'output_tokens')::bigint, (res.response->'usage'->>'completion_tokens')::bigint, (res.response->'usage'->>'output_tokens')::bigint, 0) AS output_tokens,
+    COALESCE((res.response->'metrics'->>'total_tokens')::bigint, (res.response->'usage'->>'total_tokens')::bigint,
+      COALESCE((res.response->'metrics'->>'input_tokens')::bigint, (res.response->'usage'->>'prompt_tokens')::bigint, (res.response->'usage'->>'input_tokens')::bigint, 0)
+      + COALESCE((res.response->'metrics'->>'output_tokens')::bigint, (res.response->'usage'->>'completion_tokens')::bigint, (res.response->'usage'->>'output_tokens')::bigint, 0)) AS total_tokens
+  FROM request_logs rl
+  LEFT JOIN response_logs res ON rl.request_id = res.request_id AND NOT res.cache_hit
+  WHERE rl.user_id = $1
+  AND rl.received_at >= $2
+  AND rl.received_at < $3
+  AND rl.mirror_of IS NULL
+) u
+`
+
+type GetTokenUsageParams struct {
+	UserID       pgtype.UUID
+	ReceivedFrom pgtype.Timestamptz
+	ReceivedTo   pgtype.Timestamptz
+}
+
+type GetTokenUsageRow struct {
+	RequestCount int64
+	InputTokens  int64
+	OutputTokens int64
+	TotalTokens  int64
+}
+
+func (q *Queries) GetTokenUsage(ctx context.Context, arg GetTokenUsageParams) (GetTokenUsageRow, error) {
+	row := q.db.QueryRow(ctx, getTokenUsage, arg.UserID, arg.ReceivedFrom, arg.ReceivedTo)
+	var i GetTokenUsageRow
+	err := row.Scan(
+		&i.RequestCount,
+		&i.InputTokens,
+		&i.OutputTokens,
+		&i.TotalTokens,
+	)
+	return i, err
+}
+
+const getTokenUsageByModel = `-- name: GetTokenUsageByModel :many
+SELECT
+  u.model,
+  COUNT(*)::bigint AS request_count,
+  COALESCE(SUM(u.input_tokens), 0)::bigint AS input_tokens,
+  COALESCE(SUM(u.output_tokens), 0)::bigint AS output_tokens,
+  COALESCE(SUM(u.total_tokens), 0)::bigint AS total_tokens
+FROM (
+  SELECT
+    rl.model,
+    COALESCE((res.response->'metrics'->>'input_tokens')::bigint, (res.response->'usage'->>'prompt_tokens')::bigint, (res.response->'usage'->>'input_tokens')::bigint, 0) AS input_tokens,
+    COALESCE((res.response->'metrics'->>'output_tokens')::bigint, (res.response->'usage'->>'completion_tokens')::bigint, (res.response->'usage'->>'output_tokens')::bigint, 0) AS output_tokens,
+    COALESCE((res.response->'metrics'->>'total_tokens')::bigint, (res.response->'usage'->>'total_tokens')::bigint,
+      COALESCE((res.response->'metrics'->>'input_tokens')::bigint, (res.response->'usage'->>'prompt_tokens')::bigint, (res.response->'usage'->>'input_tokens')::bigint, 0)
+      + COALESCE((res.response->'metrics'->>'output_tokens')::bigint, (res.response->'usage'->>'completion_tokens')::bigint, (res.response->'usage'->>'output_tokens')::bigint, 0)) AS total_tokens
+  FROM request_logs rl
+  LEFT JOIN response_logs res ON rl.request_id = res.request_id AND NOT res.cache_hit
+  WHERE rl.user_id = $1
+  AND rl.received_at >= $2
+  AND rl.received_at < $3
+  AND rl.mirror_of IS NULL
+) u
+GROUP BY u.model
+ORDER BY u.model
+`
+
+type GetTokenUsageByModelParams struct {
+	UserID       pgtype.UUID
+	ReceivedFrom pgtype.Timestamptz
+	ReceivedTo   pgtype.Timestamptz
+}
+
+type GetTokenUsageByModelRow struct {
+	Model        string
+	RequestCount int64
+	InputTokens  int64
+	OutputTokens int64
+	TotalTokens  int64
+}
+
+func (q *Queries) GetTokenUsageByModel(ctx context.Context, arg GetTokenUsageByModelParams) ([]GetTokenUsageByModelRow, error) {
+	rows, err := q.db.Query(ctx, getTokenUsageByModel, arg.UserID, arg.ReceivedFrom, arg.ReceivedTo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetTokenUsageByModelRow
+	for rows.Next() {
+		var i GetTokenUsageByModelRow
+		if err := rows.Scan(
+			&i.Model,
+			&i.RequestCount,
+			&i.InputTokens,
+			&i.OutputTokens,
+			&i.TotalTokens,
 		); err != nil {
 			return nil, err
 		}
@@ -85,7 +651,7 @@ func (q *Queries) GetRequestFullTrace(ctx context.Context, requestID pgtype.UUID
 }
 
 const getUnarchivedRequests = `-- name: GetUnarchivedRequests :many
-SELECT request_id, user_id, api_key_id, model, target_url, inputs, parameters, received_at, client_ip, archived FROM request_logs
+SELECT request_id, user_id, api_key_id, model, target_url, inputs, parameters, received_at, client_ip, archived, client_request_id, sampled, mirror_of, schema_version, metadata FROM request_logs
 WHERE archived = FALSE
 AND received_at < now() - interval '10 minutes'
 `
@@ -110,6 +676,11 @@ func (q *Queries) GetUnarchivedRequests(ctx context.Context) ([]RequestLog, erro
 			&i.ReceivedAt,
 			&i.ClientIp,
 			&i.Archived,
+			&i.ClientRequestID,
+			&i.Sampled,
+			&i.MirrorOf,
+			&i.SchemaVersion,
+			&i.Metadata,
 		); err != nil {
 			return nil, err
 		}
@@ -121,22 +692,63 @@ func (q *Queries) GetUnarchivedRequests(ctx context.Context) ([]RequestLog, erro
 	return items, nil
 }
 
+const insertAPIKey = `-- name: InsertAPIKey :one
+INSERT INTO api_keys (
+  user_id, key_hash, scopes, allowed_models
+)
+VALUES ($1, $2, $3, $4)
+RETURNING api_key_id, user_id, key_hash, revoked, created_at, scopes, allowed_models
+`
+
+type InsertAPIKeyParams struct {
+	UserID        pgtype.UUID
+	KeyHash       string
+	Scopes        []string
+	AllowedModels []string
+}
+
+func (q *Queries) InsertAPIKey(ctx context.Context, arg InsertAPIKeyParams) (ApiKey, error) {
+	row := q.db.QueryRow(ctx, insertAPIKey,
+		arg.UserID,
+		arg.KeyHash,
+		arg.Scopes,
+		arg.AllowedModels,
+	)
+	var i ApiKey
+	err := row.Scan(
+		&i.ApiKeyID,
+		&i.UserID,
+		&i.KeyHash,
+		&i.Revoked,
+		&i.CreatedAt,
+		&i.Scopes,
+		&i.AllowedModels,
+	)
+	return i, err
+}
+
 const insertAuditArchive = `-- name: InsertAuditArchive :one
 INSERT INTO audit_archives (
-  request_id, s3_path, archive_hash
+  request_id, s3_path, archive_hash, content_encoding
 )
-VALUES ($1, $2, $3)
-RETURNING archive_id, request_id, s3_path, archived_at, archive_hash
+VALUES ($1, $2, $3, $4)
+RETURNING archive_id, request_id, s3_path, archived_at, archive_hash, content_encoding
 `
 
 type InsertAuditArchiveParams struct {
-	RequestID   pgtype.UUID
-	S3Path      string
-	ArchiveHash pgtype.Text
+	RequestID       pgtype.UUID
+	S3Path          string
+	ArchiveHash     pgtype.Text
+	ContentEncoding string
 }
 
 func (q *Queries) InsertAuditArchive(ctx context.Context, arg InsertAuditArchiveParams) (AuditArchive, error) {
-	row := q.db.QueryRow(ctx, insertAuditArchive, arg.RequestID, arg.S3Path, arg.ArchiveHash)
+	row := q.db.QueryRow(ctx, insertAuditArchive,
+		arg.RequestID,
+		arg.S3Path,
+		arg.ArchiveHash,
+		arg.ContentEncoding,
+	)
 	var i AuditArchive
 	err := row.Scan(
 		&i.ArchiveID,
@@ -144,25 +756,35 @@ func (q *Queries) InsertAuditArchive(ctx context.Context, arg InsertAuditArchive
 		&i.S3Path,
 		&i.ArchivedAt,
 		&i.ArchiveHash,
+		&i.ContentEncoding,
 	)
 	return i, err
 }
 
 const insertFirewallEvent = `-- name: InsertFirewallEvent :one
 INSERT INTO firewall_events (
-  request_id, firewall_id, firewall_type, blocked, blocked_reason, risk_score
+  request_id, firewall_id, firewall_type, blocked, blocked_reason, risk_score, cached, enforced, replay, content_hash, aggregation, blocking_threshold, phase, stream_window, seq
 )
-VALUES ($1, $2, $3, $4, $5, $6)
-RETURNING firewall_event_id, request_id, firewall_id, firewall_type, blocked, blocked_reason, risk_score, evaluated_at
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+RETURNING firewall_event_id, request_id, firewall_id, firewall_type, blocked, blocked_reason, risk_score, evaluated_at, cached, enforced, replay, content_hash, aggregation, blocking_threshold, phase, stream_window, seq
 `
 
 type InsertFirewallEventParams struct {
-	RequestID     pgtype.UUID
-	FirewallID    string
-	FirewallType  string
-	Blocked       pgtype.Bool
-	BlockedReason pgtype.Text
-	RiskScore     pgtype.Numeric
+	RequestID         pgtype.UUID
+	FirewallID        string
+	FirewallType      string
+	Blocked           pgtype.Bool
+	BlockedReason     pgtype.Text
+	RiskScore         pgtype.Numeric
+	Cached            bool
+	Enforced          bool
+	Replay            bool
+	ContentHash       pgtype.Text
+	Aggregation       []byte
+	BlockingThreshold pgtype.Numeric
+	Phase             pgtype.Text
+	StreamWindow      pgtype.Int4
+	Seq               pgtype.Int4
 }
 
 func (q *Queries) InsertFirewallEvent(ctx context.Context, arg InsertFirewallEventParams) (FirewallEvent, error) {
@@ -173,6 +795,15 @@ func (q *Queries) InsertFirewallEvent(ctx context.Context, arg InsertFirewallEve
 		arg.Blocked,
 		arg.BlockedReason,
 		arg.RiskScore,
+		arg.Cached,
+		arg.Enforced,
+		arg.Replay,
+		arg.ContentHash,
+		arg.Aggregation,
+		arg.BlockingThreshold,
+		arg.Phase,
+		arg.StreamWindow,
+		arg.Seq,
 	)
 	var i FirewallEvent
 	err := row.Scan(
@@ -184,26 +815,56 @@ func (q *Queries) InsertFirewallEvent(ctx context.Context, arg InsertFirewallEve
 		&i.BlockedReason,
 		&i.RiskScore,
 		&i.EvaluatedAt,
+		&i.Cached,
+		&i.Enforced,
+		&i.Replay,
+		&i.ContentHash,
+		&i.Aggregation,
+		&i.BlockingThreshold,
+		&i.Phase,
+		&i.StreamWindow,
+		&i.Seq,
 	)
 	return i, err
 }
 
+type InsertFirewallEventsParams struct {
+	RequestID         pgtype.UUID
+	FirewallID        string
+	FirewallType      string
+	Blocked           pgtype.Bool
+	BlockedReason     pgtype.Text
+	RiskScore         pgtype.Numeric
+	Cached            bool
+	Enforced          bool
+	Replay            bool
+	ContentHash       pgtype.Text
+	Aggregation       []byte
+	BlockingThreshold pgtype.Numeric
+	Phase             pgtype.Text
+	StreamWindow      pgtype.Int4
+	Seq               pgtype.Int4
+}
+
 const insertRequestLog = `-- name: InsertRequestLog :one
 INSERT INTO request_logs (
-  user_id, api_key_id, model, target_url, inputs, parameters, client_ip
+  user_id, api_key_id, model, target_url, inputs, parameters, client_ip, mirror_of, schema_version, metadata
 )
-VALUES ($1, $2, $3, $4, $5, $6, $7)
-RETURNING request_id, user_id, api_key_id, model, target_url, inputs, parameters, received_at, client_ip, archived
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING request_id, user_id, api_key_id, model, target_url, inputs, parameters, received_at, client_ip, archived, client_request_id, sampled, mirror_of, schema_version, metadata
 `
 
 type InsertRequestLogParams struct {
-	UserID     pgtype.UUID
-	ApiKeyID   pgtype.UUID
-	Model      string
-	TargetUrl  string
-	Inputs     [][]byte
-	Parameters []byte
-	ClientIp   *netip.Addr
+	UserID        pgtype.UUID
+	ApiKeyID      pgtype.UUID
+	Model         string
+	TargetUrl     string
+	Inputs        [][]byte
+	Parameters    []byte
+	ClientIp      *netip.Addr
+	MirrorOf      pgtype.UUID
+	SchemaVersion pgtype.Int4
+	Metadata      []byte
 }
 
 func (q *Queries) InsertRequestLog(ctx context.Context, arg InsertRequestLogParams) (RequestLog, error) {
@@ -215,6 +876,9 @@ func (q *Queries) InsertRequestLog(ctx context.Context, arg InsertRequestLogPara
 		arg.Inputs,
 		arg.Parameters,
 		arg.ClientIp,
+		arg.MirrorOf,
+		arg.SchemaVersion,
+		arg.Metadata,
 	)
 	var i RequestLog
 	err := row.Scan(
@@ -228,35 +892,341 @@ func (q *Queries) InsertRequestLog(ctx context.Context, arg InsertRequestLogPara
 		&i.ReceivedAt,
 		&i.ClientIp,
 		&i.Archived,
+		&i.ClientRequestID,
+		&i.Sampled,
+		&i.MirrorOf,
+		&i.SchemaVersion,
+		&i.Metadata,
 	)
 	return i, err
 }
 
-const insertResponseLog = `-- name: InsertResponseLog :one
-INSERT INTO response_logs (
-  request_id, response, latency_ms
+type InsertRequestLogsParams struct {
+	RequestID     pgtype.UUID
+	UserID        pgtype.UUID
+	ApiKeyID      pgtype.UUID
+	Model         string
+	TargetUrl     string
+	Inputs        [][]byte
+	Parameters    []byte
+	ClientIp      *netip.Addr
+	MirrorOf      pgtype.UUID
+	SchemaVersion pgtype.Int4
+	Metadata      []byte
+}
+
+const insertResponseChunk = `-- name: InsertResponseChunk :exec
+INSERT INTO response_chunks (
+  request_id, seq, chunk
 )
 VALUES ($1, $2, $3)
-RETURNING response_id, request_id, response, created_at, latency_ms
 `
 
-type InsertResponseLogParams struct {
+type InsertResponseChunkParams struct {
 	RequestID pgtype.UUID
-	Response  []byte
-	LatencyMs pgtype.Int4
+	Seq       int32
+	Chunk     []byte
 }
 
-func (q *Queries) InsertResponseLog(ctx context.Context, arg InsertResponseLogParams) (ResponseLog, error) {
-	row := q.db.QueryRow(ctx, insertResponseLog, arg.RequestID, arg.Response, arg.LatencyMs)
-	var i ResponseLog
-	err := row.Scan(
-		&i.ResponseID,
-		&i.RequestID,
-		&i.Response,
-		&i.CreatedAt,
-		&i.LatencyMs,
+func (q *Queries) InsertResponseChunk(ctx context.Context, arg InsertResponseChunkParams) error {
+	_, err := q.db.Exec(ctx, insertResponseChunk, arg.RequestID, arg.Seq, arg.Chunk)
+	return err
+}
+
+type InsertResponseChunksParams struct {
+	RequestID pgtype.UUID
+	Seq       int32
+	Chunk     []byte
+}
+
+const insertSessionTurn = `-- name: InsertSessionTurn :exec
+INSERT INTO session_turns (
+  session_id, turn, request_id
+)
+VALUES ($1, $2, $3)
+`
+
+type InsertSessionTurnParams struct {
+	SessionID pgtype.UUID
+	Turn      int32
+	RequestID pgtype.UUID
+}
+
+func (q *Queries) InsertSessionTurn(ctx context.Context, arg InsertSessionTurnParams) error {
+	_, err := q.db.Exec(ctx, insertSessionTurn, arg.SessionID, arg.Turn, arg.RequestID)
+	return err
+}
+
+const listRequestsForExport = `-- name: ListRequestsForExport :many
+SELECT request_id, received_at FROM request_logs
+WHERE received_at < $1
+AND (received_at, request_id) > ($2::timestamptz, $3::uuid)
+ORDER BY received_at, request_id
+LIMIT $4
+`
+
+type ListRequestsForExportParams struct {
+	ReceivedTo      pgtype.Timestamptz
+	AfterReceivedAt pgtype.Timestamptz
+	AfterRequestID  pgtype.UUID
+	BatchSize       int32
+}
+
+type ListRequestsForExportRow struct {
+	RequestID  pgtype.UUID
+	ReceivedAt pgtype.Timestamptz
+}
+
+func (q *Queries) ListRequestsForExport(ctx context.Context, arg ListRequestsForExportParams) ([]ListRequestsForExportRow, error) {
+	rows, err := q.db.Query(ctx, listRequestsForExport,
+		arg.ReceivedTo,
+		arg.AfterReceivedAt,
+		arg.AfterRequestID,
+		arg.BatchSize,
 	)
-	return i, err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRequestsForExportRow
+	for rows.Next() {
+		var i ListRequestsForExportRow
+		if err := rows.Scan(&i.RequestID, &i.ReceivedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listSessionTurns = `-- name: ListSessionTurns :many
+SELECT session_id, turn, request_id, started_at FROM session_turns
+WHERE session_id = $1
+ORDER BY turn
+`
+
+func (q *Queries) ListSessionTurns(ctx context.Context, sessionID pgtype.UUID) ([]SessionTurn, error) {
+	rows, err := q.db.Query(ctx, listSessionTurns, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SessionTurn
+	for rows.Next() {
+		var i SessionTurn
+		if err := rows.Scan(
+			&i.SessionID,
+			&i.Turn,
+			&i.RequestID,
+			&i.StartedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTraces = `-- name: ListTraces :many
+SELECT rl.request_id, rl.user_id, rl.model, rl.received_at, rl.client_ip, rl.metadata,
+  COALESCE(fe.blocked, FALSE)::boolean AS blocked,
+  COALESCE(fe.risk_score, 0)::numeric AS risk_score
+FROM request_logs rl
+LEFT JOIN (
+  SELECT request_id, bool_or(blocked AND enforced) AS blocked, MAX(risk_score) AS risk_score
+  FROM firewall_events
+  WHERE NOT replay
+  GROUP BY request_id
+) fe ON rl.request_id = fe.request_id
+WHERE ($1::uuid IS NULL OR rl.user_id = $1)
+AND ($2::text IS NULL OR rl.model = $2)
+AND ($3::timestamptz IS NULL OR rl.received_at >= $3)
+AND ($4::timestamptz IS NULL OR rl.received_at < $4)
+AND ($5::boolean IS NULL OR COALESCE(fe.blocked, FALSE) = $5)
+AND ($6::numeric IS NULL OR COALESCE(fe.risk_score, 0) >= $6)
+AND ($7::jsonb IS NULL OR rl.metadata @> $7)
+ORDER BY rl.received_at DESC
+LIMIT $8 OFFSET $9
+`
+
+type ListTracesParams struct {
+	UserID       pgtype.UUID
+	Model        pgtype.Text
+	ReceivedFrom pgtype.Timestamptz
+	ReceivedTo   pgtype.Timestamptz
+	Blocked      pgtype.Bool
+	MinRiskScore pgtype.Numeric
+	Metadata     []byte
+	Limit        int32
+	Offset       int32
+}
+
+type ListTracesRow struct {
+	RequestID  pgtype.UUID
+	UserID     pgtype.UUID
+	Model      string
+	ReceivedAt pgtype.Timestamptz
+	ClientIp   *netip.Addr
+	Metadata   []byte
+	Blocked    bool
+	RiskScore  pgtype.Numeric
+}
+
+func (q *Queries) ListTraces(ctx context.Context, arg ListTracesParams) ([]ListTracesRow, error) {
+	rows, err := q.db.Query(ctx, listTraces,
+		arg.UserID,
+		arg.Model,
+		arg.ReceivedFrom,
+		arg.ReceivedTo,
+		arg.Blocked,
+		arg.MinRiskScore,
+		arg.Metadata,
+		arg.Limit,
+		arg.Offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListTracesRow
+	for rows.Next() {
+		var i ListTracesRow
+		if err := rows.Scan(
+			&i.RequestID,
+			&i.UserID,
+			&i.Model,
+			&i.ReceivedAt,
+			&i.ClientIp,
+			&i.Metadata,
+			&i.Blocked,
+			&i.RiskScore,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTracesByFirewall = `-- name: ListTracesByFirewall :many
+SELECT rl.request_id, rl.user_id, rl.model, rl.received_at, rl.client_ip, rl.metadata,
+  COALESCE(fe.blocked, FALSE)::boolean AS blocked,
+  COALESCE(fe.risk_score, 0)::numeric AS risk_score
+FROM firewall_events fe
+JOIN request_logs rl ON rl.request_id = fe.request_id
+WHERE fe.firewall_id = $1
+AND NOT fe.replay
+AND (NOT $2::boolean OR fe.blocked)
+AND ($3::timestamptz IS NULL OR rl.received_at >= $3)
+AND ($4::timestamptz IS NULL OR rl.received_at < $4)
+ORDER BY rl.received_at DESC
+`
+
+type ListTracesByFirewallParams struct {
+	FirewallID   string
+	BlockedOnly  bool
+	ReceivedFrom pgtype.Timestamptz
+	ReceivedTo   pgtype.Timestamptz
+}
+
+type ListTracesByFirewallRow struct {
+	RequestID  pgtype.UUID
+	UserID     pgtype.UUID
+	Model      string
+	ReceivedAt pgtype.Timestamptz
+	ClientIp   *netip.Addr
+	Metadata   []byte
+	Blocked    bool
+	RiskScore  pgtype.Numeric
+}
+
+func (q *Queries) ListTracesByFirewall(ctx context.Context, arg ListTracesByFirewallParams) ([]ListTracesByFirewallRow, error) {
+	rows, err := q.db.Query(ctx, listTracesByFirewall,
+		arg.FirewallID,
+		arg.BlockedOnly,
+		arg.ReceivedFrom,
+		arg.ReceivedTo,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListTracesByFirewallRow
+	for rows.Next() {
+		var i ListTracesByFirewallRow
+		if err := rows.Scan(
+			&i.RequestID,
+			&i.UserID,
+			&i.Model,
+			&i.ReceivedAt,
+			&i.ClientIp,
+			&i.Metadata,
+			&i.Blocked,
+			&i.RiskScore,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUnarchivedRequests = `-- name: ListUnarchivedRequests :many
+SELECT request_id, received_at FROM request_logs
+WHERE archived IS NOT TRUE
+AND received_at < $1
+AND (received_at, request_id) > ($2::timestamptz, $3::uuid)
+ORDER BY received_at, request_id
+LIMIT $4
+`
+
+type ListUnarchivedRequestsParams struct {
+	ReceivedTo      pgtype.Timestamptz
+	AfterReceivedAt pgtype.Timestamptz
+	AfterRequestID  pgtype.UUID
+	BatchSize       int32
+}
+
+type ListUnarchivedRequestsRow struct {
+	RequestID  pgtype.UUID
+	ReceivedAt pgtype.Timestamptz
+}
+
+func (q *Queries) ListUnarchivedRequests(ctx context.Context, arg ListUnarchivedRequestsParams) ([]ListUnarchivedRequestsRow, error) {
+	rows, err := q.db.Query(ctx, listUnarchivedRequests,
+		arg.ReceivedTo,
+		arg.AfterReceivedAt,
+		arg.AfterRequestID,
+		arg.BatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListUnarchivedRequestsRow
+	for rows.Next() {
+		var i ListUnarchivedRequestsRow
+		if err := rows.Scan(&i.RequestID, &i.ReceivedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
 const markRequestArchived = `-- name: MarkRequestArchived :exec
@@ -269,3 +1239,294 @@ func (q *Queries) MarkRequestArchived(ctx context.Context, requestID pgtype.UUID
 	_, err := q.db.Exec(ctx, markRequestArchived, requestID)
 	return err
 }
+
+const oldestPendingRequest = `-- name: OldestPendingRequest :one
+SELECT MIN(rl.received_at)::timestamptz AS received_at FROM request_logs rl
+WHERE (rl.received_at, rl.request_id) > ($1::timestamptz, $2::uuid)
+AND rl.received_at >= $3
+AND NOT EXISTS (SELECT 1 FROM response_logs rs WHERE rs.request_id = rl.request_id)
+`
+
+type OldestPendingRequestParams struct {
+	AfterReceivedAt pgtype.Timestamptz
+	AfterRequestID  pgtype.UUID
+	PendingFrom     pgtype.Timestamptz
+}
+
+// The oldest request after the cursor still waiting for its response, ignoring those
+// received before pending_from, which are taken to have been abandoned
+func (q *Queries) OldestPendingRequest(ctx context.Context, arg OldestPendingRequestParams) (pgtype.Timestamptz, error) {
+	row := q.db.QueryRow(ctx, oldestPendingRequest, arg.AfterReceivedAt, arg.AfterRequestID, arg.PendingFrom)
+	var received_at pgtype.Timestamptz
+	err := row.Scan(&received_at)
+	return received_at, err
+}
+
+const purgeRequestLogs = `-- name: PurgeRequestLogs :execrows
+DELETE FROM request_logs
+WHERE request_id IN (
+  SELECT request_id FROM request_logs
+  WHERE received_at < $1
+  AND ($2::boolean OR archived IS NOT TRUE)
+  ORDER BY received_at
+  LIMIT $3
+)
+`
+
+type PurgeRequestLogsParams struct {
+	Cutoff        pgtype.Timestamptz
+	ForceArchived bool
+	BatchSize     int32
+}
+
+func (q *Queries) PurgeRequestLogs(ctx context.Context, arg PurgeRequestLogsParams) (int64, error) {
+	result, err := q.db.Exec(ctx, purgeRequestLogs, arg.Cutoff, arg.ForceArchived, arg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const restoreRequestLog = `-- name: RestoreRequestLog :execrows
+INSERT INTO request_logs (
+  request_id, user_id, model, target_url, inputs, parameters, received_at, client_ip, archived, sampled, mirror_of, schema_version, metadata
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, TRUE, $9, $10, $11, $12)
+ON CONFLICT (request_id) DO NOTHING
+`
+
+type RestoreRequestLogParams struct {
+	RequestID     pgtype.UUID
+	UserID        pgtype.UUID
+	Model         string
+	TargetUrl     string
+	Inputs        [][]byte
+	Parameters    []byte
+	ReceivedAt    pgtype.Timestamptz
+	ClientIp      *netip.Addr
+	Sampled       bool
+	MirrorOf      pgtype.UUID
+	SchemaVersion pgtype.Int4
+	Metadata      []byte
+}
+
+func (q *Queries) RestoreRequestLog(ctx context.Context, arg RestoreRequestLogParams) (int64, error) {
+	result, err := q.db.Exec(ctx, restoreRequestLog,
+		arg.RequestID,
+		arg.UserID,
+		arg.Model,
+		arg.TargetUrl,
+		arg.Inputs,
+		arg.Parameters,
+		arg.ReceivedAt,
+		arg.ClientIp,
+		arg.Sampled,
+		arg.MirrorOf,
+		arg.SchemaVersion,
+		arg.Metadata,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const revokeAPIKey = `-- name: RevokeAPIKey :execrows
+UPDATE api_keys
+SET revoked = TRUE
+WHERE api_key_id = $1
+`
+
+func (q *Queries) RevokeAPIKey(ctx context.Context, apiKeyID pgtype.UUID) (int64, error) {
+	result, err := q.db.Exec(ctx, revokeAPIKey, apiKeyID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const sampleOutRequestLog = `-- name: SampleOutRequestLog :exec
+UPDATE request_logs
+SET inputs = '{}', sampled = FALSE
+WHERE request_id = $1
+`
+
+func (q *Queries) SampleOutRequestLog(ctx context.Context, requestID pgtype.UUID) error {
+	_, err := q.db.Exec(ctx, sampleOutRequestLog, requestID)
+	return err
+}
+
+const seedAPIKey = `-- name: SeedAPIKey :execrows
+INSERT INTO api_keys (
+  user_id, key_hash, scopes
+)
+VALUES ($1, $2, $3)
+ON CONFLICT (key_hash) DO NOTHING
+`
+
+type SeedAPIKeyParams struct {
+	UserID  pgtype.UUID
+	KeyHash string
+	Scopes  []string
+}
+
+// Adds a key configured outside the database, leaving it alone if it already exists so
+// a key revoked since is not brought back
+func (q *Queries) SeedAPIKey(ctx context.Context, arg SeedAPIKeyParams) (int64, error) {
+	result, err := q.db.Exec(ctx, seedAPIKey, arg.UserID, arg.KeyHash, arg.Scopes)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const upsertRequestLog = `-- name: UpsertRequestLog :one
+INSERT INTO request_logs (
+  user_id, api_key_id, model, target_url, inputs, parameters, client_ip, client_request_id, schema_version, metadata
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (user_id, client_request_id) DO UPDATE
+SET api_key_id = EXCLUDED.api_key_id,
+  model = EXCLUDED.model,
+  target_url = EXCLUDED.target_url,
+  inputs = EXCLUDED.inputs,
+  parameters = EXCLUDED.parameters,
+  client_ip = EXCLUDED.client_ip,
+  schema_version = EXCLUDED.schema_version,
+  metadata = EXCLUDED.metadata,
+  sampled = TRUE,
+  received_at = now()
+RETURNING request_id, user_id, api_key_id, model, target_url, inputs, parameters, received_at, client_ip, archived, client_request_id, sampled, mirror_of, schema_version, metadata
+`
+
+type UpsertRequestLogParams struct {
+	UserID          pgtype.UUID
+	ApiKeyID        pgtype.UUID
+	Model           string
+	TargetUrl       string
+	Inputs          [][]byte
+	Parameters      []byte
+	ClientIp        *netip.Addr
+	ClientRequestID pgtype.Text
+	SchemaVersion   pgtype.Int4
+	Metadata        []byte
+}
+
+func (q *Queries) UpsertRequestLog(ctx context.Context, arg UpsertRequestLogParams) (RequestLog, error) {
+	row := q.db.QueryRow(ctx, upsertRequestLog,
+		arg.UserID,
+		arg.ApiKeyID,
+		arg.Model,
+		arg.TargetUrl,
+		arg.Inputs,
+		arg.Parameters,
+		arg.ClientIp,
+		arg.ClientRequestID,
+		arg.SchemaVersion,
+		arg.Metadata,
+	)
+	var i RequestLog
+	err := row.Scan(
+		&i.RequestID,
+		&i.UserID,
+		&i.ApiKeyID,
+		&i.Model,
+		&i.TargetUrl,
+		&i.Inputs,
+		&i.Parameters,
+		&i.ReceivedAt,
+		&i.ClientIp,
+		&i.Archived,
+		&i.ClientRequestID,
+		&i.Sampled,
+		&i.MirrorOf,
+		&i.SchemaVersion,
+		&i.Metadata,
+	)
+	return i, err
+}
+
+const upsertResponseLog = `-- name: UpsertResponseLog :one
+INSERT INTO response_logs (
+  request_id, response, latency_ms, upstream_latency_ms, gateway_overhead_ms, served_by, attempts, cache_hit, partial, upstream_error, schema_version, upstream_status, upstream_headers, client_response, client_status
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+ON CONFLICT (request_id) DO UPDATE
+SET response = EXCLUDED.response,
+  created_at = now(),
+  latency_ms = EXCLUDED.latency_ms,
+  upstream_latency_ms = EXCLUDED.upstream_latency_ms,
+  gateway_overhead_ms = EXCLUDED.gateway_overhead_ms,
+  served_by = EXCLUDED.served_by,
+  attempts = EXCLUDED.attempts,
+  cache_hit = EXCLUDED.cache_hit,
+  partial = EXCLUDED.partial,
+  upstream_error = EXCLUDED.upstream_error,
+  schema_version = EXCLUDED.schema_version,
+  upstream_status = EXCLUDED.upstream_status,
+  upstream_headers = EXCLUDED.upstream_headers,
+  client_response = EXCLUDED.client_response,
+  client_status = EXCLUDED.client_status
+RETURNING response_id, request_id, response, created_at, latency_ms, upstream_latency_ms, gateway_overhead_ms, served_by, attempts, cache_hit, partial, upstream_error, schema_version, upstream_status, upstream_headers, client_response, client_status
+`
+
+type UpsertResponseLogParams struct {
+	RequestID         pgtype.UUID
+	Response          []byte
+	LatencyMs         pgtype.Int4
+	UpstreamLatencyMs pgtype.Int4
+	GatewayOverheadMs pgtype.Int4
+	ServedBy          pgtype.Text
+	Attempts          []byte
+	CacheHit          bool
+	Partial           bool
+	UpstreamError     pgtype.Text
+	SchemaVersion     pgtype.Int4
+	UpstreamStatus    pgtype.Int4
+	UpstreamHeaders   []byte
+	ClientResponse    []byte
+	ClientStatus      pgtype.Int4
+}
+
+// A request has one response; logging it again, such as from a retry after a timeout
+// that actually succeeded, replaces the first
+func (q *Queries) UpsertResponseLog(ctx context.Context, arg UpsertResponseLogParams) (ResponseLog, error) {
+	row := q.db.QueryRow(ctx, upsertResponseLog,
+		arg.RequestID,
+		arg.Response,
+		arg.LatencyMs,
+		arg.UpstreamLatencyMs,
+		arg.GatewayOverheadMs,
+		arg.ServedBy,
+		arg.Attempts,
+		arg.CacheHit,
+		arg.Partial,
+		arg.UpstreamError,
+		arg.SchemaVersion,
+		arg.UpstreamStatus,
+		arg.UpstreamHeaders,
+		arg.ClientResponse,
+		arg.ClientStatus,
+	)
+	var i ResponseLog
+	err := row.Scan(
+		&i.ResponseID,
+		&i.RequestID,
+		&i.Response,
+		&i.CreatedAt,
+		&i.LatencyMs,
+		&i.UpstreamLatencyMs,
+		&i.GatewayOverheadMs,
+		&i.ServedBy,
+		&i.Attempts,
+		&i.CacheHit,
+		&i.Partial,
+		&i.UpstreamError,
+		&i.SchemaVersion,
+		&i.UpstreamStatus,
+		&i.UpstreamHeaders,
+		&i.ClientResponse,
+		&i.ClientStatus,
+	)
+	return i, err
+}
@@ -10,42 +10,93 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type ApiKey struct {
+	ApiKeyID      pgtype.UUID
+	UserID        pgtype.UUID
+	KeyHash       string
+	Revoked       bool
+	CreatedAt     pgtype.Timestamptz
+	Scopes        []string
+	AllowedModels []string
+}
+
 type AuditArchive struct {
-	ArchiveID   pgtype.UUID
-	RequestID   pgtype.UUID
-	S3Path      string
-	ArchivedAt  pgtype.Timestamptz
-	ArchiveHash pgtype.Text
+	ArchiveID       pgtype.UUID
+	RequestID       pgtype.UUID
+	S3Path          string
+	ArchivedAt      pgtype.Timestamptz
+	ArchiveHash     pgtype.Text
+	ContentEncoding string
 }
 
 type FirewallEvent struct {
-	FirewallEventID pgtype.UUID
-	RequestID       pgtype.UUID
-	FirewallID      string
-	FirewallType    string
-	Blocked         pgtype.Bool
-	BlockedReason   pgtype.Text
-	RiskScore       pgtype.Numeric
-	EvaluatedAt     pgtype.Timestamptz
+	FirewallEventID   pgtype.UUID
+	RequestID         pgtype.UUID
+	FirewallID        string
+	FirewallType      string
+	Blocked           pgtype.Bool
+	BlockedReason     pgtype.Text
+	RiskScore         pgtype.Numeric
+	EvaluatedAt       pgtype.Timestamptz
+	Cached            bool
+	Enforced          bool
+	Replay            bool
+	ContentHash       pgtype.Text
+	Aggregation       []byte
+	BlockingThreshold pgtype.Numeric
+	Phase             pgtype.Text
+	StreamWindow      pgtype.Int4
+	Seq               pgtype.Int4
 }
 
 type RequestLog struct {
+	RequestID       pgtype.UUID
+	UserID          pgtype.UUID
+	ApiKeyID        pgtype.UUID
+	Model           string
+	TargetUrl       string
+	Inputs          [][]byte
+	Parameters      []byte
+	ReceivedAt      pgtype.Timestamptz
+	ClientIp        *netip.Addr
+	Archived        pgtype.Bool
+	ClientRequestID pgtype.Text
+	Sampled         bool
+	MirrorOf        pgtype.UUID
+	SchemaVersion   pgtype.Int4
+	Metadata        []byte
+}
+
+type ResponseChunk struct {
 	RequestID  pgtype.UUID
-	UserID     pgtype.UUID
-	ApiKeyID   pgtype.UUID
-	Model      string
-	TargetUrl  string
-	Inputs     [][]byte
-	Parameters []byte
+	Seq        int32
+	Chunk      []byte
 	ReceivedAt pgtype.Timestamptz
-	ClientIp   *netip.Addr
-	Archived   pgtype.Bool
 }
 
 type ResponseLog struct {
-	ResponseID pgtype.UUID
-	RequestID  pgtype.UUID
-	Response   []byte
-	CreatedAt  pgtype.Timestamptz
-	LatencyMs  pgtype.Int4
+	ResponseID        pgtype.UUID
+	RequestID         pgtype.UUID
+	Response          []byte
+	CreatedAt         pgtype.Timestamptz
+	LatencyMs         pgtype.Int4
+	UpstreamLatencyMs pgtype.Int4
+	GatewayOverheadMs pgtype.Int4
+	ServedBy          pgtype.Text
+	Attempts          []byte
+	CacheHit          bool
+	Partial           bool
+	UpstreamError     pgtype.Text
+	SchemaVersion     pgtype.Int4
+	UpstreamStatus    pgtype.Int4
+	UpstreamHeaders   []byte
+	ClientResponse    []byte
+	ClientStatus      pgtype.Int4
+}
+
+type SessionTurn struct {
+	SessionID pgtype.UUID
+	Turn      int32
+	RequestID pgtype.UUID
+	StartedAt pgtype.Timestamptz
 }
@@ -3,8 +3,10 @@ package s3
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"time"
 
@@ -116,7 +118,8 @@ func (c *Client) UploadObject(bucketName, objectName string, data []byte, conten
 	return nil
 }
 
-// DownloadObject downloads an object from a bucket
+// DownloadObject downloads an object from a bucket. A missing object's error wraps
+// fs.ErrNotExist.
 func (c *Client) DownloadObject(bucketName, objectName string) ([]byte, error) {
 	ctx := context.TODO()
 
@@ -124,6 +127,10 @@ func (c *Client) DownloadObject(bucketName, objectName string) ([]byte, error) {
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectName),
 	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("failed to download object %s: %w", objectName, fs.ErrNotExist)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to download object: %w", err)
 	}
@@ -214,6 +221,6 @@ func (c *Client) GetPresignedURL(bucketName, objectName string, expiry time.Dura
 	// Note: For presigned URLs we need to use the aws-sdk-go-v2/feature/s3/manager package
 	// This is a simplified implementation
 	log.Printf("Generated presigned URL for '%s' in bucket '%s'", objectName, bucketName)
-	return fmt.Sprintf("https://%s/%s/%s?signature=xxx&expires=%d",
+	return fmt.Sprintf("https://%s/%s?signature=xxx&expires=%d",
 		bucketName, objectName, time.Now().Add(expiry).Unix()), nil
 }
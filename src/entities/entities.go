@@ -0,0 +1,218 @@
+package entities
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Kinds of sensitive identifier a Detector can find
+const (
+	Email    = "email"
+	Card     = "card"
+	Phone    = "phone"
+	SSN      = "ssn"
+	Passport = "passport"
+)
+
+type entity struct {
+	kind     string
+	severity float32 // How damaging a leak of one is, between 0 and 1
+	// Where a pattern has a group, only the group is the entity and the rest is context
+	pattern *regexp.Regexp
+	valid   func(match string) bool // Optional extra check on a candidate match
+}
+
+// known is every entity, in the order they are detected. An entity claims its matches
+// before the ones after it can, so cards are detected before phones and long digit
+// runs are classified correctly.
+var known = []entity{
+	{
+		kind:     Email,
+		severity: 0.3,
+		pattern:  regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+	{
+		kind:     Card,
+		severity: 0.9,
+		pattern:  regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`),
+		valid:    isLuhnValid,
+	},
+	{
+		kind:     SSN,
+		severity: 0.9,
+		pattern:  regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+		valid:    isSSN,
+	},
+	{
+		kind:     Phone,
+		severity: 0.4,
+		pattern:  regexp.MustCompile(`\+[1-9]\d{1,14}\b`),
+	},
+	{
+		// Passport numbers have no common format, so only one that is named as such is found
+		kind:     Passport,
+		severity: 0.8,
+		pattern:  regexp.MustCompile(`(?i)\bpassport(?:\s+(?:no\.?|num(?:ber)?|#))?\s*[:#]?\s*([A-Z0-9]{6,9})\b`),
+		valid:    hasDigit,
+	},
+}
+
+// Match is one sensitive identifier found in a string
+type Match struct {
+	Kind       string
+	Severity   float32
+	Start, End int // Byte offsets of the identifier
+}
+
+// Detector finds a chosen set of sensitive identifiers in text
+type Detector struct {
+	entities []entity
+}
+
+// NewDetector creates a detector for the given kinds, or for every known kind if none
+// are given
+func NewDetector(kinds ...string) (*Detector, error) {
+	if len(kinds) == 0 {
+		return &Detector{entities: known}, nil
+	}
+
+	wanted := map[string]bool{}
+	for _, kind := range kinds {
+		if !isKnown(kind) {
+			return nil, fmt.Errorf("unknown entity %q (must be one of %s)", kind, strings.Join(Kinds(), ", "))
+		}
+		wanted[kind] = true
+	}
+
+	d := &Detector{}
+	for _, e := range known {
+		if wanted[e.kind] {
+			d.entities = append(d.entities, e)
+		}
+	}
+	return d, nil
+}
+
+// MustNewDetector is NewDetector for kinds known to be valid, panicking otherwise
+func MustNewDetector(kinds ...string) *Detector {
+	d, err := NewDetector(kinds...)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Kinds returns every kind of entity that can be detected
+func Kinds() []string {
+	kinds := make([]string, 0, len(known))
+	for _, e := range known {
+		kinds = append(kinds, e.kind)
+	}
+	return kinds
+}
+
+func isKnown(kind string) bool {
+	for _, e := range known {
+		if e.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the identifiers in s, ordered by offset. A span claimed by one entity
+// isn't matched again by a later one.
+func (d *Detector) Find(s string) []Match {
+	matches := []Match{}
+	for _, e := range d.entities {
+		for _, m := range e.find(s) {
+			if !overlaps(matches, m) {
+				matches = append(matches, m)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Start < matches[j].Start })
+	return matches
+}
+
+// Replace returns s with every identifier replaced by replacement(kind). Entities are
+// replaced one kind at a time, in detection order, so a replacement is never mistaken
+// for a later entity.
+func (d *Detector) Replace(s string, replacement func(kind string) string) string {
+	for _, e := range d.entities {
+		matches := e.find(s)
+		// Replace from the end so earlier offsets stay valid
+		for i := len(matches) - 1; i >= 0; i-- {
+			m := matches[i]
+			s = s[:m.Start] + replacement(e.kind) + s[m.End:]
+		}
+	}
+	return s
+}
+
+func (e entity) find(s string) []Match {
+	matches := []Match{}
+	for _, loc := range e.pattern.FindAllStringSubmatchIndex(s, -1) {
+		start, end := loc[0], loc[1]
+		if e.pattern.NumSubexp() > 0 {
+			start, end = loc[2], loc[3]
+		}
+		if e.valid != nil && !e.valid(s[start:end]) {
+			continue
+		}
+		matches = append(matches, Match{Kind: e.kind, Severity: e.severity, Start: start, End: end})
+	}
+	return matches
+}
+
+func overlaps(matches []Match, m Match) bool {
+	for _, other := range matches {
+		if m.Start < other.End && other.Start < m.End {
+			return true
+		}
+	}
+	return false
+}
+
+// isLuhnValid reports whether the digits in s pass the Luhn checksum
+func isLuhnValid(s string) bool {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+
+	return sum%10 == 0
+}
+
+// isSSN rejects the area, group and serial numbers that are never issued
+func isSSN(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+func hasDigit(s string) bool {
+	return strings.ContainsAny(s, "0123456789")
+}
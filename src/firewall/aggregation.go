@@ -0,0 +1,110 @@
+package firewall
+
+import (
+	"fmt"
+
+	"covalence/src/audit"
+)
+
+// AggregationPolicy is how the decisions of the firewalls run on the same content
+// combine into whether it is blocked. Only enforced firewalls take part; monitored ones
+// are recorded without a say.
+type AggregationPolicy string
+
+const (
+	// AggregateAny blocks if any firewall blocks
+	AggregateAny AggregationPolicy = "any"
+	// AggregateAll blocks only if every firewall blocks
+	AggregateAll AggregationPolicy = "all"
+	// AggregateWeighted blocks if the weighted mean of the firewalls' risk scores
+	// reaches the threshold, whatever each firewall decided on its own
+	AggregateWeighted AggregationPolicy = "weighted"
+)
+
+// Aggregation is the policy a config's firewalls are combined with
+type Aggregation struct {
+	Policy    AggregationPolicy
+	Threshold float64 // Only used by the weighted policy
+}
+
+// DefaultAggregation blocks if any firewall blocks, as the gateway always has
+func DefaultAggregation() Aggregation {
+	return Aggregation{Policy: AggregateAny}
+}
+
+// NewAggregation validates a policy name and, for the weighted policy, its threshold.
+// An empty name is the default policy.
+func NewAggregation(policy string, threshold float64) (Aggregation, error) {
+	switch p := AggregationPolicy(policy); p {
+	case "":
+		return DefaultAggregation(), nil
+	case AggregateAny, AggregateAll:
+		return Aggregation{Policy: p}, nil
+	case AggregateWeighted:
+		if threshold <= 0 || threshold > 1 {
+			return Aggregation{}, fmt.Errorf("invalid weighted threshold %v: must be above 0 and at most 1", threshold)
+		}
+		return Aggregation{Policy: p, Threshold: threshold}, nil
+	default:
+		return Aggregation{}, fmt.Errorf("unknown aggregation policy %q (must be any, all or weighted)", policy)
+	}
+}
+
+// decide combines the events of the firewalls run into whether the content is blocked.
+// For the weighted policy it also returns the combined score. A firewall that blocked
+// without scoring, such as one timing out closed, counts as a score of 1.
+func (a Aggregation) decide(events []audit.FirewallEvent, weights map[string]float64) (bool, float64) {
+	switch a.Policy {
+	case AggregateAll:
+		enforced := 0
+		for _, event := range events {
+			if !event.Enforced {
+				continue
+			}
+			enforced++
+			if !event.Blocked {
+				return false, 0
+			}
+		}
+		return enforced > 0, 0
+	case AggregateWeighted:
+		var total, weighted float64
+		for _, event := range events {
+			if !event.Enforced {
+				continue
+			}
+			score := event.RiskScore
+			if event.Blocked && score == 0 {
+				score = 1
+			}
+			total += weights[event.FirewallID]
+			weighted += weights[event.FirewallID] * score
+		}
+		if total == 0 {
+			return false, 0
+		}
+		score := weighted / total
+		return score >= a.Threshold, score
+	default:
+		for _, event := range events {
+			if event.Enforced && event.Blocked {
+				return true, 0
+			}
+		}
+		return false, 0
+	}
+}
+
+// record notes on each event how it was combined with the others, so a trace explains
+// the decision as well as each firewall's part in it
+func (a Aggregation) record(events []audit.FirewallEvent, weights map[string]float64, blocked bool, score float64) {
+	for i := range events {
+		aggregation := &audit.Aggregation{Policy: string(a.Policy), Blocked: blocked}
+		if a.Policy == AggregateWeighted {
+			aggregation.Weight = weights[events[i].FirewallID]
+			aggregation.Threshold = a.Threshold
+			aggregation.Score = score
+		}
+		events[i].Aggregation = aggregation
+	}
+}
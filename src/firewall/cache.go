@@ -0,0 +1,109 @@
+package firewall
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"covalence/src/types"
+)
+
+// decision is the cached outcome of running a firewall on a single message
+type decision struct {
+	blocked   bool
+	riskScore float32
+	reason    string // What the firewall found, for firewalls that say
+}
+
+type cacheEntry struct {
+	key       string
+	decision  decision
+	expiresAt time.Time
+}
+
+// decisionCache is a size-bounded LRU of firewall decisions with a fixed TTL.
+// It is safe for concurrent use.
+type decisionCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // Front is most recently used
+	entries map[string]*list.Element
+}
+
+// newDecisionCache returns nil when caching is disabled by a zero TTL or size
+func newDecisionCache(size int, ttl time.Duration) *decisionCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &decisionCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// cacheKeys returns, for each message of a conversation, the key identifying a
+// firewall's decision on that message. The earlier messages are part of the key, since a
+// firewall may judge a message by them; each key is chained from the one before it so
+// the conversation is hashed once rather than once per message.
+func cacheKeys(firewallID string, conversation []types.Message) []string {
+	keys := make([]string, len(conversation))
+	previous := sha256.Sum256([]byte(firewallID))
+	for i, message := range conversation {
+		hash := sha256.New()
+		hash.Write(previous[:])
+		// Lengths are written so that content can't run into the next message
+		fmt.Fprintf(hash, "\x00%s\x00%d:%s", message.Role.String(), len(message.Content), message.Content)
+		copy(previous[:], hash.Sum(nil))
+		keys[i] = hex.EncodeToString(previous[:])
+	}
+	return keys
+}
+
+func (c *decisionCache) get(key string) (decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return decision{}, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return decision{}, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.decision, true
+}
+
+func (c *decisionCache) put(key string, d decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.decision = d
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, decision: d, expiresAt: expiresAt})
+
+	// Evict the least recently used entry once over capacity
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -1,10 +1,20 @@
 package firewall
 
 import (
+	"bytes"
+	"covalence/src/entities"
+	"covalence/src/firewall/injection"
+	"covalence/src/firewall/length"
 	"covalence/src/internal"
+	"covalence/src/tokenizer"
 	"covalence/src/types"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
@@ -16,39 +26,327 @@ type Firewall struct {
 	Type              types.FirewallType
 	Model             internal.Model
 	BlockingThreshold float32
+	Scope             types.FirewallScope // Which messages are evaluated
+	Timeout           time.Duration       // Zero means no per-firewall deadline
+	FailMode          types.FailMode      // What to do when evaluation times out
+	Mode              types.FirewallMode  // Monitor records blocks without applying them
+	Direction         types.FirewallDirection
+	AppliesTo         []types.ModelID     // Empty means every model
+	Limits            length.Limits       // Only used by length firewalls, which have no model
+	Tokenizer         tokenizer.Tokenizer // Nil counts with the tokenizer of the target's provider
+	Patterns          injection.Patterns  // Only used by injection firewalls, which have no model
+	Entities          *entities.Detector  // Only used by pii firewalls, which have no model
+	HashContent       bool                // Record a sha256 of the evaluated messages with each event
+	Weight            float64             // Share of the combined score under the weighted aggregation policy
+	cache             *decisionCache      // Shared by all firewalls in a config, nil when disabled
+}
+
+// CacheConfig bounds the firewall decision cache. A zero TTL disables caching.
+type CacheConfig struct {
+	Size int
+	TTL  time.Duration
+}
+
+// StreamConfig sizes the window of streamed output the output firewalls evaluate at a
+// time. Overlap characters from the end of each window are evaluated again with the
+// next, so content split across windows is still seen whole.
+type StreamConfig struct {
+	Window  int // Characters per window
+	Overlap int // Characters carried into the next window
+}
+
+// DefaultStreamConfig is used when the config doesn't size the window
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{Window: 512, Overlap: 128}
 }
 
 type Config struct {
-	Name      string
-	Firewalls []Firewall
+	Name   string
+	Cache  CacheConfig
+	Stream StreamConfig
+	// Events record a sha256 of the content each firewall evaluated, so decisions can
+	// be tied to an input without storing it
+	HashContent bool
+	// How the decisions of the firewalls run on the same content combine
+	Aggregation Aggregation
+	Firewalls   []Firewall
+}
+
+// InputFirewalls returns the firewalls that evaluate request messages
+func (c Config) InputFirewalls() []Firewall {
+	return c.byDirection(types.InputDirection())
+}
+
+// OutputFirewalls returns the firewalls that evaluate model responses
+func (c Config) OutputFirewalls() []Firewall {
+	return c.byDirection(types.OutputDirection())
+}
+
+// ForModel returns the firewalls that apply to a request for model.
+//
+// Precedence: a firewall whose AppliesTo lists the model overrides every firewall of
+// the same type and direction with an empty AppliesTo, so a trusted model can be
+// given a higher BlockingThreshold than the default. Firewalls that survive this are
+// all run, and the request is blocked if any of them blocks it, so when several
+// model-specific firewalls of one type match, the strictest one decides.
+func (c Config) ForModel(model types.ModelID) Config {
+	type key struct {
+		firewallType types.FirewallType
+		direction    types.FirewallDirection
+	}
+
+	overridden := map[key]bool{}
+	for _, f := range c.Firewalls {
+		if len(f.AppliesTo) > 0 && f.appliesTo(model) {
+			overridden[key{f.Type, f.Direction}] = true
+		}
+	}
+
+	firewalls := []Firewall{}
+	for _, f := range c.Firewalls {
+		if len(f.AppliesTo) == 0 && overridden[key{f.Type, f.Direction}] {
+			continue
+		}
+		if f.appliesTo(model) {
+			firewalls = append(firewalls, f)
+		}
+	}
+
+	c.Firewalls = firewalls
+	return c
+}
+
+func (f Firewall) appliesTo(model types.ModelID) bool {
+	if len(f.AppliesTo) == 0 {
+		return true
+	}
+	for _, m := range f.AppliesTo {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// GuardsOutput reports whether an enabled output firewall applies to model, in which
+// case a response the firewalls can't read must not reach the client
+func (c Config) GuardsOutput(model types.ModelID) bool {
+	for _, f := range c.ForModel(model).OutputFirewalls() {
+		if f.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Config) byDirection(direction types.FirewallDirection) []Firewall {
+	firewalls := []Firewall{}
+	for _, f := range c.Firewalls {
+		if f.Direction == direction {
+			firewalls = append(firewalls, f)
+		}
+	}
+	return firewalls
 }
 
 type rawFirewall struct {
-	ID                string  `yaml:"id"`
-	Enabled           bool    `yaml:"enabled"`
-	Type              string  `yaml:"type"`
-	Model             string  `yaml:"model"`
-	BlockingThreshold float32 `yaml:"blocking_threshold"`
+	ID                string   `yaml:"id" json:"id"`
+	Enabled           bool     `yaml:"enabled" json:"enabled"`
+	Type              string   `yaml:"type" json:"type"`
+	Model             string   `yaml:"model" json:"model"`
+	BlockingThreshold float32  `yaml:"blocking_threshold" json:"blocking_threshold"`
+	Scope             string   `yaml:"scope" json:"scope"`
+	TimeoutMs         int      `yaml:"timeout_ms" json:"timeout_ms"`
+	FailMode          string   `yaml:"fail_mode" json:"fail_mode"`
+	Mode              string   `yaml:"mode" json:"mode"`
+	Direction         string   `yaml:"direction" json:"direction"`
+	AppliesTo         []string `yaml:"applies_to" json:"applies_to"`
+	MaxChars          int      `yaml:"max_chars" json:"max_chars"`
+	MaxTokens         int      `yaml:"max_tokens" json:"max_tokens"`
+	Patterns          []string `yaml:"patterns" json:"patterns"` // Added to the injection defaults
+	Entities          []string `yaml:"entities" json:"entities"` // Detected by pii firewalls; empty detects all
+	Weight            *float64 `yaml:"weight" json:"weight"`     // Defaults to 1; only used by the weighted policy
+}
+
+type rawCache struct {
+	Size  int `yaml:"size" json:"size"`
+	TTLMs int `yaml:"ttl_ms" json:"ttl_ms"`
+}
+
+type rawAggregation struct {
+	Policy    string  `yaml:"policy" json:"policy"`       // any (the default), all or weighted
+	Threshold float64 `yaml:"threshold" json:"threshold"` // Required by the weighted policy
+}
+
+type rawStream struct {
+	WindowChars  int `yaml:"window_chars" json:"window_chars"`
+	OverlapChars int `yaml:"overlap_chars" json:"overlap_chars"`
 }
 
 type rawConfig struct {
-	Name      string        `yaml:"name"`
-	Firewalls []rawFirewall `yaml:"firewalls"`
+	Name        string         `yaml:"name" json:"name"`
+	Cache       rawCache       `yaml:"cache" json:"cache"`
+	Stream      rawStream      `yaml:"stream" json:"stream"`
+	HashContent bool           `yaml:"hash_content" json:"hash_content"`
+	Aggregation rawAggregation `yaml:"aggregation" json:"aggregation"`
+	Firewalls   []rawFirewall  `yaml:"firewalls" json:"firewalls"`
+}
+
+// envReference matches a ${VAR} reference or the $$ escape for a literal $
+var envReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// envExpander substitutes ${VAR} references with environment variables so secrets can
+// be kept out of the config file. Only string values of the parsed config are expanded,
+// so a variable can't add keys or change the structure around it. Every unset variable
+// is reported rather than expanded to an empty string.
+type envExpander struct {
+	missing []string
+}
+
+func (e *envExpander) expand(value string) string {
+	return envReference.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		name := match[2 : len(match)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			e.missing = append(e.missing, name)
+		}
+		return value
+	})
 }
 
+// json expands the strings in a decoded JSON value, leaving object keys as written
+func (e *envExpander) json(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return e.expand(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = e.json(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = e.json(item)
+		}
+	}
+	return value
+}
+
+// yaml expands the string scalars under node, leaving mapping keys as written
+func (e *envExpander) yaml(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!str" {
+			node.Value = e.expand(node.Value)
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			e.yaml(node.Content[i])
+		}
+	default:
+		for _, child := range node.Content {
+			e.yaml(child)
+		}
+	}
+}
+
+func (e *envExpander) err() error {
+	if len(e.missing) > 0 {
+		return fmt.Errorf("config references unset environment variables: %s", strings.Join(e.missing, ", "))
+	}
+	return nil
+}
+
+// decodeJSON decodes a JSON config into raw with its environment references expanded
+func decodeJSON(data []byte, raw *rawConfig) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return err
+	}
+
+	var env envExpander
+	tree = env.json(tree)
+	if err := env.err(); err != nil {
+		return err
+	}
+
+	expanded, err := json.Marshal(tree)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(expanded, raw)
+}
+
+// decodeYAML decodes a YAML config into raw with its environment references expanded
+func decodeYAML(data []byte, raw *rawConfig) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+
+	var env envExpander
+	env.yaml(&root)
+	if err := env.err(); err != nil {
+		return err
+	}
+	return root.Decode(raw)
+}
+
+// LoadConfig reads a firewall config, choosing JSON or YAML by the file's extension
 func LoadConfig(path string) (Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return Config{}, err
 	}
 
+	// Both formats decode into the same raw config, so validation is identical
 	var raw rawConfig
-	err = yaml.Unmarshal(data, &raw)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = decodeJSON(data, &raw)
+	case ".yaml", ".yml", "":
+		err = decodeYAML(data, &raw)
+	default:
+		return Config{}, fmt.Errorf("unsupported config format %q (must be .json, .yaml or .yml)", ext)
+	}
 	if err != nil {
 		return Config{}, err
 	}
 
-	var cfg Config
+	if raw.Cache.Size < 0 || raw.Cache.TTLMs < 0 {
+		return Config{}, fmt.Errorf("invalid cache config: size %d, ttl %dms", raw.Cache.Size, raw.Cache.TTLMs)
+	}
+
+	aggregation, err := NewAggregation(raw.Aggregation.Policy, raw.Aggregation.Threshold)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid aggregation config: %w", err)
+	}
+
+	cfg := Config{
+		Name: raw.Name,
+		Cache: CacheConfig{
+			Size: raw.Cache.Size,
+			TTL:  time.Duration(raw.Cache.TTLMs) * time.Millisecond,
+		},
+		Stream:      DefaultStreamConfig(),
+		HashContent: raw.HashContent,
+		Aggregation: aggregation,
+	}
+
+	if raw.Stream.WindowChars != 0 || raw.Stream.OverlapChars != 0 {
+		if raw.Stream.WindowChars <= 0 || raw.Stream.OverlapChars < 0 || raw.Stream.OverlapChars >= raw.Stream.WindowChars {
+			return Config{}, fmt.Errorf("invalid stream config: window %d chars, overlap %d chars (overlap must be smaller than the window)", raw.Stream.WindowChars, raw.Stream.OverlapChars)
+		}
+		cfg.Stream = StreamConfig{Window: raw.Stream.WindowChars, Overlap: raw.Stream.OverlapChars}
+	}
+
+	// Each load gets a fresh cache so decisions made under old thresholds are dropped
+	cache := newDecisionCache(cfg.Cache.Size, cfg.Cache.TTL)
+
 	for _, rf := range raw.Firewalls {
 		ft, err := types.NewFirewallType(rf.Type)
 		if err != nil {
@@ -60,14 +358,92 @@ func LoadConfig(path string) (Config, error) {
 			return Config{}, fmt.Errorf("invalid firewall ID: %w", err)
 		}
 
-		modelID, err := types.NewModelID(rf.Model)
-		if err != nil {
-			return Config{}, fmt.Errorf("invalid model: %w", err)
+		// Length, injection and pii firewalls evaluate messages themselves, without a model
+		var model internal.Model
+		var limits length.Limits
+		var patterns injection.Patterns
+		var detector *entities.Detector
+		switch ft.String() {
+		case "length":
+			if rf.MaxChars < 0 || rf.MaxTokens < 0 || rf.MaxChars+rf.MaxTokens == 0 {
+				return Config{}, fmt.Errorf("invalid length limits: %d chars, %d tokens (set max_chars, max_tokens or both)", rf.MaxChars, rf.MaxTokens)
+			}
+			limits = length.Limits{MaxChars: rf.MaxChars, MaxTokens: rf.MaxTokens}
+		case "injection":
+			patterns, err = injection.NewPatterns(rf.Patterns)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid injection patterns: %w", err)
+			}
+		case "pii":
+			detector, err = entities.NewDetector(rf.Entities...)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid pii entities: %w", err)
+			}
+		default:
+			modelID, err := types.NewModelID(rf.Model)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid model: %w", err)
+			}
+
+			model, err = internal.GetModel(modelID)
+			if err != nil {
+				return Config{}, fmt.Errorf("failed to get model: %w", err)
+			}
 		}
 
-		model, err := internal.GetModel(modelID)
-		if err != nil {
-			return Config{}, fmt.Errorf("failed to get model: %w", err)
+		// Evaluate the whole conversation unless told otherwise
+		scope := types.AllMessages()
+		if rf.Scope != "" {
+			scope, err = types.NewFirewallScope(rf.Scope)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid firewall scope: %w", err)
+			}
+		}
+
+		if rf.TimeoutMs < 0 {
+			return Config{}, fmt.Errorf("invalid firewall timeout: %dms", rf.TimeoutMs)
+		}
+
+		// Fail closed unless a firewall explicitly opts out
+		failMode := types.FailClosed()
+		if rf.FailMode != "" {
+			failMode, err = types.NewFailMode(rf.FailMode)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid fail mode: %w", err)
+			}
+		}
+
+		mode := types.Enforce()
+		if rf.Mode != "" {
+			mode, err = types.NewFirewallMode(rf.Mode)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid firewall mode: %w", err)
+			}
+		}
+
+		direction := types.InputDirection()
+		if rf.Direction != "" {
+			direction, err = types.NewFirewallDirection(rf.Direction)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid firewall direction: %w", err)
+			}
+		}
+
+		weight := 1.0
+		if rf.Weight != nil {
+			if *rf.Weight <= 0 {
+				return Config{}, fmt.Errorf("invalid firewall weight: %v", *rf.Weight)
+			}
+			weight = *rf.Weight
+		}
+
+		appliesTo := []types.ModelID{}
+		for _, m := range rf.AppliesTo {
+			target, err := types.NewModelID(m)
+			if err != nil {
+				return Config{}, fmt.Errorf("invalid applies_to model: %w", err)
+			}
+			appliesTo = append(appliesTo, target)
 		}
 
 		cfg.Firewalls = append(cfg.Firewalls, Firewall{
@@ -76,6 +452,18 @@ func LoadConfig(path string) (Config, error) {
 			Type:              ft,
 			Model:             model,
 			BlockingThreshold: rf.BlockingThreshold,
+			Scope:             scope,
+			Timeout:           time.Duration(rf.TimeoutMs) * time.Millisecond,
+			FailMode:          failMode,
+			Mode:              mode,
+			Direction:         direction,
+			AppliesTo:         appliesTo,
+			Limits:            limits,
+			Patterns:          patterns,
+			Entities:          detector,
+			HashContent:       raw.HashContent,
+			Weight:            weight,
+			cache:             cache,
 		})
 	}
 
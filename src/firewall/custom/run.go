@@ -1,15 +1,16 @@
 package custom
 
 import (
+	"context"
 	"covalence/src/internal"
+	"covalence/src/logging"
 	"covalence/src/types"
-	"log"
 )
 
-func Run(message types.Message, model internal.Model, blockingThreshold float32) (bool, error) {
-	content := message.Content
+func Run(ctx context.Context, messages []types.Message, target types.ModelID, model internal.Model, blockingThreshold float32) (bool, float32, error) {
+	content := messages[len(messages)-1].Content
 
-	log.Printf("Running custom firewall with content: %v", content)
+	logging.FromContext(ctx).Debug("evaluating message", "firewall", "custom", "content_length", len(content), "context_messages", len(messages)-1, "target", target.String())
 
-	return true, nil
+	return true, 0, nil
 }
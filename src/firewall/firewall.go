@@ -1,92 +1,520 @@
 package firewall
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"covalence/src/audit"
-	"covalence/src/db/postgres"
 	custom "covalence/src/firewall/custom"
 	hallucinationRisk "covalence/src/firewall/hallucination_risk"
+	"covalence/src/firewall/injection"
+	"covalence/src/firewall/length"
 	maliciousIntent "covalence/src/firewall/malicious_intent"
 	obfuscation "covalence/src/firewall/obfuscation"
+	"covalence/src/firewall/pii"
 	policyViolation "covalence/src/firewall/policy_violation"
 	promptInjection "covalence/src/firewall/prompt_injection"
 	sensitiveData "covalence/src/firewall/sensitive_data"
 	spam "covalence/src/firewall/spam"
+	"covalence/src/logging"
 	"covalence/src/request"
+	"covalence/src/tokenizer"
 	"covalence/src/types"
-	"covalence/src/utils"
+	"covalence/src/user"
 
 	"github.com/gin-gonic/gin"
 )
 
-func (f Firewall) Apply(messages []types.Message) (bool, error) {
-	message := messages[len(messages)-1]
-	if f.Enabled {
-		log.Printf("================ running %s firewall ================", f.Type.String())
-		switch f.Type.String() {
-		case "prompt-injection":
-			return promptInjection.Run(message, f.Model, f.BlockingThreshold)
-		case "malicious-intent":
-			return maliciousIntent.Run(message, f.Model, f.BlockingThreshold)
-		case "custom":
-			return custom.Run(message, f.Model, f.BlockingThreshold)
-		case "policy-violation":
-			return policyViolation.Run(message, f.Model, f.BlockingThreshold)
-		case "sensitive-data":
-			return sensitiveData.Run(message, f.Model, f.BlockingThreshold)
-		case "hallucination-risk":
-			return hallucinationRisk.Run(message, f.Model, f.BlockingThreshold)
-		case "spam":
-			return spam.Run(message, f.Model, f.BlockingThreshold)
-		case "obfuscation":
-			return obfuscation.Run(message, f.Model, f.BlockingThreshold)
-		default:
-			return true, nil
-		}
-	}
-
-	return true, nil
-}
-
-func HookFirewalls(c *gin.Context, payload *request.Generate, config *Config) (int, error) {
-	log.Printf("firewall hook called with payload")
-	db := c.MustGet("db").(*postgres.DB)
-	requestID := c.MustGet("requestID").(string)
+// targets returns the indexes of the messages this firewall should evaluate
+func (f Firewall) targets(messages []types.Message) []int {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	switch f.Scope {
+	case types.LastMessage():
+		return []int{len(messages) - 1}
+	case types.UserMessagesOnly():
+		return messagesWithRole(messages, types.UserRole())
+	case types.SystemPromptOnly():
+		return messagesWithRole(messages, types.SystemRole())
+	default:
+		indexes := make([]int, len(messages))
+		for i := range messages {
+			indexes[i] = i
+		}
+		return indexes
+	}
+}
+
+func messagesWithRole(messages []types.Message, role types.Role) []int {
+	indexes := []int{}
+	for i, message := range messages {
+		if message.Role == role {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// Result is the outcome of applying a firewall to a conversation
+type Result struct {
+	Passed    bool
+	Index     int     // The offending message, or -1 if the messages passed
+	RiskScore float32 // Highest risk score among the evaluated messages
+	Cached    bool    // Every evaluated message was decided from the cache
+	Reason    string  // What the firewall found in the offending message, if it says
+}
+
+// Apply evaluates the messages in scope for a request to target, stopping at the first
+// one that is blocked. Each message is evaluated along with the conversation before it,
+// so a firewall can weigh it in context. Decisions are looked up in and stored to the
+// firewall's cache when it has one.
+func (f Firewall) Apply(ctx context.Context, messages []types.Message, target user.Model) (Result, error) {
+	if !f.Enabled {
+		return Result{Passed: true, Index: -1}, nil
+	}
+
+	logging.FromContext(ctx).Debug("running firewall", "firewall", f.Type.String(), "messages", len(messages))
+	var keys []string
+	if f.cache != nil {
+		keys = cacheKeys(f.ID.String(), messages)
+	}
 
-	// Check latest message
-	for _, firewall := range config.Firewalls {
-		res, err := firewall.Apply(payload.Messages)
+	evaluated, hits := 0, 0
+	var riskScore float32
+	for _, i := range f.targets(messages) {
+		if err := ctx.Err(); err != nil {
+			return Result{Index: i}, err
+		}
+
+		evaluated++
+		conversation := messages[:i+1]
+		d, hit := f.lookup(keys, i)
+		if hit {
+			hits++
+		} else {
+			var err error
+			d, err = f.run(ctx, conversation, target)
+			if err != nil {
+				return Result{Index: i}, err
+			}
+			f.store(keys, i, d)
+		}
+
+		riskScore = max(riskScore, d.riskScore)
+		if d.blocked {
+			return Result{Index: i, RiskScore: riskScore, Cached: hits == evaluated, Reason: d.reason}, nil
+		}
+	}
+
+	return Result{Passed: true, Index: -1, RiskScore: riskScore, Cached: evaluated > 0 && hits == evaluated}, nil
+}
+
+func (f Firewall) lookup(keys []string, i int) (decision, bool) {
+	if f.cache == nil {
+		return decision{}, false
+	}
+	return f.cache.get(keys[i])
+}
+
+func (f Firewall) store(keys []string, i int, d decision) {
+	if f.cache == nil {
+		return
+	}
+	f.cache.put(keys[i], d)
+}
+
+// run evaluates the last message of conversation. Each firewall decides how much of the
+// conversation before it to take into account.
+func (f Firewall) run(ctx context.Context, conversation []types.Message, target user.Model) (decision, error) {
+	switch f.Type.String() {
+	case "prompt-injection":
+		return verdict(promptInjection.Run(ctx, conversation, target.Model, f.Model, f.BlockingThreshold))
+	case "malicious-intent":
+		return verdict(maliciousIntent.Run(ctx, conversation, target.Model, f.Model, f.BlockingThreshold))
+	case "custom":
+		return verdict(custom.Run(ctx, conversation, target.Model, f.Model, f.BlockingThreshold))
+	case "policy-violation":
+		return verdict(policyViolation.Run(ctx, conversation, target.Model, f.Model, f.BlockingThreshold))
+	case "sensitive-data":
+		return verdict(sensitiveData.Run(ctx, conversation, target.Model, f.Model, f.BlockingThreshold))
+	case "hallucination-risk":
+		return verdict(hallucinationRisk.Run(ctx, conversation, target.Model, f.Model, f.BlockingThreshold))
+	case "spam":
+		return verdict(spam.Run(ctx, conversation, target.Model, f.Model, f.BlockingThreshold))
+	case "obfuscation":
+		return verdict(obfuscation.Run(ctx, conversation, target.Model, f.Model, f.BlockingThreshold))
+	case "length":
+		tk := f.Tokenizer
+		if tk == nil {
+			tk = tokenizer.ForProvider(target.Provider)
+		}
+		return verdict(length.Run(ctx, conversation, target.Model, f.Limits, tk))
+	case "injection":
+		return verdict(injection.Run(ctx, conversation, f.Patterns, f.BlockingThreshold))
+	case "pii":
+		passed, score, found, err := pii.Run(ctx, conversation, f.Entities)
+		return decision{blocked: !passed, riskScore: score, reason: strings.Join(found, ", ")}, err
+	default:
+		return decision{}, nil
+	}
+}
+
+// verdict is the decision of a firewall that only reports whether a message passed
+func verdict(passed bool, riskScore float32, err error) (decision, error) {
+	return decision{blocked: !passed, riskScore: riskScore}, err
+}
+
+// FirewallResult is the combined outcome of running a set of firewalls
+type FirewallResult struct {
+	Blocked   bool                  // The decision of the aggregation policy
+	RiskScore float64               // Highest risk score reported by any enforced firewall
+	Events    []audit.FirewallEvent // One per firewall run, length firewalls first
+	// The policy the events were combined with; Score is only set by the weighted policy
+	Aggregation Aggregation
+	Score       float64
+}
+
+// Status is the HTTP status the proxy should respond with for this result
+func (r FirewallResult) Status() int {
+	if r.Blocked {
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+// Reason describes the first enforced firewall that blocked, or the combined score that
+// did under the weighted policy. It is empty if the content wasn't blocked.
+func (r FirewallResult) Reason() string {
+	if !r.Blocked {
+		return ""
+	}
+	if r.Aggregation.Policy == AggregateWeighted {
+		return fmt.Sprintf("request rejected by firewalls: weighted risk score %.2f reached threshold %.2f", r.Score, r.Aggregation.Threshold)
+	}
+	for _, event := range r.Events {
+		if event.Blocked && event.Enforced {
+			return fmt.Sprintf("request rejected by %s firewall: %s", event.FirewallType, event.BlockedReason)
+		}
+	}
+	return ""
+}
+
+// RunAll evaluates every firewall against the messages of a request to target. The
+// caller tags the events with their request and phase. Whether the request is blocked
+// is decided by the aggregation policy over the enforced firewalls; monitored
+// firewalls only record what they would have done.
+//
+// Length firewalls are cheap, so they run first: under the any policy, if they block,
+// the model-backed firewalls are skipped and only the length events are returned.
+func RunAll(ctx context.Context, firewalls []Firewall, policy Aggregation, messages []types.Message, target user.Model) (FirewallResult, error) {
+	if policy.Policy == "" {
+		policy = DefaultAggregation()
+	}
+
+	weights := make(map[string]float64, len(firewalls))
+	var first, rest []Firewall
+	for _, f := range firewalls {
+		weights[f.ID.String()] = f.Weight
+		if f.Type.String() == "length" {
+			first = append(first, f)
+		} else {
+			rest = append(rest, f)
+		}
+	}
+
+	result, err := runConcurrently(ctx, first, messages, target)
+	if err != nil {
+		return FirewallResult{}, err
+	}
+	if blocked, _ := policy.decide(result.Events, weights); !blocked || policy.Policy != AggregateAny {
+		restResult, err := runConcurrently(ctx, rest, messages, target)
 		if err != nil {
-			return http.StatusInternalServerError, err
+			return FirewallResult{}, err
 		}
+		result.RiskScore = max(result.RiskScore, restResult.RiskScore)
+		result.Events = append(result.Events, restResult.Events...)
+	}
+
+	result.Aggregation = policy
+	result.Blocked, result.Score = policy.decide(result.Events, weights)
+	policy.record(result.Events, weights, result.Blocked, result.Score)
+	return result, nil
+}
+
+// tag fills in the request and the evaluation of it that logged each event. Events are
+// numbered in the order they were returned, which is the order they were evaluated in.
+func (r FirewallResult) tag(requestID, phase string, window int) {
+	for i := range r.Events {
+		r.Events[i].RequestID = requestID
+		r.Events[i].Phase = phase
+		r.Events[i].Window = window
+		r.Events[i].Seq = i
+	}
+}
+
+// runConcurrently evaluates the firewalls in parallel, returning their events in the
+// order they were configured. If ctx is cancelled before all firewalls finish, the slow
+// ones are abandoned and ctx.Err() is returned.
+func runConcurrently(ctx context.Context, firewalls []Firewall, messages []types.Message, target user.Model) (FirewallResult, error) {
+	type outcome struct {
+		Result
+		err      error
+		timedOut bool
+	}
+
+	outcomes := make([]outcome, len(firewalls))
+	var wg sync.WaitGroup
+	for i, firewall := range firewalls {
+		wg.Add(1)
+		go func(i int, firewall Firewall) {
+			defer wg.Done()
 
-		// Log the firewall event
-		loggingStartTime := time.Now()
-		utils.BoxLog(fmt.Sprintf("audit loggging: firewall event %s 📝", firewall.Type.String()))
+			firewallCtx, cancel := ctx, context.CancelFunc(func() {})
+			if firewall.Timeout > 0 {
+				firewallCtx, cancel = context.WithTimeout(ctx, firewall.Timeout)
+			}
+			defer cancel()
 
-		fe := audit.FirewallEvent{
-			RequestID:     requestID,
+			result, err := firewall.Apply(firewallCtx, messages, target)
+
+			// Only this firewall's own deadline counts as a timeout, not the request's
+			timedOut := err != nil && errors.Is(firewallCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+			outcomes[i] = outcome{result, err, timedOut}
+		}(i, firewall)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return FirewallResult{}, ctx.Err()
+	}
+
+	result := FirewallResult{Events: make([]audit.FirewallEvent, 0, len(firewalls))}
+	for i, firewall := range firewalls {
+		o := outcomes[i]
+
+		enforced := firewall.Mode != types.Monitor()
+
+		blockedReason := ""
+		switch {
+		case o.err != nil && !o.timedOut && !enforced:
+			// A monitored firewall failing must not fail the request
+			logging.FromContext(ctx).Warn("monitored firewall failed", "firewall", firewall.Type.String(), "message", o.Index, "error", o.err)
+			continue
+		case o.timedOut:
+			logging.FromContext(ctx).Warn("firewall timed out", "firewall", firewall.Type.String(), "timeout", firewall.Timeout, "fail_mode", firewall.FailMode.String())
+			o.Passed = firewall.FailMode == types.FailOpen()
+			blockedReason = "evaluation timeout"
+		case o.err != nil:
+			return FirewallResult{}, fmt.Errorf("firewall %s failed on message %d: %w", firewall.Type.String(), o.Index, o.err)
+		case !o.Passed:
+			blockedReason = fmt.Sprintf("message %d", o.Index)
+			if o.Reason != "" {
+				blockedReason += ": " + o.Reason
+			}
+		}
+
+		// Monitored scores are logged on their event but don't raise the request's risk
+		if enforced {
+			result.RiskScore = max(result.RiskScore, float64(o.RiskScore))
+		}
+
+		event := audit.FirewallEvent{
 			FirewallID:    firewall.ID.String(),
 			FirewallType:  firewall.Type.String(),
-			Blocked:       !res,
-			BlockedReason: "",
-			RiskScore:     0.0,
+			Blocked:       !o.Passed,
+			BlockedReason: blockedReason,
+			RiskScore:     float64(o.RiskScore),
+			Cached:        o.Cached,
+			Enforced:      enforced,
+			Threshold:     float64(firewall.BlockingThreshold),
+		}
+		if firewall.HashContent {
+			event.ContentHash = firewall.contentHash(messages, o.Result)
+		}
+		result.Events = append(result.Events, event)
+	}
+
+	return result, nil
+}
+
+// contentHash is the hex sha256 of the messages a firewall's decision rests on: the
+// offending message when it blocked, otherwise every message in its scope. The hashed
+// form is the JSON array of the messages, [{"content": ..., "role": ...}], as the
+// firewall saw them, before the audit log's redactor runs. A stored input can only be
+// checked against it when nothing in it was redacted; otherwise the client's original
+// messages are needed.
+func (f Firewall) contentHash(messages []types.Message, result Result) string {
+	evaluated := []map[string]interface{}{}
+	if !result.Passed && result.Index >= 0 && result.Index < len(messages) {
+		evaluated = append(evaluated, messages[result.Index].ToMap())
+	} else {
+		for _, i := range f.targets(messages) {
+			evaluated = append(evaluated, messages[i].ToMap())
+		}
+	}
+
+	// Maps marshal with sorted keys, so the encoding is stable
+	data, err := json.Marshal(evaluated)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// HookFirewalls runs the input firewalls that apply to a request and logs their events.
+// An error means the firewalls could not be evaluated; a blocked request is reported
+// through the result, whose Status and Reason the caller can respond with.
+func HookFirewalls(c *gin.Context, payload *request.Generate, config *Config) (FirewallResult, error) {
+	logger := logging.FromContext(c.Request.Context())
+	auditWriter := c.MustGet("auditWriter").(*audit.Writer)
+	requestID := c.MustGet("requestID").(string)
+
+	result, err := RunAll(c.Request.Context(), config.ForModel(payload.Model.Model).InputFirewalls(), config.Aggregation, payload.Messages, payload.Model)
+	if err != nil {
+		return FirewallResult{}, err
+	}
+	result.tag(requestID, audit.PhaseInput, 0)
+
+	// Log the firewall events
+	loggingStartTime := time.Now()
+	if err := auditWriter.LogFirewallEvents(c.Request.Context(), result.Events); err != nil {
+		logger.Error("failed to log firewall events", "error", err)
+	}
+
+	logger.Debug("logged firewall events", "events", len(result.Events), "risk_score", result.RiskScore, "duration", time.Since(loggingStartTime))
+
+	return result, nil
+}
+
+const refusalMessage = "I'm sorry, but I can't provide that response."
+
+// RunOutput evaluates the output firewalls against the content target generated in a
+// response. Both OpenAI (choices[].message.content) and Anthropic (content[].text)
+// shapes are read.
+func RunOutput(ctx context.Context, firewalls []Firewall, policy Aggregation, response map[string]interface{}, target user.Model) (FirewallResult, error) {
+	output := []Firewall{}
+	for _, f := range firewalls {
+		if f.Direction == types.OutputDirection() {
+			output = append(output, f)
 		}
+	}
+
+	messages := responseMessages(response)
+	if len(output) == 0 || len(messages) == 0 {
+		return FirewallResult{}, nil
+	}
+
+	return RunAll(ctx, output, policy, messages, target)
+}
 
-		audit.LogFirewallEvent(c, fe, db)
+// responseMessages extracts the generated content of a response as assistant messages
+func responseMessages(response map[string]interface{}) []types.Message {
+	messages := []types.Message{}
 
-		loggingEndTime := time.Since(loggingStartTime)
-		log.Printf("firewall audit logging took %s", loggingEndTime)
+	if choices, ok := response["choices"].([]interface{}); ok {
+		for _, raw := range choices {
+			choice, ok := raw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			message, ok := choice["message"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if content, ok := message["content"].(string); ok && content != "" {
+				messages = append(messages, types.Message{Role: types.AssistantRole(), Content: content})
+			}
+		}
+	}
 
-		if !res {
-			return http.StatusForbidden, errors.New("request rejected: blocked by firewall")
+	if blocks, ok := response["content"].([]interface{}); ok {
+		for _, raw := range blocks {
+			block, ok := raw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if text, ok := block["text"].(string); ok && text != "" {
+				messages = append(messages, types.Message{Role: types.AssistantRole(), Content: text})
+			}
 		}
 	}
 
-	return http.StatusOK, nil
+	return messages
+}
+
+// refusal returns a copy of response with all generated content replaced by a refusal
+func refusal(response map[string]interface{}) map[string]interface{} {
+	safe := make(map[string]interface{}, len(response))
+	for k, v := range response {
+		safe[k] = v
+	}
+
+	if choices, ok := response["choices"].([]interface{}); ok {
+		safeChoices := make([]interface{}, 0, len(choices))
+		for i := range choices {
+			safeChoices = append(safeChoices, map[string]interface{}{
+				"index": i,
+				"message": map[string]interface{}{
+					"role":    "assistant",
+					"content": refusalMessage,
+				},
+				"finish_reason": "content_filter",
+			})
+		}
+		safe["choices"] = safeChoices
+	}
+
+	if _, ok := response["content"].([]interface{}); ok {
+		safe["content"] = []interface{}{
+			map[string]interface{}{"type": "text", "text": refusalMessage},
+		}
+		safe["stop_reason"] = "refusal"
+	}
+
+	return safe
+}
+
+// HookOutputFirewalls evaluates the output firewalls against a response and returns the
+// response the client should receive: the original, or a refusal if it was blocked
+func HookOutputFirewalls(c *gin.Context, payload *request.Generate, response map[string]interface{}, config *Config) (map[string]interface{}, bool, error) {
+	auditWriter := c.MustGet("auditWriter").(*audit.Writer)
+	requestID := c.MustGet("requestID").(string)
+
+	result, err := RunOutput(c.Request.Context(), config.ForModel(payload.Model.Model).Firewalls, config.Aggregation, response, payload.Model)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(result.Events) == 0 {
+		return response, false, nil
+	}
+	result.tag(requestID, audit.PhaseOutput, 0)
+
+	if err := auditWriter.LogFirewallEvents(c.Request.Context(), result.Events); err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to log output firewall events", "error", err)
+	}
+
+	if result.Blocked {
+		logging.FromContext(c.Request.Context()).Info("response blocked by output firewall", "reason", result.Reason())
+		return refusal(response), true, nil
+	}
+
+	return response, false, nil
 }
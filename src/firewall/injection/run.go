@@ -0,0 +1,101 @@
+package injection
+
+import (
+	"context"
+	"covalence/src/logging"
+	"covalence/src/types"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// customWeight is the risk a configured pattern adds when it matches
+const customWeight = 0.8
+
+// embeddedFactor discounts a match in the middle of a sentence, which is more often a
+// quote or a discussion of an injection than an instruction
+const embeddedFactor = 0.7
+
+type pattern struct {
+	name   string
+	re     *regexp.Regexp
+	weight float32
+}
+
+// defaultPatterns are the classic override phrases, weighted by how rarely they
+// appear in legitimate requests
+var defaultPatterns = []pattern{
+	{"ignore-instructions", regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\s+(all\s+|any\s+)?(of\s+)?(the\s+|your\s+)?(previous|prior|above|earlier|preceding|original)\s+(instructions|prompts?|rules|directions|messages)`), 0.9},
+	{"reveal-system-prompt", regexp.MustCompile(`(?i)\b(reveal|show|print|repeat|output|tell)\s+(me\s+)?(your|the)\s+(system\s+prompt|(initial|original|hidden)\s+instructions|instructions\s+above)`), 0.8},
+	{"ask-system-prompt", regexp.MustCompile(`(?i)\bwhat\s+(is|are|was|were)\s+your\s+(system\s+prompt|(initial|original|hidden)\s+instructions)`), 0.7},
+	{"jailbreak-mode", regexp.MustCompile(`(?i)\b(developer|god|dan|jailbreak)\s+mode\b|\bdo\s+anything\s+now\b`), 0.7},
+	{"unrestricted-persona", regexp.MustCompile(`(?i)\b(pretend|act)\s+(to\s+be|as\s+if\s+you\s+are|as)\s+(an?\s+)?(unrestricted|unfiltered|uncensored|jailbroken)`), 0.7},
+	{"new-instructions", regexp.MustCompile(`(?i)\bnew\s+(system\s+)?instructions\s*:`), 0.6},
+	{"fake-system-turn", regexp.MustCompile(`(?im)^\s*(\[system\]|<\|?system\|?>|system\s*:)`), 0.6},
+	{"role-reassignment", regexp.MustCompile(`(?i)\byou\s+are\s+now\b|\bfrom\s+now\s+on,?\s+you\s+(will|must|are)\b`), 0.5},
+}
+
+// Patterns is the set of phrases the firewall looks for
+type Patterns struct {
+	patterns []pattern
+}
+
+// NewPatterns compiles the default patterns plus custom regular expressions from the
+// config. Custom patterns are matched case-insensitively.
+func NewPatterns(custom []string) (Patterns, error) {
+	patterns := append([]pattern{}, defaultPatterns...)
+	for i, expr := range custom {
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return Patterns{}, fmt.Errorf("invalid pattern %q: %w", expr, err)
+		}
+		patterns = append(patterns, pattern{name: fmt.Sprintf("custom-%d", i), re: re, weight: customWeight})
+	}
+	return Patterns{patterns: patterns}, nil
+}
+
+// Run scores a message by the injection patterns it matches. Each matching pattern
+// adds its weight, discounted if the match is embedded mid-sentence, and the weights
+// combine so that more matches approach a score of 1 without exceeding it. Only the
+// last message is scored.
+func Run(ctx context.Context, messages []types.Message, patterns Patterns, blockingThreshold float32) (bool, float32, error) {
+	content := messages[len(messages)-1].Content
+	logger := logging.FromContext(ctx).With("firewall", "injection")
+
+	safe := float32(1) // The chance that none of the matches is an injection
+	matched := []string{}
+	for _, p := range patterns.patterns {
+		loc := p.re.FindStringIndex(content)
+		if loc == nil {
+			continue
+		}
+
+		weight := p.weight
+		if !startsSentence(content, loc[0]) {
+			weight *= embeddedFactor
+		}
+		safe *= 1 - weight
+		matched = append(matched, p.name)
+	}
+
+	riskScore := 1 - safe
+	if len(matched) > 0 && riskScore > blockingThreshold {
+		logger.Info("blocking message matching injection patterns", "patterns", matched, "risk_score", riskScore, "threshold", blockingThreshold)
+		return false, riskScore, nil
+	}
+
+	return true, riskScore, nil
+}
+
+// startsSentence reports whether only whitespace and punctuation precede offset in its
+// line or sentence
+func startsSentence(content string, offset int) bool {
+	sentence := content[:offset]
+	if i := strings.LastIndexAny(sentence, "\n.!?"); i >= 0 {
+		sentence = sentence[i+1:]
+	}
+	return strings.TrimFunc(sentence, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) == ""
+}
@@ -0,0 +1,45 @@
+package length
+
+import (
+	"context"
+	"covalence/src/logging"
+	"covalence/src/tokenizer"
+	"covalence/src/types"
+)
+
+// Limits caps the size of a message. A zero limit is not checked.
+type Limits struct {
+	MaxChars  int
+	MaxTokens int
+}
+
+// Run blocks a message over either limit. The risk score is 0 within the limits and
+// approaches 1 the further over a limit the message is: twice the limit scores 0.5.
+// Only the last message is measured, in the tokens of the target model.
+func Run(ctx context.Context, messages []types.Message, target types.ModelID, limits Limits, tk tokenizer.Tokenizer) (bool, float32, error) {
+	content := messages[len(messages)-1].Content
+	logger := logging.FromContext(ctx).With("firewall", "length")
+
+	var riskScore float32
+	if limits.MaxChars > 0 {
+		riskScore = max(riskScore, overLimit(len([]rune(content)), limits.MaxChars))
+	}
+	if limits.MaxTokens > 0 {
+		riskScore = max(riskScore, overLimit(tk.CountText(target, content), limits.MaxTokens))
+	}
+
+	if riskScore > 0 {
+		logger.Info("blocking oversized message", "content_length", len(content), "risk_score", riskScore)
+		return false, riskScore, nil
+	}
+
+	return true, 0, nil
+}
+
+// overLimit scores how far count exceeds limit
+func overLimit(count, limit int) float32 {
+	if count <= limit {
+		return 0
+	}
+	return 1 - float32(limit)/float32(count)
+}
@@ -0,0 +1,36 @@
+package pii
+
+import (
+	"context"
+	"covalence/src/entities"
+	"covalence/src/logging"
+	"covalence/src/types"
+	"slices"
+)
+
+// Run blocks a message containing any of the detector's entities, returning the kinds
+// found. Each match adds its severity, and the severities combine so that more and more
+// severe matches approach a score of 1 without exceeding it. Only the last message is
+// scanned, with the same detection the audit log is redacted with.
+func Run(ctx context.Context, messages []types.Message, detector *entities.Detector) (bool, float32, []string, error) {
+	content := messages[len(messages)-1].Content
+	logger := logging.FromContext(ctx).With("firewall", "pii")
+
+	safe := float32(1) // The chance that none of the matches is sensitive
+	kinds := []string{}
+	for _, match := range detector.Find(content) {
+		safe *= 1 - match.Severity
+		if !slices.Contains(kinds, match.Kind) {
+			kinds = append(kinds, match.Kind)
+		}
+	}
+
+	riskScore := 1 - safe
+	if len(kinds) > 0 {
+		// Only the kinds are logged; the identifiers themselves must not be
+		logger.Info("blocking message containing sensitive identifiers", "entities", kinds, "risk_score", riskScore)
+		return false, riskScore, kinds, nil
+	}
+
+	return true, 0, nil, nil
+}
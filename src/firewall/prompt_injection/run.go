@@ -1,11 +1,12 @@
 package promptInjection
 
 import (
+	"context"
 	"covalence/src/internal"
 	textClassification "covalence/src/internal/text_classification"
+	"covalence/src/logging"
 	"covalence/src/types"
 	"covalence/src/utils"
-	"log"
 	"strings"
 )
 
@@ -13,35 +14,44 @@ var (
 	safeLabels = []string{"safe", "neutral", "benign"}
 )
 
-func Run(message types.Message, model internal.Model, blockingThreshold float32) (bool, error) {
-	content := message.Content
+// Run classifies the last message on its own; the earlier turns aren't needed to
+// recognise an injection attempt
+func Run(ctx context.Context, messages []types.Message, target types.ModelID, model internal.Model, blockingThreshold float32) (bool, float32, error) {
+	content := messages[len(messages)-1].Content
+	logger := logging.FromContext(ctx).With("firewall", "prompt-injection")
 
 	textClassificationRequest, err := textClassification.NewRequest(model, content)
 	if err != nil {
-		log.Printf("error creating text classification request: %v", err)
-		return false, err
+		logger.Error("failed to create text classification request", "error", err)
+		return false, 0, err
 	}
 
-	response, err := textClassificationRequest.Run()
+	response, err := textClassificationRequest.Run(ctx)
 	if err != nil {
-		log.Printf("error running text classification request: %v", err)
-		return false, err
+		logger.Error("failed to run text classification request", "error", err)
+		return false, 0, err
 	}
 
-	log.Printf("text classification response: %v", response)
+	logger.Debug("text classification response", "labels", response.Labels, "probabilities", response.Probabilities)
 
-	// Now, check if the response values are above the threshold. if they are, block the request
+	// The risk score is the highest probability assigned to any unsafe label
+	var riskScore float32
+	var riskLabel string
 	for i, label := range response.Labels {
 		if utils.Contains(safeLabels, strings.ToLower(label)) {
-			log.Printf("skipping safe label: %v", label)
 			continue // Skip safe labels (we only care about unsafe labels)
 		}
-		probability := response.Probabilities[i]
-		if probability > blockingThreshold {
-			log.Printf("blocking request due to high confidence label: %v (%v > %v)", label, probability, blockingThreshold)
-			return false, nil
+		if probability := response.Probabilities[i]; probability > riskScore {
+			riskScore = probability
+			riskLabel = label
 		}
 	}
 
-	return true, nil
+	// Block the request if the riskiest label is above the threshold
+	if riskScore > blockingThreshold {
+		logger.Info("blocking request due to high confidence label", "label", riskLabel, "risk_score", riskScore, "threshold", blockingThreshold)
+		return false, riskScore, nil
+	}
+
+	return true, riskScore, nil
 }
@@ -0,0 +1,86 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+
+	"covalence/src/audit"
+	"covalence/src/db/postgres"
+	"covalence/src/types"
+	"covalence/src/user"
+)
+
+// ReplayResult is what a firewall config would have decided for a stored request
+type ReplayResult struct {
+	Input  FirewallResult // The input firewalls run over the stored messages
+	Output FirewallResult // The output firewalls run over the stored response, if there was one
+}
+
+// Blocked reports whether the request or its response would have been blocked
+func (r ReplayResult) Blocked() bool {
+	return r.Input.Blocked || r.Output.Blocked
+}
+
+// ReplayTrace runs a stored request back through cfg, so a new firewall can be
+// backtested against historical traffic. No model provider is contacted and no request
+// rows are written; when record is set the events are logged against the original
+// request, tagged as replays so they never change how the request itself is reported.
+func ReplayTrace(ctx context.Context, requestID string, cfg Config, db *postgres.DB, record bool) (ReplayResult, error) {
+	trace, err := audit.GetTrace(ctx, requestID, db)
+	if err != nil {
+		return ReplayResult{}, fmt.Errorf("failed to load trace: %w", err)
+	}
+
+	if !trace.Sampled {
+		return ReplayResult{}, fmt.Errorf("request %s was sampled out, so its inputs were not kept", requestID)
+	}
+
+	model, err := types.NewModelID(trace.Model)
+	if err != nil {
+		return ReplayResult{}, fmt.Errorf("invalid stored model: %w", err)
+	}
+
+	messages := make([]types.Message, 0, len(trace.Inputs))
+	for i, input := range trace.Inputs {
+		message, err := types.NewMessageFromJson(input)
+		if err != nil {
+			return ReplayResult{}, fmt.Errorf("invalid stored input %d: %w", i, err)
+		}
+		messages = append(messages, message)
+	}
+
+	cfg = cfg.ForModel(model)
+
+	// Traces don't record the provider, so length firewalls estimate tokens
+	target := user.Model{Model: model}
+
+	var result ReplayResult
+	result.Input, err = RunAll(ctx, cfg.InputFirewalls(), cfg.Aggregation, messages, target)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	if trace.Response != nil {
+		result.Output, err = RunOutput(ctx, cfg.Firewalls, cfg.Aggregation, trace.Response, target)
+		if err != nil {
+			return ReplayResult{}, err
+		}
+	}
+
+	if !record {
+		return result, nil
+	}
+
+	result.Input.tag(requestID, audit.PhaseInput, 0)
+	result.Output.tag(requestID, audit.PhaseOutput, 0)
+	events := append(append([]audit.FirewallEvent{}, result.Input.Events...), result.Output.Events...)
+	for i := range events {
+		events[i].Replay = true
+	}
+
+	if err := audit.LogFirewallEvents(ctx, events, db); err != nil {
+		return result, fmt.Errorf("failed to log replay firewall events: %w", err)
+	}
+
+	return result, nil
+}
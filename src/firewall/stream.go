@@ -0,0 +1,112 @@
+package firewall
+
+import (
+	"context"
+
+	"covalence/src/audit"
+	"covalence/src/logging"
+	"covalence/src/request"
+	"covalence/src/types"
+	"covalence/src/user"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamGuard runs the output firewalls over a streamed response a window at a time.
+// The caller holds back streamed events until the window containing them has passed.
+type StreamGuard struct {
+	firewalls   []Firewall
+	aggregation Aggregation
+	model       user.Model
+	stream      StreamConfig
+	auditWriter *audit.Writer
+	requestID   string
+
+	overlap []rune // The end of the last window, evaluated again with the next
+	pending []rune // Content not yet evaluated
+	windows int    // Windows evaluated so far
+}
+
+// NewStreamGuard returns a guard for a streamed response, or nil if no output firewalls
+// apply to the request's model
+func NewStreamGuard(c *gin.Context, payload *request.Generate, config *Config) *StreamGuard {
+	firewalls := config.ForModel(payload.Model.Model).OutputFirewalls()
+	if len(firewalls) == 0 {
+		return nil
+	}
+
+	return &StreamGuard{
+		firewalls:   firewalls,
+		aggregation: config.Aggregation,
+		model:       payload.Model,
+		stream:      config.Stream,
+		auditWriter: c.MustGet("auditWriter").(*audit.Writer),
+		requestID:   c.MustGet("requestID").(string),
+	}
+}
+
+// Add takes a streamed chunk and evaluates a window once enough content has built up.
+// It reports whether a window was evaluated, so the events held back so far can be
+// released if it wasn't blocked.
+func (g *StreamGuard) Add(ctx context.Context, chunk map[string]interface{}) (FirewallResult, bool, error) {
+	g.pending = append(g.pending, []rune(streamChunkText(chunk))...)
+	if len(g.overlap)+len(g.pending) < g.stream.Window {
+		return FirewallResult{}, false, nil
+	}
+
+	result, err := g.evaluate(ctx)
+	return result, true, err
+}
+
+// Flush evaluates whatever content is left once the stream has ended
+func (g *StreamGuard) Flush(ctx context.Context) (FirewallResult, error) {
+	if len(g.pending) == 0 {
+		return FirewallResult{}, nil
+	}
+	return g.evaluate(ctx)
+}
+
+func (g *StreamGuard) evaluate(ctx context.Context) (FirewallResult, error) {
+	window := append(append([]rune{}, g.overlap...), g.pending...)
+	g.pending = nil
+	g.overlap = append([]rune{}, window[max(0, len(window)-g.stream.Overlap):]...)
+
+	messages := []types.Message{{Role: types.AssistantRole(), Content: string(window)}}
+	result, err := RunAll(ctx, g.firewalls, g.aggregation, messages, g.model)
+	if err != nil {
+		return FirewallResult{}, err
+	}
+	g.windows++
+	result.tag(g.requestID, audit.PhaseStream, g.windows)
+
+	if err := g.auditWriter.LogFirewallEvents(ctx, result.Events); err != nil {
+		logging.FromContext(ctx).Error("failed to log streamed output firewall events", "error", err)
+	}
+
+	return result, nil
+}
+
+// streamChunkText extracts the generated text of a streamed chunk. Both OpenAI
+// (choices[].delta.content) and Anthropic (content_block_delta) events are read.
+func streamChunkText(chunk map[string]interface{}) string {
+	text := ""
+
+	if choices, ok := chunk["choices"].([]interface{}); ok {
+		for _, raw := range choices {
+			choice, _ := raw.(map[string]interface{})
+			delta, _ := choice["delta"].(map[string]interface{})
+			if content, ok := delta["content"].(string); ok {
+				text += content
+			}
+		}
+	}
+
+	if chunk["type"] == "content_block_delta" {
+		delta, _ := chunk["delta"].(map[string]interface{})
+		if content, ok := delta["text"].(string); ok {
+			text += content
+		}
+	}
+
+	return text
+}
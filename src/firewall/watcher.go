@@ -0,0 +1,100 @@
+package firewall
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ConfigWatcher reloads a firewall config whenever its file changes. A config that
+// fails to load is rejected and the previous one stays active.
+type ConfigWatcher struct {
+	path    string
+	current atomic.Pointer[Config]
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// NewConfigWatcher loads the config at path and starts watching it for changes
+func NewConfigWatcher(path string) (*ConfigWatcher, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+
+	// Watch the directory rather than the file, since editors and config management
+	// often replace the file with a rename, which drops a watch on the file itself
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+
+	w := &ConfigWatcher{
+		path:    filepath.Clean(path),
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+	w.current.Store(&cfg)
+
+	go w.run()
+
+	return w, nil
+}
+
+// Current returns the active config. Callers should hold on to the returned pointer
+// for the duration of a request so they see a consistent snapshot.
+func (w *ConfigWatcher) Current() *Config {
+	return w.current.Load()
+}
+
+// Close stops watching the config file
+func (w *ConfigWatcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+func (w *ConfigWatcher) run() {
+	defer close(w.done)
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != w.path {
+				continue
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			w.reload()
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("firewall config watcher error", "error", err)
+		}
+	}
+}
+
+func (w *ConfigWatcher) reload() {
+	cfg, err := LoadConfig(w.path)
+	if err != nil {
+		slog.Error("rejected firewall config reload, keeping previous config", "path", w.path, "error", err)
+		return
+	}
+
+	w.current.Store(&cfg)
+	slog.Info("reloaded firewall config", "path", w.path, "firewalls", len(cfg.Firewalls))
+}
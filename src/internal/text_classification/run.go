@@ -2,6 +2,7 @@ package textClassification
 
 import (
 	"bytes"
+	"context"
 	"covalence/src/internal"
 	"covalence/src/types"
 	"encoding/json"
@@ -48,7 +49,7 @@ func (m Request) ToMap() map[string]interface{} {
 	return requestMap
 }
 
-func (m Request) Run() (Response, error) {
+func (m Request) Run(ctx context.Context) (Response, error) {
 	// Start with required parameters
 	requestMap := m.ToMap()
 	url := API_URL
@@ -62,7 +63,7 @@ func (m Request) Run() (Response, error) {
 	log.Printf("sending request to %s", url)
 
 	// Create a new HTTP POST request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return Response{}, errors.New("failed to create HTTP request: " + err.Error())
 	}
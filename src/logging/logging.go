@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type loggerKey struct{}
+
+// New returns a JSON logger writing to stdout. LOG_LEVEL (debug, info, warn or error)
+// sets the minimum level, which is info by default.
+func New() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(os.Getenv("LOG_LEVEL")))); err != nil {
+		level = slog.LevelInfo
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+}
+
+// WithRequest returns a context whose logger tags every line with the request's audit
+// ID, user and model, so one request can be followed through the logs and the audit DB
+func WithRequest(ctx context.Context, requestID, userID, model string) context.Context {
+	logger := FromContext(ctx).With(
+		slog.String("request_id", requestID),
+		slog.String("user_id", userID),
+		slog.String("model", model),
+	)
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger if there is none
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
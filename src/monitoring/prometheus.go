@@ -0,0 +1,304 @@
+package monitoring
+
+import (
+	"net/http"
+	"strconv"
+
+	"covalence/src/audit"
+	"covalence/src/db/postgres"
+	"covalence/src/register"
+	"covalence/src/request"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	// Latencies span from sub-millisecond gateway work to minute-long generations
+	latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "covalence_requests_total",
+		Help: "Generate requests handled, by model and response status.",
+	}, []string{"name", "model", "status"})
+
+	streamingTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "covalence_requests_streaming_total",
+		Help: "Generate requests by whether the response was streamed.",
+	}, []string{"name", "model", "streaming"})
+
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "covalence_tokens_total",
+		Help: "Tokens consumed by generate requests, by direction (input or output).",
+	}, []string{"name", "model", "direction"})
+
+	// Not labelled by API key, which would add a series per key; the audit log has the key
+	rateLimitedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "covalence_requests_rate_limited_total",
+		Help: "Generate requests rejected for exceeding their API key's rate limit.",
+	})
+
+	totalLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "covalence_request_duration_seconds",
+		Help:    "Total time spent processing a generate request.",
+		Buckets: latencyBuckets,
+	}, []string{"name", "model"})
+
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "covalence_request_upstream_latency_seconds",
+		Help:    "Time spent waiting on the model provider.",
+		Buckets: latencyBuckets,
+	}, []string{"name", "model"})
+
+	queueTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "covalence_request_queue_seconds",
+		Help:    "Time a request waited between being accepted and processing starting.",
+		Buckets: latencyBuckets,
+	}, []string{"name", "model"})
+
+	gatewayOverhead = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "covalence_request_gateway_overhead_seconds",
+		Help:    "Time spent in the gateway itself, excluding the provider.",
+		Buckets: latencyBuckets,
+	}, []string{"name", "model"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		streamingTotal,
+		tokensTotal,
+		rateLimitedTotal,
+		totalLatency,
+		upstreamLatency,
+		queueTime,
+		gatewayOverhead,
+	)
+}
+
+// Record publishes the metrics of a finished request
+func Record(m request.Metrics) {
+	name, model := m.Name.String(), m.Model.String()
+
+	requestsTotal.WithLabelValues(name, model, strconv.Itoa(m.StatusCode)).Inc()
+	streamingTotal.WithLabelValues(name, model, strconv.FormatBool(m.StreamingResponse)).Inc()
+	tokensTotal.WithLabelValues(name, model, "input").Add(float64(m.InputTokens))
+	tokensTotal.WithLabelValues(name, model, "output").Add(float64(m.OutputTokens))
+	totalLatency.WithLabelValues(name, model).Observe(m.TotalProcessTime.Seconds())
+	queueTime.WithLabelValues(name, model).Observe(m.QueueTime.Seconds())
+
+	// Requests rejected before reaching the provider have no upstream timing
+	if m.UpstreamLatency > 0 {
+		upstreamLatency.WithLabelValues(name, model).Observe(m.UpstreamLatency.Seconds())
+		gatewayOverhead.WithLabelValues(name, model).Observe(m.GatewayOverhead().Seconds())
+	}
+}
+
+// RecordRateLimited counts a request rejected by the rate limiter
+func RecordRateLimited() {
+	rateLimitedTotal.Inc()
+}
+
+// Handler serves the registered metrics for Prometheus to scrape
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+var modelHealthDesc = prometheus.NewDesc(
+	"covalence_model_healthy",
+	"Whether a backend of a registered model is passing its health checks (1) or not (0).",
+	[]string{"backend"}, nil,
+)
+
+// healthCollector reads backend health at scrape time
+type healthCollector struct {
+	snapshot func() map[string]register.HealthStatus
+}
+
+func (h healthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- modelHealthDesc
+}
+
+func (h healthCollector) Collect(ch chan<- prometheus.Metric) {
+	for backend, status := range h.snapshot() {
+		value := 0.0
+		if status.Healthy {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(modelHealthDesc, prometheus.GaugeValue, value, backend)
+	}
+}
+
+var circuitStateDesc = prometheus.NewDesc(
+	"covalence_circuit_state",
+	"Circuit breaker state per backend: closed (0), half-open (1) or open (2).",
+	[]string{"backend"}, nil,
+)
+
+// breakerCollector reads circuit breaker states at scrape time
+type breakerCollector struct {
+	snapshot func() map[string]register.BreakerState
+}
+
+func (b breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- circuitStateDesc
+}
+
+func (b breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	for backend, state := range b.snapshot() {
+		ch <- prometheus.MustNewConstMetric(circuitStateDesc, prometheus.GaugeValue, float64(state), backend)
+	}
+}
+
+// WatchBreakers publishes the circuit breaker state of every backend that has been called
+func WatchBreakers(breakers *register.Breakers) {
+	registry.MustRegister(breakerCollector{snapshot: breakers.Snapshot})
+}
+
+var inFlightDesc = prometheus.NewDesc(
+	"covalence_upstream_in_flight",
+	"Requests currently in flight to each backend.",
+	[]string{"backend"}, nil,
+)
+
+// limiterCollector reads in-flight counts at scrape time
+type limiterCollector struct {
+	snapshot func() map[string]int
+}
+
+func (l limiterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- inFlightDesc
+}
+
+func (l limiterCollector) Collect(ch chan<- prometheus.Metric) {
+	for backend, inFlight := range l.snapshot() {
+		ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(inFlight), backend)
+	}
+}
+
+// WatchLimiters publishes the requests in flight to every backend that has been called
+func WatchLimiters(limiters *register.Limiters) {
+	registry.MustRegister(limiterCollector{snapshot: limiters.Snapshot})
+}
+
+// WatchAuditWriter publishes how many audit entries were dropped because its buffer was full
+func WatchAuditWriter(writer *audit.Writer) {
+	registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "covalence_audit_dropped_total",
+		Help: "Audit entries dropped because the write buffer was full.",
+	}, func() float64 {
+		return float64(writer.Dropped())
+	}))
+}
+
+// WatchHealth publishes the health of every backend the checker has probed
+func WatchHealth(checker *register.HealthChecker) {
+	registry.MustRegister(healthCollector{snapshot: checker.Snapshot})
+}
+
+var (
+	poolConnsDesc = prometheus.NewDesc(
+		"covalence_db_pool_connections",
+		"Database connections by state: acquired, idle or constructing.",
+		[]string{"state"}, nil,
+	)
+	poolMaxConnsDesc = prometheus.NewDesc(
+		"covalence_db_pool_max_connections",
+		"The most connections the database pool will open.",
+		nil, nil,
+	)
+	poolWaitsDesc = prometheus.NewDesc(
+		"covalence_db_pool_waits_total",
+		"Acquires that found no idle database connection and had to wait for one.",
+		nil, nil,
+	)
+	poolWaitSecondsDesc = prometheus.NewDesc(
+		"covalence_db_pool_wait_seconds_total",
+		"Time spent waiting for a database connection.",
+		nil, nil,
+	)
+	poolCanceledDesc = prometheus.NewDesc(
+		"covalence_db_pool_canceled_acquires_total",
+		"Acquires of a database connection given up on before one was free.",
+		nil, nil,
+	)
+)
+
+// poolCollector reads database pool stats at scrape time
+type poolCollector struct {
+	stats func() postgres.PoolStats
+}
+
+func (p poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolConnsDesc
+	ch <- poolMaxConnsDesc
+	ch <- poolWaitsDesc
+	ch <- poolWaitSecondsDesc
+	ch <- poolCanceledDesc
+}
+
+func (p poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := p.stats()
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stats.Acquired), "acquired")
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stats.Idle), "idle")
+	ch <- prometheus.MustNewConstMetric(poolConnsDesc, prometheus.GaugeValue, float64(stats.Constructing), "constructing")
+	ch <- prometheus.MustNewConstMetric(poolMaxConnsDesc, prometheus.GaugeValue, float64(stats.Max))
+	ch <- prometheus.MustNewConstMetric(poolWaitsDesc, prometheus.CounterValue, float64(stats.Waits))
+	ch <- prometheus.MustNewConstMetric(poolWaitSecondsDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(poolCanceledDesc, prometheus.CounterValue, float64(stats.CanceledAcquires))
+}
+
+// WatchDatabase publishes the saturation of the database connection pool
+func WatchDatabase(db *postgres.DB) {
+	registry.MustRegister(poolCollector{stats: db.Stats})
+}
+
+var (
+	archiveBacklogDesc = prometheus.NewDesc(
+		"covalence_archive_backlog",
+		"Requests old enough to archive that have not been archived yet.",
+		nil, nil,
+	)
+	archiveTracesDesc = prometheus.NewDesc(
+		"covalence_archive_traces_total",
+		"Traces handled by the archive worker by outcome: archived, skipped or failed.",
+		[]string{"outcome"}, nil,
+	)
+	archiveLastPassDesc = prometheus.NewDesc(
+		"covalence_archive_last_pass_timestamp_seconds",
+		"When the archive worker last finished a pass over the backlog.",
+		nil, nil,
+	)
+)
+
+// archiveCollector reads archive worker progress at scrape time
+type archiveCollector struct {
+	progress func() audit.ArchiveProgress
+}
+
+func (a archiveCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- archiveBacklogDesc
+	ch <- archiveTracesDesc
+	ch <- archiveLastPassDesc
+}
+
+func (a archiveCollector) Collect(ch chan<- prometheus.Metric) {
+	progress := a.progress()
+	ch <- prometheus.MustNewConstMetric(archiveBacklogDesc, prometheus.GaugeValue, float64(progress.Backlog))
+	ch <- prometheus.MustNewConstMetric(archiveTracesDesc, prometheus.CounterValue, float64(progress.Archived), "archived")
+	ch <- prometheus.MustNewConstMetric(archiveTracesDesc, prometheus.CounterValue, float64(progress.Skipped), "skipped")
+	ch <- prometheus.MustNewConstMetric(archiveTracesDesc, prometheus.CounterValue, float64(progress.Failed), "failed")
+	if !progress.LastPass.IsZero() {
+		ch <- prometheus.MustNewConstMetric(archiveLastPassDesc, prometheus.GaugeValue, float64(progress.LastPass.Unix()))
+	}
+}
+
+// WatchArchiveWorker publishes the archive backlog and the worker's progress through it
+func WatchArchiveWorker(worker *audit.ArchiveWorker) {
+	registry.MustRegister(archiveCollector{progress: worker.Progress})
+}
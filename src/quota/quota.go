@@ -0,0 +1,193 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"covalence/src/audit"
+	"covalence/src/db/postgres"
+)
+
+// Period is how the billing period a quota covers is bounded
+type Period string
+
+const (
+	// CalendarMonth resets usage at the start of each UTC month
+	CalendarMonth Period = "calendar_month"
+	// Rolling30Days counts usage over the 30 days before each request
+	Rolling30Days Period = "rolling_30_days"
+)
+
+// NewPeriod validates a configured billing period
+func NewPeriod(period string) (Period, error) {
+	switch p := Period(period); p {
+	case CalendarMonth, Rolling30Days:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid quota period %q (must be %s or %s)", period, CalendarMonth, Rolling30Days)
+}
+
+// Start returns when the billing period containing now began
+func (p Period) Start(now time.Time) time.Time {
+	if p == Rolling30Days {
+		return now.AddDate(0, 0, -30)
+	}
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Config sets the tokens each user may spend per billing period
+type Config struct {
+	Tokens int64
+	Period Period
+	// How long a cached total is trusted before it is summed from the audit log again,
+	// picking up usage recorded by other instances and usage leaving a rolling period
+	TTL time.Duration
+}
+
+func (c Config) validate() error {
+	if c.Tokens <= 0 {
+		return errors.New("quota tokens must be positive")
+	}
+	if _, err := NewPeriod(string(c.Period)); err != nil {
+		return err
+	}
+	if c.TTL <= 0 {
+		return errors.New("quota ttl must be positive")
+	}
+	return nil
+}
+
+// Decision is the outcome of checking a user's quota
+type Decision struct {
+	Allowed bool
+	Used    int64
+	Limit   int64
+}
+
+type total struct {
+	tokens      int64
+	periodStart time.Time
+	loadedAt    time.Time
+}
+
+// load tracks the tokens recorded for a user while their total is being summed. The
+// sum may have been taken before those responses reached the audit log, so they are
+// added to it rather than lost when it replaces the cached total.
+type load struct {
+	recorded int64
+	loaders  int // Checks summing the user's usage at once
+}
+
+// Checker enforces the quota, caching each user's running total so the usage
+// aggregate isn't run for every request
+type Checker struct {
+	config Config
+	db     *postgres.DB
+
+	mu        sync.Mutex
+	totals    map[string]*total
+	loads     map[string]*load
+	lastSweep time.Time
+}
+
+// NewChecker creates a quota checker summing usage from db
+func NewChecker(config Config, db *postgres.DB) (*Checker, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &Checker{
+		config:    config,
+		db:        db,
+		totals:    make(map[string]*total),
+		loads:     make(map[string]*load),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+// Check reports whether the user has tokens left in the current billing period
+func (q *Checker) Check(ctx context.Context, userID string) (Decision, error) {
+	now := time.Now()
+	start := q.config.Period.Start(now)
+
+	q.mu.Lock()
+	q.sweep(now)
+	var used int64
+	t, ok := q.totals[userID]
+	ok = ok && q.fresh(t, now, start)
+	var l *load
+	if ok {
+		used = t.tokens
+	} else {
+		if l = q.loads[userID]; l == nil {
+			l = &load{}
+			q.loads[userID] = l
+		}
+		l.loaders++
+	}
+	q.mu.Unlock()
+
+	if !ok {
+		usage, err := audit.GetTokenUsage(ctx, userID, start, now, q.db)
+
+		q.mu.Lock()
+		if l.loaders--; l.loaders == 0 {
+			delete(q.loads, userID)
+		}
+		if err == nil {
+			used = usage.TotalTokens + l.recorded
+			q.totals[userID] = &total{tokens: used, periodStart: start, loadedAt: now}
+		}
+		q.mu.Unlock()
+
+		if err != nil {
+			return Decision{}, err
+		}
+	}
+
+	return Decision{Allowed: used < q.config.Tokens, Used: used, Limit: q.config.Tokens}, nil
+}
+
+// Record adds the tokens of a logged response to the user's cached total, and to the
+// total being summed if a check is loading it
+func (q *Checker) Record(userID string, tokens int64) {
+	if tokens <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t, ok := q.totals[userID]; ok {
+		t.tokens += tokens
+	}
+	if l, ok := q.loads[userID]; ok {
+		l.recorded += tokens
+	}
+}
+
+// fresh reports whether a cached total can still be trusted. A total from the previous
+// calendar month is stale even within the TTL, since the new month starts from zero.
+func (q *Checker) fresh(t *total, now, start time.Time) bool {
+	if now.Sub(t.loadedAt) > q.config.TTL {
+		return false
+	}
+	return q.config.Period != CalendarMonth || t.periodStart.Equal(start)
+}
+
+// sweep drops totals past their TTL, since they would be summed again anyway.
+// Callers must hold the lock.
+func (q *Checker) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < q.config.TTL {
+		return
+	}
+	q.lastSweep = now
+
+	for userID, t := range q.totals {
+		if now.Sub(t.loadedAt) > q.config.TTL {
+			delete(q.totals, userID)
+		}
+	}
+}
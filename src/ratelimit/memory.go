@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have refilled completely are dropped
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryLimiter keeps buckets in process. Limits are per instance.
+type MemoryLimiter struct {
+	config Config
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryLimiter creates an in-process limiter
+func NewMemoryLimiter(config Config) (*MemoryLimiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &MemoryLimiter{
+		config:    config,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}, nil
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	now := time.Now()
+	rate, burst := l.config.rate(), float64(l.config.Burst)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return Decision{RetryAfter: retryAfter(b.tokens, rate)}, nil
+	}
+	b.tokens--
+	return Decision{Allowed: true}, nil
+}
+
+// sweep drops buckets that would be full by now, since a new bucket is identical.
+// Callers must hold the lock.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	rate, burst := l.config.rate(), float64(l.config.Burst)
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Config sets the sustained rate and burst allowed for each key
+type Config struct {
+	RequestsPerMinute int
+	Burst             int // Largest number of requests allowed at once; the bucket size
+}
+
+func (c Config) validate() error {
+	if c.RequestsPerMinute <= 0 {
+		return errors.New("requests per minute must be positive")
+	}
+	if c.Burst <= 0 {
+		return errors.New("burst must be positive")
+	}
+	return nil
+}
+
+// rate is the number of tokens added to a bucket per second
+func (c Config) rate() float64 {
+	return float64(c.RequestsPerMinute) / 60
+}
+
+// Decision is the outcome of asking a limiter to admit a request
+type Decision struct {
+	Allowed bool
+	// How long until a request would be admitted; zero when Allowed
+	RetryAfter time.Duration
+}
+
+// Limiter admits requests using a token bucket per key. Implementations decide where
+// bucket state lives, so limits can be shared across instances.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (Decision, error)
+}
+
+// retryAfter is how long a bucket holding tokens needs to refill to one token
+func retryAfter(tokens, rate float64) time.Duration {
+	return time.Duration((1 - tokens) / rate * float64(time.Second))
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript refills and takes from a bucket atomically. It returns whether the
+// request was allowed and the tokens left, as a string to keep the fraction.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "last", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+
+return {allowed, tostring(tokens)}
+`)
+
+// RedisLimiter keeps buckets in Redis so every instance shares the same limits
+type RedisLimiter struct {
+	client *redis.Client
+	config Config
+	prefix string
+}
+
+// NewRedisLimiter creates a limiter storing buckets under "ratelimit:<key>"
+func NewRedisLimiter(client *redis.Client, config Config) (*RedisLimiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &RedisLimiter{client: client, config: config, prefix: "ratelimit:"}, nil
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string) (Decision, error) {
+	rate := l.config.rate()
+	now := float64(time.Now().UnixMicro()) / 1e6
+
+	result, err := tokenBucketScript.Run(ctx, l.client, []string{l.prefix + key}, rate, l.config.Burst, now).Slice()
+	if err != nil {
+		return Decision{}, err
+	}
+
+	if allowed, _ := result[0].(int64); allowed == 1 {
+		return Decision{Allowed: true}, nil
+	}
+
+	tokens, err := strconv.ParseFloat(result[1].(string), 64)
+	if err != nil {
+		return Decision{}, err
+	}
+	return Decision{RetryAfter: retryAfter(tokens, rate)}, nil
+}
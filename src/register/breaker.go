@@ -0,0 +1,192 @@
+package register
+
+import (
+	"covalence/src/user"
+	"log"
+	"sync"
+	"time"
+)
+
+// BreakerState is the position of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every call through while tracking failures
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a single probe through to test recovery
+	BreakerHalfOpen
+	// BreakerOpen fails calls immediately until the cooldown passes
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// Breaker is a circuit breaker for one backend. It tracks the outcome of the last
+// MinRequests calls and opens once the failure rate reaches the threshold.
+type Breaker struct {
+	backend string
+	config  user.BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	outcomes []bool // Ring buffer of recent calls, true for failures
+	next     int
+	filled   int
+	failures int
+	openedAt time.Time
+	probedAt time.Time // When the half-open probe was let through
+}
+
+func newBreaker(backend string, config user.BreakerConfig) *Breaker {
+	if config.MinRequests <= 0 {
+		config = user.DefaultBreakerConfig()
+	}
+	return &Breaker{
+		backend:  backend,
+		config:   config,
+		outcomes: make([]bool, config.MinRequests),
+	}
+}
+
+// Allow reports whether a call may be made now. While half-open only one probe is
+// let through per cooldown, so a probe whose outcome is never recorded can't wedge
+// the breaker.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.openedAt) < b.config.Cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probedAt = now
+		log.Printf("circuit for %s half-open, probing", b.backend)
+		return true
+	case BreakerHalfOpen:
+		if now.Sub(b.probedAt) < b.config.Cooldown {
+			return false
+		}
+		b.probedAt = now
+		return true
+	}
+	return true
+}
+
+// Record reports the outcome of a call let through by Allow
+func (b *Breaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+		b.state = BreakerClosed
+		b.reset()
+		log.Printf("circuit for %s closed after a successful probe", b.backend)
+		return
+	case BreakerOpen:
+		// A call admitted before the circuit opened; it doesn't change anything
+		return
+	}
+
+	if b.filled == len(b.outcomes) && b.outcomes[b.next] {
+		b.failures--
+	}
+	b.outcomes[b.next] = failed
+	if failed {
+		b.failures++
+	}
+	b.next = (b.next + 1) % len(b.outcomes)
+	b.filled = min(b.filled+1, len(b.outcomes))
+
+	if b.filled >= b.config.MinRequests && float64(b.failures)/float64(b.filled) >= b.config.FailureRate {
+		b.open()
+	}
+}
+
+// open trips the breaker. Callers must hold the lock.
+func (b *Breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.reset()
+	log.Printf("circuit for %s opened for %s", b.backend, b.config.Cooldown)
+}
+
+// reset forgets recorded outcomes. Callers must hold the lock.
+func (b *Breaker) reset() {
+	clear(b.outcomes)
+	b.next, b.filled, b.failures = 0, 0, 0
+}
+
+// State returns the current position of the breaker
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Breakers holds a circuit breaker per backend of each model
+type Breakers struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// NewBreakers creates an empty set of breakers
+func NewBreakers() *Breakers {
+	return &Breakers{breakers: make(map[string]*Breaker)}
+}
+
+// For returns the breaker for a model's backend, creating it with the model's config.
+// Each model has its own breaker even when several share a provider URL.
+func (s *Breakers) For(model user.Model) *Breaker {
+	backend := backendKey(model)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.breakers[backend]
+	if !ok {
+		b = newBreaker(backend, model.Breaker)
+		s.breakers[backend] = b
+	}
+	return b
+}
+
+// forget drops the breakers of backends that are no longer registered, so a model
+// registered again under the name starts with its new config
+func (s *Breakers) forget(backends []user.Model) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, backend := range backends {
+		delete(s.breakers, backendKey(backend))
+	}
+}
+
+// Snapshot returns the state of every backend's breaker, keyed by name@api_url
+func (s *Breakers) Snapshot() map[string]BreakerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]BreakerState, len(s.breakers))
+	for backend, b := range s.breakers {
+		snapshot[backend] = b.State()
+	}
+	return snapshot
+}
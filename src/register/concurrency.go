@@ -0,0 +1,138 @@
+package register
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"covalence/src/user"
+)
+
+// ErrSaturated is returned when a backend is at its concurrency limit and the request
+// can't wait, or waited as long as it may
+var ErrSaturated = errors.New("backend concurrency limit reached")
+
+// Limiter caps the requests in flight to one backend
+type Limiter struct {
+	config user.ConcurrencyConfig
+	slots  chan struct{} // Nil when the backend is unlimited
+
+	mu       sync.Mutex
+	inFlight int
+}
+
+func newLimiter(config user.ConcurrencyConfig) *Limiter {
+	l := &Limiter{config: config}
+	if config.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, config.MaxInFlight)
+	}
+	return l
+}
+
+// Acquire takes a slot for a request, waiting for one under the wait policy. The
+// returned release must be called once the response has been read; it is safe to
+// call more than once.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.config.Policy != user.ConcurrencyWait {
+				return nil, ErrSaturated
+			}
+			if err := l.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	l.mu.Lock()
+	l.inFlight++
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.inFlight--
+			l.mu.Unlock()
+			if l.slots != nil {
+				<-l.slots
+			}
+		})
+	}, nil
+}
+
+func (l *Limiter) wait(ctx context.Context) error {
+	timer := time.NewTimer(l.config.MaxWait)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrSaturated
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// InFlight returns the number of requests currently holding a slot
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Limiters holds a concurrency limiter per backend of each model
+type Limiters struct {
+	mu       sync.Mutex
+	limiters map[string]*Limiter
+}
+
+// NewLimiters creates an empty set of limiters
+func NewLimiters() *Limiters {
+	return &Limiters{limiters: make(map[string]*Limiter)}
+}
+
+// For returns the limiter for a model's backend, creating it with the model's config.
+// Each model has its own limiter even when several share a provider URL.
+func (s *Limiters) For(model user.Model) *Limiter {
+	backend := backendKey(model)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.limiters[backend]
+	if !ok {
+		l = newLimiter(model.Concurrency)
+		s.limiters[backend] = l
+	}
+	return l
+}
+
+// forget drops the limiters of backends that are no longer registered, so a model
+// registered again under the name starts with its new config. Requests still holding
+// a slot release it on the old limiter.
+func (s *Limiters) forget(backends []user.Model) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, backend := range backends {
+		delete(s.limiters, backendKey(backend))
+	}
+}
+
+// Snapshot returns the requests in flight to every backend that has been called, keyed
+// by name@api_url
+func (s *Limiters) Snapshot() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]int, len(s.limiters))
+	for backend, l := range s.limiters {
+		snapshot[backend] = l.InFlight()
+	}
+	return snapshot
+}
@@ -0,0 +1,189 @@
+package register
+
+import (
+	"context"
+	"covalence/src/user"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthStatus is the last known health of one backend of a registered model
+type HealthStatus struct {
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	LastChecked          time.Time `json:"last_checked"`
+	LastError            string    `json:"last_error,omitempty"`
+}
+
+// HealthChecker periodically probes every backend of every registered model. A backend
+// is marked unhealthy after FailureThreshold consecutive failed probes and only marked
+// healthy again after RecoveryThreshold consecutive successful ones.
+type HealthChecker struct {
+	registry          *Registry
+	client            *http.Client
+	interval          time.Duration
+	failureThreshold  int
+	recoveryThreshold int
+
+	mu     sync.RWMutex
+	status map[string]*HealthStatus // By backendKey
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewHealthChecker creates a checker for the models in registry. Call Start to begin probing.
+func NewHealthChecker(registry *Registry, client *http.Client, interval time.Duration, failureThreshold, recoveryThreshold int) *HealthChecker {
+	return &HealthChecker{
+		registry:          registry,
+		client:            client,
+		interval:          interval,
+		failureThreshold:  max(failureThreshold, 1),
+		recoveryThreshold: max(recoveryThreshold, 1),
+		status:            make(map[string]*HealthStatus),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+}
+
+// Start probes all models every interval until Stop is called
+func (h *HealthChecker) Start() {
+	go func() {
+		defer close(h.done)
+
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				h.CheckAll()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends probing and waits for an in-progress round to finish
+func (h *HealthChecker) Stop() {
+	close(h.stop)
+	<-h.done
+}
+
+// CheckAll probes every registered backend once. Backends sharing a provider URL
+// share a probe.
+func (h *HealthChecker) CheckAll() {
+	h.registry.Mu.RLock()
+	targets := make(map[string][]string)
+	for _, backends := range h.registry.Backends {
+		for _, backend := range backends {
+			target := backend.APIURL.String()
+			targets[target] = append(targets[target], backendKey(backend))
+		}
+	}
+	h.registry.Mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for target, keys := range targets {
+		wg.Add(1)
+		go func(target string, keys []string) {
+			defer wg.Done()
+			err := h.probe(target)
+			for _, key := range keys {
+				h.record(key, err)
+			}
+		}(target, keys)
+	}
+	wg.Wait()
+}
+
+// probe makes a lightweight request to a provider. Any response below 500, including
+// auth errors, shows the provider is up.
+func (h *HealthChecker) probe(target string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("provider returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *HealthChecker) record(key string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.status[key]
+	if !ok {
+		s = &HealthStatus{Healthy: true}
+		h.status[key] = s
+	}
+	s.LastChecked = time.Now()
+
+	if err != nil {
+		s.ConsecutiveFailures++
+		s.ConsecutiveSuccesses = 0
+		s.LastError = err.Error()
+		if s.Healthy && s.ConsecutiveFailures >= h.failureThreshold {
+			s.Healthy = false
+			log.Printf("backend %s marked unhealthy after %d failed probes: %v", key, s.ConsecutiveFailures, err)
+		}
+		return
+	}
+
+	s.ConsecutiveSuccesses++
+	s.ConsecutiveFailures = 0
+	s.LastError = ""
+	if !s.Healthy && s.ConsecutiveSuccesses >= h.recoveryThreshold {
+		s.Healthy = true
+		log.Printf("backend %s marked healthy after %d successful probes", key, s.ConsecutiveSuccesses)
+	}
+}
+
+// Healthy reports whether a backend is currently considered healthy. Backends that
+// haven't been probed yet are assumed healthy.
+func (h *HealthChecker) Healthy(model user.Model) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s, ok := h.status[backendKey(model)]
+	return !ok || s.Healthy
+}
+
+// forget drops the health of backends that are no longer registered
+func (h *HealthChecker) forget(backends []user.Model) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, backend := range backends {
+		delete(h.status, backendKey(backend))
+	}
+}
+
+// Snapshot returns a copy of the health of every probed backend, keyed by name@api_url
+func (h *HealthChecker) Snapshot() map[string]HealthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	snapshot := make(map[string]HealthStatus, len(h.status))
+	for key, s := range h.status {
+		snapshot[key] = *s
+	}
+	return snapshot
+}
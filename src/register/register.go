@@ -1,21 +1,50 @@
 package register
 
 import (
+	"covalence/src/types"
 	"covalence/src/user"
 	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
 	"sync"
 )
 
 // ModelRegistry stores registered models
 type Registry struct {
-	Mu     sync.RWMutex
-	Models map[string]user.Model
+	Mu       sync.RWMutex
+	Models   map[string]user.Model   // The first backend registered under each name
+	Backends map[string][]user.Model // Every backend serving a name, including the first
+	Aliases  map[string]string       // Alias -> target, which may itself be an alias
+	Health   *HealthChecker          // Optional; without it every model is considered healthy
+	Breakers *Breakers
+	Limiters *Limiters
+	// How names are matched, set before anything is registered. Names are always
+	// trimmed; with FoldCase they are also matched regardless of case.
+	NameCase types.NameCase
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
 }
 
 // NewModelRegistry creates a new model registry
 func NewModelRegistry() *Registry {
+	return newModelRegistry(rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+}
+
+// NewSeededModelRegistry creates a registry whose backend picks are deterministic for a seed
+func NewSeededModelRegistry(seed uint64) *Registry {
+	return newModelRegistry(rand.New(rand.NewPCG(seed, seed)))
+}
+
+func newModelRegistry(rng *rand.Rand) *Registry {
 	return &Registry{
-		Models: make(map[string]user.Model),
+		Models:   make(map[string]user.Model),
+		Backends: make(map[string][]user.Model),
+		Aliases:  make(map[string]string),
+		Breakers: NewBreakers(),
+		Limiters: NewLimiters(),
+		rng:      rng,
 	}
 }
 
@@ -24,19 +53,276 @@ func (r *Registry) Register(modelInfo user.Model) error {
 	r.Mu.Lock()
 	defer r.Mu.Unlock()
 
-	// check if model name already exists
-	if _, exists := r.Models[modelInfo.Name.String()]; exists {
-		return fmt.Errorf("model with name %s already exists", modelInfo.Name.String())
+	// Models are stored under the name they are matched by, so that is the name listed
+	if name, err := types.NewNameWithCase(modelInfo.Name.String(), r.NameCase); err == nil {
+		modelInfo.Name = name
+	}
+	name := r.key(modelInfo.Name.String())
+
+	// check if model name already exists. Weighted models can share a name, each
+	// registration adding another backend.
+	if existing, exists := r.Models[name]; exists {
+		if existing.Weight == 0 || modelInfo.Weight == 0 {
+			return fmt.Errorf("model with name %s already exists", modelInfo.Name.String())
+		}
+	}
+	if _, exists := r.Aliases[name]; exists {
+		return fmt.Errorf("model name %s is already used as an alias", modelInfo.Name.String())
+	}
+
+	// Fallbacks must already be registered, which also rules out cycles
+	for _, fallback := range modelInfo.Fallbacks {
+		resolved, err := r.resolve(fallback.String())
+		if err != nil {
+			return err
+		}
+		if _, exists := r.Models[resolved]; !exists {
+			return fmt.Errorf("fallback model %s is not registered", fallback.String())
+		}
+	}
+	if _, exists := r.Models[name]; !exists {
+		r.Models[name] = modelInfo
+	}
+	r.Backends[name] = append(r.Backends[name], modelInfo)
+
+	return nil
+}
+
+// Unregister removes a model and every backend serving it. Aliases of the model and
+// models falling back to it are left in place; they skip the name until a model is
+// registered under it again.
+func (r *Registry) Unregister(name string) error {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	name = r.key(name)
+	if _, exists := r.Aliases[name]; exists {
+		return fmt.Errorf("%s is an alias, not a model", name)
+	}
+	if _, exists := r.Models[name]; !exists {
+		return fmt.Errorf("model %s is not registered", name)
+	}
+
+	if r.Health != nil {
+		r.Health.forget(r.Backends[name])
+	}
+	r.Breakers.forget(r.Backends[name])
+	r.Limiters.forget(r.Backends[name])
+	delete(r.Models, name)
+	delete(r.Backends, name)
+	return nil
+}
+
+// List returns every registered backend, sorted by name. Backends sharing a name are
+// listed in the order they were registered.
+func (r *Registry) List() []user.Model {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	models := []user.Model{}
+	for _, backends := range r.Backends {
+		models = append(models, backends...)
+	}
+
+	sort.SliceStable(models, func(i, j int) bool {
+		return models[i].Name.String() < models[j].Name.String()
+	})
+	return models
+}
+
+// RegisterAlias makes alias resolve to target, a model name or another alias.
+// Re-registering an alias points it at the new target.
+func (r *Registry) RegisterAlias(alias, target string) error {
+	alias, target = r.key(alias), r.key(target)
+	if alias == "" || target == "" {
+		return fmt.Errorf("alias and target cannot be empty")
+	}
+
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+
+	if _, exists := r.Models[alias]; exists {
+		return fmt.Errorf("alias %s would shadow a registered model", alias)
+	}
+
+	r.Aliases[alias] = target
+
+	// Reject the alias if it closes a cycle
+	if _, err := r.resolve(alias); err != nil {
+		delete(r.Aliases, alias)
+		return err
 	}
-	r.Models[modelInfo.Name.String()] = modelInfo
 
 	return nil
 }
 
-// GetModelInfo retrieves model information by custom name
+// GetModelInfo retrieves model information by custom name, following aliases. When
+// several backends serve the name, one is picked by weight.
 func (r *Registry) GetInfo(name string) (user.Model, bool) {
+	return r.Pick(name)
+}
+
+// Pick resolves name and chooses one of its backends with probability proportional to
+// weight. Backends failing their health checks are only picked when every one is.
+func (r *Registry) Pick(name string) (user.Model, bool) {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	resolved, err := r.resolve(name)
+	if err != nil {
+		log.Printf("failed to resolve model %s: %v", name, err)
+		return user.Model{}, false
+	}
+
+	backends := r.Backends[resolved]
+	switch len(backends) {
+	case 0:
+		return user.Model{}, false
+	case 1:
+		return backends[0], true
+	}
+
+	healthy := make([]user.Model, 0, len(backends))
+	for _, backend := range backends {
+		if r.Healthy(backend) {
+			healthy = append(healthy, backend)
+		}
+	}
+	if len(healthy) > 0 {
+		backends = healthy
+	}
+
+	total := 0
+	for _, backend := range backends {
+		total += backend.Weight
+	}
+
+	r.rngMu.Lock()
+	n := r.rng.IntN(total)
+	r.rngMu.Unlock()
+
+	for _, backend := range backends {
+		if n < backend.Weight {
+			return backend, true
+		}
+		n -= backend.Weight
+	}
+	return backends[len(backends)-1], true
+}
+
+// BackendsOf resolves name and returns a copy of every backend serving it, or nil if
+// none do
+func (r *Registry) BackendsOf(name string) []user.Model {
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	resolved, err := r.resolve(name)
+	if err != nil {
+		return nil
+	}
+	return append([]user.Model(nil), r.Backends[resolved]...)
+}
+
+// RotateKey starts rotating every backend of a model to a new provider key. Each
+// backend keeps using its current key until the provider rejects it.
+func (r *Registry) RotateKey(name, key string) error {
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+
+	r.Mu.RLock()
+	defer r.Mu.RUnlock()
+
+	resolved, err := r.resolve(name)
+	if err != nil {
+		return err
+	}
+
+	backends := r.Backends[resolved]
+	if len(backends) == 0 {
+		return fmt.Errorf("model %s is not registered", name)
+	}
+
+	for _, backend := range backends {
+		if backend.Keys == nil {
+			return fmt.Errorf("model %s was registered without a provider key", name)
+		}
+	}
+	for _, backend := range backends {
+		backend.Keys.SetNext(key)
+	}
+
+	return nil
+}
+
+// Entry is a name clients can call: a registered model or an alias of one
+type Entry struct {
+	Name   string
+	Target string     // The alias's target, which may be another alias; empty for models
+	Model  user.Model // The first backend of the model the name resolves to
+}
+
+// Entries lists every registered model and alias, sorted by name. Aliases that don't
+// resolve to a registered model are left out.
+func (r *Registry) Entries() []Entry {
 	r.Mu.RLock()
 	defer r.Mu.RUnlock()
-	info, exists := r.Models[name]
-	return info, exists
+
+	entries := make([]Entry, 0, len(r.Models)+len(r.Aliases))
+	for name, model := range r.Models {
+		entries = append(entries, Entry{Name: name, Model: model})
+	}
+	for alias, target := range r.Aliases {
+		resolved, err := r.resolve(alias)
+		if err != nil {
+			continue
+		}
+		model, ok := r.Models[resolved]
+		if !ok {
+			continue
+		}
+		entries = append(entries, Entry{Name: alias, Target: target, Model: model})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// Healthy reports whether a backend's provider is passing its health checks
+func (r *Registry) Healthy(model user.Model) bool {
+	if r.Health == nil {
+		return true
+	}
+	return r.Health.Healthy(model)
+}
+
+// key is the form of name the registry's maps are keyed by
+func (r *Registry) key(name string) string {
+	return types.NormalizeName(name, r.NameCase)
+}
+
+// backendKey identifies one backend: the name it serves and its provider URL, so two
+// backends of a name, or two names on one provider, are tracked apart
+func backendKey(model user.Model) string {
+	return model.Name.String() + "@" + model.APIURL.String()
+}
+
+// resolve follows aliases from name until it reaches a name that isn't an alias.
+// Callers must hold the lock.
+func (r *Registry) resolve(name string) (string, error) {
+	name = r.key(name)
+	seen := map[string]bool{}
+	for {
+		target, isAlias := r.Aliases[name]
+		if !isAlias {
+			return name, nil
+		}
+		if seen[name] {
+			return "", fmt.Errorf("alias cycle detected at %s", name)
+		}
+		seen[name] = true
+		name = target
+	}
 }
@@ -0,0 +1,503 @@
+package request
+
+import (
+	"covalence/src/register"
+	"covalence/src/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultAnthropicMaxTokens is sent when the client didn't set max_tokens, which the
+// Messages API requires
+const defaultAnthropicMaxTokens = 4096
+
+// rawAnthropicGenerate is a request in the Anthropic Messages format
+type rawAnthropicGenerate struct {
+	Name          string        `json:"model"`
+	System        interface{}   `json:"system"` // A string or an array of text blocks
+	Messages      []interface{} `json:"messages"`
+	MaxTokens     *int          `json:"max_tokens"`
+	Temperature   *float32      `json:"temperature"`
+	TopP          *float32      `json:"top_p"`
+	StopSequences []string      `json:"stop_sequences"`
+	IsStreaming   bool          `json:"stream"`
+	Tools         []interface{} `json:"tools"`
+	ToolChoice    interface{}   `json:"tool_choice"`
+}
+
+// anthropicFields are the Messages API fields that map onto the internal request
+var anthropicFields = map[string]struct{}{
+	"model":          {},
+	"system":         {},
+	"messages":       {},
+	"max_tokens":     {},
+	"temperature":    {},
+	"top_p":          {},
+	"stop_sequences": {},
+	"stream":         {},
+	"tools":          {},
+	"tool_choice":    {},
+}
+
+// ParseAnthropicGenerate validates a request in the Anthropic Messages format. It is
+// converted to the same internal form as ParseGenerate, so firewalls and audit see no
+// difference. Fields with no internal equivalent, such as top_k, are rejected rather
+// than silently dropped.
+func ParseAnthropicGenerate(c *gin.Context, registry *register.Registry, opts ParseOptions) (Generate, error) {
+
+	body, err := c.GetRawData()
+	if err != nil {
+		return Generate{}, malformed(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return Generate{}, malformed(err)
+	}
+	var ra rawAnthropicGenerate
+	if err := json.Unmarshal(body, &ra); err != nil {
+		return Generate{}, malformed(err)
+	}
+
+	v := validator{failFast: opts.FailFast}
+
+	unsupported := []string{}
+	for field := range fields {
+		if _, ok := anthropicFields[field]; !ok {
+			unsupported = append(unsupported, field)
+		}
+	}
+	sort.Strings(unsupported)
+	for _, field := range unsupported {
+		if v.add(field, errors.New("is not supported by this gateway")) {
+			return Generate{}, v.err()
+		}
+	}
+
+	rg := rawGenerate{
+		Name:        ra.Name,
+		IsStreaming: ra.IsStreaming,
+		MaxTokens:   ra.MaxTokens,
+		Temperature: ra.Temperature,
+		TopP:        ra.TopP,
+	}
+
+	if ra.System != nil {
+		system, err := anthropicSystem(ra.System)
+		if err != nil {
+			if v.add("system", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			rg.System = &system
+		}
+	}
+
+	for i, object := range ra.Messages {
+		message, err := anthropicMessage(object)
+		if err != nil {
+			if v.add(fmt.Sprintf("messages[%d]", i), err) {
+				return Generate{}, v.err()
+			}
+			continue
+		}
+		rg.Messages = append(rg.Messages, message)
+	}
+
+	if len(ra.StopSequences) > 0 {
+		stop := make([]interface{}, len(ra.StopSequences))
+		for i, sequence := range ra.StopSequences {
+			stop[i] = sequence
+		}
+		rg.Stop = stop
+	}
+
+	for i, object := range ra.Tools {
+		tool, err := anthropicTool(object)
+		if err != nil {
+			if v.add(fmt.Sprintf("tools[%d]", i), err) {
+				return Generate{}, v.err()
+			}
+			continue
+		}
+		rg.Tools = append(rg.Tools, tool)
+	}
+
+	if ra.ToolChoice != nil {
+		toolChoice, err := anthropicToolChoice(ra.ToolChoice)
+		if err != nil {
+			if v.add("tool_choice", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			rg.ToolChoice = toolChoice
+		}
+	}
+
+	// Report format problems before the converted request is validated
+	if err := v.err(); err != nil {
+		return Generate{}, err
+	}
+
+	return parseGenerate(c, registry, rg, FormatAnthropic, opts)
+}
+
+// anthropicSystem accepts a system prompt as a string or as text blocks
+func anthropicSystem(value interface{}) (string, error) {
+	switch system := value.(type) {
+	case string:
+		return system, nil
+	case []interface{}:
+		texts := []string{}
+		for i, object := range system {
+			block, _ := object.(map[string]interface{})
+			text, _ := block["text"].(string)
+			if block["type"] != "text" || text == "" {
+				return "", fmt.Errorf("block %d must be a text block", i)
+			}
+			texts = append(texts, text)
+		}
+		return strings.Join(texts, "\n"), nil
+	default:
+		return "", errors.New("must be a string or an array of text blocks")
+	}
+}
+
+// anthropicMessage converts a message to the internal shape. Text and image blocks
+// become content parts; tool_use and tool_result blocks have no internal equivalent.
+func anthropicMessage(object interface{}) (interface{}, error) {
+	messageObject, ok := object.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid message format")
+	}
+
+	role, _ := messageObject["role"].(string)
+	if role != "user" && role != "assistant" {
+		return nil, fmt.Errorf("role '%v' is invalid (must be user or assistant)", messageObject["role"])
+	}
+
+	blocks, ok := messageObject["content"].([]interface{})
+	if !ok {
+		// Plain strings need no conversion
+		return messageObject, nil
+	}
+
+	parts := make([]interface{}, 0, len(blocks))
+	for i, b := range blocks {
+		block, _ := b.(map[string]interface{})
+		switch block["type"] {
+		case "text":
+			parts = append(parts, map[string]interface{}{"type": types.TextPart, "text": block["text"]})
+		case "image":
+			url, err := anthropicImageURL(block["source"])
+			if err != nil {
+				return nil, fmt.Errorf("invalid content block %d: %v", i, err)
+			}
+			parts = append(parts, map[string]interface{}{"type": types.ImagePart, "image_url": map[string]interface{}{"url": url}})
+		default:
+			return nil, fmt.Errorf("content block type '%v' is not supported by this gateway", block["type"])
+		}
+	}
+
+	return map[string]interface{}{"role": role, "content": parts}, nil
+}
+
+// anthropicImageURL turns an image source into a URL, inlining base64 data as a data: URL
+func anthropicImageURL(value interface{}) (string, error) {
+	source, _ := value.(map[string]interface{})
+	switch source["type"] {
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		if mediaType == "" || data == "" {
+			return "", errors.New("base64 image source must have a media_type and data")
+		}
+		return "data:" + mediaType + ";base64," + data, nil
+	case "url":
+		url, _ := source["url"].(string)
+		if url == "" {
+			return "", errors.New("url image source must have a url")
+		}
+		return url, nil
+	default:
+		return "", fmt.Errorf("image source type '%v' is invalid", source["type"])
+	}
+}
+
+// anthropicTool converts a client tool to a function definition. Server tools, which
+// have a type, run on Anthropic's side and can't be proxied to other providers.
+func anthropicTool(object interface{}) (interface{}, error) {
+	tool, ok := object.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid tool format")
+	}
+	if toolType, ok := tool["type"]; ok && toolType != "custom" {
+		return nil, fmt.Errorf("tool type '%v' is not supported by this gateway", toolType)
+	}
+
+	function := map[string]interface{}{
+		"name":       tool["name"],
+		"parameters": tool["input_schema"],
+	}
+	if description, ok := tool["description"]; ok {
+		function["description"] = description
+	}
+	return map[string]interface{}{"type": "function", "function": function}, nil
+}
+
+// anthropicToolChoice converts a tool choice to its internal mode or function
+func anthropicToolChoice(value interface{}) (interface{}, error) {
+	choice, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("must be an object")
+	}
+	if _, ok := choice["disable_parallel_tool_use"]; ok {
+		return nil, errors.New("disable_parallel_tool_use is not supported by this gateway")
+	}
+
+	switch choice["type"] {
+	case "auto":
+		return "auto", nil
+	case "any":
+		return "required", nil
+	case "none":
+		return "none", nil
+	case "tool":
+		return map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": choice["name"]},
+		}, nil
+	default:
+		return nil, fmt.Errorf("tool_choice type '%v' is invalid", choice["type"])
+	}
+}
+
+// toAnthropicMap is the request body in the Messages format. System messages move to
+// the top-level system field.
+func (m Generate) toAnthropicMap() map[string]interface{} {
+	messages := []map[string]interface{}{}
+	for _, message := range m.Messages {
+		if message.Role != types.SystemRole() {
+			messages = append(messages, anthropicMessageMap(message))
+		}
+	}
+
+	maxTokens := defaultAnthropicMaxTokens
+	if m.MaxTokens != nil {
+		maxTokens = m.MaxTokens.Int()
+	} else if m.Model.MaxContextTokens > 0 && m.Model.MaxContextTokens < maxTokens {
+		maxTokens = m.Model.MaxContextTokens
+	}
+
+	requestMap := map[string]interface{}{
+		"model":      m.Model.Model.String(),
+		"messages":   messages,
+		"max_tokens": maxTokens,
+		"stream":     m.IsStreaming,
+	}
+
+	if m.System != "" {
+		requestMap["system"] = m.System
+	}
+
+	if m.Temperature != nil {
+		requestMap["temperature"] = m.Temperature.Float32()
+	}
+
+	if m.TopP != nil {
+		requestMap["top_p"] = m.TopP.Float32()
+	}
+
+	if m.Stop != nil {
+		requestMap["stop_sequences"] = m.Stop.Strings()
+	}
+
+	if len(m.Tools) > 0 {
+		tools := make([]map[string]interface{}, len(m.Tools))
+		for i, tool := range m.Tools {
+			tools[i] = map[string]interface{}{
+				"name":         tool.Name,
+				"input_schema": tool.Parameters,
+			}
+			if tool.Description != "" {
+				tools[i]["description"] = tool.Description
+			}
+		}
+		requestMap["tools"] = tools
+	}
+
+	if m.ToolChoice != nil {
+		requestMap["tool_choice"] = anthropicToolChoiceMap(*m.ToolChoice)
+	}
+
+	return requestMap
+}
+
+func anthropicMessageMap(message types.Message) map[string]interface{} {
+	// Tool results are user turns in the Messages format, answering a tool_use block by ID
+	if message.Role == types.ToolRole() {
+		return map[string]interface{}{"role": "user", "content": []map[string]interface{}{{
+			"type":        "tool_result",
+			"tool_use_id": message.ToolCallID,
+			"content":     message.Content,
+		}}}
+	}
+	if len(message.ToolCalls) > 0 {
+		return map[string]interface{}{"role": message.Role.String(), "content": anthropicToolUseBlocks(message)}
+	}
+
+	if message.Parts == nil {
+		return map[string]interface{}{"role": message.Role.String(), "content": message.Content}
+	}
+
+	blocks := make([]map[string]interface{}, len(message.Parts))
+	for i, part := range message.Parts {
+		if part.Type != types.ImagePart {
+			blocks[i] = map[string]interface{}{"type": "text", "text": part.Text}
+			continue
+		}
+
+		source := map[string]interface{}{"type": "url", "url": part.ImageURL}
+		if header, data, ok := strings.Cut(strings.TrimPrefix(part.ImageURL, "data:"), ";base64,"); ok && strings.HasPrefix(part.ImageURL, "data:") {
+			source = map[string]interface{}{"type": "base64", "media_type": header, "data": data}
+		}
+		blocks[i] = map[string]interface{}{"type": "image", "source": source}
+	}
+	return map[string]interface{}{"role": message.Role.String(), "content": blocks}
+}
+
+// anthropicToolUseBlocks is an assistant message's text followed by a tool_use block
+// for each call it made
+func anthropicToolUseBlocks(message types.Message) []map[string]interface{} {
+	blocks := []map[string]interface{}{}
+	if message.Content != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": message.Content})
+	}
+	for _, call := range message.ToolCalls {
+		input := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(call.Arguments), &input); err != nil {
+			input = map[string]interface{}{}
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    call.ID,
+			"name":  call.Name,
+			"input": input,
+		})
+	}
+	return blocks
+}
+
+func anthropicToolChoiceMap(choice types.ToolChoice) map[string]interface{} {
+	if choice.Function() != "" {
+		return map[string]interface{}{"type": "tool", "name": choice.Function()}
+	}
+	switch choice.Value() {
+	case "required":
+		return map[string]interface{}{"type": "any"}
+	case "none":
+		return map[string]interface{}{"type": "none"}
+	default:
+		return map[string]interface{}{"type": "auto"}
+	}
+}
+
+// AnthropicResponse is a message in the shape the Anthropic SDKs expect, whichever
+// provider produced it
+type AnthropicResponse struct {
+	ID           string                   `json:"id"`
+	Type         string                   `json:"type"`
+	Role         string                   `json:"role"`
+	Model        string                   `json:"model"`
+	Content      []map[string]interface{} `json:"content"`
+	StopReason   *string                  `json:"stop_reason"`
+	StopSequence *string                  `json:"stop_sequence"`
+	Usage        AnthropicUsage           `json:"usage"`
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// openAIStopReasons maps OpenAI finish reasons to their Anthropic equivalents
+var openAIStopReasons = map[string]string{
+	"stop":           "end_turn",
+	"length":         "max_tokens",
+	"tool_calls":     "tool_use",
+	"content_filter": "refusal",
+}
+
+// NewAnthropicResponse builds the Anthropic message for a provider response. Like
+// NewResponseEnvelope it takes its ID from the audit request ID and its usage from
+// metrics. OpenAI responses are converted from their first choice.
+func NewAnthropicResponse(requestID string, m Generate, response map[string]interface{}, metrics Metrics) AnthropicResponse {
+	message := AnthropicResponse{
+		ID:      "msg_" + strings.ReplaceAll(requestID, "-", ""),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   m.Model.Name.String(),
+		Content: []map[string]interface{}{},
+		Usage: AnthropicUsage{
+			InputTokens:  metrics.InputTokens,
+			OutputTokens: metrics.OutputTokens,
+		},
+	}
+
+	if blocks, ok := response["content"].([]interface{}); ok {
+		for _, b := range blocks {
+			if block, ok := b.(map[string]interface{}); ok {
+				message.Content = append(message.Content, block)
+			}
+		}
+		if stopReason, ok := response["stop_reason"].(string); ok {
+			message.StopReason = &stopReason
+		}
+		if stopSequence, ok := response["stop_sequence"].(string); ok {
+			message.StopSequence = &stopSequence
+		}
+		return message
+	}
+
+	choices, _ := response["choices"].([]interface{})
+	if len(choices) == 0 {
+		return message
+	}
+	choice, _ := choices[0].(map[string]interface{})
+
+	if finishReason, ok := choice["finish_reason"].(string); ok {
+		stopReason := openAIStopReasons[finishReason]
+		if stopReason == "" {
+			stopReason = finishReason
+		}
+		message.StopReason = &stopReason
+	}
+
+	choiceMessage, _ := choice["message"].(map[string]interface{})
+	if content, ok := choiceMessage["content"].(string); ok && content != "" {
+		message.Content = append(message.Content, map[string]interface{}{"type": "text", "text": content})
+	}
+	toolCalls, _ := choiceMessage["tool_calls"].([]interface{})
+	for _, t := range toolCalls {
+		toolCall, _ := t.(map[string]interface{})
+		function, _ := toolCall["function"].(map[string]interface{})
+		arguments, _ := function["arguments"].(string)
+		input := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(arguments), &input); err != nil {
+			input = map[string]interface{}{}
+		}
+		message.Content = append(message.Content, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    toolCall["id"],
+			"name":  function["name"],
+			"input": input,
+		})
+	}
+
+	return message
+}
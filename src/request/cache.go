@@ -0,0 +1,103 @@
+package request
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type responseCacheEntry struct {
+	key       string
+	response  map[string]interface{}
+	expiresAt time.Time
+}
+
+// ResponseCache is a size-bounded LRU of provider responses to deterministic
+// requests, each kept for a fixed TTL. It is safe for concurrent use.
+type ResponseCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // Front is most recently used
+	entries map[string]*list.Element
+}
+
+// NewResponseCache returns nil when caching is disabled by a zero TTL or size
+func NewResponseCache(size int, ttl time.Duration) *ResponseCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &ResponseCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// Cacheable reports whether the request always produces the same response: temperature
+// explicitly 0, no tools and not streamed
+func (m Generate) Cacheable() bool {
+	return m.Temperature != nil && m.Temperature.Float32() == 0 &&
+		len(m.Tools) == 0 && m.ToolChoice == nil && !m.IsStreaming
+}
+
+// CacheKey is the sha256 of the user, the registered model and everything sent to it.
+// Backends of the same name share entries; users never do.
+func (m Generate) CacheKey() string {
+	requestMap := m.ToMap()
+	requestMap["model"] = m.Model.Name.String()
+	requestMap["user_id"] = m.User.ID.String()
+
+	// Map keys are marshalled in sorted order, so equal requests hash equally
+	body, _ := json.Marshal(requestMap)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *ResponseCache) Get(key string) (map[string]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*responseCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.response, true
+}
+
+// Put stores a response. It must not be modified afterwards, as hits share it.
+func (c *ResponseCache) Put(key string, response map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*responseCacheEntry)
+		entry.response = response
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&responseCacheEntry{key: key, response: response, expiresAt: expiresAt})
+
+	// Evict the least recently used entry once over capacity
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*responseCacheEntry).key)
+	}
+}
@@ -0,0 +1,96 @@
+package request
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs, or bare addresses, of the
+// proxies allowed to report a client's address
+func ParseTrustedProxies(value string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", field, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// ClientIP is the address of the client that made r. Forwarding headers are only
+// believed when the socket peer is a trusted proxy: X-Forwarded-For is walked from the
+// right, skipping trusted proxies, and X-Real-IP is used if it is absent. Malformed
+// headers fall back to the peer. It returns an empty string if even the peer can't be
+// parsed.
+func ClientIP(r *http.Request, trusted []netip.Prefix) string {
+	peer, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return ""
+	}
+	if !isTrusted(peer, trusted) {
+		return peer.String()
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseIP(hops[i])
+			if !ok {
+				return peer.String()
+			}
+			client = hop
+			if !isTrusted(hop, trusted) {
+				break
+			}
+		}
+		return client.String()
+	}
+
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		if addr, ok := parseIP(realIP); ok {
+			return addr.String()
+		}
+	}
+
+	return peer.String()
+}
+
+// parseIP parses an IPv4 or IPv6 address, with or without a port or brackets. IPv4
+// addresses mapped into IPv6 are unmapped and zones are dropped.
+func parseIP(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package request
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ResponseEnvelope is a chat completion in the shape the OpenAI SDKs expect, whichever
+// provider produced it
+type ResponseEnvelope struct {
+	ID      string           `json:"id"`
+	Object  string           `json:"object"`
+	Created int64            `json:"created"`
+	Model   string           `json:"model"`
+	Choices []EnvelopeChoice `json:"choices"`
+	Usage   EnvelopeUsage    `json:"usage"`
+	// The client's metadata, echoed back unchanged
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+type EnvelopeChoice struct {
+	Index        int             `json:"index"`
+	Message      EnvelopeMessage `json:"message"`
+	FinishReason string          `json:"finish_reason"`
+}
+
+type EnvelopeMessage struct {
+	Role      string        `json:"role"`
+	Content   *string       `json:"content"` // Null when the model only called tools
+	ToolCalls []interface{} `json:"tool_calls,omitempty"`
+}
+
+type EnvelopeUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// anthropicFinishReasons maps Anthropic stop reasons to their OpenAI equivalents
+var anthropicFinishReasons = map[string]string{
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+	"refusal":       "content_filter",
+}
+
+// NewResponseEnvelope builds the OpenAI envelope for a provider response. The ID is
+// derived from the audit request ID so responses can be traced, the model is the
+// registered name the client asked for, usage comes from metrics and the client's
+// metadata is echoed back. Both OpenAI choices and Anthropic content blocks are
+// understood.
+func NewResponseEnvelope(requestID string, m Generate, response map[string]interface{}, metrics Metrics) ResponseEnvelope {
+	envelope := ResponseEnvelope{
+		ID:      "chatcmpl-" + strings.ReplaceAll(requestID, "-", ""),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   m.Model.Name.String(),
+		Choices: []EnvelopeChoice{},
+		Usage: EnvelopeUsage{
+			PromptTokens:     metrics.InputTokens,
+			CompletionTokens: metrics.OutputTokens,
+			TotalTokens:      metrics.TotalTokens,
+		},
+	}
+	if m.Metadata != nil {
+		envelope.Metadata = m.Metadata.Map()
+	}
+	if created, ok := response["created"].(float64); ok {
+		envelope.Created = int64(created)
+	}
+
+	if choices, ok := response["choices"].([]interface{}); ok {
+		for i, c := range choices {
+			choice, _ := c.(map[string]interface{})
+			envelope.Choices = append(envelope.Choices, openAIChoice(i, choice))
+		}
+		return envelope
+	}
+
+	if blocks, ok := response["content"].([]interface{}); ok {
+		stopReason, _ := response["stop_reason"].(string)
+		envelope.Choices = append(envelope.Choices, anthropicChoice(blocks, stopReason))
+	}
+
+	return envelope
+}
+
+func openAIChoice(i int, choice map[string]interface{}) EnvelopeChoice {
+	result := EnvelopeChoice{Index: i, Message: EnvelopeMessage{Role: "assistant"}}
+	if index, ok := choice["index"].(float64); ok {
+		result.Index = int(index)
+	}
+	result.FinishReason, _ = choice["finish_reason"].(string)
+
+	message, _ := choice["message"].(map[string]interface{})
+	if role, ok := message["role"].(string); ok {
+		result.Message.Role = role
+	}
+	if content, ok := message["content"].(string); ok {
+		result.Message.Content = &content
+	}
+	result.Message.ToolCalls, _ = message["tool_calls"].([]interface{})
+
+	return result
+}
+
+// anthropicChoice joins the text blocks of a message and turns tool_use blocks into tool calls
+func anthropicChoice(blocks []interface{}, stopReason string) EnvelopeChoice {
+	result := EnvelopeChoice{
+		Message:      EnvelopeMessage{Role: "assistant"},
+		FinishReason: anthropicFinishReasons[stopReason],
+	}
+	if result.FinishReason == "" {
+		result.FinishReason = stopReason
+	}
+
+	var text []string
+	for _, b := range blocks {
+		block, _ := b.(map[string]interface{})
+		switch block["type"] {
+		case "text":
+			if t, ok := block["text"].(string); ok {
+				text = append(text, t)
+			}
+		case "tool_use":
+			arguments, _ := json.Marshal(block["input"])
+			result.Message.ToolCalls = append(result.Message.ToolCalls, map[string]interface{}{
+				"id":   block["id"],
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":      block["name"],
+					"arguments": string(arguments),
+				},
+			})
+		}
+	}
+	if len(text) > 0 {
+		content := strings.Join(text, "")
+		result.Message.Content = &content
+	}
+
+	return result
+}
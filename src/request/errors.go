@@ -0,0 +1,86 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Error is a request error the HTTP layer can respond with directly: it carries the
+// status to respond with and a machine-readable code for clients to switch on
+type Error interface {
+	error
+	Status() int
+	Code() string
+}
+
+// codedError is a sentinel request error
+type codedError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *codedError) Error() string { return e.message }
+func (e *codedError) Status() int   { return e.status }
+func (e *codedError) Code() string  { return e.code }
+
+var (
+	// ErrModelNotFound is a request for a model that isn't registered
+	ErrModelNotFound Error = &codedError{http.StatusNotFound, "model_not_found", "model not found"}
+	// ErrModelNotAllowed is a request for a model the API key is restricted from using
+	ErrModelNotAllowed Error = &codedError{http.StatusForbidden, "model_not_allowed", "model not allowed for this API key"}
+	// ErrEmptyMessages is a request without any messages
+	ErrEmptyMessages Error = &codedError{http.StatusBadRequest, "empty_messages", "messages must be a non-empty array"}
+	// ErrInvalidParameter is matched by every invalid field without a more specific error
+	ErrInvalidParameter Error = &codedError{http.StatusBadRequest, "invalid_parameter", "invalid parameter"}
+	// ErrMalformedBody is a body that isn't valid JSON of the expected shape
+	ErrMalformedBody Error = &codedError{http.StatusBadRequest, "malformed_body", "malformed request body"}
+)
+
+// wrappedError gives an underlying error the status and code of a sentinel, keeping
+// its own message
+type wrappedError struct {
+	kind Error
+	err  error
+}
+
+func (e *wrappedError) Error() string        { return e.err.Error() }
+func (e *wrappedError) Status() int          { return e.kind.Status() }
+func (e *wrappedError) Code() string         { return e.kind.Code() }
+func (e *wrappedError) Unwrap() error        { return e.err }
+func (e *wrappedError) Is(target error) bool { return target == e.kind }
+
+// asRequestError returns err as a request Error, treating anything else as kind
+func asRequestError(err error, kind Error) Error {
+	var reqErr Error
+	if errors.As(err, &reqErr) {
+		return reqErr
+	}
+	return &wrappedError{kind: kind, err: err}
+}
+
+func (e *ValidationError) Status() int {
+	if len(e.Fields) == 1 {
+		return e.Fields[0].err.Status()
+	}
+	return http.StatusBadRequest
+}
+
+func (e *ValidationError) Code() string {
+	if len(e.Fields) == 1 {
+		return e.Fields[0].err.Code()
+	}
+	return "invalid_request"
+}
+
+// Unwrap exposes each field's error, so errors.Is(err, ErrModelNotFound) works on the whole
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, len(e.Fields))
+	for i, f := range e.Fields {
+		errs[i] = f.err
+	}
+	return errs
+}
+
+func (e *TooLargeError) Status() int  { return http.StatusRequestEntityTooLarge }
+func (e *TooLargeError) Code() string { return "request_too_large" }
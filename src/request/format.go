@@ -0,0 +1,45 @@
+package request
+
+import (
+	"covalence/src/types"
+	"covalence/src/user"
+	"strings"
+)
+
+// Format is the chat schema spoken by a client or a provider
+type Format string
+
+const (
+	// FormatOpenAI is the Chat Completions schema, which most providers accept
+	FormatOpenAI Format = "openai"
+	// FormatAnthropic is the Messages schema: a top-level system prompt and content blocks
+	FormatAnthropic Format = "anthropic"
+)
+
+// FormatForPath is the format a client uses based on the endpoint it called
+func FormatForPath(path string) Format {
+	if strings.HasSuffix(path, "/messages") {
+		return FormatAnthropic
+	}
+	return FormatOpenAI
+}
+
+// FormatForProvider is the format a provider's API expects
+func FormatForProvider(provider types.ModelProvider) Format {
+	if provider.String() == "anthropic" {
+		return FormatAnthropic
+	}
+	return FormatOpenAI
+}
+
+// providerPath sends chat requests to the chat endpoint of the model's own format,
+// whichever one the client called. Other paths are forwarded unchanged.
+func providerPath(model user.Model, path string) string {
+	if !strings.HasSuffix(path, "/chat/completions") && !strings.HasSuffix(path, "/messages") {
+		return path
+	}
+	if FormatForProvider(model.Provider) == FormatAnthropic {
+		return "/messages"
+	}
+	return "/chat/completions"
+}
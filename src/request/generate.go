@@ -3,12 +3,15 @@ package request
 import (
 	"covalence/src/audit"
 	"covalence/src/register"
+	"covalence/src/tokenizer"
 	"covalence/src/types"
 	"covalence/src/user"
 	"errors"
+	"fmt"
 	"log"
 	"net/url"
 	"path"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -16,131 +19,545 @@ import (
 
 // GenerateRequest represents the incoming JSON request
 type rawGenerate struct {
-	Name        string        `json:"model" binding:"required"`
-	IsStreaming bool          `json:"stream"`
-	MaxTokens   *int          `json:"max_tokens"`  // Pointer to make it optional
-	Temperature *float32      `json:"temperature"` // Pointer to make it optional
-	Messages    []interface{} `json:"messages" binding:"required"`
+	Name             string        `json:"model" binding:"required"`
+	System           *string       `json:"system"` // Prepended as a system message
+	IsStreaming      bool          `json:"stream"`
+	MaxTokens        *int          `json:"max_tokens"`  // Pointer to make it optional
+	Temperature      *float32      `json:"temperature"` // Pointer to make it optional
+	TopP             *float32      `json:"top_p"`
+	Stop             interface{}   `json:"stop"` // A string or an array of strings
+	FrequencyPenalty *float32      `json:"frequency_penalty"`
+	PresencePenalty  *float32      `json:"presence_penalty"`
+	N                *int          `json:"n"` // Number of completions to generate
+	Tools            []interface{} `json:"tools"`
+	ToolChoice       interface{}   `json:"tool_choice"` // A mode string or a function object
+	ResponseFormat   interface{}   `json:"response_format"`
+	Messages         []interface{} `json:"messages" binding:"required"`
+	Metadata         interface{}   `json:"metadata"` // The client's own tags, never forwarded
 }
 
 // GeneratePayload stores information about a generation request
 type Generate struct {
-	User        user.User
-	Model       user.Model
-	TargetURL   url.URL
-	IsStreaming bool
-	MaxTokens   *types.MaxTokens   // Now a pointer to make it optional
-	Temperature *types.Temperature // Now a pointer to make it optional
-	Messages    []types.Message
-	ClientIP    string
+	User             user.User
+	Model            user.Model
+	TargetURL        url.URL
+	IsStreaming      bool
+	MaxTokens        *types.MaxTokens   // Now a pointer to make it optional
+	Temperature      *types.Temperature // Now a pointer to make it optional
+	TopP             *types.TopP
+	Stop             *types.Stop
+	FrequencyPenalty *types.Penalty
+	PresencePenalty  *types.Penalty
+	N                *types.N
+	Tools            []types.ToolDefinition
+	ToolChoice       *types.ToolChoice
+	ResponseFormat   *types.ResponseFormat
+	Metadata         *types.Metadata
+	Messages         []types.Message
+	System           string // The effective system prompt, also present in Messages
+	ClientIP         string
+	ClientFormat     Format // The schema the client spoke, and expects its response in
+	// Parameters taken from the model's defaults because the client left them out
+	Defaulted []string
 }
 
-func ParseGenerate(c *gin.Context, registry *register.Registry) (Generate, error) {
+// ParseGenerate validates a generate request. Invalid fields are reported together as
+// a *ValidationError, or just the first one if opts.FailFast is set.
+func ParseGenerate(c *gin.Context, registry *register.Registry, opts ParseOptions) (Generate, error) {
 
 	var rg rawGenerate
 	if err := c.ShouldBindJSON(&rg); err != nil {
-		return Generate{}, err
+		return Generate{}, malformed(err)
 	}
 
-	// Read API key from Authorization header
-	authHeader := c.GetHeader("Authorization")
-	// Expecting format: "Bearer <apikey>"
-	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		return Generate{}, errors.New("missing or invalid Authorization header")
-	}
-	apiKey := strings.TrimPrefix(authHeader, "Bearer ")
-	apiKey = strings.TrimSpace(apiKey)
+	return parseGenerate(c, registry, rg, FormatOpenAI, opts)
+}
 
-	// Look up user by API key
-	user, err := user.GetUserByAPIKey(apiKey)
-	if err != nil {
-		return Generate{}, errors.New("Invalid API key")
+// parseGenerate validates a request already decoded into the internal raw form
+func parseGenerate(c *gin.Context, registry *register.Registry, rg rawGenerate, format Format, opts ParseOptions) (Generate, error) {
+
+	// The user is resolved from the API key by the auth middleware
+	caller := c.MustGet("user").(user.User)
+
+	v := validator{failFast: opts.FailFast}
+	payload := Generate{
+		IsStreaming:  rg.IsStreaming,
+		ClientIP:     ClientIP(c.Request, opts.TrustedProxies),
+		User:         caller,
+		ClientFormat: format,
 	}
 
-	// Look for model in the parsed data
-	name, err := types.NewName(rg.Name)
+	// Look for model in the parsed data. Checks that depend on the model's
+	// capabilities are skipped if it can't be resolved.
+	modelFound := false
+	name, err := types.NewNameWithCase(rg.Name, registry.NameCase)
 	if err != nil {
-		return Generate{}, err
+		if v.add("model", err) {
+			return Generate{}, v.err()
+		}
+	} else if payload.Model, modelFound = registry.GetInfo(name.String()); !modelFound {
+		if v.add("model", ErrModelNotFound) {
+			return Generate{}, v.err()
+		}
 	}
-
-	// Look up model info
-	modelInfo, exists := registry.GetInfo(name.String())
-	if !exists {
-		return Generate{}, errors.New("model not found")
+	modelInfo := payload.Model
+	if modelFound && modelInfo.Name.String() != name.String() {
+		log.Printf("resolved model alias %s to %s (%s)", name.String(), modelInfo.Name.String(), modelInfo.Model.String())
 	}
 
-	// Get the client IP address
-	clientIP := c.RemoteIP()
+	// Checked on the resolved name, so an alias can't reach a model the key is denied
+	if modelFound && !caller.AllowsModel(modelInfo.Name, registry.NameCase) {
+		return Generate{}, &wrappedError{kind: ErrModelNotAllowed, err: fmt.Errorf("API key is not allowed to use model %s", modelInfo.Name.String())}
+	}
 
-	// Build target URL
-	baseURL := modelInfo.APIURL // assuming this is a *url.URL
-	pathToAdd := c.Param("path")
+	// Responses are converted between formats, but streamed events are passed through as-is
+	anthropicModel := modelFound && FormatForProvider(modelInfo.Provider) == FormatAnthropic
+	if modelFound && rg.IsStreaming && FormatForProvider(modelInfo.Provider) != format {
+		if v.add("stream", fmt.Errorf("streaming is not supported when model %s uses the %s format", modelInfo.Name.String(), FormatForProvider(modelInfo.Provider))) {
+			return Generate{}, v.err()
+		}
+	}
 
-	// Clone the URL to avoid mutating the original
-	targetURL := *baseURL
-	targetURL.Path = path.Join(targetURL.Path, pathToAdd)
+	// Backends of a name may disagree on role order, and any of them may end up
+	// serving the request, so the order is checked if any is strict
+	strictRoles := modelFound && slices.ContainsFunc(registry.BackendsOf(name.String()), func(backend user.Model) bool {
+		return backend.StrictRoles
+	})
 
-	log.Printf("target URL raw: %s", targetURL.String())
-	if err != nil {
-		return Generate{}, err
+	// Oversized requests are rejected outright rather than validated field by field
+	if limit := opts.Limits.MaxMessages; limit > 0 && len(rg.Messages) > limit {
+		return Generate{}, &TooLargeError{Limit: "max_messages", Max: int64(limit)}
 	}
 
 	// Build messages array
 	if len(rg.Messages) == 0 {
-		return Generate{}, errors.New("messages must be a non-empty array")
+		if v.add("messages", ErrEmptyMessages) {
+			return Generate{}, v.err()
+		}
+	}
+
+	// An explicit system prompt becomes the first message
+	if rg.System != nil {
+		system, err := types.NewMessage("system", *rg.System)
+		if err != nil {
+			if v.add("system", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.Messages = append(payload.Messages, system)
+		}
 	}
 
-	messagesArray := []types.Message{}
 	// Check each message format
-	for _, msg := range rg.Messages {
+	for i, msg := range rg.Messages {
+		field := fmt.Sprintf("messages[%d]", i)
 		message, err := types.NewMessageFromJson(msg)
 		if err != nil {
-			return Generate{}, err
+			if v.add(field, err) {
+				return Generate{}, v.err()
+			}
+			continue
+		}
+
+		// Only forward images to models that can see them
+		if modelFound && !modelInfo.Vision && message.HasImages() {
+			if v.add(field, fmt.Errorf("contains an image but model %s does not support vision", modelInfo.Name.String())) {
+				return Generate{}, v.err()
+			}
+			continue
+		}
+
+		// Mixing both styles makes it ambiguous which system prompt applies
+		if rg.System != nil && message.Role == types.SystemRole() {
+			if v.add(field, errors.New("system messages cannot be combined with the system field")) {
+				return Generate{}, v.err()
+			}
+			continue
+		}
+
+		// Strict providers reject a system prompt mid-conversation or an orphaned tool result
+		var previous types.Role
+		if len(payload.Messages) > 0 {
+			previous = payload.Messages[len(payload.Messages)-1].Role
+		}
+		if message.Role == types.SystemRole() && previous.Complete() && previous != types.SystemRole() {
+			if v.add(field, errors.New("system messages must come before all other messages")) {
+				return Generate{}, v.err()
+			}
+			continue
+		}
+		if message.Role == types.ToolRole() && previous != types.AssistantRole() && previous != types.ToolRole() {
+			if v.add(field, errors.New("tool messages must follow an assistant message")) {
+				return Generate{}, v.err()
+			}
+			continue
+		}
+		if strictRoles {
+			if err := alternationError(message.Role, previous); err != nil {
+				if v.add(field, fmt.Errorf("%w (required by model %s)", err, modelInfo.Name.String())) {
+					return Generate{}, v.err()
+				}
+				continue
+			}
+		}
+
+		payload.Messages = append(payload.Messages, message)
+	}
+
+	if limit := opts.Limits.MaxContentChars; limit > 0 {
+		chars := 0
+		for _, message := range payload.Messages {
+			chars += len([]rune(message.Content))
+		}
+		if chars > limit {
+			return Generate{}, &TooLargeError{Limit: "max_content_chars", Max: int64(limit)}
 		}
-		messagesArray = append(messagesArray, message)
 	}
 
-	// Initialize the payload with required fields
-	payload := Generate{
-		Model:       modelInfo,
-		IsStreaming: rg.IsStreaming,
-		TargetURL:   targetURL,
-		ClientIP:    clientIP,
-		Messages:    messagesArray,
-		User:        user,
+	systemPrompts := []string{}
+	for _, message := range payload.Messages {
+		if message.Role == types.SystemRole() {
+			systemPrompts = append(systemPrompts, message.Content)
+		}
 	}
+	payload.System = strings.Join(systemPrompts, "\n")
 
 	// Handle optional parameters
 	if rg.MaxTokens != nil {
 		maxTokens, err := types.NewMaxTokens(*rg.MaxTokens)
+		// Don't forward a request the model is certain to reject
+		if err == nil && modelFound {
+			err = contextError(modelInfo, payload.Messages, maxTokens.Int())
+		}
 		if err != nil {
-			return Generate{}, err
+			if v.add("max_tokens", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.MaxTokens = &maxTokens
+		}
+	} else if modelFound {
+		if err := contextError(modelInfo, payload.Messages, 0); err != nil {
+			if v.add("messages", err) {
+				return Generate{}, v.err()
+			}
 		}
-		payload.MaxTokens = &maxTokens
 	}
 
 	if rg.Temperature != nil {
 		temp, err := types.NewTemperature(*rg.Temperature)
+		// Providers cap temperature differently, so check the model's own limit
+		if err == nil && modelFound && modelInfo.MaxTemperature > 0 && temp.Float32() > modelInfo.MaxTemperature {
+			err = fmt.Errorf("temperature %g exceeds the maximum of %g for model %s", temp.Float32(), modelInfo.MaxTemperature, modelInfo.Name.String())
+		}
 		if err != nil {
-			return Generate{}, err
+			if v.add("temperature", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.Temperature = &temp
 		}
-		payload.Temperature = &temp
 	}
 
+	if rg.TopP != nil {
+		topP, err := types.NewTopP(*rg.TopP)
+		if err != nil {
+			if v.add("top_p", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.TopP = &topP
+		}
+	}
+
+	if rg.Stop != nil {
+		stop, err := types.NewStop(rg.Stop)
+		if err != nil {
+			if v.add("stop", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.Stop = &stop
+		}
+	}
+
+	if rg.FrequencyPenalty != nil {
+		penalty, err := types.NewPenalty("frequency_penalty", *rg.FrequencyPenalty)
+		if err == nil && anthropicModel {
+			err = fmt.Errorf("not supported by model %s", modelInfo.Name.String())
+		}
+		if err != nil {
+			if v.add("frequency_penalty", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.FrequencyPenalty = &penalty
+		}
+	}
+
+	if rg.PresencePenalty != nil {
+		penalty, err := types.NewPenalty("presence_penalty", *rg.PresencePenalty)
+		if err == nil && anthropicModel {
+			err = fmt.Errorf("not supported by model %s", modelInfo.Name.String())
+		}
+		if err != nil {
+			if v.add("presence_penalty", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.PresencePenalty = &penalty
+		}
+	}
+
+	if rg.N != nil {
+		n, err := types.NewN(*rg.N)
+		// Providers stream multiple completions differently, which we don't handle yet
+		if err == nil && n.Int() > 1 && rg.IsStreaming {
+			err = errors.New("n greater than 1 is not supported with streaming")
+		}
+		if err == nil && n.Int() > 1 && anthropicModel {
+			err = fmt.Errorf("n greater than 1 is not supported by model %s", modelInfo.Name.String())
+		}
+		if err != nil {
+			if v.add("n", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.N = &n
+		}
+	}
+
+	if len(rg.Tools) > 0 && modelFound && !modelInfo.ToolUse {
+		if v.add("tools", fmt.Errorf("model %s does not support tools", modelInfo.Name.String())) {
+			return Generate{}, v.err()
+		}
+	} else {
+		for i, object := range rg.Tools {
+			tool, err := types.NewToolDefinitionFromJson(object)
+			if err != nil {
+				if v.add(fmt.Sprintf("tools[%d]", i), err) {
+					return Generate{}, v.err()
+				}
+				continue
+			}
+			payload.Tools = append(payload.Tools, tool)
+		}
+	}
+
+	if rg.ToolChoice != nil {
+		toolChoice, err := types.NewToolChoice(rg.ToolChoice, payload.Tools)
+		if err != nil {
+			if v.add("tool_choice", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.ToolChoice = &toolChoice
+		}
+	}
+
+	if rg.ResponseFormat != nil {
+		responseFormat, err := types.NewResponseFormat(rg.ResponseFormat)
+		// Plain text needs no support from the model
+		if err == nil && responseFormat.Type() != "text" && modelFound && (anthropicModel || !modelInfo.JSONMode) {
+			err = fmt.Errorf("%s is not supported by model %s", responseFormat.Type(), modelInfo.Name.String())
+		}
+		if err != nil {
+			if v.add("response_format", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.ResponseFormat = &responseFormat
+		}
+	}
+
+	if rg.Metadata != nil {
+		metadata, err := types.NewMetadata(rg.Metadata)
+		if err != nil {
+			if v.add("metadata", err) {
+				return Generate{}, v.err()
+			}
+		} else {
+			payload.Metadata = &metadata
+		}
+	}
+
+	if err := v.err(); err != nil {
+		return Generate{}, err
+	}
+
+	payload.applyDefaults()
+
+	// Build target URL
+	payload.TargetURL = targetURL(modelInfo, providerPath(modelInfo, c.Param("path")))
+	log.Printf("target URL raw: %s", payload.TargetURL.String())
+
 	return payload, nil
 }
 
+// alternationError checks a message's role against the one before it for providers
+// that only accept a single leading system message followed by user and assistant
+// turns that alternate, starting with the user. Tool results answer the assistant
+// message before them, so they take the user's turn.
+func alternationError(role, previous types.Role) error {
+	switch role {
+	case types.SystemRole():
+		if previous.Complete() {
+			return errors.New("only one system message is allowed")
+		}
+	case types.UserRole():
+		switch previous {
+		case types.UserRole():
+			return errors.New("user messages must alternate with assistant messages, but the previous message is also from the user")
+		case types.ToolRole():
+			return errors.New("a user message cannot follow a tool message; the assistant must respond to the tool result first")
+		}
+	case types.AssistantRole():
+		switch previous {
+		case types.Role{}, types.SystemRole():
+			return errors.New("the conversation must start with a user message")
+		case types.AssistantRole():
+			return errors.New("assistant messages must alternate with user messages, but the previous message is also from the assistant")
+		}
+	}
+	return nil
+}
+
+// contextError reports why a prompt and up to maxTokens of completion can't fit in the
+// model's context window together, or nil if they can or the window is unknown
+func contextError(model user.Model, messages []types.Message, maxTokens int) error {
+	if model.MaxContextTokens <= 0 {
+		return nil
+	}
+
+	prompt := tokenizer.ForProvider(model.Provider).CountTokens(model.Model, messages)
+	if prompt+maxTokens <= model.MaxContextTokens {
+		return nil
+	}
+	if maxTokens == 0 {
+		return fmt.Errorf("the %d token prompt exceeds the %d token context window of model %s", prompt, model.MaxContextTokens, model.Name.String())
+	}
+	return fmt.Errorf("max_tokens %d plus the %d token prompt exceeds the %d token context window of model %s", maxTokens, prompt, model.MaxContextTokens, model.Name.String())
+}
+
+// WithModel returns a copy of the request addressed to a different model, such as a fallback
+func (m Generate) WithModel(model user.Model, pathToAdd string) Generate {
+	// Defaults belong to the model, so the new model's replace the old one's
+	for _, parameter := range m.Defaulted {
+		switch parameter {
+		case "max_tokens":
+			m.MaxTokens = nil
+		case "temperature":
+			m.Temperature = nil
+		}
+	}
+	m.Model = model
+	m.TargetURL = targetURL(model, providerPath(model, pathToAdd))
+	m.applyDefaults()
+	return m
+}
+
+// CheckCapabilities reports why the request can't be sent to its model, or nil if it
+// can. The requested model is checked field by field while parsing, so this is for a
+// request readdressed with WithModel, such as to a fallback.
+func (m Generate) CheckCapabilities() error {
+	name := m.Model.Name.String()
+
+	for i, message := range m.Messages {
+		if !m.Model.Vision && message.HasImages() {
+			return fmt.Errorf("messages[%d] contains an image but model %s does not support vision", i, name)
+		}
+	}
+
+	if len(m.Tools) > 0 && !m.Model.ToolUse {
+		return fmt.Errorf("model %s does not support tools", name)
+	}
+
+	if m.Model.StrictRoles {
+		var previous types.Role
+		for i, message := range m.Messages {
+			if err := alternationError(message.Role, previous); err != nil {
+				return fmt.Errorf("messages[%d]: %w (required by model %s)", i, err, name)
+			}
+			previous = message.Role
+		}
+	}
+
+	anthropicModel := FormatForProvider(m.Model.Provider) == FormatAnthropic
+	if m.ResponseFormat != nil && m.ResponseFormat.Type() != "text" && (anthropicModel || !m.Model.JSONMode) {
+		return fmt.Errorf("%s is not supported by model %s", m.ResponseFormat.Type(), name)
+	}
+
+	// The model's own defaults are within its limits
+	maxTokens := 0
+	if m.MaxTokens != nil && m.parameterSource("max_tokens") == "client" {
+		maxTokens = m.MaxTokens.Int()
+	}
+	if err := contextError(m.Model, m.Messages, maxTokens); err != nil {
+		return err
+	}
+	if m.Temperature != nil && m.parameterSource("temperature") == "client" && m.Model.MaxTemperature > 0 && m.Temperature.Float32() > m.Model.MaxTemperature {
+		return fmt.Errorf("temperature %g exceeds the maximum of %g for model %s", m.Temperature.Float32(), m.Model.MaxTemperature, name)
+	}
+
+	if anthropicModel {
+		if m.FrequencyPenalty != nil || m.PresencePenalty != nil {
+			return fmt.Errorf("penalties are not supported by model %s", name)
+		}
+		if m.N != nil && m.N.Int() > 1 {
+			return fmt.Errorf("n greater than 1 is not supported by model %s", name)
+		}
+	}
+
+	return nil
+}
+
+// applyDefaults fills in the model's default max_tokens and temperature where the
+// client sent none. A client-supplied value always wins.
+func (m *Generate) applyDefaults() {
+	m.Defaulted = nil
+	if m.MaxTokens == nil && m.Model.DefaultMaxTokens != nil {
+		maxTokens := *m.Model.DefaultMaxTokens
+		m.MaxTokens = &maxTokens
+		m.Defaulted = append(m.Defaulted, "max_tokens")
+	}
+	if m.Temperature == nil && m.Model.DefaultTemperature != nil {
+		temperature := *m.Model.DefaultTemperature
+		m.Temperature = &temperature
+		m.Defaulted = append(m.Defaulted, "temperature")
+	}
+}
+
+// parameterSource reports whether a set parameter came from the client or the model's defaults
+func (m Generate) parameterSource(parameter string) string {
+	if slices.Contains(m.Defaulted, parameter) {
+		return "default"
+	}
+	return "client"
+}
+
+func targetURL(model user.Model, pathToAdd string) url.URL {
+	// Clone the URL to avoid mutating the original
+	targetURL := *model.APIURL
+	targetURL.Path = path.Join(targetURL.Path, pathToAdd)
+	return targetURL
+}
+
+// ToMap is the request body in the format the model's provider expects
 func (m Generate) ToMap() map[string]interface{} {
+	if FormatForProvider(m.Model.Provider) == FormatAnthropic {
+		return m.toAnthropicMap()
+	}
+
 	// Start with required parameters
 	requestMap := map[string]interface{}{
 		"model":    m.Model.Model.String(),
-		"messages": make([]map[string]string, len(m.Messages)),
+		"messages": make([]map[string]interface{}, len(m.Messages)),
 		"stream":   m.IsStreaming,
 	}
 
 	// Convert messages
 	for i, msg := range m.Messages {
-		requestMap["messages"].([]map[string]string)[i] = msg.ToMap()
+		requestMap["messages"].([]map[string]interface{})[i] = msg.ToMap()
 	}
 
 	// Only add optional parameters if they were explicitly set
@@ -152,6 +569,38 @@ func (m Generate) ToMap() map[string]interface{} {
 		requestMap["temperature"] = m.Temperature.Float32()
 	}
 
+	if m.TopP != nil {
+		requestMap["top_p"] = m.TopP.Float32()
+	}
+
+	if m.Stop != nil {
+		requestMap["stop"] = m.Stop.Strings()
+	}
+
+	if m.FrequencyPenalty != nil {
+		requestMap["frequency_penalty"] = m.FrequencyPenalty.Float32()
+	}
+
+	if m.PresencePenalty != nil {
+		requestMap["presence_penalty"] = m.PresencePenalty.Float32()
+	}
+
+	if m.N != nil {
+		requestMap["n"] = m.N.Int()
+	}
+
+	if len(m.Tools) > 0 {
+		requestMap["tools"] = toolMaps(m.Tools)
+	}
+
+	if m.ToolChoice != nil {
+		requestMap["tool_choice"] = m.ToolChoice.Value()
+	}
+
+	if m.ResponseFormat != nil {
+		requestMap["response_format"] = m.ResponseFormat.Value()
+	}
+
 	return requestMap
 }
 
@@ -161,19 +610,58 @@ func (m Generate) ToAuditRequest() audit.Request {
 
 	parameters := map[string]interface{}{
 		"stream":      m.IsStreaming,
-		"max_tokens":  m.MaxTokens,
-		"temperature": m.Temperature,
+		"max_tokens":  nil,
+		"temperature": nil,
+	}
+
+	// Record where each value came from, to tell a client's choice from a model default
+	sources := map[string]string{}
+	if m.MaxTokens != nil {
+		parameters["max_tokens"] = m.MaxTokens.Int()
+		sources["max_tokens"] = m.parameterSource("max_tokens")
+	}
+	if m.Temperature != nil {
+		parameters["temperature"] = m.Temperature.Float32()
+		sources["temperature"] = m.parameterSource("temperature")
+	}
+	if len(sources) > 0 {
+		parameters["parameter_sources"] = sources
+	}
+
+	// Only record the newer sampling parameters when the client sent them
+	if m.TopP != nil {
+		parameters["top_p"] = m.TopP.Float32()
+	}
+	if m.Stop != nil {
+		parameters["stop"] = m.Stop.Strings()
+	}
+	if m.FrequencyPenalty != nil {
+		parameters["frequency_penalty"] = m.FrequencyPenalty.Float32()
+	}
+	if m.PresencePenalty != nil {
+		parameters["presence_penalty"] = m.PresencePenalty.Float32()
+	}
+	if m.N != nil {
+		parameters["n"] = m.N.Int()
+	}
+	if len(m.Tools) > 0 {
+		parameters["tools"] = toolMaps(m.Tools)
+	}
+	if m.ToolChoice != nil {
+		parameters["tool_choice"] = m.ToolChoice.Value()
+	}
+	if m.ResponseFormat != nil {
+		parameters["response_format"] = m.ResponseFormat.Value()
 	}
 
 	var messages []map[string]interface{}
 	for _, message := range m.Messages {
-		msgMap := message.ToMap()
-		// Convert map[string]string to map[string]interface{}
-		interfaceMap := make(map[string]interface{})
-		for k, v := range msgMap {
-			interfaceMap[k] = v
-		}
-		messages = append(messages, interfaceMap)
+		messages = append(messages, message.ToMap())
+	}
+
+	var metadata map[string]string
+	if m.Metadata != nil {
+		metadata = m.Metadata.Map()
 	}
 
 	return audit.Request{
@@ -184,5 +672,14 @@ func (m Generate) ToAuditRequest() audit.Request {
 		Inputs:     messages,
 		Parameters: parameters,
 		ClientIP:   m.ClientIP,
+		Metadata:   metadata,
+	}
+}
+
+func toolMaps(tools []types.ToolDefinition) []map[string]interface{} {
+	maps := make([]map[string]interface{}, len(tools))
+	for i, tool := range tools {
+		maps[i] = tool.ToMap()
 	}
+	return maps
 }
@@ -0,0 +1,61 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Limits bounds the size of a request so an oversized one is rejected before it can
+// exhaust the gateway's memory. A zero field is not checked.
+type Limits struct {
+	MaxBodyBytes    int64 // Size of the raw request body
+	MaxMessages     int   // Number of messages, including a separate system prompt
+	MaxContentChars int   // Characters of message content across all messages
+}
+
+// DefaultLimits are generous enough for long conversations with images
+func DefaultLimits() Limits {
+	return Limits{
+		MaxBodyBytes:    10 << 20,
+		MaxMessages:     1000,
+		MaxContentChars: 1_000_000,
+	}
+}
+
+// TooLargeError is returned for a request over one of its Limits
+type TooLargeError struct {
+	Limit string // The limit exceeded, as named in the error
+	Max   int64
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("request exceeds the %s limit of %d", e.Limit, e.Max)
+}
+
+// LimitBody stops reading the request body past MaxBodyBytes. It must be applied
+// before the body is parsed; a body cut short then fails to parse with a TooLargeError.
+// A body declared larger than the limit is rejected with one straight away.
+func LimitBody(w http.ResponseWriter, r *http.Request, limits Limits) *TooLargeError {
+	if limits.MaxBodyBytes <= 0 {
+		return nil
+	}
+
+	// Reject a declared size up front rather than reading up to the limit first
+	if r.ContentLength > limits.MaxBodyBytes {
+		return &TooLargeError{Limit: "max_body_bytes", Max: limits.MaxBodyBytes}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+	return nil
+}
+
+// malformed classifies an error reading or decoding the body: one that hit the
+// MaxBytesReader becomes a TooLargeError, anything else ErrMalformedBody
+func malformed(err error) Error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &TooLargeError{Limit: "max_body_bytes", Max: maxBytesErr.Limit}
+	}
+	return asRequestError(err, ErrMalformedBody)
+}
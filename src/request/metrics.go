@@ -1,20 +1,194 @@
 package request
 
 import (
+	"covalence/src/tokenizer"
 	"covalence/src/types"
+	"covalence/src/user"
 	"time"
 )
 
 // RequestMetrics collects metrics about the request
 type Metrics struct {
 	StartTime              time.Time
+	QueueTime              time.Duration // Between the server accepting the request and StartTime, plus waits for a backend slot
 	RequestPreparationTime time.Duration
 	HookTime               time.Duration
 	RequestBodyTime        time.Duration
 	UpstreamLatency        time.Duration
+	UpstreamTimeout        time.Duration // The deadline the provider was given
+	TimedOut               bool          // The provider missed UpstreamTimeout
 	TotalProcessTime       time.Duration
 	StatusCode             int
 	Name                   types.Name
 	Model                  types.ModelID
 	StreamingResponse      bool
+	InputTokens            int
+	OutputTokens           int
+	TotalTokens            int
+	CacheHit               bool // Served from the response cache, so no tokens were spent
+
+	// Set once the provider reports usage for a stream, after which chunks are no longer counted
+	streamUsageReported bool
+	// The text generated so far in a stream, counted if the provider never reports usage
+	streamedText []byte
+}
+
+// SetTokens records the token counts from a response's usage block. Both OpenAI
+// (prompt/completion) and Anthropic (input/output) field names are read.
+// Providers that report usage per choice instead, as some do for n > 1, have the
+// output tokens of every choice summed. It reports whether any counts were found.
+func (m *Metrics) SetTokens(response map[string]interface{}) bool {
+	usage, ok := response["usage"].(map[string]interface{})
+	if !ok {
+		return m.setChoiceTokens(response)
+	}
+
+	found := false
+	for _, key := range []string{"prompt_tokens", "input_tokens"} {
+		if n, ok := usage[key].(float64); ok {
+			m.InputTokens = int(n)
+			found = true
+		}
+	}
+	for _, key := range []string{"completion_tokens", "output_tokens"} {
+		if n, ok := usage[key].(float64); ok {
+			m.OutputTokens = int(n)
+			found = true
+		}
+	}
+
+	m.TotalTokens = m.InputTokens + m.OutputTokens
+	return found
+}
+
+// setChoiceTokens sums the usage blocks of individual choices. The prompt is shared,
+// so its tokens are only counted once.
+func (m *Metrics) setChoiceTokens(response map[string]interface{}) bool {
+	choices, _ := response["choices"].([]interface{})
+
+	found := false
+	inputTokens, outputTokens := 0, 0
+	for _, c := range choices {
+		choice, _ := c.(map[string]interface{})
+		usage, ok := choice["usage"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, key := range []string{"prompt_tokens", "input_tokens"} {
+			if n, ok := usage[key].(float64); ok {
+				inputTokens = int(n)
+				found = true
+			}
+		}
+		for _, key := range []string{"completion_tokens", "output_tokens"} {
+			if n, ok := usage[key].(float64); ok {
+				outputTokens += int(n)
+				found = true
+			}
+		}
+	}
+	if !found {
+		return false
+	}
+
+	m.InputTokens = inputTokens
+	m.OutputTokens = outputTokens
+	m.TotalTokens = inputTokens + outputTokens
+	return true
+}
+
+// AddStreamChunk accumulates token counts from one streamed chunk. Usage reported by
+// the provider wins; until it arrives the generated text is kept for CountTokens.
+func (m *Metrics) AddStreamChunk(chunk map[string]interface{}) {
+	// Anthropic reports input usage on message_start
+	if message, ok := chunk["message"].(map[string]interface{}); ok {
+		m.SetTokens(message)
+	}
+
+	if m.SetTokens(chunk) {
+		m.streamUsageReported = true
+		return
+	}
+
+	if m.streamUsageReported {
+		return
+	}
+	m.streamedText = append(m.streamedText, contentDelta(chunk)...)
+}
+
+// CountTokens fills in the counts a provider didn't report with the tokenizer for the
+// model's provider: the input from the request's messages, and the output from the
+// generated text of response, or of the streamed chunks if response is nil
+func (m *Metrics) CountTokens(model user.Model, messages []types.Message, response map[string]interface{}) {
+	tk := tokenizer.ForProvider(model.Provider)
+
+	if m.InputTokens == 0 {
+		m.InputTokens = tk.CountTokens(model.Model, messages)
+	}
+	if m.OutputTokens == 0 {
+		text := string(m.streamedText)
+		if response != nil {
+			text = responseText(response)
+		}
+		m.OutputTokens = tk.CountText(model.Model, text)
+	}
+
+	m.TotalTokens = m.InputTokens + m.OutputTokens
+}
+
+// contentDelta returns the generated text a chunk carries, in either the OpenAI
+// (choices[].delta.content) or Anthropic (content_block_delta) shape
+func contentDelta(chunk map[string]interface{}) string {
+	text := ""
+
+	if choices, ok := chunk["choices"].([]interface{}); ok {
+		for _, raw := range choices {
+			choice, _ := raw.(map[string]interface{})
+			delta, _ := choice["delta"].(map[string]interface{})
+			if content, ok := delta["content"].(string); ok {
+				text += content
+			}
+		}
+	}
+
+	if chunk["type"] == "content_block_delta" {
+		delta, _ := chunk["delta"].(map[string]interface{})
+		if content, ok := delta["text"].(string); ok {
+			text += content
+		}
+	}
+
+	return text
+}
+
+// responseText returns the generated text of a response, in either the OpenAI
+// (choices[].message.content) or Anthropic (content[].text) shape
+func responseText(response map[string]interface{}) string {
+	text := ""
+
+	if choices, ok := response["choices"].([]interface{}); ok {
+		for _, raw := range choices {
+			choice, _ := raw.(map[string]interface{})
+			message, _ := choice["message"].(map[string]interface{})
+			if content, ok := message["content"].(string); ok {
+				text += content
+			}
+		}
+	}
+
+	if blocks, ok := response["content"].([]interface{}); ok {
+		for _, raw := range blocks {
+			block, _ := raw.(map[string]interface{})
+			if content, ok := block["text"].(string); ok {
+				text += content
+			}
+		}
+	}
+
+	return text
+}
+
+// GatewayOverhead is the part of the total processing time not spent waiting on the provider
+func (m Metrics) GatewayOverhead() time.Duration {
+	return m.TotalProcessTime - m.UpstreamLatency
 }
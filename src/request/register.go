@@ -17,6 +17,51 @@ type rawRegister struct {
 	APIURL   string  `json:"api_url" binding:"required"`
 	Provider string  `json:"provider" binding:"required"`
 	Status   *string `json:"status"`
+	// Optional, used to reject requests that would overflow the context window
+	MaxContextTokens *int `json:"max_context_tokens"`
+	// Optional; defaults to the provider's limit
+	MaxTemperature *float32 `json:"max_temperature"`
+	Vision         bool     `json:"vision"`
+	ToolUse        bool     `json:"tool_use"`
+	JSONMode       bool     `json:"json_mode"`
+	StrictRoles    bool     `json:"strict_roles"` // Check role order before the provider does
+	// Optional; sent when the client leaves the parameter out
+	DefaultTemperature *float32 `json:"default_temperature"`
+	DefaultMaxTokens   *int     `json:"default_max_tokens"`
+	// Registered model names to try, in order, if this model's provider fails
+	Fallbacks []string `json:"fallbacks"`
+	// Optional; set on every backend registered under the same name to balance between them
+	Weight *int `json:"weight"`
+	// Optional; unset fields keep their defaults
+	CircuitBreaker *rawBreaker `json:"circuit_breaker"`
+	// Optional; without it requests to the backend are not capped
+	Concurrency *rawConcurrency `json:"concurrency"`
+	// Optional; unset fields keep their defaults, and max_attempts 1 turns retries off
+	Retry *rawRetry `json:"retry"`
+	// Optional; defaults to the gateway's upstream timeout
+	RequestTimeoutMs *int `json:"request_timeout_ms"`
+	// Optional; the provider API key the gateway sends in place of the client's
+	APIKey string `json:"api_key"`
+}
+
+type rawBreaker struct {
+	FailureRate *float64 `json:"failure_rate"` // Between 0 and 1
+	MinRequests *int     `json:"min_requests"`
+	CooldownMs  *int     `json:"cooldown_ms"`
+}
+
+type rawConcurrency struct {
+	MaxInFlight int    `json:"max_in_flight"`
+	Policy      string `json:"policy"`      // wait (the default) or reject
+	MaxWaitMs   *int   `json:"max_wait_ms"` // Defaults to 5 seconds
+}
+
+type rawRetry struct {
+	MaxAttempts *int     `json:"max_attempts"`
+	BaseDelayMs *int     `json:"base_delay_ms"`
+	MaxDelayMs  *int     `json:"max_delay_ms"`
+	Jitter      *float64 `json:"jitter"` // Between 0 and 1
+	Statuses    []int    `json:"statuses"`
 }
 
 func ParseRegister(c *gin.Context) (user.Model, error) {
@@ -28,7 +73,7 @@ func ParseRegister(c *gin.Context) (user.Model, error) {
 
 	name, err := types.NewName(r.Name)
 	if err != nil {
-		return user.Model{}, errors.New("invalid name")
+		return user.Model{}, err
 	}
 
 	provider, err := types.NewModelProvider(r.Provider)
@@ -57,13 +102,178 @@ func ParseRegister(c *gin.Context) (user.Model, error) {
 		return user.Model{}, errors.New("invalid api url")
 	}
 
+	var maxContextTokens int
+	if r.MaxContextTokens != nil {
+		if *r.MaxContextTokens <= 0 {
+			return user.Model{}, errors.New("invalid max context tokens")
+		}
+		maxContextTokens = *r.MaxContextTokens
+	}
+
+	maxTemperature := provider.MaxTemperature()
+	if r.MaxTemperature != nil {
+		if _, err := types.NewTemperature(*r.MaxTemperature); err != nil || *r.MaxTemperature == 0 {
+			return user.Model{}, errors.New("invalid max temperature")
+		}
+		maxTemperature = *r.MaxTemperature
+	}
+
+	var defaultTemperature *types.Temperature
+	if r.DefaultTemperature != nil {
+		temp, err := types.NewTemperature(*r.DefaultTemperature)
+		if err != nil || temp.Float32() > maxTemperature {
+			return user.Model{}, errors.New("invalid default temperature")
+		}
+		defaultTemperature = &temp
+	}
+
+	var defaultMaxTokens *types.MaxTokens
+	if r.DefaultMaxTokens != nil {
+		maxTokens, err := types.NewMaxTokens(*r.DefaultMaxTokens)
+		if err != nil || (maxContextTokens > 0 && maxTokens.Int() > maxContextTokens) {
+			return user.Model{}, errors.New("invalid default max tokens")
+		}
+		defaultMaxTokens = &maxTokens
+	}
+
+	fallbacks := []types.Name{}
+	for _, f := range r.Fallbacks {
+		fallback, err := types.NewName(f)
+		if err != nil {
+			return user.Model{}, errors.New("invalid fallback")
+		}
+		fallbacks = append(fallbacks, fallback)
+	}
+
+	var weight int
+	if r.Weight != nil {
+		if *r.Weight <= 0 {
+			return user.Model{}, errors.New("invalid weight")
+		}
+		weight = *r.Weight
+	}
+
+	breaker := user.DefaultBreakerConfig()
+	if r.CircuitBreaker != nil {
+		if rate := r.CircuitBreaker.FailureRate; rate != nil {
+			if *rate <= 0 || *rate > 1 {
+				return user.Model{}, errors.New("invalid circuit breaker failure rate")
+			}
+			breaker.FailureRate = *rate
+		}
+		if minRequests := r.CircuitBreaker.MinRequests; minRequests != nil {
+			if *minRequests <= 0 {
+				return user.Model{}, errors.New("invalid circuit breaker min requests")
+			}
+			breaker.MinRequests = *minRequests
+		}
+		if cooldown := r.CircuitBreaker.CooldownMs; cooldown != nil {
+			if *cooldown <= 0 {
+				return user.Model{}, errors.New("invalid circuit breaker cooldown")
+			}
+			breaker.Cooldown = time.Duration(*cooldown) * time.Millisecond
+		}
+	}
+
+	var concurrency user.ConcurrencyConfig
+	if r.Concurrency != nil {
+		if r.Concurrency.MaxInFlight <= 0 {
+			return user.Model{}, errors.New("invalid concurrency max in flight")
+		}
+		concurrency = user.ConcurrencyConfig{
+			MaxInFlight: r.Concurrency.MaxInFlight,
+			Policy:      user.ConcurrencyWait,
+			MaxWait:     5 * time.Second,
+		}
+		switch policy := user.ConcurrencyPolicy(r.Concurrency.Policy); policy {
+		case "":
+		case user.ConcurrencyWait, user.ConcurrencyReject:
+			concurrency.Policy = policy
+		default:
+			return user.Model{}, errors.New("invalid concurrency policy")
+		}
+		if maxWait := r.Concurrency.MaxWaitMs; maxWait != nil {
+			if *maxWait <= 0 {
+				return user.Model{}, errors.New("invalid concurrency max wait")
+			}
+			concurrency.MaxWait = time.Duration(*maxWait) * time.Millisecond
+		}
+	}
+
+	retry := user.DefaultRetryConfig()
+	if r.Retry != nil {
+		if maxAttempts := r.Retry.MaxAttempts; maxAttempts != nil {
+			if *maxAttempts <= 0 {
+				return user.Model{}, errors.New("invalid retry max attempts")
+			}
+			retry.MaxAttempts = *maxAttempts
+		}
+		if baseDelay := r.Retry.BaseDelayMs; baseDelay != nil {
+			if *baseDelay <= 0 {
+				return user.Model{}, errors.New("invalid retry base delay")
+			}
+			retry.BaseDelay = time.Duration(*baseDelay) * time.Millisecond
+		}
+		if maxDelay := r.Retry.MaxDelayMs; maxDelay != nil {
+			if *maxDelay <= 0 {
+				return user.Model{}, errors.New("invalid retry max delay")
+			}
+			retry.MaxDelay = time.Duration(*maxDelay) * time.Millisecond
+		}
+		if retry.MaxDelay < retry.BaseDelay {
+			return user.Model{}, errors.New("invalid retry max delay: below the base delay")
+		}
+		if jitter := r.Retry.Jitter; jitter != nil {
+			if *jitter < 0 || *jitter > 1 {
+				return user.Model{}, errors.New("invalid retry jitter")
+			}
+			retry.Jitter = *jitter
+		}
+		if r.Retry.Statuses != nil {
+			for _, status := range r.Retry.Statuses {
+				if status < 400 || status > 599 {
+					return user.Model{}, errors.New("invalid retry status")
+				}
+			}
+			retry.Statuses = r.Retry.Statuses
+		}
+	}
+
+	var requestTimeout time.Duration
+	if r.RequestTimeoutMs != nil {
+		if *r.RequestTimeoutMs <= 0 {
+			return user.Model{}, errors.New("invalid request timeout")
+		}
+		requestTimeout = time.Duration(*r.RequestTimeoutMs) * time.Millisecond
+	}
+
+	var keys *user.ProviderKeys
+	if r.APIKey != "" {
+		keys = user.NewProviderKeys(r.APIKey)
+	}
+
 	return user.Model{
-		Name:      name,
-		Model:     modelID,
-		APIURL:    apiURL,
-		CreatedAt: time.Now(),
-		Provider:  provider,
-		Status:    status,
+		Name:               name,
+		Model:              modelID,
+		APIURL:             apiURL,
+		CreatedAt:          time.Now(),
+		Provider:           provider,
+		Status:             status,
+		MaxContextTokens:   maxContextTokens,
+		MaxTemperature:     maxTemperature,
+		Vision:             r.Vision,
+		ToolUse:            r.ToolUse,
+		JSONMode:           r.JSONMode,
+		StrictRoles:        r.StrictRoles,
+		Fallbacks:          fallbacks,
+		Weight:             weight,
+		Breaker:            breaker,
+		Concurrency:        concurrency,
+		Retry:              retry,
+		RequestTimeout:     requestTimeout,
+		Keys:               keys,
+		DefaultTemperature: defaultTemperature,
+		DefaultMaxTokens:   defaultMaxTokens,
 	}, nil
 
 }
@@ -0,0 +1,60 @@
+package request
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// FieldError is a problem with a single field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	err Error
+}
+
+// ValidationError collects every invalid field of a request so clients can fix them in one go
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = fmt.Sprintf("%s: %s", f.Field, f.Message)
+	}
+	return "invalid request: " + strings.Join(messages, "; ")
+}
+
+// ParseOptions controls how a request is validated
+type ParseOptions struct {
+	// FailFast stops at the first invalid field instead of collecting them all
+	FailFast bool
+	// TrustedProxies may report the client's address in forwarding headers
+	TrustedProxies []netip.Prefix
+	// Limits caps the number of messages and their total content
+	Limits Limits
+}
+
+// validator accumulates field errors while a request is parsed
+type validator struct {
+	failFast bool
+	errs     ValidationError
+}
+
+// add records an error for field and reports whether parsing should stop
+func (v *validator) add(field string, err error) bool {
+	reqErr := asRequestError(err, ErrInvalidParameter)
+	v.errs.Fields = append(v.errs.Fields, FieldError{Field: field, Code: reqErr.Code(), Message: err.Error(), err: reqErr})
+	return v.failFast
+}
+
+// err returns the accumulated errors, or nil if there were none
+func (v *validator) err() error {
+	if len(v.errs.Fields) == 0 {
+		return nil
+	}
+	return &v.errs
+}
@@ -0,0 +1,136 @@
+package router
+
+import (
+	"covalence/src/audit"
+	"covalence/src/db/postgres"
+	"covalence/src/logging"
+	"covalence/src/user"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequireScope aborts with 403 unless the authenticated API key was granted scope.
+// It must run after Authenticate.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := c.MustGet("user").(user.User)
+		if !u.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + scope + " scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetTrace returns the full audit trace of a request: inputs, response, firewall
+// events, token usage and latencies
+func GetTrace(c *gin.Context) {
+
+	db := c.MustGet("db").(*postgres.DB)
+
+	requestID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request ID"})
+		return
+	}
+
+	trace, err := audit.GetTrace(c.Request.Context(), requestID.String(), db)
+	if errors.Is(err, audit.ErrTraceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "trace not found", "request_id": requestID.String()})
+		return
+	}
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to get trace", "request_id", requestID.String(), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get trace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, trace)
+}
+
+// ExplainTrace returns why a request was or wasn't blocked: its firewall evaluations in
+// order, each score against its threshold, the aggregation policy and what decided it
+func ExplainTrace(c *gin.Context) {
+
+	db := c.MustGet("db").(*postgres.DB)
+
+	requestID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request ID"})
+		return
+	}
+
+	trace, err := audit.GetTrace(c.Request.Context(), requestID.String(), db)
+	if errors.Is(err, audit.ErrTraceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "trace not found", "request_id": requestID.String()})
+		return
+	}
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to get trace", "request_id", requestID.String(), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get trace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, audit.Explain(trace))
+}
+
+// exportAbandonAfter is how long an export waits on a request with no response before
+// passing it, taking the gateway to have crashed or dropped it. It is well beyond any
+// request's deadline, retries and fallbacks, so a long stream is never exported half
+// done.
+const exportAbandonAfter = time.Hour
+
+// ExportTraces streams the traces received after the since cursor as newline-delimited
+// JSON, oldest first, for a loader to pull incrementally. Each trace is flushed as it
+// is written. The cursor to pass as since next time is sent in the X-Export-Cursor
+// trailer; if the export fails part way, it is the cursor of the last trace sent and
+// X-Export-Error says why. Resuming from it repeats nothing, but a client that drops
+// the connection may not have kept every trace sent, so the feed is at least once.
+func ExportTraces(c *gin.Context) {
+
+	db := c.MustGet("db").(*postgres.DB)
+
+	cursor, err := audit.ParseExportCursor(c.Query("since"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Trailer", "X-Export-Cursor, X-Export-Error")
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+
+	// Stop before the oldest request still waiting on its response. If nothing has
+	// settled since the cursor, there is nothing to send yet.
+	to, err := audit.SettledBefore(c.Request.Context(), cursor, exportAbandonAfter, db)
+	if err == nil && cursor.ReceivedAt.Before(to) {
+		cursor, err = audit.ResumeExportTraces(c.Request.Context(), cursor, to, flushWriter{c.Writer}, db)
+	}
+
+	if err != nil {
+		if c.Request.Context().Err() != nil {
+			logging.FromContext(c.Request.Context()).Info("trace export stopped by the client", "cursor", cursor.RequestID, "error", err)
+			return
+		}
+		logging.FromContext(c.Request.Context()).Error("trace export failed", "cursor", cursor.RequestID, "error", err)
+		c.Writer.Header().Set("X-Export-Error", "export failed; resume from the cursor")
+	}
+	c.Writer.Header().Set("X-Export-Cursor", cursor.String())
+}
+
+// flushWriter sends each write to the client straight away, rather than letting a long
+// response collect in the buffer
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.Flush()
+	return n, err
+}
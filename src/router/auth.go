@@ -0,0 +1,115 @@
+package router
+
+import (
+	"covalence/src/db/postgres"
+	"covalence/src/logging"
+	"covalence/src/types"
+	"covalence/src/user"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Authenticate resolves the Bearer API key to a user and stores it in the context as
+// "user", with its IDs under "userID" and "apiKeyID". Requests without a valid key
+// are aborted with 401.
+func Authenticate(c *gin.Context) {
+
+	db := c.MustGet("db").(*postgres.DB)
+
+	// Expecting format: "Bearer <apikey>"
+	authHeader := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid Authorization header"})
+		return
+	}
+	apiKey := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+
+	u, err := user.GetUserByAPIKey(c.Request.Context(), apiKey, db)
+	if errors.Is(err, user.ErrInvalidAPIKey) || errors.Is(err, user.ErrRevokedAPIKey) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to look up API key", "error", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to authenticate"})
+		return
+	}
+
+	c.Set("user", u)
+	c.Set("userID", u.ID.String())
+	c.Set("apiKeyID", u.APIKeyID.String())
+	c.Next()
+}
+
+func CreateAPIKey(c *gin.Context) {
+
+	db := c.MustGet("db").(*postgres.DB)
+
+	var body struct {
+		UserID string   `json:"user_id" binding:"required"`
+		Scopes []string `json:"scopes"` // Such as "admin"; none by default
+		// Registered model names the key may call; every model if left out
+		AllowedModels []string `json:"allowed_models"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, err := uuid.Parse(body.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+		return
+	}
+
+	allowedModels := make([]string, 0, len(body.AllowedModels))
+	for _, model := range body.AllowedModels {
+		name, err := types.NewName(model)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid allowed_models entry %q: %v", model, err)})
+			return
+		}
+		allowedModels = append(allowedModels, name.String())
+	}
+
+	apiKey, u, err := user.CreateAPIKey(c.Request.Context(), userID, body.Scopes, allowedModels, db)
+	if errors.Is(err, user.ErrUnknownScope) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to create API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API key"})
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("API key created", "api_key_id", u.APIKeyID.String(), "user_id", u.ID.String(), "scopes", u.Scopes, "allowed_models", u.AllowedModels)
+	c.JSON(http.StatusOK, gin.H{"api_key": apiKey, "api_key_id": u.APIKeyID.String(), "user_id": u.ID.String(), "scopes": u.Scopes, "allowed_models": u.AllowedModels})
+}
+
+func RevokeAPIKey(c *gin.Context) {
+
+	db := c.MustGet("db").(*postgres.DB)
+
+	apiKeyID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid API key ID"})
+		return
+	}
+
+	err = user.RevokeAPIKey(c.Request.Context(), apiKeyID, db)
+	if errors.Is(err, user.ErrAPIKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to revoke API key", "api_key_id", apiKeyID.String(), "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke API key"})
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("API key revoked", "api_key_id", apiKeyID.String())
+	c.JSON(http.StatusOK, gin.H{"status": "API key revoked", "api_key_id": apiKeyID.String()})
+}
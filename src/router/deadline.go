@@ -0,0 +1,71 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultMaxRequestTimeout caps the deadline a client can ask for when the gateway
+// doesn't configure its own maximum
+const DefaultMaxRequestTimeout = 5 * time.Minute
+
+// requestTimeoutKey carries the timeout a client set on its request's context
+type requestTimeoutKey struct{}
+
+// RequestDeadline gives a request the deadline its client asked for in X-Timeout-Ms,
+// clamped to maxTimeout. Everything the request does with its context shares it:
+// authentication, the firewalls and the upstream call. Audit writes recording the
+// request and its outcome use auditContext, so a request that ran out of time is still
+// logged. The timeout applied is echoed back in the same header. WebSocket upgrades are left alone, since
+// the header would otherwise bound the whole session.
+func RequestDeadline(maxTimeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		raw := c.GetHeader("X-Timeout-Ms")
+		if raw == "" || c.IsWebsocket() {
+			c.Next()
+			return
+		}
+
+		ms, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || ms <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "X-Timeout-Ms must be a positive number of milliseconds"})
+			return
+		}
+		timeout := min(time.Duration(ms)*time.Millisecond, maxTimeout)
+
+		ctx := context.WithValue(c.Request.Context(), requestTimeoutKey{}, timeout)
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Header("X-Timeout-Ms", strconv.FormatInt(timeout.Milliseconds(), 10))
+		c.Next()
+	}
+}
+
+// requestTimeout returns the timeout the client set on the request, if it set one
+func requestTimeout(ctx context.Context) (time.Duration, bool) {
+	timeout, ok := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	return timeout, ok
+}
+
+// auditTimeout bounds an audit write made after the request's own context has ended
+const auditTimeout = 5 * time.Second
+
+// auditContext returns a context for writing a request's trace that outlives the
+// request's own, which may be the one that expired. The caller must call cancel.
+func auditContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(c.Request.Context()), auditTimeout)
+}
+
+// deadlineExceeded reports whether the request ran out its client's deadline, as
+// opposed to the client going away
+func deadlineExceeded(c *gin.Context) bool {
+	_, ok := requestTimeout(c.Request.Context())
+	return ok && errors.Is(c.Request.Context().Err(), context.DeadlineExceeded)
+}
@@ -1,82 +1,179 @@
 package router
 
 import (
+	"bytes"
 	"context"
 	"covalence/src/audit"
 	"covalence/src/db/postgres"
 	"covalence/src/firewall"
+	"covalence/src/logging"
+	"covalence/src/monitoring"
+	"covalence/src/quota"
+	"covalence/src/ratelimit"
 	"covalence/src/register"
 	"covalence/src/request"
-	"covalence/src/utils"
+	"covalence/src/user"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func Generate(c *gin.Context, firewallConfig *firewall.Config, hook func(*gin.Context, *request.Generate, *firewall.Config) (int, error)) {
+// maxClientRequestIDLength bounds the X-Request-Id header stored with a request
+const maxClientRequestIDLength = 255
+
+// forwardedHeaders are the client headers copied onto upstream requests
+var forwardedHeaders = []string{
+	"Authorization", "Content-Type", "Accept", "User-Agent",
+	"OpenAI-Organization", "Anthropic-Version", "X-Request-ID",
+}
+
+func Generate(
+	c *gin.Context,
+	firewallConfig *firewall.Config,
+	hook func(*gin.Context, *request.Generate, *firewall.Config) (firewall.FirewallResult, error),
+	outputHook func(*gin.Context, *request.Generate, map[string]interface{}, *firewall.Config) (map[string]interface{}, bool, error),
+	streamGuard func(*gin.Context, *request.Generate, *firewall.Config) *firewall.StreamGuard,
+) {
 
 	registry := c.MustGet("registry").(*register.Registry)
 	httpClient := c.MustGet("httpClient").(*http.Client)
 	db := c.MustGet("db").(*postgres.DB)
+	auditOptions := c.MustGet("auditOptions").(audit.Options)
+	auditWriter := c.MustGet("auditWriter").(*audit.Writer)
 
 	// ========================= Request Metrics =========================
 
 	metrics := request.Metrics{
 		StartTime: time.Now(),
 	}
+	if acceptedAt, ok := c.Get("acceptedAt"); ok {
+		metrics.QueueTime = metrics.StartTime.Sub(acceptedAt.(time.Time))
+	}
 
 	// Defer function to log metrics
 	defer func() {
 		metrics.TotalProcessTime = time.Since(metrics.StartTime)
+		if metrics.StatusCode == 0 {
+			metrics.StatusCode = c.Writer.Status()
+		}
+		monitoring.Record(metrics)
 
-		logData, _ := json.Marshal(map[string]interface{}{
-			"timestamp":              time.Now().Format(time.RFC3339),
+		logging.FromContext(c.Request.Context()).Info("request metrics", "metrics", map[string]interface{}{
 			"name":                   metrics.Name.String(),
 			"model":                  metrics.Model.String(),
 			"status":                 metrics.StatusCode,
+			"queue_ms":               metrics.QueueTime.Milliseconds(),
 			"request_preparation_ms": metrics.RequestPreparationTime.Milliseconds(),
 			"hook_time_ms":           metrics.HookTime.Milliseconds(),
 			"body_process_ms":        metrics.RequestBodyTime.Milliseconds(),
 			"upstream_ms":            metrics.UpstreamLatency.Milliseconds(),
+			"upstream_timeout_ms":    metrics.UpstreamTimeout.Milliseconds(),
+			"timed_out":              metrics.TimedOut,
 			"total_ms":               metrics.TotalProcessTime.Milliseconds(),
 			"streaming":              metrics.StreamingResponse,
+			"input_tokens":           metrics.InputTokens,
+			"output_tokens":          metrics.OutputTokens,
+			"total_tokens":           metrics.TotalTokens,
+			"cache_hit":              metrics.CacheHit,
 			"path":                   c.Param("path"),
 		})
-
-		utils.BoxLog(fmt.Sprintf("request_metrics: %s", logData))
 	}()
 
 	// ========================= Read & Parse Request =========================
 
-	utils.BoxLog(fmt.Sprintf("reading & parsing request made to %s 🚀", c.Param("path")))
+	logging.FromContext(c.Request.Context()).Debug("parsing request", "path", c.Param("path"))
 
 	requestPreparationStart := time.Now()
 
-	generateRequest, err := request.ParseGenerate(c, registry)
+	// Requests to the Messages endpoint are in Anthropic's format
+	parse := request.ParseGenerate
+	if request.FormatForPath(c.Param("path")) == request.FormatAnthropic {
+		parse = request.ParseAnthropicGenerate
+	}
+	parseOptions := request.ParseOptions{Limits: request.DefaultLimits()}
+	if trusted, ok := c.Get("trustedProxies"); ok {
+		parseOptions.TrustedProxies = trusted.([]netip.Prefix)
+	}
+	if limits, ok := c.Get("requestLimits"); ok {
+		parseOptions.Limits = limits.(request.Limits)
+	}
+
+	// Cap the body before anything reads it, so an oversized one is never held in memory
+	if err := request.LimitBody(c.Writer, c.Request, parseOptions.Limits); err != nil {
+		rejectRequest(c, err)
+		return
+	}
+	generateRequest, err := parse(c, registry, parseOptions)
 	if err != nil {
+		var reqErr request.Error
+		if errors.As(err, &reqErr) {
+			rejectRequest(c, reqErr)
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	// ========================= Audit: Log Request =========================
 
-	utils.BoxLog("audit loggging: request 📝")
+	logging.FromContext(c.Request.Context()).Debug("logging request")
+
+	// ========================= Idempotency =========================
+
+	// A retried request with a completed ID gets the response its client was originally
+	// sent instead of a second upstream call. Streamed requests, and requests whose
+	// response failed, was blocked or was sampled out, are always re-run.
+	clientRequestID := strings.TrimSpace(c.GetHeader("X-Request-Id"))
+	if len(clientRequestID) > maxClientRequestIDLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("X-Request-Id cannot exceed %d characters", maxClientRequestIDLength)})
+		return
+	}
+	if clientRequestID != "" && !generateRequest.IsStreaming {
+		completed, found, err := audit.FindCompletedRequest(c.Request.Context(), generateRequest.User.ID.String(), clientRequestID, db)
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Error("failed to look up completed request", "client_request_id", clientRequestID, "error", err)
+		} else if found {
+			logging.FromContext(c.Request.Context()).Info("replaying completed request", "replayed_request_id", completed.RequestID)
+			c.Header("X-Request-Id", clientRequestID)
+			c.Data(completed.Status, "application/json; charset=utf-8", completed.Body)
+			return
+		}
+	}
 
 	auditRequest := generateRequest.ToAuditRequest()
-	requestID, err := audit.LogRequest(c.Request.Context(), auditRequest, db)
+	auditRequest.ClientRequestID = clientRequestID
+	// The request is logged even if it runs out of time, as are the responses below
+	auditCtx, cancelAudit := auditContext(c)
+	requestID, err := auditWriter.LogRequestTyped(auditCtx, auditRequest, generateRequest.Messages, auditOptions)
+	cancelAudit()
+	if err != nil && deadlineExceeded(c) {
+		timeout, _ := requestTimeout(c.Request.Context())
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "request deadline exceeded", "status": "timeout", "timeout_ms": timeout.Milliseconds()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log request"})
 		return
 	}
 
-	// Set RequestID
+	// Set RequestID, and tag everything logged for the request with it
 	c.Set("requestID", requestID)
+	if turn, ok := c.Request.Context().Value(sessionTurnKey{}).(*sessionTurn); ok {
+		turn.requestID = requestID
+		if err := audit.LogSessionTurn(c.Request.Context(), turn.sessionID, turn.turn, requestID, db); err != nil {
+			logging.FromContext(c.Request.Context()).Error("failed to log session turn", "error", err)
+		}
+	}
+	c.Request = c.Request.WithContext(logging.WithRequest(c.Request.Context(), requestID, generateRequest.User.ID.String(), generateRequest.Model.Model.String()))
 
 	// ========================= Init Metrics =========================
 
@@ -84,74 +181,400 @@ func Generate(c *gin.Context, firewallConfig *firewall.Config, hook func(*gin.Co
 	metrics.Name = generateRequest.Model.Name
 	metrics.Model = generateRequest.Model.Model
 
+	// ========================= Rate Limit =========================
+
+	// Limited requests stay in the audit log, with the rejection as their response
+	if limiter, ok := c.Get("rateLimiter"); ok {
+		apiKeyID := generateRequest.User.APIKeyID.String()
+		decision, err := limiter.(ratelimit.Limiter).Allow(c.Request.Context(), apiKeyID)
+		if err != nil {
+			// Fail open rather than turn a limiter outage into a gateway outage
+			logging.FromContext(c.Request.Context()).Warn("rate limiter unavailable, admitting request", "error", err)
+		} else if !decision.Allowed {
+			retryAfter := max(1, int(math.Ceil(decision.RetryAfter.Seconds())))
+			body := gin.H{"error": "rate limit exceeded", "status": "rate_limited", "retry_after_seconds": retryAfter}
+
+			logging.FromContext(c.Request.Context()).Info("rate limited", "api_key_id", apiKeyID)
+			monitoring.RecordRateLimited()
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(http.StatusTooManyRequests, body)
+
+			err = auditWriter.LogResponse(c.Request.Context(), audit.Response{
+				RequestID: requestID,
+				Response:  body,
+				LatencyMs: time.Since(metrics.StartTime).Milliseconds(),
+			})
+			if err != nil {
+				logging.FromContext(c.Request.Context()).Error("failed to log response", "error", err)
+			}
+			return
+		}
+	}
+
+	// ========================= Quota =========================
+
+	// Over-quota requests are logged with the rejection as their response too
+	if checker, ok := c.Get("quota"); ok {
+		userID := generateRequest.User.ID.String()
+		decision, err := checker.(*quota.Checker).Check(c.Request.Context(), userID)
+		if err != nil {
+			// Fail open, as for the rate limiter
+			logging.FromContext(c.Request.Context()).Warn("quota check failed, admitting request", "error", err)
+		} else if !decision.Allowed {
+			body := gin.H{"error": "token quota exceeded", "code": "quota_exceeded", "used": decision.Used, "limit": decision.Limit}
+
+			logging.FromContext(c.Request.Context()).Info("over quota")
+			c.JSON(http.StatusTooManyRequests, body)
+
+			err = auditWriter.LogResponse(c.Request.Context(), audit.Response{
+				RequestID: requestID,
+				Response:  body,
+				LatencyMs: time.Since(metrics.StartTime).Milliseconds(),
+			})
+			if err != nil {
+				logging.FromContext(c.Request.Context()).Error("failed to log response", "error", err)
+			}
+			return
+		}
+	}
+
 	hookStartTime := time.Now()
 
 	// ========================= Run Hook ===========================
 
 	if hook != nil {
-		utils.BoxLog("entering hook function ✅")
-		if status, err := hook(c, &generateRequest, firewallConfig); err != nil {
-			c.JSON(status, gin.H{"error": err.Error()})
+		logging.FromContext(c.Request.Context()).Debug("running input firewalls")
+		result, err := hook(c, &generateRequest, firewallConfig)
+		if err != nil && deadlineExceeded(c) {
+			respondTimeout(c, auditWriter, requestID, &metrics, nil)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if result.Blocked {
+			c.JSON(result.Status(), gin.H{"error": result.Reason(), "risk_score": result.RiskScore})
 			return
 		}
 	} else {
-		utils.BoxLog("no hook function provided ❌")
+		logging.FromContext(c.Request.Context()).Debug("no input firewall hook provided")
 	}
 
 	metrics.HookTime = time.Since(hookStartTime)
 
-	// ========================= Build Request =========================
-	utils.BoxLog("building request 🏗️")
+	// ========================= Mirror ===========================
 
-	bodyProcessStart := time.Now()
-	requestData := generateRequest.ToMap()
-	modifiedRequestBody, err := json.Marshal(requestData)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request to json"})
-		return
+	// Only requests the firewalls let through are copied to the shadow model
+	mirror(c, generateRequest, requestID)
+
+	// ========================= Response Cache =========================
+
+	// Deterministic requests already answered are served without the provider. Hits
+	// still go through the output firewalls, which may have changed since the response
+	// was stored.
+	var responseCache *request.ResponseCache
+	if value, ok := c.Get("responseCache"); ok {
+		responseCache = value.(*request.ResponseCache)
 	}
+	cacheKey := ""
+	if responseCache != nil && generateRequest.Cacheable() {
+		cacheKey = generateRequest.CacheKey()
+		if cached, ok := responseCache.Get(cacheKey); ok {
+			logging.FromContext(c.Request.Context()).Info("serving cached response")
+			metrics.CacheHit = true
+			cachedResponse := cached
+			replaced := false
+			if outputHook != nil {
+				cachedResponse, replaced, err = outputHook(c, &generateRequest, cached, firewallConfig)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to evaluate response", "message": err.Error()})
+					return
+				}
+			}
 
-	// Create context for the request
-	ctx, cancel := context.WithTimeout(c.Request.Context(), 55*time.Second)
-	defer cancel()
+			// The usage reported is what the original response cost
+			var usage request.Metrics
+			usage.SetTokens(cached)
+			var served interface{} = cachedResponse
+			if body, ok := clientEnvelope(c, requestID, generateRequest, cachedResponse, usage); ok {
+				served = body
+			}
+			c.JSON(http.StatusOK, served)
 
-	// Create and send the proxied request
-	proxyReq, err := http.NewRequestWithContext(ctx, c.Request.Method, generateRequest.TargetURL.String(), strings.NewReader(string(modifiedRequestBody)))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
-		return
+			metrics.TotalProcessTime = time.Since(metrics.StartTime)
+			auditResponse := audit.Response{
+				RequestID:  requestID,
+				Response:   cached,
+				LatencyMs:  metrics.TotalProcessTime.Milliseconds(),
+				ServedBy:   generateRequest.Model.Name.String(),
+				CacheHit:   true,
+				SampledOut: !replaced && !auditOptions.Sampling.Keep(requestID),
+			}
+			// Blocked responses aren't replayed, as on the upstream path
+			if !replaced {
+				auditResponse.ClientResponse, _ = json.Marshal(served)
+				auditResponse.ClientStatus = http.StatusOK
+			}
+			auditCtx, cancelAudit = auditContext(c)
+			defer cancelAudit()
+			err = auditWriter.LogResponse(auditCtx, auditResponse)
+			if err != nil {
+				logging.FromContext(c.Request.Context()).Error("failed to log response", "error", err)
+			}
+			return
+		}
 	}
 
-	// Copy important headers
-	safeHeaders := []string{
-		"Authorization", "Content-Type", "Accept", "User-Agent",
-		"OpenAI-Organization", "Anthropic-Version", "X-Request-ID",
+	// ========================= Upstream With Fallbacks =========================
+
+	candidates := []user.Model{generateRequest.Model}
+	for _, name := range generateRequest.Model.Fallbacks {
+		fallback, ok := registry.GetInfo(name.String())
+		if !ok {
+			logging.FromContext(c.Request.Context()).Warn("fallback model is no longer registered, skipping", "fallback", name.String())
+			continue
+		}
+		if !generateRequest.User.AllowsModel(fallback.Name, registry.NameCase) {
+			logging.FromContext(c.Request.Context()).Info("fallback model is not allowed for the API key, skipping", "fallback", name.String())
+			continue
+		}
+		// The request was only validated against the model it asked for
+		if err := generateRequest.WithModel(fallback, c.Param("path")).CheckCapabilities(); err != nil {
+			logging.FromContext(c.Request.Context()).Info("fallback model can't serve the request, skipping", "fallback", name.String(), "reason", err)
+			continue
+		}
+		candidates = append(candidates, fallback)
 	}
 
-	for _, header := range safeHeaders {
-		if value := c.GetHeader(header); value != "" {
-			proxyReq.Header.Set(header, value)
+	// Skip providers failing their health checks, unless that would leave nothing to try
+	healthy := []user.Model{}
+	for _, candidate := range candidates {
+		if registry.Healthy(candidate) {
+			healthy = append(healthy, candidate)
+		} else {
+			logging.FromContext(c.Request.Context()).Warn("skipping unhealthy backend", "candidate", candidate.Name.String(), "api_url", candidate.APIURL.String())
 		}
 	}
+	if len(healthy) > 0 {
+		candidates = healthy
+	}
 
-	// Ensure proper content type
-	if proxyReq.Header.Get("Content-Type") == "" {
-		proxyReq.Header.Set("Content-Type", "application/json")
+	// Streamed events are passed through unconverted, so only providers speaking the
+	// client's format can serve them. The requested model always does.
+	if generateRequest.IsStreaming {
+		streamable := []user.Model{}
+		for _, candidate := range candidates {
+			if request.FormatForProvider(candidate.Provider) == generateRequest.ClientFormat {
+				streamable = append(streamable, candidate)
+			} else {
+				logging.FromContext(c.Request.Context()).Info("skipping model, its format can't be streamed to the client", "candidate", candidate.Name.String())
+			}
+		}
+		if len(streamable) > 0 {
+			candidates = streamable
+		}
 	}
 
-	// Make the upstream request
-	metrics.RequestBodyTime = time.Since(bodyProcessStart)
+	var resp *http.Response
+	var attempts []audit.Attempt
+	var upstreamStart time.Time
+	var upstreamCtx context.Context
+	var cancelUpstream context.CancelFunc
+	for i, candidate := range candidates {
+		last := i == len(candidates)-1
+		attemptRequest := generateRequest.WithModel(candidate, c.Param("path"))
 
-	utils.BoxLog(fmt.Sprintf("making request to %s 🚀", generateRequest.TargetURL.String()))
-	upstreamStart := time.Now()
-	resp, err := httpClient.Do(proxyReq)
-	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": "upstream service unavailable", "message": err.Error()})
-		return
+		// Fail fast on a backend whose circuit is open instead of waiting on it
+		breaker := registry.Breakers.For(candidate)
+		if !breaker.Allow() {
+			attempts = append(attempts, audit.Attempt{
+				Model:   candidate.Name.String(),
+				Backend: attemptRequest.TargetURL.String(),
+				Error:   "circuit open",
+			})
+			if last {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "upstream service unavailable", "message": "circuit open"})
+				return
+			}
+			logging.FromContext(c.Request.Context()).Warn("circuit open, falling back", "candidate", candidate.Name.String())
+			continue
+		}
+
+		// Hold a slot on the backend until its response has been read. Waiting for one is
+		// queueing like any other.
+		limiter := registry.Limiters.For(candidate)
+		waitStart := time.Now()
+		release, err := limiter.Acquire(c.Request.Context())
+		metrics.QueueTime += time.Since(waitStart)
+		if err != nil {
+			attempts = append(attempts, audit.Attempt{
+				Model:   candidate.Name.String(),
+				Backend: attemptRequest.TargetURL.String(),
+				Error:   err.Error(),
+			})
+			if last || !errors.Is(err, register.ErrSaturated) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "upstream service unavailable", "message": err.Error()})
+				return
+			}
+			logging.FromContext(c.Request.Context()).Warn("concurrency limit reached, falling back", "candidate", candidate.Name.String())
+			continue
+		}
+		// Released and taken again while waiting to retry, so the slot held may change
+		defer func() { release() }()
+
+		logging.FromContext(c.Request.Context()).Debug("building upstream request", "candidate", candidate.Name.String())
+
+		bodyProcessStart := time.Now()
+		requestData := attemptRequest.ToMap()
+		modifiedRequestBody, err := json.Marshal(requestData)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request to json"})
+			return
+		}
+
+		// Create context for the request; each attempt gets its own model's deadline
+		timeout := upstreamTimeout(candidate)
+		metrics.UpstreamTimeout = timeout
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+
+		// Create the proxied request; it is built again if a rotated key has to be tried
+		newRequest := func() (*http.Request, error) {
+			proxyReq, err := http.NewRequestWithContext(ctx, c.Request.Method, attemptRequest.TargetURL.String(), bytes.NewReader(modifiedRequestBody))
+			if err != nil {
+				return nil, err
+			}
+
+			// Copy important headers
+			for _, header := range forwardedHeaders {
+				if value := c.GetHeader(header); value != "" {
+					proxyReq.Header.Set(header, value)
+				}
+			}
+
+			// Ensure proper content type
+			if proxyReq.Header.Get("Content-Type") == "" {
+				proxyReq.Header.Set("Content-Type", "application/json")
+			}
+			return proxyReq, nil
+		}
+
+		// Make the upstream request
+		metrics.RequestBodyTime = time.Since(bodyProcessStart)
+
+		logging.FromContext(c.Request.Context()).Debug("calling upstream", "url", attemptRequest.TargetURL.String())
+		var keyIndex *int
+		var attemptStart time.Time
+		retry, waitFailed := 0, false
+		// Upstream latency runs from the first call, through retries and fallbacks
+		if upstreamStart.IsZero() {
+			upstreamStart = time.Now()
+		}
+		for ; ; retry++ {
+			attemptStart = time.Now()
+			resp, keyIndex, err = doUpstream(httpClient, candidate, newRequest)
+			if err != nil || !shouldRetry(candidate.Retry, retry, resp) {
+				break
+			}
+
+			// Retry a transient error on the same backend, as long as it can finish in time
+			delay, ok := retryDelay(ctx, candidate.Retry, retry, resp)
+			if !ok {
+				break
+			}
+			attempts = append(attempts, audit.Attempt{
+				Model:     candidate.Name.String(),
+				Backend:   attemptRequest.TargetURL.String(),
+				Status:    resp.StatusCode,
+				LatencyMs: time.Since(attemptStart).Milliseconds(),
+				KeyIndex:  keyIndex,
+				Retry:     retry,
+			})
+			breaker.Record(resp.StatusCode >= http.StatusInternalServerError)
+			resp.Body.Close()
+			resp = nil
+
+			// The slot is given back while waiting, so other requests can use the backend
+			release()
+			logging.FromContext(c.Request.Context()).Warn("upstream returned a retryable status, retrying", "candidate", candidate.Name.String(), "status", attempts[len(attempts)-1].Status, "delay", delay)
+			if err = sleep(ctx, delay); err == nil {
+				waitStart := time.Now()
+				release, err = limiter.Acquire(ctx)
+				metrics.QueueTime += time.Since(waitStart)
+			}
+			// The retry was never sent, so the failed wait belongs to the call before it
+			if err != nil {
+				release = func() {}
+				attempts[len(attempts)-1].Error = err.Error()
+				waitFailed = true
+				break
+			}
+		}
+		if errors.Is(err, errBuildRequest) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
+			return
+		}
+
+		attempt := audit.Attempt{
+			Model:     candidate.Name.String(),
+			Backend:   attemptRequest.TargetURL.String(),
+			LatencyMs: time.Since(attemptStart).Milliseconds(),
+			KeyIndex:  keyIndex,
+			Retry:     retry,
+		}
+		if err != nil {
+			if !waitFailed {
+				attempt.Error = err.Error()
+				attempts = append(attempts, attempt)
+			}
+
+			// A client that has gone away says nothing about the provider, and a failed wait
+			// to retry was already recorded with the call before it
+			clientGone := c.Request.Context().Err() != nil
+			if !clientGone && !waitFailed {
+				breaker.Record(true)
+			}
+
+			// A request past its own deadline, or whose last candidate timed out, is a timeout
+			if deadlineExceeded(c) || (last && errors.Is(ctx.Err(), context.DeadlineExceeded)) {
+				metrics.UpstreamLatency = time.Since(upstreamStart)
+				respondTimeout(c, auditWriter, requestID, &metrics, attempts)
+				return
+			}
+			// Don't fall back for a client that has gone away
+			if last || clientGone {
+				c.JSON(http.StatusBadGateway, gin.H{"error": "upstream service unavailable", "message": err.Error()})
+				return
+			}
+			logging.FromContext(c.Request.Context()).Warn("upstream failed, falling back", "candidate", candidate.Name.String(), "error", err)
+			cancel()
+			release()
+			continue
+		}
+
+		attempt.Status = resp.StatusCode
+		attempts = append(attempts, attempt)
+		breaker.Record(resp.StatusCode >= http.StatusInternalServerError)
+
+		if resp.StatusCode >= http.StatusInternalServerError && !last {
+			logging.FromContext(c.Request.Context()).Warn("upstream returned an error, falling back", "candidate", candidate.Name.String(), "status", resp.StatusCode)
+			resp.Body.Close()
+			cancel()
+			release()
+			continue
+		}
+
+		generateRequest = attemptRequest
+		upstreamCtx, cancelUpstream = ctx, cancel
+		break
 	}
+
 	metrics.UpstreamLatency = time.Since(upstreamStart)
 	metrics.StatusCode = resp.StatusCode
 	metrics.StreamingResponse = generateRequest.IsStreaming
+	metrics.Name = generateRequest.Model.Name
+	metrics.Model = generateRequest.Model.Model
 
 	// Copy response headers
 	for key, values := range resp.Header {
@@ -160,70 +583,517 @@ func Generate(c *gin.Context, firewallConfig *firewall.Config, hook func(*gin.Co
 		}
 	}
 
-	// Set the status code
-	c.Writer.WriteHeader(resp.StatusCode)
-
 	// Stream or copy the response body
-	var responseBody []byte
 	if generateRequest.IsStreaming {
-		// For streaming responses, we need to flush after each write
-		flusher, ok := c.Writer.(http.Flusher)
-		if !ok {
-			log.Println("streaming requested but responsewriter doesn't support flush")
-			responseBody, _ = io.ReadAll(resp.Body)
-			c.Writer.Write(responseBody)
+		// Output firewalls see the stream a window at a time; events are held back until
+		// the window containing them has passed
+		var guard *firewall.StreamGuard
+		if streamGuard != nil {
+			guard = streamGuard(c, &generateRequest, firewallConfig)
+		}
+
+		seq := 0
+		var streamErr error
+		if resp.StatusCode >= http.StatusMultipleChoices {
+			// Provider errors come back as a plain body rather than a stream
+			c.Writer.WriteHeader(resp.StatusCode)
+			if _, streamErr = io.Copy(c.Writer, resp.Body); streamErr == nil {
+				streamErr = io.EOF
+			}
 		} else {
-			// Create a buffer for efficient reading
-			buf := make([]byte, 1024)
+			sse := newSSEWriter(c, generateRequest.ClientFormat, resp.StatusCode)
+
+			var held []sseEvent
+			release := func() error {
+				for _, event := range held {
+					if err := sse.Write(event); err != nil {
+						return err
+					}
+				}
+				held = nil
+				return nil
+			}
+
+			// A client that has gone away can't be written to, so the provider is told to
+			// stop generating rather than left streaming into the void
+			clientGone := func(err error) error {
+				cancelUpstream()
+				return fmt.Errorf("%w: %v", errClientGone, err)
+			}
+
+			// Read event by event so each can be logged as a chunk
+			reader := newSSEReader(resp.Body)
 			for {
-				n, err := resp.Body.Read(buf)
-				if n > 0 {
-					c.Writer.Write(buf[:n])
-					flusher.Flush()
-					responseBody = append(responseBody, buf[:n]...)
+				event, err := reader.Next()
+				if event.Name != "" || len(event.Data) > 0 {
+					// The [DONE] sentinel is sent once the stream has been let through
+					if !bytes.Equal(event.Data, sseDone) {
+						held = append(held, event)
+					}
+					if guard == nil {
+						if werr := release(); werr != nil {
+							streamErr = clientGone(werr)
+							break
+						}
+					}
+
+					if chunk, isChunk := parseStreamChunk(event.Data); isChunk {
+						metrics.AddStreamChunk(chunk)
+						if err := auditWriter.LogResponseChunk(c.Request.Context(), requestID, chunk, seq); err != nil {
+							logging.FromContext(c.Request.Context()).Error("failed to log response chunk", "seq", seq, "error", err)
+						}
+						seq++
+
+						if guard != nil {
+							result, evaluated, err := guard.Add(c.Request.Context(), chunk)
+							if cut := cutStream(c.Request.Context(), sse, generateRequest, result, err); cut != nil {
+								streamErr = cut
+								break
+							}
+							if evaluated {
+								if werr := release(); werr != nil {
+									streamErr = clientGone(werr)
+									break
+								}
+							}
+						}
+					}
 				}
 
 				if err != nil {
+					streamErr = err
 					break
 				}
 			}
+
+			if errors.Is(streamErr, io.EOF) {
+				// Whatever is left is evaluated once the provider has finished
+				if guard != nil {
+					result, err := guard.Flush(c.Request.Context())
+					if cut := cutStream(c.Request.Context(), sse, generateRequest, result, err); cut != nil {
+						streamErr = cut
+					} else if werr := release(); werr != nil {
+						streamErr = clientGone(werr)
+					}
+				}
+				if errors.Is(streamErr, io.EOF) {
+					if werr := sse.Done(); werr != nil {
+						streamErr = clientGone(werr)
+					}
+				}
+			}
+		}
+		resp.Body.Close()
+
+		// A stream cut short, e.g. by the client leaving or the server shutting down,
+		// still has its partial response logged
+		if !errors.Is(streamErr, io.EOF) {
+			logging.FromContext(c.Request.Context()).Warn("stream ended early", "chunks", seq, "error", streamErr)
+		}
+		auditCtx, cancelAudit = auditContext(c)
+		defer cancelAudit()
+
+		// A read error while the client is still connected means the provider died
+		// mid-stream, so the trace records a truncated response and why
+		upstreamError := ""
+		if !errors.Is(streamErr, io.EOF) && !errors.Is(streamErr, errStreamCut) && !errors.Is(streamErr, errClientGone) && c.Request.Context().Err() == nil {
+			upstreamError = streamErr.Error()
 		}
-	} else {
-		// For non-streaming, just copy the entire response
-		responseBody, _ = io.ReadAll(resp.Body)
 
-		// Write to body
-		_, err := c.Writer.Write(responseBody)
+		// Audit log the stitched response with the latency of the whole stream
+		logging.FromContext(c.Request.Context()).Debug("logging streamed response")
+		metrics.UpstreamLatency = time.Since(upstreamStart)
+		metrics.TotalProcessTime = time.Since(metrics.StartTime)
+		var counted *audit.TokenUsage
+		if resp.StatusCode < http.StatusMultipleChoices {
+			metrics.CountTokens(generateRequest.Model, generateRequest.Messages, nil)
+			counted = countedUsage(metrics)
+		}
+		err = auditWriter.FinalizeStreamingResponse(auditCtx, audit.Response{
+			RequestID:         requestID,
+			LatencyMs:         metrics.TotalProcessTime.Milliseconds(),
+			UpstreamLatencyMs: metrics.UpstreamLatency.Milliseconds(),
+			GatewayOverheadMs: metrics.GatewayOverhead().Milliseconds(),
+			ServedBy:          generateRequest.Model.Name.String(),
+			Attempts:          attempts,
+			Partial:           upstreamError != "",
+			UpstreamError:     upstreamError,
+			UpstreamStatus:    resp.StatusCode,
+			UpstreamHeaders:   resp.Header,
+			CountedUsage:      counted,
+			// Streams that ended early or were cut are always kept in full
+			SampledOut: errors.Is(streamErr, io.EOF) && resp.StatusCode < http.StatusMultipleChoices && !auditOptions.Sampling.Keep(requestID),
+		})
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to write response"})
-			return
+			logging.FromContext(c.Request.Context()).Error("failed to finalize streamed response", "error", err)
 		}
-		// Flush the response writer to ensure all data is sent
-		c.Writer.Flush()
+		recordQuota(c, generateRequest, metrics)
+		return
+	}
+
+	// For non-streaming, read the entire response before deciding what to send
+	responseBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil && errors.Is(upstreamCtx.Err(), context.DeadlineExceeded) {
+		metrics.UpstreamLatency = time.Since(upstreamStart)
+		respondTimeout(c, auditWriter, requestID, &metrics, attempts)
+		return
 	}
 
 	var response map[string]interface{}
 	err = json.Unmarshal(responseBody, &response)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": "response couldn't be parsed"})
+		// Pass unparseable bodies (e.g. provider error pages) through untouched, unless
+		// output firewalls would have to vouch for them
+		logging.FromContext(c.Request.Context()).Warn("response couldn't be parsed", "error", err)
+		if outputHook != nil && firewallConfig != nil && firewallConfig.GuardsOutput(generateRequest.Model.Model) {
+			c.Writer.Header().Del("Content-Length")
+			c.Writer.Header().Del("Content-Type")
+			c.JSON(http.StatusBadGateway, gin.H{"error": "upstream response couldn't be evaluated by the output firewalls"})
+		} else {
+			c.Writer.WriteHeader(resp.StatusCode)
+			c.Writer.Write(responseBody)
+		}
+
+		// The body is still logged, since it is often the only explanation of a failure
+		metrics.TotalProcessTime = time.Since(metrics.StartTime)
+		auditCtx, cancelAudit = auditContext(c)
+		defer cancelAudit()
+		err = auditWriter.LogResponse(auditCtx, audit.Response{
+			RequestID:         requestID,
+			Response:          map[string]interface{}{"error": "response couldn't be parsed", "body": string(responseBody)},
+			LatencyMs:         metrics.TotalProcessTime.Milliseconds(),
+			UpstreamLatencyMs: metrics.UpstreamLatency.Milliseconds(),
+			GatewayOverheadMs: metrics.GatewayOverhead().Milliseconds(),
+			ServedBy:          generateRequest.Model.Name.String(),
+			Attempts:          attempts,
+			UpstreamStatus:    resp.StatusCode,
+			UpstreamHeaders:   resp.Header,
+		})
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Error("failed to log response", "error", err)
+		}
 		return
 	}
 
 	// Log the response body for debugging purposes
-	utils.BoxLog(fmt.Sprintf("response body: %v", response))
+	logging.FromContext(c.Request.Context()).Debug("upstream response", "body", response)
+	// Providers that don't report usage have it counted, but failures aren't charged
+	var counted *audit.TokenUsage
+	if !metrics.SetTokens(response) && resp.StatusCode < http.StatusMultipleChoices {
+		metrics.CountTokens(generateRequest.Model, generateRequest.Messages, response)
+		counted = countedUsage(metrics)
+	}
+
+	// ========================= Run Output Hook ===========================
 
-	// Audit log response
-	utils.BoxLog("audit loggging: response 📝")
+	replaced := false
+	clientResponse := response
+	if outputHook != nil {
+		logging.FromContext(c.Request.Context()).Debug("running output firewalls")
+		clientResponse, replaced, err = outputHook(c, &generateRequest, response, firewallConfig)
+		if err != nil && deadlineExceeded(c) {
+			c.Writer.Header().Del("Content-Length")
+			respondTimeout(c, auditWriter, requestID, &metrics, attempts)
+			return
+		}
+		if err != nil {
+			c.Writer.Header().Del("Content-Length")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to evaluate response", "message": err.Error()})
+			return
+		}
+	}
+
+	// Provider support asks for its own ID of a failed request, so errors can carry it
+	annotated := false
+	if resp.StatusCode >= http.StatusBadRequest && c.GetBool("exposeUpstreamRequestID") {
+		if id := upstreamRequestID(resp.Header); id != "" {
+			clientResponse = withUpstreamRequestID(clientResponse, id)
+			annotated = true
+		}
+	}
+
+	// Re-encode only if the response was substituted, annotated or has to be reshaped
+	var body interface{} = clientResponse
+	envelope := false
+	if resp.StatusCode < http.StatusMultipleChoices {
+		body, envelope = clientEnvelope(c, requestID, generateRequest, clientResponse, metrics)
+	}
+	if replaced || annotated || envelope {
+		responseBody, err = json.Marshal(body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encode response"})
+			return
+		}
+		c.Writer.Header().Del("Content-Length")
+	}
+
+	// Set the status code
+	c.Writer.WriteHeader(resp.StatusCode)
+
+	// Write to body
+	_, err = c.Writer.Write(responseBody)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to write response", "error", err)
+	}
+	// Flush the response writer to ensure all data is sent
+	c.Writer.Flush()
+
+	// Only cache successes the output firewalls let through unchanged
+	if cacheKey != "" && !replaced && resp.StatusCode < http.StatusMultipleChoices {
+		responseCache.Put(cacheKey, response)
+	}
+
+	// Audit log the response the provider actually returned
+	logging.FromContext(c.Request.Context()).Debug("logging response")
+	metrics.TotalProcessTime = time.Since(metrics.StartTime)
 	auditResponse := audit.Response{
-		RequestID: requestID,
-		Response:  response,
-		LatencyMs: metrics.UpstreamLatency.Milliseconds(),
+		RequestID:         requestID,
+		Response:          response,
+		LatencyMs:         metrics.TotalProcessTime.Milliseconds(),
+		UpstreamLatencyMs: metrics.UpstreamLatency.Milliseconds(),
+		GatewayOverheadMs: metrics.GatewayOverhead().Milliseconds(),
+		ServedBy:          generateRequest.Model.Name.String(),
+		Attempts:          attempts,
+		UpstreamStatus:    resp.StatusCode,
+		UpstreamHeaders:   resp.Header,
+		CountedUsage:      counted,
+		// Failed and blocked responses are always kept in full
+		SampledOut: !replaced && resp.StatusCode < http.StatusMultipleChoices && !auditOptions.Sampling.Keep(requestID),
 	}
-	err = audit.LogResponse(c.Request.Context(), auditResponse, db)
+	// Only what a retry could safely be sent again is kept for replaying
+	if !replaced && resp.StatusCode < http.StatusMultipleChoices {
+		auditResponse.ClientResponse = responseBody
+		auditResponse.ClientStatus = resp.StatusCode
+	}
+	auditCtx, cancelAudit = auditContext(c)
+	defer cancelAudit()
+	err = auditWriter.LogResponse(auditCtx, auditResponse)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log response"})
+		logging.FromContext(c.Request.Context()).Error("failed to log response", "error", err)
+	}
+	recordQuota(c, generateRequest, metrics)
+}
+
+// defaultUpstreamTimeout is how long a provider has to respond when its model doesn't
+// set a timeout
+const defaultUpstreamTimeout = 55 * time.Second
+
+// upstreamTimeout is the deadline for a call to model's provider
+func upstreamTimeout(model user.Model) time.Duration {
+	if model.RequestTimeout > 0 {
+		return model.RequestTimeout
+	}
+	return defaultUpstreamTimeout
+}
+
+// respondTimeout tells the client the provider missed its deadline, or the request
+// missed the one its client set, and logs the timeout as the request's response
+func respondTimeout(c *gin.Context, auditWriter *audit.Writer, requestID string, metrics *request.Metrics, attempts []audit.Attempt) {
+	metrics.TimedOut = true
+	metrics.StatusCode = http.StatusGatewayTimeout
+	body := gin.H{"error": "upstream timed out", "status": "timeout", "timeout_ms": metrics.UpstreamTimeout.Milliseconds()}
+	if timeout, ok := requestTimeout(c.Request.Context()); ok && deadlineExceeded(c) {
+		body = gin.H{"error": "request deadline exceeded", "status": "timeout", "timeout_ms": timeout.Milliseconds()}
+		logging.FromContext(c.Request.Context()).Warn("request deadline exceeded", "timeout", timeout)
+	} else {
+		logging.FromContext(c.Request.Context()).Warn("upstream timed out", "after", metrics.UpstreamLatency)
+	}
+	c.JSON(http.StatusGatewayTimeout, body)
+
+	// The request's context may be the one that expired, so the trace is logged without it
+	auditCtx, cancel := auditContext(c)
+	defer cancel()
+	err := auditWriter.LogResponse(auditCtx, audit.Response{
+		RequestID:         requestID,
+		Response:          body,
+		LatencyMs:         time.Since(metrics.StartTime).Milliseconds(),
+		UpstreamLatencyMs: metrics.UpstreamLatency.Milliseconds(),
+		Attempts:          attempts,
+	})
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("failed to log response", "error", err)
+	}
+}
+
+// upstreamRequestID returns the provider's ID for a response, under the header names
+// OpenAI and Anthropic use
+func upstreamRequestID(header http.Header) string {
+	if id := header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return header.Get("Request-Id")
+}
+
+// withUpstreamRequestID returns a copy of an error response carrying the provider's ID
+func withUpstreamRequestID(response map[string]interface{}, id string) map[string]interface{} {
+	annotated := make(map[string]interface{}, len(response)+1)
+	for k, v := range response {
+		annotated[k] = v
+	}
+	annotated["upstream_request_id"] = id
+	return annotated
+}
+
+// countedUsage is the token count the gateway made for a response, for the audit log
+func countedUsage(metrics request.Metrics) *audit.TokenUsage {
+	return &audit.TokenUsage{
+		InputTokens:  int64(metrics.InputTokens),
+		OutputTokens: int64(metrics.OutputTokens),
+		TotalTokens:  int64(metrics.TotalTokens),
+	}
+}
+
+// recordQuota adds the tokens a response used to the user's cached quota total, so the
+// next check sees them without summing the audit log again
+func recordQuota(c *gin.Context, m request.Generate, metrics request.Metrics) {
+	if checker, ok := c.Get("quota"); ok {
+		checker.(*quota.Checker).Record(m.User.ID.String(), int64(metrics.TotalTokens))
+	}
+}
+
+// clientEnvelope reshapes a response for clients of the chat endpoints, who expect
+// their own format regardless of provider. It reports false for other endpoints, whose
+// responses are passed through.
+func clientEnvelope(c *gin.Context, requestID string, m request.Generate, response map[string]interface{}, metrics request.Metrics) (interface{}, bool) {
+	if m.ClientFormat == request.FormatAnthropic {
+		return request.NewAnthropicResponse(requestID, m, response, metrics), true
+	}
+	if strings.HasSuffix(c.Param("path"), "/chat/completions") {
+		return request.NewResponseEnvelope(requestID, m, response, metrics), true
+	}
+	return response, false
+}
+
+// rejectRequest responds with a request error's status and code, plus whatever
+// details its type carries
+func rejectRequest(c *gin.Context, err request.Error) {
+	body := gin.H{"error": err.Error(), "code": err.Code()}
+	switch e := err.(type) {
+	case *request.ValidationError:
+		body["error"] = "invalid request"
+		body["fields"] = e.Fields
+	case *request.TooLargeError:
+		body["limit"] = e.Limit
+		body["max"] = e.Max
+	}
+	c.JSON(err.Status(), body)
+}
+
+// errBuildRequest means the upstream request couldn't be built, which is the gateway's fault
+var errBuildRequest = errors.New("failed to create request")
+
+// doUpstream sends the request newRequest builds. A model with provider keys is
+// authenticated with its current key in place of the client's credentials; if the
+// provider rejects it with a 401 during a rotation, the next key is tried and promoted
+// once it is accepted. It returns the key slot that was used, or nil without keys.
+func doUpstream(httpClient *http.Client, model user.Model, newRequest func() (*http.Request, error)) (*http.Response, *int, error) {
+	if model.Keys == nil {
+		proxyReq, err := newRequest()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errBuildRequest, err)
+		}
+		resp, err := httpClient.Do(proxyReq)
+		return resp, nil, err
+	}
+
+	var resp *http.Response
+	for _, slot := range []int{user.KeyCurrent, user.KeyNext} {
+		key := model.Keys.Get(slot)
+		if key == "" {
+			break
+		}
+
+		proxyReq, err := newRequest()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errBuildRequest, err)
+		}
+		setProviderKey(proxyReq, model, key)
+
+		if resp != nil {
+			logging.FromContext(proxyReq.Context()).Warn("current provider key was rejected, trying the next key", "backend", model.Name.String())
+			resp.Body.Close()
+		}
+		resp, err = httpClient.Do(proxyReq)
+		if err != nil {
+			return nil, &slot, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			if slot == user.KeyNext {
+				logging.FromContext(proxyReq.Context()).Info("promoting the next provider key", "backend", model.Name.String())
+				model.Keys.Promote(key)
+			}
+			return resp, &slot, nil
+		}
+		if slot == user.KeyNext {
+			return resp, &slot, nil
+		}
+	}
+
+	slot := user.KeyCurrent
+	return resp, &slot, nil
+}
+
+// setProviderKey authenticates a request in the way the model's provider expects,
+// replacing whatever credentials the client sent
+func setProviderKey(proxyReq *http.Request, model user.Model, key string) {
+	proxyReq.Header.Del("Authorization")
+	if request.FormatForProvider(model.Provider) == request.FormatAnthropic {
+		proxyReq.Header.Set("X-Api-Key", key)
 		return
 	}
+	proxyReq.Header.Set("Authorization", "Bearer "+key)
+}
 
-	resp.Body.Close()
+// errStreamCut ends a stream the output firewalls blocked or couldn't evaluate
+var errStreamCut = errors.New("stream cut by output firewall")
+
+// errClientGone ends a stream whose client could no longer be written to
+var errClientGone = errors.New("client went away")
+
+// cutStream ends a stream with a terminal error event if a window was blocked or could
+// not be evaluated, returning nil if the stream may continue. The held back events of
+// the window are dropped.
+func cutStream(ctx context.Context, sse *sseWriter, m request.Generate, result firewall.FirewallResult, err error) error {
+	message := ""
+	switch {
+	case err != nil:
+		logging.FromContext(ctx).Error("failed to evaluate streamed response", "error", err)
+		message = "failed to evaluate response"
+	case result.Blocked:
+		logging.FromContext(ctx).Info("streamed response blocked by output firewall", "served_by", m.Model.Name.String())
+		message = "response blocked by output firewall"
+	default:
+		return nil
+	}
+
+	event := sseEvent{}
+	if m.ClientFormat == request.FormatAnthropic {
+		event.Name = "error"
+		event.Data, _ = json.Marshal(gin.H{"type": "error", "error": gin.H{"type": "content_filter", "message": message}})
+	} else {
+		event.Data, _ = json.Marshal(gin.H{"error": gin.H{"type": "content_filter", "message": message}})
+	}
+	if sse.Write(event) == nil {
+		sse.Done()
+	}
+
+	return errStreamCut
+}
+
+// parseStreamChunk extracts the JSON payload of a server-sent event's data.
+// Events without data and the [DONE] sentinel are not chunks.
+func parseStreamChunk(data []byte) (map[string]interface{}, bool) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || bytes.Equal(data, sseDone) {
+		return nil, false
+	}
+
+	var chunk map[string]interface{}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, false
+	}
+
+	return chunk, true
 }
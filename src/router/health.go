@@ -1,11 +1,70 @@
 package router
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"time"
+
+	"covalence/src/db/postgres"
+	"covalence/src/firewall"
 
 	"github.com/gin-gonic/gin"
 )
 
+// readinessTimeout bounds the database ping so a hung connection fails the probe
+const readinessTimeout = 2 * time.Second
+
 func Health(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "healthy"})
 }
+
+// Liveness reports that the process is up; it checks no dependencies
+func Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+// Readiness reports whether the server can serve traffic: the database is reachable
+// with a connection to spare, and a firewall config is loaded. Any failing check
+// returns 503 so the load balancer drains traffic away.
+func Readiness(c *gin.Context, config *firewall.Config) {
+	db := c.MustGet("db").(*postgres.DB)
+
+	checks := gin.H{
+		"database":        checkDatabase(c.Request.Context(), db),
+		"firewall_config": checkFirewallConfig(config),
+	}
+
+	status, body := http.StatusOK, "ready"
+	for _, result := range checks {
+		if result != "ok" {
+			status, body = http.StatusServiceUnavailable, "unavailable"
+			break
+		}
+	}
+
+	c.JSON(status, gin.H{"status": body, "checks": checks})
+}
+
+// checkDatabase returns "ok" or why the database can't take more work
+func checkDatabase(ctx context.Context, db *postgres.DB) string {
+	// Every connection is in use, so new requests would queue for one
+	stat := db.Pool.Stat()
+	if stat.AcquiredConns() >= stat.MaxConns() {
+		return fmt.Sprintf("connection pool exhausted (%d/%d in use)", stat.AcquiredConns(), stat.MaxConns())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	if err := db.Pool.Ping(ctx); err != nil {
+		return fmt.Sprintf("unreachable: %v", err)
+	}
+	return "ok"
+}
+
+func checkFirewallConfig(config *firewall.Config) string {
+	if config == nil {
+		return "not loaded"
+	}
+	return "ok"
+}
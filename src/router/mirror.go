@@ -0,0 +1,155 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"covalence/src/audit"
+	"covalence/src/logging"
+	"covalence/src/register"
+	"covalence/src/request"
+	"covalence/src/types"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mirrorTimeout bounds a shadow request, which no client is waiting on
+const mirrorTimeout = 2 * time.Minute
+
+// MirrorConfig sends a sample of requests to a shadow model as well, so a candidate
+// model can be compared with production on real traffic. The shadow's responses are
+// logged as their own traces and never reach the client.
+type MirrorConfig struct {
+	Model types.Name
+	Rate  float64 // Fraction of requests mirrored
+}
+
+// NewMirrorConfig validates a mirror's target model name and sampling rate
+func NewMirrorConfig(model string, rate float64) (MirrorConfig, error) {
+	name, err := types.NewName(model)
+	if err != nil {
+		return MirrorConfig{}, fmt.Errorf("invalid mirror model: %w", err)
+	}
+	if rate <= 0 || rate > 1 {
+		return MirrorConfig{}, fmt.Errorf("invalid mirror rate %v: must be above 0 and at most 1", rate)
+	}
+	return MirrorConfig{Model: name, Rate: rate}, nil
+}
+
+// mirror sends a copy of a request to the shadow model in the background when it is
+// sampled. It returns at once: the shadow call can neither delay nor fail the request.
+func mirror(c *gin.Context, m request.Generate, requestID string) {
+	value, ok := c.Get("mirror")
+	if !ok {
+		return
+	}
+	config := value.(MirrorConfig)
+	if rand.Float64() >= config.Rate {
+		return
+	}
+
+	registry := c.MustGet("registry").(*register.Registry)
+	shadow, ok := registry.GetInfo(config.Model.String())
+	if !ok {
+		logging.FromContext(c.Request.Context()).Warn("mirror model is not registered, skipping", "mirror", config.Model.String())
+		return
+	}
+	if shadow.Name == m.Model.Name {
+		return
+	}
+
+	// Shadow responses are compared whole, so they are never streamed
+	shadowRequest := m.WithModel(shadow, c.Param("path"))
+	shadowRequest.IsStreaming = false
+
+	// Nothing may be read from c once the handler returns
+	header := http.Header{}
+	for _, name := range forwardedHeaders {
+		if value := c.GetHeader(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	httpClient := c.MustGet("httpClient").(*http.Client)
+	auditWriter := c.MustGet("auditWriter").(*audit.Writer)
+	auditOptions := c.MustGet("auditOptions").(audit.Options)
+	method := c.Request.Method
+	logger := logging.FromContext(c.Request.Context())
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+		defer cancel()
+
+		if err := sendMirror(ctx, httpClient, registry, auditWriter, auditOptions, method, header, shadowRequest, requestID); err != nil {
+			logger.Warn("mirror failed", "mirror", shadow.Name.String(), "error", err)
+		}
+	}()
+}
+
+// sendMirror calls the shadow model and logs its request and response as a trace
+// tagged as a mirror of requestID
+func sendMirror(ctx context.Context, httpClient *http.Client, registry *register.Registry, auditWriter *audit.Writer, auditOptions audit.Options, method string, header http.Header, m request.Generate, requestID string) error {
+	auditRequest := m.ToAuditRequest()
+	auditRequest.MirrorOf = requestID
+	mirrorID, err := auditWriter.LogRequestTyped(ctx, auditRequest, m.Messages, auditOptions)
+	if err != nil {
+		return fmt.Errorf("failed to log request: %w", err)
+	}
+
+	body, err := json.Marshal(m.ToMap())
+	if err != nil {
+		return err
+	}
+
+	// Mirrors count against the backend's concurrency limit like any other request
+	release, err := registry.Limiters.For(m.Model).Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+	resp, keyIndex, err := doUpstream(httpClient, m.Model, func() (*http.Request, error) {
+		proxyReq, err := http.NewRequestWithContext(ctx, method, m.TargetURL.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		proxyReq.Header = header.Clone()
+		proxyReq.Header.Set("Content-Type", "application/json")
+		return proxyReq, nil
+	})
+
+	attempt := audit.Attempt{
+		Model:     m.Model.Name.String(),
+		Backend:   m.TargetURL.String(),
+		LatencyMs: time.Since(start).Milliseconds(),
+		KeyIndex:  keyIndex,
+	}
+
+	var response map[string]interface{}
+	if err != nil {
+		attempt.Error = err.Error()
+		response = map[string]interface{}{"error": "upstream service unavailable", "message": err.Error()}
+	} else {
+		attempt.Status = resp.StatusCode
+		responseBody, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			response = map[string]interface{}{"error": "failed to read response", "message": readErr.Error()}
+		} else if jsonErr := json.Unmarshal(responseBody, &response); jsonErr != nil {
+			response = map[string]interface{}{"error": "response couldn't be parsed", "body": string(responseBody)}
+		}
+	}
+
+	return auditWriter.LogResponse(ctx, audit.Response{
+		RequestID: mirrorID,
+		Response:  response,
+		LatencyMs: time.Since(start).Milliseconds(),
+		ServedBy:  m.Model.Name.String(),
+		Attempts:  []audit.Attempt{attempt},
+	})
+}
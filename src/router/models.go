@@ -1,9 +1,10 @@
 package router
 
 import (
+	"covalence/src/logging"
 	"covalence/src/register"
 	"covalence/src/request"
-	"log"
+	"covalence/src/user"
 	"net/http"
 	"time"
 
@@ -26,19 +27,73 @@ func RegisterModel(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	log.Printf("model registered: %s -> %s at %s", modelInfo.Name.String(), modelInfo.Model.String(), modelInfo.APIURL.String())
-	log.Println("model status set to: active")
+	logging.FromContext(c.Request.Context()).Info("model registered", "name", modelInfo.Name.String(), "model", modelInfo.Model.String(), "api_url", modelInfo.APIURL.String(), "status", "active")
 	c.JSON(http.StatusOK, gin.H{"status": "model registered", "name": modelInfo.Name.String(), "model": modelInfo.Model.String()})
 }
 
-func ListRegisteredModels(c *gin.Context) {
+// UnregisterModel removes a model at runtime. Requests already routed to it finish.
+func UnregisterModel(c *gin.Context) {
+
+	r := c.MustGet("registry").(*register.Registry)
+
+	name := c.Param("name")
+	if err := r.Unregister(name); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("model unregistered", "name", name)
+	c.JSON(http.StatusOK, gin.H{"status": "model unregistered", "name": name})
+}
+
+func RegisterAlias(c *gin.Context) {
+
+	r := c.MustGet("registry").(*register.Registry)
+
+	var body struct {
+		Alias  string `json:"alias" binding:"required"`
+		Target string `json:"target" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := r.RegisterAlias(body.Alias, body.Target); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("model alias registered", "alias", body.Alias, "target", body.Target)
+	c.JSON(http.StatusOK, gin.H{"status": "alias registered", "alias": body.Alias, "target": body.Target})
+}
+
+// RotateModelKey gives a model's backends a new provider key, which takes over once
+// the provider rejects the current one
+func RotateModelKey(c *gin.Context) {
+
 	r := c.MustGet("registry").(*register.Registry)
 
-	r.Mu.RLock()
-	defer r.Mu.RUnlock()
+	var body struct {
+		Name   string `json:"name" binding:"required"`
+		APIKey string `json:"api_key" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	models := make([]map[string]string, 0, len(r.Models))
-	for _, info := range r.Models {
+	if err := r.RotateKey(body.Name, body.APIKey); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("provider key rotation started", "name", body.Name)
+	c.JSON(http.StatusOK, gin.H{"status": "key rotation started", "name": body.Name})
+}
+
+func ListRegisteredModels(c *gin.Context) {
+	r := c.MustGet("registry").(*register.Registry)
+
+	models := []map[string]string{}
+	for _, info := range r.List() {
 		models = append(models, map[string]string{
 			"name":          info.Name.String(),
 			"model":         info.Model.String(),
@@ -52,6 +107,56 @@ func ListRegisteredModels(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"models": models})
 }
 
+// ListModels lists the models the calling key may use, in the shape of OpenAI's
+// GET /v1/models so SDKs can discover them. Aliases are listed as their own entries,
+// with parent naming the alias's target and root the model it resolves to.
+func ListModels(c *gin.Context) {
+	r := c.MustGet("registry").(*register.Registry)
+	caller := c.MustGet("user").(user.User)
+
+	models := []gin.H{}
+	for _, entry := range r.Entries() {
+		// Checked on the resolved name, as generate requests are
+		if !caller.AllowsModel(entry.Model.Name, r.NameCase) {
+			continue
+		}
+
+		model := gin.H{
+			"id":       entry.Name,
+			"object":   "model",
+			"created":  entry.Model.CreatedAt.Unix(),
+			"owned_by": entry.Model.Provider.String(),
+		}
+		if entry.Target != "" {
+			model["parent"] = entry.Target
+			model["root"] = entry.Model.Name.String()
+		}
+		models = append(models, model)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": models})
+}
+
+// ModelHealth reports the health check status of every probed backend
+func ModelHealth(c *gin.Context) {
+
+	r := c.MustGet("registry").(*register.Registry)
+
+	breakers := map[string]string{}
+	for backend, state := range r.Breakers.Snapshot() {
+		breakers[backend] = state.String()
+	}
+
+	inFlight := r.Limiters.Snapshot()
+
+	if r.Health == nil {
+		c.JSON(http.StatusOK, gin.H{"health": gin.H{}, "circuits": breakers, "in_flight": inFlight})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"health": r.Health.Snapshot(), "circuits": breakers, "in_flight": inFlight})
+}
+
 func ListModelProviders(c *gin.Context) {
 
 	r := c.MustGet("providers").(*[]register.ModelProvider)
@@ -0,0 +1,69 @@
+package router
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"covalence/src/user"
+)
+
+// shouldRetry reports whether a response is a transient error the policy retries, with
+// attempts left after the given retry
+func shouldRetry(policy user.RetryConfig, retry int, resp *http.Response) bool {
+	return retry+1 < policy.MaxAttempts && slices.Contains(policy.Statuses, resp.StatusCode)
+}
+
+// retryDelay returns how long to wait before the next retry of a transient error. A
+// Retry-After header longer than the backoff is honoured, in seconds or as an HTTP
+// date. It returns false if the wait would reach ctx's deadline, since the retry
+// couldn't finish in time.
+func retryDelay(ctx context.Context, policy user.RetryConfig, retry int, resp *http.Response) (time.Duration, bool) {
+	delay := policy.BaseDelay
+	for range retry {
+		delay *= 2
+		if delay >= policy.MaxDelay {
+			delay = policy.MaxDelay
+			break
+		}
+	}
+	if policy.Jitter > 0 {
+		spread := float64(delay) * policy.Jitter
+		delay += time.Duration((rand.Float64()*2 - 1) * spread)
+	}
+
+	delay = max(delay, retryAfter(resp.Header.Get("Retry-After")))
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+		return 0, false
+	}
+	return delay, true
+}
+
+// retryAfter parses a Retry-After header, either a number of seconds or an HTTP date.
+// It returns zero for a missing or malformed header or a date already past.
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// sleep waits for d, returning early with ctx's error if it is cancelled first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,119 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"covalence/src/request"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseDone is the data of the sentinel event that ends an OpenAI stream
+var sseDone = []byte("[DONE]")
+
+// sseEvent is one server-sent event. Multi-line data is joined with newlines.
+type sseEvent struct {
+	Name string
+	Data []byte
+}
+
+// sseReader splits a provider's stream into events at blank lines
+type sseReader struct {
+	reader *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{reader: bufio.NewReader(r)}
+}
+
+// Next returns the next event. Like bufio.Reader.ReadBytes, it may return an event
+// along with an error when the stream ends without a trailing blank line, so callers
+// should handle the event before the error. Comments and id/retry fields are dropped.
+func (r *sseReader) Next() (sseEvent, error) {
+	var event sseEvent
+	var data [][]byte
+	seen := false
+
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		line = bytes.TrimRight(line, "\r\n")
+
+		switch {
+		case len(line) == 0:
+			if seen && err == nil {
+				event.Data = bytes.Join(data, []byte("\n"))
+				return event, nil
+			}
+		case bytes.HasPrefix(line, []byte("event:")):
+			event.Name = string(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("event:"))))
+			seen = true
+		case bytes.HasPrefix(line, []byte("data:")):
+			data = append(data, bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" ")))
+			seen = true
+		}
+
+		if err != nil {
+			event.Data = bytes.Join(data, []byte("\n"))
+			if !seen {
+				return sseEvent{}, err
+			}
+			return event, err
+		}
+	}
+}
+
+// sseWriter frames events for the client, flushing each one as it is written so
+// tokens reach the client as they arrive
+type sseWriter struct {
+	w      gin.ResponseWriter
+	format request.Format
+	done   bool
+}
+
+// newSSEWriter sends the status and event stream headers, replacing whatever the
+// provider sent for them
+func newSSEWriter(c *gin.Context, format request.Format, status int) *sseWriter {
+	header := c.Writer.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no") // Stop nginx buffering the stream
+	c.Writer.WriteHeader(status)
+	c.Writer.Flush()
+
+	return &sseWriter{w: c.Writer, format: format}
+}
+
+// Write sends an event and flushes it. An error means the client has gone away.
+func (s *sseWriter) Write(event sseEvent) error {
+	var buf bytes.Buffer
+	if event.Name != "" {
+		buf.WriteString("event: " + event.Name + "\n")
+	}
+	for _, line := range bytes.Split(event.Data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	s.w.Flush()
+	return nil
+}
+
+// Done ends an OpenAI stream with the [DONE] sentinel, sending it at most once whether
+// or not the provider sent its own. Anthropic streams end with the provider's
+// message_stop event instead.
+func (s *sseWriter) Done() error {
+	if s.done || s.format == request.FormatAnthropic {
+		return nil
+	}
+	s.done = true
+	return s.Write(sseEvent{Data: sseDone})
+}
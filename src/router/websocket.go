@@ -0,0 +1,241 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"covalence/src/logging"
+	"covalence/src/request"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsPingInterval is how often an idle client is pinged; it must answer within wsPongWait
+	wsPingInterval = 30 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 10 * time.Second
+)
+
+// Clients authenticate with an API key rather than cookies, so any origin may connect
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// sessionTurn is carried in the context of a turn's request so its audit row can be
+// linked to the session
+type sessionTurn struct {
+	sessionID string
+	turn      int
+	requestID string // Set once the request has been logged
+}
+
+type sessionTurnKey struct{}
+
+// wsFrame is a message sent to a WebSocket client. A streamed turn sends a chunk per
+// event; any other turn sends a single response. Every turn ends with done.
+type wsFrame struct {
+	Type      string          `json:"type"`
+	Turn      int             `json:"turn"`
+	RequestID string          `json:"request_id,omitempty"`
+	Status    int             `json:"status,omitempty"`
+	Event     string          `json:"event,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Stream serves a WebSocket session. Each frame the client sends is a chat completion
+// request, run through handler exactly as an HTTP request would be, so it is parsed,
+// firewalled and audit logged as its own request. Turns are served one at a time.
+func Stream(c *gin.Context, handler http.Handler) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already responded
+		logging.FromContext(c.Request.Context()).Warn("failed to upgrade websocket", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	sessionID := uuid.NewString()
+	logger := logging.FromContext(c.Request.Context()).With("session_id", sessionID)
+	logger.Info("websocket session opened")
+
+	// The session ends as soon as the client goes away, cancelling any turn in flight
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	if limits, ok := c.Get("requestLimits"); ok {
+		conn.SetReadLimit(limits.(request.Limits).MaxBodyBytes)
+	}
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	frames := make(chan []byte)
+	go func() {
+		defer cancel()
+		for {
+			conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					logger.Warn("websocket session read failed", "error", err)
+				}
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for turn := 1; ; turn++ {
+		var frame []byte
+		select {
+		case frame = <-frames:
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+			logger.Info("websocket session closed", "turns", turn-1)
+			return
+		}
+		serveTurn(ctx, c, handler, conn, &sessionTurn{sessionID: sessionID, turn: turn}, frame)
+	}
+}
+
+// serveTurn runs one frame through handler as a request to the chat completions
+// endpoint, authenticated with the headers the session was opened with
+func serveTurn(ctx context.Context, c *gin.Context, handler http.Handler, conn *websocket.Conn, turn *sessionTurn, frame []byte) {
+	ctx = context.WithValue(ctx, sessionTurnKey{}, turn)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", bytes.NewReader(frame))
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to build request for websocket turn", "session_id", turn.sessionID, "turn", turn.turn, "error", err)
+		return
+	}
+
+	req.Header = c.Request.Header.Clone()
+	for _, header := range []string{
+		"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+		"Sec-Websocket-Extensions", "Sec-Websocket-Protocol",
+		"X-Request-Id", // An idempotency key would replay the first turn for every other
+	} {
+		req.Header.Del(header)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = c.Request.RemoteAddr
+
+	w := &wsResponseWriter{conn: conn, turn: turn, header: http.Header{}}
+	handler.ServeHTTP(w, req)
+	w.finish()
+}
+
+// wsResponseWriter relays a turn's response over the socket. Server-sent events are
+// forwarded as chunk frames as they are flushed; any other body is sent whole.
+type wsResponseWriter struct {
+	conn   *websocket.Conn
+	turn   *sessionTurn
+	header http.Header
+	status int
+	body   bytes.Buffer
+	err    error // Set once the client can no longer be written to
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *wsResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.body.Write(p)
+}
+
+// Flush forwards the complete events written so far
+func (w *wsResponseWriter) Flush() {
+	if !w.streaming() {
+		return
+	}
+
+	data := w.body.Bytes()
+	end := bytes.LastIndex(data, []byte("\n\n"))
+	if end < 0 {
+		return
+	}
+
+	reader := newSSEReader(bytes.NewReader(data[:end+2]))
+	for {
+		event, err := reader.Next()
+		if len(event.Data) > 0 && !bytes.Equal(event.Data, sseDone) {
+			w.send(wsFrame{Type: "chunk", Event: event.Name, Data: frameData(event.Data)})
+		}
+		if err != nil {
+			break
+		}
+	}
+	w.body.Next(end + 2)
+}
+
+// finish sends what is left of the response and ends the turn
+func (w *wsResponseWriter) finish() {
+	if w.streaming() {
+		w.Flush()
+	} else if w.body.Len() > 0 {
+		w.send(wsFrame{Type: "response", Status: w.status, Data: frameData(w.body.Bytes())})
+	}
+	w.send(wsFrame{Type: "done", RequestID: w.turn.requestID, Status: w.status})
+}
+
+func (w *wsResponseWriter) streaming() bool {
+	return strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream")
+}
+
+func (w *wsResponseWriter) send(frame wsFrame) {
+	if w.err != nil {
+		return
+	}
+	frame.Turn = w.turn.turn
+
+	w.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if err := w.conn.WriteJSON(frame); err != nil {
+		w.err = err
+	}
+}
+
+// frameData embeds a JSON body as is, and anything else as a string
+func frameData(data []byte) json.RawMessage {
+	if json.Valid(data) {
+		return append(json.RawMessage{}, data...)
+	}
+	encoded, _ := json.Marshal(string(data))
+	return encoded
+}
@@ -2,29 +2,128 @@ package server
 
 import (
 	"context"
+	"covalence/src/audit"
 	"covalence/src/db/postgres"
+	"covalence/src/db/s3"
 	"covalence/src/firewall"
 	"covalence/src/internal"
+	"covalence/src/logging"
+	"covalence/src/monitoring"
+	"covalence/src/quota"
+	"covalence/src/ratelimit"
 	"covalence/src/register"
+	"covalence/src/request"
 	"covalence/src/router"
+	"covalence/src/types"
+	"covalence/src/user"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
 )
 
+// shutdownAuditGrace bounds the wait for cut requests to log their responses
+const shutdownAuditGrace = 10 * time.Second
+
+// shutdownTimeout is how long in-flight requests get to finish; k8s allows 30s by default
+const shutdownTimeout = 25 * time.Second
+
+// Server is the running gateway
+type Server struct {
+	httpServer    *http.Server
+	db            *postgres.DB
+	auditWriter   *audit.Writer
+	archiveWorker *audit.ArchiveWorker // Nil unless archiving is configured
+
+	// Handlers still running, including their audit writes
+	inFlight sync.WaitGroup
+}
+
+// Shutdown stops accepting requests and waits for in-flight ones to finish until ctx is
+// done. Requests still running then are cut, which lets streams log what they sent.
+// Queued audit writes are flushed before the database pool is closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Println("shutting down, draining in-flight requests")
+
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		log.Printf("drain deadline passed, closing remaining connections: %v", err)
+		s.httpServer.Close()
+	}
+
+	// Audit writes happen at the end of a handler, so give cut requests time to make them
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(shutdownAuditGrace):
+		log.Println("gave up waiting for in-flight audit writes")
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), shutdownAuditGrace)
+	defer cancel()
+	if err := s.auditWriter.Close(flushCtx); err != nil {
+		log.Printf("failed to flush audit writes: %v", err)
+	}
+	if s.archiveWorker != nil {
+		if err := s.archiveWorker.Close(flushCtx); err != nil {
+			log.Printf("failed to stop archiving: %v", err)
+		}
+	}
+
+	s.db.Close()
+	log.Println("shutdown complete")
+	return err
+}
+
 func Start() {
 	ctx := context.Background()
 
+	// Structured logs; lines logged for a request carry its ID, user and model
+	slog.SetDefault(logging.New())
+
 	// Set Gin to release mode for production
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
 
+	s := &Server{}
+
+	// Stamp requests as they are accepted, before any other middleware runs, so time spent
+	// waiting before a handler runs is visible
+	r.Use(func(c *gin.Context) {
+		c.Set("acceptedAt", time.Now())
+		c.Next()
+	})
+
+	// Track handlers so shutdown can wait for them
+	r.Use(func(c *gin.Context) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Done()
+		c.Next()
+	})
+
 	// Create model registry
 	registry := register.NewModelRegistry()
 
+	// Match model names regardless of case, so "GPT-4" finds "gpt-4"
+	if os.Getenv("MODEL_NAMES_CASE_INSENSITIVE") == "true" {
+		registry.NameCase = types.FoldCase
+	}
+
 	// Load Model Providers
 	modelProviders, err := register.ReadModelProviders()
 	if err != nil {
@@ -35,20 +134,123 @@ func Start() {
 	// Load Internal Models
 	internal.LoadModels("models.yaml")
 
-	// Load Firewall Config
-	firewallConfig, err := firewall.LoadConfig("config.yaml")
+	// Load Firewall Config, reloading it whenever the file changes
+	firewallConfig, err := firewall.NewConfigWatcher("config.yaml")
 	if err != nil {
 		log.Fatalf("failed to load firewall config: %v", err)
 		return
 	}
+	defer firewallConfig.Close()
+
+	// Size the database pool; unset values keep their defaults
+	poolConfig := postgres.DefaultPoolConfig()
+	for name, conns := range map[string]**int32{"DB_MAX_CONNS": &poolConfig.MaxConns, "DB_MIN_CONNS": &poolConfig.MinConns} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				log.Fatalf("invalid %s: %q", name, value)
+			}
+			n32 := int32(n)
+			*conns = &n32
+		}
+	}
+	for name, duration := range map[string]**time.Duration{
+		"DB_MAX_CONN_LIFETIME":   &poolConfig.MaxConnLifetime,
+		"DB_MAX_CONN_IDLE_TIME":  &poolConfig.MaxConnIdleTime,
+		"DB_HEALTH_CHECK_PERIOD": &poolConfig.HealthCheckPeriod,
+	} {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				log.Fatalf("invalid %s: %v", name, err)
+			}
+			*duration = &d
+		}
+	}
 
 	// Load Audit DB
 	// Connect to database
-	db, err := postgres.New(ctx, "user=alialh dbname=covalence_dev sslmode=disable")
+	db, err := postgres.New(ctx, "user=alialh dbname=covalence_dev sslmode=disable", poolConfig)
 	if err != nil {
 		log.Fatal("Database connection failed:", err)
 	}
-	defer db.Close()
+	s.db = db
+	monitoring.WatchDatabase(db)
+
+	// Seed the first admin key, which issues every other key through POST /apikey
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" {
+		adminUserID, err := uuid.Parse(os.Getenv("ADMIN_USER_ID"))
+		if err != nil {
+			log.Fatalf("invalid ADMIN_USER_ID: %q", os.Getenv("ADMIN_USER_ID"))
+		}
+		added, err := user.SeedAdminKey(ctx, adminUserID, adminKey, db)
+		if err != nil {
+			log.Fatalf("failed to seed admin API key: %v", err)
+		}
+		if added {
+			log.Printf("seeded admin API key for user %s", adminUserID)
+		}
+	}
+
+	// Batch audit inserts off the request path
+	s.auditWriter = audit.NewWriter(db, audit.DefaultWriterOptions())
+	monitoring.WatchAuditWriter(s.auditWriter)
+
+	// Archive old traces to S3-compatible storage in the background
+	if endpoint := os.Getenv("ARCHIVE_S3_ENDPOINT"); endpoint != "" {
+		store, err := s3.Connect(s3.Config{
+			Endpoint:        endpoint,
+			Region:          os.Getenv("ARCHIVE_S3_REGION"),
+			AccessKeyID:     os.Getenv("ARCHIVE_S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("ARCHIVE_S3_SECRET_ACCESS_KEY"),
+			UseSSL:          os.Getenv("ARCHIVE_S3_INSECURE") != "true",
+			ForcePathStyle:  true,
+		})
+		if err != nil {
+			log.Fatalf("failed to connect to archive storage: %v", err)
+		}
+		archiveOptions := audit.DefaultArchiveWorkerOptions()
+		if olderThan := os.Getenv("ARCHIVE_AFTER"); olderThan != "" {
+			if archiveOptions.OlderThan, err = time.ParseDuration(olderThan); err != nil {
+				log.Fatalf("invalid ARCHIVE_AFTER: %v", err)
+			}
+		}
+		s.archiveWorker = audit.NewArchiveWorker(db, store, archiveOptions)
+		s.archiveWorker.Start()
+		monitoring.WatchArchiveWorker(s.archiveWorker)
+	}
+
+	// Scrub PII from inputs before they are persisted
+	auditOptions := audit.Options{
+		Redactor: audit.NewRegexRedactor(),
+	}
+
+	// Keep only a sample of successful requests in full; blocked and failed ones always are
+	if rate := os.Getenv("AUDIT_SAMPLE_RATE"); rate != "" {
+		sampleRate, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			log.Fatalf("invalid AUDIT_SAMPLE_RATE: %v", err)
+		}
+		auditOptions.Sampling, err = audit.NewSamplingPolicy(sampleRate)
+		if err != nil {
+			log.Fatalf("invalid AUDIT_SAMPLE_RATE: %v", err)
+		}
+	}
+
+	// Serve repeated deterministic requests without calling the provider. A zero size
+	// or TTL turns the cache off.
+	cacheSize, cacheTTL := 1000, 10*time.Minute
+	if size := os.Getenv("RESPONSE_CACHE_SIZE"); size != "" {
+		if cacheSize, err = strconv.Atoi(size); err != nil || cacheSize < 0 {
+			log.Fatalf("invalid RESPONSE_CACHE_SIZE: %q", size)
+		}
+	}
+	if ttl := os.Getenv("RESPONSE_CACHE_TTL"); ttl != "" {
+		if cacheTTL, err = time.ParseDuration(ttl); err != nil {
+			log.Fatalf("invalid RESPONSE_CACHE_TTL: %v", err)
+		}
+	}
+	responseCache := request.NewResponseCache(cacheSize, cacheTTL)
 
 	// Create a custom HTTP client with connection pooling
 	httpClient := &http.Client{
@@ -57,46 +259,269 @@ func Start() {
 			MaxIdleConnsPerHost: 100,
 			IdleConnTimeout:     90 * time.Second,
 		},
-		Timeout: 60 * time.Second, // Longer timeout for streaming responses
+		// No client timeout: each upstream call carries its model's deadline instead
+	}
+
+	// Limit each API key, sharing buckets through Redis when several instances run
+	rateLimitConfig := ratelimit.Config{RequestsPerMinute: 60, Burst: 10}
+	for name, setting := range map[string]*int{"RATE_LIMIT_PER_MINUTE": &rateLimitConfig.RequestsPerMinute, "RATE_LIMIT_BURST": &rateLimitConfig.Burst} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				log.Fatalf("invalid %s: %q", name, value)
+			}
+			*setting = n
+		}
+	}
+	var limiter ratelimit.Limiter
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		redisOptions, err := redis.ParseURL(redisURL)
+		if err != nil {
+			log.Fatalf("invalid REDIS_URL: %v", err)
+		}
+		redisClient := redis.NewClient(redisOptions)
+		defer redisClient.Close()
+		limiter, err = ratelimit.NewRedisLimiter(redisClient, rateLimitConfig)
+		if err != nil {
+			log.Fatalf("failed to create rate limiter: %v", err)
+		}
+	} else {
+		limiter, err = ratelimit.NewMemoryLimiter(rateLimitConfig)
+		if err != nil {
+			log.Fatalf("failed to create rate limiter: %v", err)
+		}
+	}
+
+	// Only the load balancer's forwarding headers are believed
+	trustedProxies, err := request.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	// Reject oversized requests before they are parsed
+	requestLimits := request.DefaultLimits()
+	if maxBody := os.Getenv("MAX_REQUEST_BODY_BYTES"); maxBody != "" {
+		requestLimits.MaxBodyBytes, err = strconv.ParseInt(maxBody, 10, 64)
+		if err != nil || requestLimits.MaxBodyBytes <= 0 {
+			log.Fatalf("invalid MAX_REQUEST_BODY_BYTES: %q", maxBody)
+		}
+	}
+
+	// Cap each user's tokens per billing period when a quota is configured
+	var quotaChecker *quota.Checker
+	if monthlyTokens := os.Getenv("MONTHLY_TOKEN_QUOTA"); monthlyTokens != "" {
+		quotaConfig := quota.Config{Period: quota.CalendarMonth, TTL: time.Minute}
+		quotaConfig.Tokens, err = strconv.ParseInt(monthlyTokens, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid MONTHLY_TOKEN_QUOTA: %q", monthlyTokens)
+		}
+		if period := os.Getenv("QUOTA_PERIOD"); period != "" {
+			quotaConfig.Period, err = quota.NewPeriod(period)
+			if err != nil {
+				log.Fatalf("invalid QUOTA_PERIOD: %v", err)
+			}
+		}
+		quotaChecker, err = quota.NewChecker(quotaConfig, db)
+		if err != nil {
+			log.Fatalf("failed to create quota checker: %v", err)
+		}
 	}
 
+	// Provider request IDs help support tickets with the provider, but reveal which one served a request
+	exposeUpstreamRequestID := os.Getenv("EXPOSE_UPSTREAM_REQUEST_ID") == "true"
+
+	// Clients may ask for a deadline shorter than this with X-Timeout-Ms
+	maxRequestTimeout := router.DefaultMaxRequestTimeout
+	if maxTimeout := os.Getenv("MAX_REQUEST_TIMEOUT_MS"); maxTimeout != "" {
+		ms, err := strconv.Atoi(maxTimeout)
+		if err != nil || ms <= 0 {
+			log.Fatalf("invalid MAX_REQUEST_TIMEOUT_MS: %q", maxTimeout)
+		}
+		maxRequestTimeout = time.Duration(ms) * time.Millisecond
+	}
+
+	// Copy a sample of requests to a shadow model to compare it against production
+	var mirrorConfig *router.MirrorConfig
+	if mirrorModel := os.Getenv("MIRROR_MODEL"); mirrorModel != "" {
+		rate := 1.0
+		if sampleRate := os.Getenv("MIRROR_SAMPLE_RATE"); sampleRate != "" {
+			rate, err = strconv.ParseFloat(sampleRate, 64)
+			if err != nil {
+				log.Fatalf("invalid MIRROR_SAMPLE_RATE: %q", sampleRate)
+			}
+		}
+		config, err := router.NewMirrorConfig(mirrorModel, rate)
+		if err != nil {
+			log.Fatalf("invalid mirror config: %v", err)
+		}
+		mirrorConfig = &config
+	}
+
+	// Probe providers so unhealthy ones are skipped in favour of fallbacks
+	registry.Health = register.NewHealthChecker(registry, httpClient, 30*time.Second, 3, 2)
+	registry.Health.Start()
+	defer registry.Health.Stop()
+	monitoring.WatchHealth(registry.Health)
+	monitoring.WatchBreakers(registry.Breakers)
+	monitoring.WatchLimiters(registry.Limiters)
+
+	// Resolve the API key to a user before anything is proxied
+	authenticate := func(c *gin.Context) {
+		c.Set("db", db)
+		router.Authenticate(c)
+	}
+
+	// The model admin API, limited to admin keys: registration stores provider API keys,
+	// and the listings expose each backend's URL. Clients discover models at /v1/models.
+	models := r.Group("/model", authenticate, router.RequireScope(user.AdminScope))
+
 	// Model registration endpoint
-	r.POST("/model/register", func(c *gin.Context) {
+	models.POST("/register", func(c *gin.Context) {
 		c.Set("registry", registry)
 		router.RegisterModel(c)
 	})
 
+	// Model alias endpoint
+	models.POST("/alias", func(c *gin.Context) {
+		c.Set("registry", registry)
+		router.RegisterAlias(c)
+	})
+
 	// List registered models endpoint
-	r.GET("/model/list", func(c *gin.Context) {
+	models.GET("/list", func(c *gin.Context) {
 		c.Set("registry", registry)
 		router.ListRegisteredModels(c)
 	})
 
 	// List registered models endpoint
-	r.GET("/model/list/providers", func(c *gin.Context) {
+	models.GET("/list/providers", func(c *gin.Context) {
 		c.Set("providers", modelProviders)
 		router.ListModelProviders(c)
 	})
 
+	// Model health endpoint
+	models.GET("/health", func(c *gin.Context) {
+		c.Set("registry", registry)
+		router.ModelHealth(c)
+	})
+
+	// Model removal
+	models.DELETE("/:name", func(c *gin.Context) {
+		c.Set("registry", registry)
+		router.UnregisterModel(c)
+	})
+
+	// Provider key rotation
+	models.POST("/key", func(c *gin.Context) {
+		c.Set("registry", registry)
+		router.RotateModelKey(c)
+	})
+
+	// Prometheus scrape endpoint
+	r.GET("/metrics", gin.WrapH(monitoring.Handler()))
+
 	// Health check endpoint
 	r.GET("/health", func(c *gin.Context) {
 		router.Health(c)
 	})
 
+	// Kubernetes liveness probe
+	r.GET("/healthz", func(c *gin.Context) {
+		router.Liveness(c)
+	})
+
+	// Kubernetes readiness probe
+	r.GET("/readyz", func(c *gin.Context) {
+		c.Set("db", db)
+		router.Readiness(c, firewallConfig.Current())
+	})
+
+	// API key issuing endpoint, limited to admin keys
+	r.POST("/apikey", authenticate, router.RequireScope(user.AdminScope), func(c *gin.Context) {
+		c.Set("db", db)
+		router.CreateAPIKey(c)
+	})
+
+	// API key revocation endpoint, limited to admin keys
+	r.POST("/apikey/:id/revoke", authenticate, router.RequireScope(user.AdminScope), func(c *gin.Context) {
+		c.Set("db", db)
+		router.RevokeAPIKey(c)
+	})
+
+	// Trace lookup for support, limited to admin keys
+	r.GET("/admin/traces/:id", authenticate, router.RequireScope(user.AdminScope), func(c *gin.Context) {
+		c.Set("db", db)
+		router.GetTrace(c)
+	})
+
+	// Incremental NDJSON feed of traces for the warehouse, limited to admin keys
+	r.GET("/admin/traces/export", authenticate, router.RequireScope(user.AdminScope), func(c *gin.Context) {
+		c.Set("db", db)
+		router.ExportTraces(c)
+	})
+
+	// Why a request was blocked, for support, limited to admin keys
+	r.GET("/admin/traces/:id/explain", authenticate, router.RequireScope(user.AdminScope), func(c *gin.Context) {
+		c.Set("db", db)
+		router.ExplainTrace(c)
+	})
+
 	// Proxy endpoint - catch all requests
-	r.Any("/v1/*path", func(c *gin.Context) {
+	r.Any("/v1/*path", router.RequestDeadline(maxRequestTimeout), authenticate, func(c *gin.Context) {
 		c.Set("registry", registry)
 		c.Set("httpClient", httpClient)
 		c.Set("db", db)
+		c.Set("auditOptions", auditOptions)
+		c.Set("auditWriter", s.auditWriter)
+		c.Set("rateLimiter", limiter)
+		c.Set("responseCache", responseCache)
+		c.Set("trustedProxies", trustedProxies)
+		c.Set("requestLimits", requestLimits)
+		c.Set("exposeUpstreamRequestID", exposeUpstreamRequestID)
+		if quotaChecker != nil {
+			c.Set("quota", quotaChecker)
+		}
+		if mirrorConfig != nil {
+			c.Set("mirror", *mirrorConfig)
+		}
+
+		// Model discovery, for SDKs that list models before calling one
+		if c.Param("path") == "/models" && c.Request.Method == http.MethodGet {
+			router.ListModels(c)
+			return
+		}
+
+		// Follow-up turns can be sent over a WebSocket, each served by this same route
+		if c.Param("path") == "/stream" && c.IsWebsocket() {
+			router.Stream(c, r)
+			return
+		}
 
-		router.Generate(c, &firewallConfig, firewall.HookFirewalls)
+		router.Generate(c, firewallConfig.Current(), firewall.HookFirewalls, firewall.HookOutputFirewalls, firewall.NewStreamGuard)
 	})
 
 	port := 8080
 
 	// Start server
-	log.Printf("starting ai model proxy server on :%d", port)
-	if err := r.Run(fmt.Sprintf(":%d", port)); err != nil {
-		log.Fatalf("failed to start server: %v", err)
+	s.httpServer = &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: r,
+	}
+	go func() {
+		log.Printf("starting ai model proxy server on :%d", port)
+		if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to start server: %v", err)
+		}
+	}()
+
+	// Drain on SIGTERM so deploys don't drop requests
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown did not drain cleanly: %v", err)
 	}
 }
@@ -0,0 +1,107 @@
+package tokenizer
+
+import (
+	"log"
+	"sync"
+
+	"covalence/src/types"
+
+	"github.com/pkoukk/tiktoken-go"
+	loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Tokenizer counts tokens the way a model's provider does
+type Tokenizer interface {
+	// CountTokens counts a prompt, including the tokens each message is framed with
+	CountTokens(model types.ModelID, messages []types.Message) int
+	// CountText counts bare text, such as a completion or a single message's content
+	CountText(model types.ModelID, text string) int
+}
+
+// ForProvider returns the tokenizer matching a provider's counts, or the heuristic
+// for providers whose tokenizers aren't available
+func ForProvider(provider types.ModelProvider) Tokenizer {
+	if provider.String() == "openai" {
+		return tikToken
+	}
+	return Heuristic{}
+}
+
+// ========================= Heuristic =========================
+
+// Heuristic estimates about four characters per token, which holds roughly for English
+// text across providers
+type Heuristic struct{}
+
+func (h Heuristic) CountTokens(model types.ModelID, messages []types.Message) int {
+	tokens := replyPriming
+	for _, message := range messages {
+		tokens += messageOverhead + h.CountText(model, message.Content)
+	}
+	return tokens
+}
+
+func (Heuristic) CountText(model types.ModelID, text string) int {
+	return (len([]rune(text)) + 3) / 4
+}
+
+// ========================= TikToken =========================
+
+const (
+	// Every message is wrapped in start, role and end tokens
+	messageOverhead = 3
+	// Every reply is primed with an assistant header
+	replyPriming = 3
+	// The encoding of models tiktoken doesn't know, such as fine-tunes or new releases
+	defaultEncoding = "cl100k_base"
+)
+
+func init() {
+	// The encodings are embedded so they aren't downloaded on first use
+	tiktoken.SetBpeLoader(loader.NewOfflineLoader())
+}
+
+var tikToken = &TikToken{encoders: make(map[string]*tiktoken.Tiktoken)}
+
+// TikToken counts tokens with the BPE encodings OpenAI models use
+type TikToken struct {
+	mu       sync.Mutex
+	encoders map[string]*tiktoken.Tiktoken // By model, built on first use
+}
+
+func (t *TikToken) CountTokens(model types.ModelID, messages []types.Message) int {
+	tokens := replyPriming
+	for _, message := range messages {
+		tokens += messageOverhead + t.CountText(model, message.Role.String()) + t.CountText(model, message.Content)
+	}
+	return tokens
+}
+
+func (t *TikToken) CountText(model types.ModelID, text string) int {
+	encoder := t.encoder(model)
+	if encoder == nil {
+		return Heuristic{}.CountText(model, text)
+	}
+	return len(encoder.EncodeOrdinary(text))
+}
+
+// encoder returns the encoding for a model, or nil if none could be loaded
+func (t *TikToken) encoder(model types.ModelID) *tiktoken.Tiktoken {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if encoder, ok := t.encoders[model.String()]; ok {
+		return encoder
+	}
+
+	encoder, err := tiktoken.EncodingForModel(model.String())
+	if err != nil {
+		encoder, err = tiktoken.GetEncoding(defaultEncoding)
+	}
+	if err != nil {
+		log.Printf("failed to load token encoding for %s, estimating: %v", model.String(), err)
+	}
+	// A failure is cached too, so the encoding isn't loaded again for every count
+	t.encoders[model.String()] = encoder
+	return encoder
+}
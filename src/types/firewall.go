@@ -26,6 +26,9 @@ func isValidFirewallType(value string) bool {
 		"hallucination-risk": {},
 		"spam":               {},
 		"obfuscation":        {},
+		"length":             {},
+		"injection":          {},
+		"pii":                {},
 	}
 	_, exists := validTypes[value]
 	return exists
@@ -40,3 +43,162 @@ func NewFirewallType(value string) (FirewallType, error) {
 	}
 	return FirewallType{value}, nil
 }
+
+// ======== Firewall Scope ==========
+
+type FirewallScope struct {
+	raw string
+}
+
+func (s FirewallScope) Complete() bool {
+	return s.raw != ""
+}
+
+func (s FirewallScope) String() string {
+	return s.raw
+}
+
+func LastMessage() FirewallScope {
+	return FirewallScope{"last-message"}
+}
+
+func AllMessages() FirewallScope {
+	return FirewallScope{"all-messages"}
+}
+
+func UserMessagesOnly() FirewallScope {
+	return FirewallScope{"user-messages"}
+}
+
+func SystemPromptOnly() FirewallScope {
+	return FirewallScope{"system-prompt"}
+}
+
+func isValidFirewallScope(value string) bool {
+	return value == "last-message" || value == "all-messages" || value == "user-messages" || value == "system-prompt"
+}
+
+func NewFirewallScope(value string) (FirewallScope, error) {
+	if value == "" {
+		return FirewallScope{}, errors.New("firewall scope cannot be empty")
+	}
+	if !isValidFirewallScope(value) {
+		return FirewallScope{}, fmt.Errorf("invalid firewall scope: %s", value)
+	}
+	return FirewallScope{value}, nil
+}
+
+// ======== Firewall Fail Mode ==========
+
+type FailMode struct {
+	raw string
+}
+
+func (s FailMode) Complete() bool {
+	return s.raw != ""
+}
+
+func (s FailMode) String() string {
+	return s.raw
+}
+
+// FailOpen lets a request through when the firewall can't reach a decision
+func FailOpen() FailMode {
+	return FailMode{"fail-open"}
+}
+
+// FailClosed blocks a request when the firewall can't reach a decision
+func FailClosed() FailMode {
+	return FailMode{"fail-closed"}
+}
+
+func isValidFailMode(value string) bool {
+	return value == "fail-open" || value == "fail-closed"
+}
+
+func NewFailMode(value string) (FailMode, error) {
+	if value == "" {
+		return FailMode{}, errors.New("fail mode cannot be empty")
+	}
+	if !isValidFailMode(value) {
+		return FailMode{}, fmt.Errorf("invalid fail mode: %s", value)
+	}
+	return FailMode{value}, nil
+}
+
+// ======== Firewall Mode ==========
+
+type FirewallMode struct {
+	raw string
+}
+
+func (s FirewallMode) Complete() bool {
+	return s.raw != ""
+}
+
+func (s FirewallMode) String() string {
+	return s.raw
+}
+
+// Enforce blocks requests the firewall rejects
+func Enforce() FirewallMode {
+	return FirewallMode{"enforce"}
+}
+
+// Monitor only records what the firewall would have blocked, so a new firewall can be
+// tuned against real traffic first
+func Monitor() FirewallMode {
+	return FirewallMode{"monitor"}
+}
+
+func isValidFirewallMode(value string) bool {
+	return value == "enforce" || value == "monitor"
+}
+
+func NewFirewallMode(value string) (FirewallMode, error) {
+	if value == "" {
+		return FirewallMode{}, errors.New("firewall mode cannot be empty")
+	}
+	if !isValidFirewallMode(value) {
+		return FirewallMode{}, fmt.Errorf("invalid firewall mode: %s", value)
+	}
+	return FirewallMode{value}, nil
+}
+
+// ======== Firewall Direction ==========
+
+type FirewallDirection struct {
+	raw string
+}
+
+func (s FirewallDirection) Complete() bool {
+	return s.raw != ""
+}
+
+func (s FirewallDirection) String() string {
+	return s.raw
+}
+
+// InputDirection firewalls evaluate the request messages
+func InputDirection() FirewallDirection {
+	return FirewallDirection{"input"}
+}
+
+// OutputDirection firewalls evaluate the model's response
+func OutputDirection() FirewallDirection {
+	return FirewallDirection{"output"}
+}
+
+func isValidFirewallDirection(value string) bool {
+	return value == "input" || value == "output"
+}
+
+func NewFirewallDirection(value string) (FirewallDirection, error) {
+	if value == "" {
+		return FirewallDirection{}, errors.New("firewall direction cannot be empty")
+	}
+	if !isValidFirewallDirection(value) {
+		return FirewallDirection{}, fmt.Errorf("invalid firewall direction: %s", value)
+	}
+	return FirewallDirection{value}, nil
+}
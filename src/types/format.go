@@ -0,0 +1,215 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ========================= ResponseFormat =========================
+
+// ResponseFormat constrains the shape of the model's reply, as OpenAI's response_format
+// does: free text, any JSON object, or JSON matching a schema
+type ResponseFormat struct {
+	formatType string
+	name       string
+	strict     *bool
+	schema     map[string]interface{}
+}
+
+func (s ResponseFormat) Complete() bool {
+	return s.formatType != ""
+}
+
+// Type is text, json_object or json_schema
+func (s ResponseFormat) Type() string {
+	return s.formatType
+}
+
+// Value returns the response format in the shape the provider expects
+func (s ResponseFormat) Value() map[string]interface{} {
+	value := map[string]interface{}{"type": s.formatType}
+	if s.formatType == "json_schema" {
+		jsonSchema := map[string]interface{}{
+			"name":   s.name,
+			"schema": s.schema,
+		}
+		if s.strict != nil {
+			jsonSchema["strict"] = *s.strict
+		}
+		value["json_schema"] = jsonSchema
+	}
+	return value
+}
+
+func isValidResponseFormatType(value string) bool {
+	return value == "text" || value == "json_object" || value == "json_schema"
+}
+
+// OpenAI limits schema names to these characters
+var schemaNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// NewResponseFormat parses a response format in the OpenAI shape:
+// {"type": "json_schema", "json_schema": {"name": ..., "strict": ..., "schema": {...}}}
+func NewResponseFormat(value interface{}) (ResponseFormat, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return ResponseFormat{}, errors.New("response_format must be an object")
+	}
+
+	formatType, _ := object["type"].(string)
+	if !isValidResponseFormatType(formatType) {
+		return ResponseFormat{}, fmt.Errorf("response_format type '%v' is invalid (must be text, json_object or json_schema)", object["type"])
+	}
+	if formatType != "json_schema" {
+		return ResponseFormat{formatType: formatType}, nil
+	}
+
+	jsonSchema, ok := object["json_schema"].(map[string]interface{})
+	if !ok {
+		return ResponseFormat{}, errors.New("response_format json_schema must be an object")
+	}
+
+	name, _ := jsonSchema["name"].(string)
+	if !schemaNamePattern.MatchString(name) {
+		return ResponseFormat{}, errors.New("response_format json_schema name must be 1 to 64 letters, digits, underscores or dashes")
+	}
+
+	var strict *bool
+	if raw, ok := jsonSchema["strict"]; ok && raw != nil {
+		value, ok := raw.(bool)
+		if !ok {
+			return ResponseFormat{}, errors.New("response_format json_schema strict must be a boolean")
+		}
+		strict = &value
+	}
+
+	// The schema is optional, in which case the model may reply with any JSON
+	var schema map[string]interface{}
+	if raw, ok := jsonSchema["schema"]; ok && raw != nil {
+		if schema, ok = raw.(map[string]interface{}); !ok {
+			return ResponseFormat{}, errors.New("response_format json_schema schema must be an object")
+		}
+		if err := validateSchema(schema, "schema"); err != nil {
+			return ResponseFormat{}, fmt.Errorf("response_format json_schema %w", err)
+		}
+	}
+
+	return ResponseFormat{formatType: formatType, name: name, strict: strict, schema: schema}, nil
+}
+
+var schemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// validateSchema checks that value is a well-formed JSON Schema: the keywords the
+// providers act on must have the right shape, and nested schemas are checked in turn.
+// Unknown keywords are left for the provider to judge.
+func validateSchema(value interface{}, path string) error {
+	schema, ok := value.(map[string]interface{})
+	if !ok {
+		// true and false are valid schemas, matching anything and nothing
+		if _, ok := value.(bool); ok {
+			return nil
+		}
+		return fmt.Errorf("%s must be an object", path)
+	}
+
+	if raw, ok := schema["type"]; ok {
+		var types []interface{}
+		switch v := raw.(type) {
+		case string:
+			types = []interface{}{v}
+		case []interface{}:
+			if len(v) == 0 {
+				return fmt.Errorf("%s.type cannot be empty", path)
+			}
+			types = v
+		default:
+			return fmt.Errorf("%s.type must be a string or an array of strings", path)
+		}
+		for _, t := range types {
+			name, _ := t.(string)
+			if !schemaTypes[name] {
+				return fmt.Errorf("%s.type '%v' is not a JSON Schema type", path, t)
+			}
+		}
+	}
+
+	if raw, ok := schema["properties"]; ok {
+		properties, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s.properties must be an object", path)
+		}
+		for name, property := range properties {
+			if err := validateSchema(property, path+".properties."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if raw, ok := schema["required"]; ok {
+		required, ok := raw.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s.required must be an array of strings", path)
+		}
+		for _, name := range required {
+			if _, ok := name.(string); !ok {
+				return fmt.Errorf("%s.required must be an array of strings", path)
+			}
+		}
+	}
+
+	if raw, ok := schema["enum"]; ok {
+		if _, ok := raw.([]interface{}); !ok {
+			return fmt.Errorf("%s.enum must be an array", path)
+		}
+	}
+
+	if raw, ok := schema["items"]; ok {
+		if err := validateSchema(raw, path+".items"); err != nil {
+			return err
+		}
+	}
+
+	if raw, ok := schema["additionalProperties"]; ok {
+		if err := validateSchema(raw, path+".additionalProperties"); err != nil {
+			return err
+		}
+	}
+
+	for _, keyword := range []string{"anyOf", "oneOf", "allOf"} {
+		raw, ok := schema[keyword]
+		if !ok {
+			continue
+		}
+		schemas, ok := raw.([]interface{})
+		if !ok || len(schemas) == 0 {
+			return fmt.Errorf("%s.%s must be a non-empty array of schemas", path, keyword)
+		}
+		for i, nested := range schemas {
+			if err := validateSchema(nested, fmt.Sprintf("%s.%s[%d]", path, keyword, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, keyword := range []string{"$defs", "definitions"} {
+		raw, ok := schema[keyword]
+		if !ok {
+			continue
+		}
+		defs, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s.%s must be an object", path, keyword)
+		}
+		for name, nested := range defs {
+			if err := validateSchema(nested, path+"."+keyword+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
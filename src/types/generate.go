@@ -1,6 +1,12 @@
 package types
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"unicode/utf8"
+)
 
 // ========================= MaxTokens =========================
 
@@ -59,3 +65,193 @@ func NewTemperature(value float32) (Temperature, error) {
 	}
 	return Temperature{value}, nil
 }
+
+// ========================= TopP =========================
+
+type TopP struct {
+	value float32
+}
+
+func (s TopP) Complete() bool {
+	return true
+}
+
+func (s TopP) Float32() float32 {
+	return s.value
+}
+
+func isValidTopP(value float32) bool {
+	if value < 0 || value > 1 {
+		return false
+	}
+	return true
+}
+
+func NewTopP(value float32) (TopP, error) {
+	if !isValidTopP(value) {
+		return TopP{}, fmt.Errorf("invalid top_p value %v (must be between 0 and 1)", value)
+	}
+	return TopP{value}, nil
+}
+
+// ========================= Penalty =========================
+
+// Penalty is a frequency or presence penalty
+type Penalty struct {
+	value float32
+}
+
+func (s Penalty) Complete() bool {
+	return true
+}
+
+func (s Penalty) Float32() float32 {
+	return s.value
+}
+
+func isValidPenalty(value float32) bool {
+	if value < -2 || value > 2 {
+		return false
+	}
+	return true
+}
+
+// NewPenalty validates a penalty; name is the request field, used in the error
+func NewPenalty(name string, value float32) (Penalty, error) {
+	if !isValidPenalty(value) {
+		return Penalty{}, fmt.Errorf("invalid %s value %v (must be between -2 and 2)", name, value)
+	}
+	return Penalty{value}, nil
+}
+
+// ========================= Stop =========================
+
+const maxStopSequences = 4
+
+type Stop struct {
+	sequences []string
+}
+
+func (s Stop) Complete() bool {
+	return true
+}
+
+func (s Stop) Strings() []string {
+	return s.sequences
+}
+
+func isValidStop(sequences []string) bool {
+	if len(sequences) == 0 || len(sequences) > maxStopSequences {
+		return false
+	}
+	for _, sequence := range sequences {
+		if sequence == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// NewStop accepts either a single string or an array of strings, as OpenAI does
+func NewStop(value interface{}) (Stop, error) {
+	var sequences []string
+	switch v := value.(type) {
+	case string:
+		sequences = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			sequence, ok := item.(string)
+			if !ok {
+				return Stop{}, errors.New("invalid stop value (sequences must be strings)")
+			}
+			sequences = append(sequences, sequence)
+		}
+	default:
+		return Stop{}, errors.New("invalid stop value (must be a string or an array of strings)")
+	}
+
+	if !isValidStop(sequences) {
+		return Stop{}, fmt.Errorf("invalid stop value (must be 1 to %d non-empty strings, got %d)", maxStopSequences, len(sequences))
+	}
+	return Stop{sequences}, nil
+}
+
+// ========================= N =========================
+
+const maxN = 10
+
+// N is the number of completions to generate for one request
+type N struct {
+	value int
+}
+
+func (s N) Complete() bool {
+	return true
+}
+
+func (s N) Int() int {
+	return s.value
+}
+
+func isValidN(value int) bool {
+	return value >= 1 && value <= maxN
+}
+
+func NewN(value int) (N, error) {
+	if !isValidN(value) {
+		return N{}, fmt.Errorf("invalid n value (must be between 1 and %d)", maxN)
+	}
+	return N{value}, nil
+}
+
+// ========================= Metadata =========================
+
+const (
+	maxMetadataPairs       = 16
+	maxMetadataValueLength = 512
+)
+
+// Keys are short identifiers, so they can be filtered on without quoting
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,64}$`)
+
+// Metadata is the client's own tags for a request, such as a tenant or experiment. It
+// is stored with the request and echoed back, but never sent to the provider.
+type Metadata struct {
+	pairs map[string]string
+}
+
+func (s Metadata) Complete() bool {
+	return true
+}
+
+// Map returns a copy of the key/value pairs
+func (s Metadata) Map() map[string]string {
+	return maps.Clone(s.pairs)
+}
+
+// NewMetadata accepts an object of string values, as OpenAI does
+func NewMetadata(value interface{}) (Metadata, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return Metadata{}, errors.New("invalid metadata (must be an object of string values)")
+	}
+	if len(object) > maxMetadataPairs {
+		return Metadata{}, fmt.Errorf("invalid metadata (at most %d keys, got %d)", maxMetadataPairs, len(object))
+	}
+
+	pairs := make(map[string]string, len(object))
+	for key, v := range object {
+		if !metadataKeyPattern.MatchString(key) {
+			return Metadata{}, fmt.Errorf("invalid metadata key %q (must be 1 to 64 letters, digits, '_', '-' or '.')", key)
+		}
+		value, ok := v.(string)
+		if !ok {
+			return Metadata{}, fmt.Errorf("invalid metadata value for %q (must be a string)", key)
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueLength {
+			return Metadata{}, fmt.Errorf("invalid metadata value for %q (at most %d characters)", key, maxMetadataValueLength)
+		}
+		pairs[key] = value
+	}
+	return Metadata{pairs}, nil
+}
@@ -3,26 +3,177 @@ package types
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
+// Message is a chat message. Content holds the text of the message; for multimodal
+// messages it is the text parts joined together and Parts holds every part in order.
 type Message struct {
-	Role    string
-	Content string
+	Role       Role
+	Content    string
+	Parts      []ContentPart // Nil when the content was a plain string
+	ToolCallID string        // Set on tool messages: the call they answer
+	ToolCalls  []ToolCall    // Calls an assistant message made; its content may then be empty
 }
 
 func (s Message) Complete() bool {
-	return s.Role != "" && s.Content != ""
+	return s.Role.Complete() && (s.Content != "" || len(s.Parts) > 0 || len(s.ToolCalls) > 0)
 }
 
-func (s Message) ToMap() map[string]string {
-	return map[string]string{
-		"role":    s.Role,
-		"content": s.Content,
+// HasImages reports whether any part of the message is an image
+func (s Message) HasImages() bool {
+	for _, part := range s.Parts {
+		if part.Type == ImagePart {
+			return true
+		}
 	}
+	return false
+}
+
+// ToMap returns the message in the shape it was received: content is a string for
+// plain messages, an array of parts for multimodal ones and null for an assistant
+// message that only calls tools
+func (s Message) ToMap() map[string]interface{} {
+	message := map[string]interface{}{"role": s.Role.String()}
+	switch {
+	case s.Parts != nil:
+		parts := make([]interface{}, len(s.Parts))
+		for i, part := range s.Parts {
+			parts[i] = part.ToMap()
+		}
+		message["content"] = parts
+	case s.Content == "" && len(s.ToolCalls) > 0:
+		message["content"] = nil
+	default:
+		message["content"] = s.Content
+	}
+
+	if s.ToolCallID != "" {
+		message["tool_call_id"] = s.ToolCallID
+	}
+	if len(s.ToolCalls) > 0 {
+		calls := make([]interface{}, len(s.ToolCalls))
+		for i, call := range s.ToolCalls {
+			calls[i] = call.ToMap()
+		}
+		message["tool_calls"] = calls
+	}
+	return message
+}
+
+// ========================= Role =========================
+
+// Role is who a message is from
+type Role struct {
+	raw string
+}
+
+func (s Role) Complete() bool {
+	return s.raw != ""
+}
+
+func (s Role) String() string {
+	return s.raw
+}
+
+func SystemRole() Role {
+	return Role{"system"}
+}
+
+func UserRole() Role {
+	return Role{"user"}
+}
+
+func AssistantRole() Role {
+	return Role{"assistant"}
+}
+
+func ToolRole() Role {
+	return Role{"tool"}
 }
 
 func isValidRole(value string) bool {
-	return value == "user" || value == "assistant"
+	return value == "system" || value == "user" || value == "assistant" || value == "tool"
+}
+
+// NewRole parses a role, normalizing case and surrounding whitespace so "User " is
+// stored as "user". Unknown roles are rejected.
+func NewRole(value string) (Role, error) {
+	role := strings.ToLower(strings.TrimSpace(value))
+	if role == "" {
+		return Role{}, errors.New("role cannot be empty")
+	}
+	if !isValidRole(role) {
+		return Role{}, fmt.Errorf("role '%s' is invalid (must be system, user, assistant or tool)", value)
+	}
+	return Role{role}, nil
+}
+
+// ========================= ContentPart =========================
+
+const (
+	TextPart  = "text"
+	ImagePart = "image_url"
+)
+
+// ContentPart is one element of a multimodal message's content array
+type ContentPart struct {
+	Type     string
+	Text     string // Set for text parts
+	ImageURL string // Set for image parts; may be a data: URL
+	Detail   string // Optional image detail hint
+}
+
+func (s ContentPart) ToMap() map[string]interface{} {
+	if s.Type == ImagePart {
+		image := map[string]interface{}{"url": s.ImageURL}
+		if s.Detail != "" {
+			image["detail"] = s.Detail
+		}
+		return map[string]interface{}{
+			"type":      ImagePart,
+			"image_url": image,
+		}
+	}
+	return map[string]interface{}{
+		"type": TextPart,
+		"text": s.Text,
+	}
+}
+
+func NewContentPartFromJson(object interface{}) (ContentPart, error) {
+	partObject, ok := object.(map[string]interface{})
+	if !ok {
+		return ContentPart{}, fmt.Errorf("invalid content part format")
+	}
+
+	partType, _ := partObject["type"].(string)
+	switch partType {
+	case TextPart:
+		text, ok := partObject["text"].(string)
+		if !ok || text == "" {
+			return ContentPart{}, errors.New("text part must have a non-empty text string")
+		}
+		return ContentPart{Type: TextPart, Text: text}, nil
+
+	case ImagePart:
+		// Accept both {"image_url": {"url": ...}} and the older {"image_url": "..."}
+		var imageURL, detail string
+		switch image := partObject["image_url"].(type) {
+		case string:
+			imageURL = image
+		case map[string]interface{}:
+			imageURL, _ = image["url"].(string)
+			detail, _ = image["detail"].(string)
+		}
+		if imageURL == "" {
+			return ContentPart{}, errors.New("image_url part must have a url")
+		}
+		return ContentPart{Type: ImagePart, ImageURL: imageURL, Detail: detail}, nil
+
+	default:
+		return ContentPart{}, fmt.Errorf("content part type '%s' is invalid", partType)
+	}
 }
 
 func isValidContent(value string) bool {
@@ -30,21 +181,40 @@ func isValidContent(value string) bool {
 }
 
 func NewMessage(role string, content string) (Message, error) {
-	if role == "" {
-		return Message{}, errors.New("role cannot be empty")
+	r, err := NewRole(role)
+	if err != nil {
+		return Message{}, err
 	}
 	if content == "" {
 		return Message{}, errors.New("content cannot be empty")
 	}
 
-	if !isValidRole(role) {
-		return Message{}, fmt.Errorf("role '%s' is invalid", role)
-	}
 	if !isValidContent(content) {
 		return Message{}, fmt.Errorf("content '%s' is invalid", content)
 	}
 
-	return Message{role, content}, nil
+	return Message{Role: r, Content: content}, nil
+}
+
+// NewMultimodalMessage builds a message from content parts. Its Content is the text
+// of the text parts, so text-based firewalls still see what the user wrote.
+func NewMultimodalMessage(role string, parts []ContentPart) (Message, error) {
+	r, err := NewRole(role)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(parts) == 0 {
+		return Message{}, errors.New("content cannot be empty")
+	}
+
+	texts := []string{}
+	for _, part := range parts {
+		if part.Type == TextPart {
+			texts = append(texts, part.Text)
+		}
+	}
+
+	return Message{Role: r, Content: strings.Join(texts, "\n"), Parts: parts}, nil
 }
 
 func NewMessageFromJson(object interface{}) (Message, error) {
@@ -53,11 +223,64 @@ func NewMessageFromJson(object interface{}) (Message, error) {
 		return Message{}, fmt.Errorf("invalid message format")
 	}
 
-	message, err := NewMessage(messageObject["role"].(string), messageObject["content"].(string))
+	role, ok := messageObject["role"].(string)
+	if !ok {
+		return Message{}, fmt.Errorf("message role must be a string")
+	}
+
+	var message Message
+	var err error
+	switch content := messageObject["content"].(type) {
+	case string:
+		message, err = NewMessage(role, content)
+	case []interface{}:
+		parts := make([]ContentPart, 0, len(content))
+		for i, object := range content {
+			part, partErr := NewContentPartFromJson(object)
+			if partErr != nil {
+				return Message{}, fmt.Errorf("invalid content part %d: %v", i, partErr)
+			}
+			parts = append(parts, part)
+		}
+		message, err = NewMultimodalMessage(role, parts)
+	case nil:
+		// An assistant message that only calls tools has no content
+		if messageObject["tool_calls"] == nil {
+			return Message{}, fmt.Errorf("message content must be a string or an array of parts")
+		}
+		message.Role, err = NewRole(role)
+	default:
+		return Message{}, fmt.Errorf("message content must be a string or an array of parts")
+	}
 	if err != nil {
 		return Message{}, fmt.Errorf("failed to parse message: %v", err)
 	}
 
+	if object := messageObject["tool_calls"]; object != nil {
+		if message.Role != AssistantRole() {
+			return Message{}, fmt.Errorf("only assistant messages can have tool_calls")
+		}
+		calls, ok := object.([]interface{})
+		if !ok || len(calls) == 0 {
+			return Message{}, fmt.Errorf("message tool_calls must be a non-empty array")
+		}
+		for i, object := range calls {
+			call, err := NewToolCallFromJson(object)
+			if err != nil {
+				return Message{}, fmt.Errorf("invalid tool call %d: %v", i, err)
+			}
+			message.ToolCalls = append(message.ToolCalls, call)
+		}
+	}
+
+	// A tool result is matched to the call it answers by ID
+	if message.Role == ToolRole() {
+		message.ToolCallID, _ = messageObject["tool_call_id"].(string)
+		if message.ToolCallID == "" {
+			return Message{}, fmt.Errorf("tool messages must have a tool_call_id")
+		}
+	}
+
 	return message, nil
 
 }
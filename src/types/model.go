@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"strings"
 )
 
 // ========================= Name =========================
@@ -20,30 +21,70 @@ func (s Name) String() string {
 	return s.raw
 }
 
-// isValidModelName checks if a model name contains only valid characters
-func isValidName(name string) bool {
-	if len(name) < 1 || len(name) > 64 {
-		return false
+const maxNameLength = 64
+
+// NameCase is how the letters of a name are normalized
+type NameCase int
+
+const (
+	// PreserveCase keeps a name as written, so names differing only in case are distinct
+	PreserveCase NameCase = iota
+	// FoldCase lowercases a name, so "GPT-4" and "gpt-4" are the same model
+	FoldCase
+)
+
+// NameError is returned for a name that can't be used
+type NameError struct {
+	Name   string // As the client sent it
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	if e.Name == "" {
+		return "invalid name: " + e.Reason
 	}
+	return fmt.Sprintf("invalid name %q: %s", e.Name, e.Reason)
+}
 
+// invalidNameRune returns the first character a name can't contain, if any
+func invalidNameRune(name string) (rune, bool) {
 	// Allow alphanumeric, dash, underscore, and dot
 	for _, r := range name {
 		if !(('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_' || r == '.') {
-			return false
+			return r, true
 		}
 	}
+	return 0, false
+}
 
-	return true
+// NormalizeName trims the whitespace clients leave around a name and applies
+// nameCase, without checking the result
+func NormalizeName(value string, nameCase NameCase) string {
+	value = strings.TrimSpace(value)
+	if nameCase == FoldCase {
+		value = strings.ToLower(value)
+	}
+	return value
 }
 
+// NewName trims a name and checks it, keeping its case. An invalid name is a *NameError.
 func NewName(value string) (Name, error) {
-	if value == "" {
-		return Name{}, errors.New("empty name")
+	return NewNameWithCase(value, PreserveCase)
+}
+
+// NewNameWithCase is NewName with the letters normalized by nameCase
+func NewNameWithCase(value string, nameCase NameCase) (Name, error) {
+	name := NormalizeName(value, nameCase)
+	if name == "" {
+		return Name{}, &NameError{Name: value, Reason: "must not be empty"}
 	}
-	if !isValidName(value) {
-		return Name{}, errors.New("invalid name")
+	if len(name) > maxNameLength {
+		return Name{}, &NameError{Name: value, Reason: fmt.Sprintf("must be at most %d characters", maxNameLength)}
 	}
-	return Name{value}, nil
+	if r, ok := invalidNameRune(name); ok {
+		return Name{}, &NameError{Name: value, Reason: fmt.Sprintf("contains %q; only letters, digits, '-', '_' and '.' are allowed", r)}
+	}
+	return Name{name}, nil
 }
 
 // ========================= APIURL =========================
@@ -89,6 +130,14 @@ func (s ModelProvider) String() string {
 	return s.raw
 }
 
+// MaxTemperature is the highest temperature the provider accepts
+func (s ModelProvider) MaxTemperature() float32 {
+	if s.raw == "anthropic" {
+		return 1
+	}
+	return 2
+}
+
 func isValidModelProvider(value string) bool {
 	validTypes := map[string]struct{}{
 		"openai":    {},
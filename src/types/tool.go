@@ -0,0 +1,190 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ========================= ToolDefinition =========================
+
+// ToolDefinition is a function the model may call
+type ToolDefinition struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{} // JSON schema of the arguments
+}
+
+func (s ToolDefinition) Complete() bool {
+	return s.Name != "" && s.Parameters != nil
+}
+
+func (s ToolDefinition) ToMap() map[string]interface{} {
+	function := map[string]interface{}{
+		"name":       s.Name,
+		"parameters": s.Parameters,
+	}
+	if s.Description != "" {
+		function["description"] = s.Description
+	}
+	return map[string]interface{}{
+		"type":     "function",
+		"function": function,
+	}
+}
+
+func isValidToolParameters(value map[string]interface{}) bool {
+	schemaType, ok := value["type"].(string)
+	return ok && schemaType == "object"
+}
+
+// NewToolDefinitionFromJson parses a tool in the OpenAI shape:
+// {"type": "function", "function": {"name": ..., "description": ..., "parameters": {...}}}
+func NewToolDefinitionFromJson(object interface{}) (ToolDefinition, error) {
+	toolObject, ok := object.(map[string]interface{})
+	if !ok {
+		return ToolDefinition{}, errors.New("invalid tool format")
+	}
+
+	if toolType, _ := toolObject["type"].(string); toolType != "function" {
+		return ToolDefinition{}, fmt.Errorf("tool type '%v' is invalid", toolObject["type"])
+	}
+
+	function, ok := toolObject["function"].(map[string]interface{})
+	if !ok {
+		return ToolDefinition{}, errors.New("tool function must be an object")
+	}
+
+	name, _ := function["name"].(string)
+	if name == "" {
+		return ToolDefinition{}, errors.New("tool name cannot be empty")
+	}
+
+	parameters, ok := function["parameters"].(map[string]interface{})
+	if !ok || !isValidToolParameters(parameters) {
+		return ToolDefinition{}, fmt.Errorf("tool '%s' parameters must be a JSON schema object", name)
+	}
+
+	description, _ := function["description"].(string)
+
+	return ToolDefinition{Name: name, Description: description, Parameters: parameters}, nil
+}
+
+// ========================= ToolCall =========================
+
+// ToolCall is a function call an assistant message made. The tool message with its ID
+// carries the result.
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string // JSON-encoded, exactly as the model produced it
+}
+
+func (s ToolCall) Complete() bool {
+	return s.ID != "" && s.Name != ""
+}
+
+func (s ToolCall) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":   s.ID,
+		"type": "function",
+		"function": map[string]interface{}{
+			"name":      s.Name,
+			"arguments": s.Arguments,
+		},
+	}
+}
+
+// NewToolCallFromJson parses a tool call in the OpenAI shape:
+// {"id": ..., "type": "function", "function": {"name": ..., "arguments": "..."}}
+func NewToolCallFromJson(object interface{}) (ToolCall, error) {
+	callObject, ok := object.(map[string]interface{})
+	if !ok {
+		return ToolCall{}, errors.New("invalid tool call format")
+	}
+
+	if callType, _ := callObject["type"].(string); callType != "function" {
+		return ToolCall{}, fmt.Errorf("tool call type '%v' is invalid", callObject["type"])
+	}
+
+	id, _ := callObject["id"].(string)
+	if id == "" {
+		return ToolCall{}, errors.New("tool call id cannot be empty")
+	}
+
+	function, ok := callObject["function"].(map[string]interface{})
+	if !ok {
+		return ToolCall{}, errors.New("tool call function must be an object")
+	}
+
+	name, _ := function["name"].(string)
+	if name == "" {
+		return ToolCall{}, errors.New("tool call name cannot be empty")
+	}
+
+	arguments, ok := function["arguments"].(string)
+	if !ok {
+		return ToolCall{}, fmt.Errorf("tool call '%s' arguments must be a JSON string", name)
+	}
+
+	return ToolCall{ID: id, Name: name, Arguments: arguments}, nil
+}
+
+// ========================= ToolChoice =========================
+
+// ToolChoice controls whether and which tool the model calls. It is either a mode
+// ("none", "auto" or "required") or a specific function.
+type ToolChoice struct {
+	mode     string
+	function string
+}
+
+func (s ToolChoice) Complete() bool {
+	return s.mode != "" || s.function != ""
+}
+
+// Function is the name of the forced function, or empty if a mode was chosen
+func (s ToolChoice) Function() string {
+	return s.function
+}
+
+// Value returns the tool choice in the shape the provider expects
+func (s ToolChoice) Value() interface{} {
+	if s.function == "" {
+		return s.mode
+	}
+	return map[string]interface{}{
+		"type":     "function",
+		"function": map[string]interface{}{"name": s.function},
+	}
+}
+
+func isValidToolChoiceMode(value string) bool {
+	return value == "none" || value == "auto" || value == "required"
+}
+
+// NewToolChoice parses a tool choice, checking that a forced function is one of tools
+func NewToolChoice(value interface{}, tools []ToolDefinition) (ToolChoice, error) {
+	switch v := value.(type) {
+	case string:
+		if !isValidToolChoiceMode(v) {
+			return ToolChoice{}, fmt.Errorf("tool_choice '%s' is invalid (must be none, auto or required)", v)
+		}
+		return ToolChoice{mode: v}, nil
+
+	case map[string]interface{}:
+		function, _ := v["function"].(map[string]interface{})
+		name, _ := function["name"].(string)
+		if name == "" {
+			return ToolChoice{}, errors.New("tool_choice function name cannot be empty")
+		}
+		for _, tool := range tools {
+			if tool.Name == name {
+				return ToolChoice{function: name}, nil
+			}
+		}
+		return ToolChoice{}, fmt.Errorf("tool_choice function '%s' is not a defined tool", name)
+
+	default:
+		return ToolChoice{}, errors.New("tool_choice must be a string or an object")
+	}
+}
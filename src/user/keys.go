@@ -0,0 +1,48 @@
+package user
+
+import "sync"
+
+// Provider key slots. During a rotation both are set.
+const (
+	KeyCurrent = 0
+	KeyNext    = 1
+)
+
+// ProviderKeys holds the API keys a backend authenticates to its provider with. The
+// current key is tried first; while a rotation is under way the next key is tried when
+// the provider rejects the current one, and promoted once it is accepted. It is shared
+// by every copy of a Model, so a rotation is seen by requests already holding one.
+type ProviderKeys struct {
+	mu   sync.RWMutex
+	keys [2]string
+}
+
+// NewProviderKeys creates a key set with only a current key
+func NewProviderKeys(current string) *ProviderKeys {
+	return &ProviderKeys{keys: [2]string{current, ""}}
+}
+
+// Get returns the key in a slot, or "" if the slot is empty
+func (k *ProviderKeys) Get(slot int) string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[slot]
+}
+
+// SetNext starts a rotation to key. The current key keeps being used until the
+// provider rejects it.
+func (k *ProviderKeys) SetNext(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[KeyNext] = key
+}
+
+// Promote makes key the current key if it is still the next one, so a rotation that
+// was replaced in the meantime isn't undone
+func (k *ProviderKeys) Promote(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys[KeyNext] == key && key != "" {
+		k.keys = [2]string{key, ""}
+	}
+}
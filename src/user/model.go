@@ -15,4 +15,93 @@ type Model struct {
 	CreatedAt time.Time
 	Status    types.Status // Status of the model (active, inactive, etc.)
 	Provider  types.ModelProvider
+	// Size of the model's context window in tokens, shared by the prompt and the
+	// completion. Zero means unknown.
+	MaxContextTokens int
+	// Highest temperature the model accepts, which varies by provider
+	MaxTemperature float32
+	Vision         bool // Accepts image content parts
+	ToolUse        bool // Accepts tool definitions
+	JSONMode       bool // Accepts a JSON response_format
+	StrictRoles    bool // Requires one leading system message and alternating user and assistant turns
+	// Sent when the client omits temperature or max_tokens. Nil sends nothing, leaving
+	// the provider's own default.
+	DefaultTemperature *types.Temperature
+	DefaultMaxTokens   *types.MaxTokens
+	// Registered model names to retry, in order, when this model's provider fails
+	Fallbacks []types.Name
+	// Share of traffic relative to other backends registered under the same name.
+	// Zero means the name has a single backend.
+	Weight int
+	// When to stop sending traffic to this model's backend after repeated failures
+	Breaker BreakerConfig
+	// How many requests may be in flight to this model's backend at once
+	Concurrency ConcurrencyConfig
+	// When to call this model's backend again before falling back
+	Retry RetryConfig
+	// How long the provider has to respond, including a streamed body. Zero uses the
+	// gateway default.
+	RequestTimeout time.Duration
+	// Keys the gateway authenticates to the provider with. Nil forwards the client's
+	// Authorization header instead.
+	Keys *ProviderKeys
+}
+
+// BreakerConfig tunes the circuit breaker around a model's backend. The circuit opens
+// once at least MinRequests of the recent calls are recorded and FailureRate of them
+// failed, then lets a probe through after Cooldown.
+type BreakerConfig struct {
+	FailureRate float64
+	MinRequests int
+	Cooldown    time.Duration
+}
+
+// RetryConfig retries a backend that answered with a transient error status. The
+// delay doubles from BaseDelay on each retry, up to MaxDelay, and is spread by up to
+// Jitter of itself so clients retrying together don't hit the backend together.
+type RetryConfig struct {
+	MaxAttempts int // Including the first call; one never retries
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64 // Fraction of the delay, between 0 and 1
+	Statuses    []int   // Response statuses worth retrying
+}
+
+// ConcurrencyPolicy is what happens to a request when its backend is at its limit
+type ConcurrencyPolicy string
+
+const (
+	// ConcurrencyWait queues the request until a slot frees up or MaxWait passes
+	ConcurrencyWait ConcurrencyPolicy = "wait"
+	// ConcurrencyReject fails the request immediately
+	ConcurrencyReject ConcurrencyPolicy = "reject"
+)
+
+// ConcurrencyConfig caps the requests in flight to a backend. A zero MaxInFlight
+// leaves it unlimited.
+type ConcurrencyConfig struct {
+	MaxInFlight int
+	Policy      ConcurrencyPolicy
+	MaxWait     time.Duration // Only used by the wait policy
+}
+
+// DefaultBreakerConfig is used for models registered without breaker settings
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureRate: 0.5,
+		MinRequests: 10,
+		Cooldown:    30 * time.Second,
+	}
+}
+
+// DefaultRetryConfig is used for models registered without retry settings. It retries
+// rate limiting and unavailability, which providers return for load that passes.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts: 3,
+		BaseDelay:   250 * time.Millisecond,
+		MaxDelay:    4 * time.Second,
+		Jitter:      0.2,
+		Statuses:    []int{429, 503},
+	}
 }
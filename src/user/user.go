@@ -1,20 +1,171 @@
 package user
 
-import "github.com/google/uuid"
+import (
+	"context"
+	"covalence/src/db/postgres"
+	"covalence/src/db/postgres/sqlc"
+	"covalence/src/types"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// apiKeyPrefix marks covalence keys so they are recognisable if leaked
+const apiKeyPrefix = "cov_"
+
+var (
+	ErrInvalidAPIKey  = errors.New("invalid API key")
+	ErrRevokedAPIKey  = errors.New("API key has been revoked")
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// AdminScope lets a key use the /admin endpoints and the /model admin API
+const AdminScope = "admin"
+
+// ErrUnknownScope is returned for a key granted a scope that isn't one of these
+var ErrUnknownScope = errors.New("unknown scope")
+
+// validScope reports whether scope is one a key can be granted
+func validScope(scope string) bool {
+	return scope == AdminScope
+}
 
 type User struct {
 	ID       uuid.UUID
 	APIKeyID uuid.UUID
+	Scopes   []string // Permissions of the API key the user authenticated with
+	// Registered model names the API key may call. Empty means every model.
+	AllowedModels []string
+}
+
+// HasScope reports whether the user's API key was granted scope
+func (u User) HasScope(scope string) bool {
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsModel reports whether the user's API key may call the registered model name.
+// Both sides are compared as the registry matches names, so with FoldCase an allowlist
+// entry matches the model whatever case either was written in.
+func (u User) AllowsModel(name types.Name, nameCase types.NameCase) bool {
+	if len(u.AllowedModels) == 0 {
+		return true
+	}
+	want := types.NormalizeName(name.String(), nameCase)
+	for _, m := range u.AllowedModels {
+		if types.NormalizeName(m, nameCase) == want {
+			return true
+		}
+	}
+	return false
+}
+
+// HashAPIKey returns the form an API key is stored and looked up in
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
 }
 
-func GetUserByAPIKey(apiKey string) (User, error) {
-	// hash api key
+// GetUserByAPIKey resolves a presented key to its user. Unknown keys return
+// ErrInvalidAPIKey and revoked ones ErrRevokedAPIKey.
+func GetUserByAPIKey(ctx context.Context, apiKey string, db *postgres.DB) (User, error) {
+	if apiKey == "" {
+		return User{}, ErrInvalidAPIKey
+	}
 
-	// lookup api key id in db
+	row, err := db.Queries.GetAPIKeyByHash(ctx, HashAPIKey(apiKey))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return User{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if row.Revoked {
+		return User{}, ErrRevokedAPIKey
+	}
 
-	// for now, leave it random
 	return User{
-		ID:       uuid.New(),
-		APIKeyID: uuid.New(),
+		ID:            uuid.UUID(row.UserID.Bytes),
+		APIKeyID:      uuid.UUID(row.ApiKeyID.Bytes),
+		Scopes:        row.Scopes,
+		AllowedModels: row.AllowedModels,
+	}, nil
+}
+
+// CreateAPIKey issues a new key for a user with the given scopes, which may be none,
+// limited to the registered model names in allowedModels, or free to call any model if
+// it is empty. The plaintext key is only available here; just its hash is stored.
+func CreateAPIKey(ctx context.Context, userID uuid.UUID, scopes, allowedModels []string, db *postgres.DB) (string, User, error) {
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", User{}, fmt.Errorf("%w: %q", ErrUnknownScope, scope)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", User{}, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	apiKey := apiKeyPrefix + hex.EncodeToString(secret)
+
+	row, err := db.Queries.InsertAPIKey(ctx, sqlc.InsertAPIKeyParams{
+		UserID:  pgtype.UUID{Bytes: userID, Valid: true},
+		KeyHash: HashAPIKey(apiKey),
+		// The columns are NOT NULL, so never nil
+		Scopes:        append([]string{}, scopes...),
+		AllowedModels: append([]string{}, allowedModels...),
+	})
+	if err != nil {
+		return "", User{}, err
+	}
+
+	return apiKey, User{
+		ID:            uuid.UUID(row.UserID.Bytes),
+		APIKeyID:      uuid.UUID(row.ApiKeyID.Bytes),
+		Scopes:        row.Scopes,
+		AllowedModels: row.AllowedModels,
 	}, nil
 }
+
+// SeedAdminKey adds apiKey as an admin key for a user, so the first admin key can be
+// configured before any exist to issue it with. A key already stored is left as it is,
+// even if it has been revoked, and false is returned.
+func SeedAdminKey(ctx context.Context, userID uuid.UUID, apiKey string, db *postgres.DB) (bool, error) {
+	if apiKey == "" {
+		return false, ErrInvalidAPIKey
+	}
+
+	added, err := db.Queries.SeedAPIKey(ctx, sqlc.SeedAPIKeyParams{
+		UserID:  pgtype.UUID{Bytes: userID, Valid: true},
+		KeyHash: HashAPIKey(apiKey),
+		Scopes:  []string{AdminScope},
+	})
+	if err != nil {
+		return false, err
+	}
+	return added > 0, nil
+}
+
+// RevokeAPIKey stops a key from authenticating. Revoking an unknown key returns
+// ErrAPIKeyNotFound.
+func RevokeAPIKey(ctx context.Context, apiKeyID uuid.UUID, db *postgres.DB) error {
+	revoked, err := db.Queries.RevokeAPIKey(ctx, pgtype.UUID{Bytes: apiKeyID, Valid: true})
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
@@ -4,16 +4,32 @@ import (
 	"context"
 	"covalence/src/audit"
 	"covalence/src/db/postgres"
+	"covalence/src/register"
+	"covalence/src/types"
+	"covalence/src/user"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 )
 
 func main() {
 	// fmt.Println(uuid.New())
 	ctx := context.Background()
 
+	// Registering and reading models at once must never show a half-registered model;
+	// run with -race to check the locking as well
+	concurrentRegistry(100)
+
+	// Names clients actually sent with stray whitespace or capitals must find the model
+	modelNames()
+
 	// Connect to database
-	db, err := postgres.New(ctx, "user=alialh dbname=covalence_dev sslmode=disable")
+	db, err := postgres.New(ctx, "user=alialh dbname=covalence_dev sslmode=disable", postgres.DefaultPoolConfig())
 	if err != nil {
 		log.Fatal("Database connection failed:", err)
 	}
@@ -34,7 +50,7 @@ func main() {
 	}
 
 	// Log a request
-	requestID, err := audit.LogRequest(ctx, request, db)
+	requestID, err := audit.LogRequest(ctx, request, db, audit.Options{})
 	if err != nil {
 		log.Fatal("Failed to log request:", err)
 	}
@@ -62,11 +78,11 @@ func main() {
 	}
 
 	// Log a firewall event
-	err = audit.LogFirewallEvent(ctx, firewallEvent, db)
+	firewallEventID, err := audit.LogFirewallEvent(ctx, firewallEvent, db)
 	if err != nil {
 		log.Fatal("Failed to log firewall event:", err)
 	}
-	fmt.Println("Firewall event logged")
+	fmt.Println("Firewall event logged:", firewallEventID)
 
 	// Get trace
 	trace, err := audit.GetTrace(ctx, requestID, db)
@@ -88,4 +104,550 @@ func main() {
 				i+1, event.FirewallID, event.Blocked, event.BlockedReason)
 		}
 	}
+
+	// Fire concurrent requests to make sure the pool handles them without a global lock
+	concurrentLogRequests(ctx, db, request, response, 100)
+
+	// A cancelled context must short-circuit before touching the database
+	cancelledLogRequest(ctx, db, request)
+
+	// Logging a second response for a request must replace the first
+	duplicateLogResponse(ctx, db, request, response)
+
+	// Risk scores must come back exactly as the firewalls reported them
+	riskScorePrecision(ctx, db, request)
+
+	// IDs that aren't UUIDs must be rejected rather than stored as NULL
+	malformedIDs(ctx, db, request)
+
+	// Joining responses and firewall events must not multiply either
+	traceJoin(ctx, db, request, response)
+
+	// Gzipped archives must come out smaller than the raw trace
+	archiveCompression(ctx, db, request, response)
+
+	// Tokens the gateway counted must be stored where usage totals read them
+	countedUsage(ctx, db, request)
+
+	// Events logged together share a timestamp; explain must order them by evaluation
+	explainOrder(ctx, db, request)
+}
+
+// explainOrder logs a passed input evaluation and a blocked stream window in one batch,
+// in reverse, so every event shares evaluated_at, and checks the explanation puts them
+// back in order and is decided by the stream window
+func explainOrder(ctx context.Context, db *postgres.DB, request audit.Request) {
+	requestID, err := audit.LogRequest(ctx, request, db, audit.Options{})
+	if err != nil {
+		log.Fatal("Failed to log request:", err)
+	}
+
+	anyPolicy := func(blocked bool) *audit.Aggregation {
+		return &audit.Aggregation{Policy: "any", Blocked: blocked}
+	}
+	events := []audit.FirewallEvent{
+		{RequestID: requestID, FirewallID: "STREAM_PII", FirewallType: "pii", Blocked: true, BlockedReason: "message 0", Enforced: true, Aggregation: anyPolicy(true), Phase: audit.PhaseStream, Window: 2, Seq: 0},
+		{RequestID: requestID, FirewallID: "STREAM_PII", FirewallType: "pii", Enforced: true, Aggregation: anyPolicy(false), Phase: audit.PhaseStream, Window: 1, Seq: 0},
+		{RequestID: requestID, FirewallID: "INPUT_INJECTION", FirewallType: "prompt-injection", Enforced: true, Aggregation: anyPolicy(false), Phase: audit.PhaseInput, Seq: 1},
+		{RequestID: requestID, FirewallID: "INPUT_LENGTH", FirewallType: "length", Enforced: true, Aggregation: anyPolicy(false), Phase: audit.PhaseInput, Seq: 0},
+	}
+	if err := audit.LogFirewallEvents(ctx, events, db); err != nil {
+		log.Fatal("Failed to log firewall events:", err)
+	}
+
+	trace, err := audit.GetTrace(ctx, requestID, db)
+	if err != nil {
+		log.Fatalf("Failed to get trace %s: %v", requestID, err)
+	}
+	explanation := audit.Explain(trace)
+
+	order := []string{}
+	for _, evaluation := range explanation.Evaluations {
+		order = append(order, fmt.Sprintf("%s:%d:%s", evaluation.Phase, evaluation.Window, evaluation.FirewallID))
+	}
+	fmt.Printf("\nExplain order: %v, decided by %q\n", order, explanation.Decision)
+
+	expected := []string{"input:0:INPUT_LENGTH", "input:0:INPUT_INJECTION", "stream:1:STREAM_PII", "stream:2:STREAM_PII"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		log.Fatalf("Evaluations are in order %v, expected %v", order, expected)
+	}
+	if !explanation.Blocked || !explanation.Evaluations[3].Deciding {
+		log.Fatalf("Expected the second stream window to decide the block: %+v", explanation)
+	}
+	for _, evaluation := range explanation.Evaluations[:3] {
+		if evaluation.Deciding {
+			log.Fatalf("Evaluation %s:%d:%s decided nothing but is marked deciding", evaluation.Phase, evaluation.Window, evaluation.FirewallID)
+		}
+	}
+}
+
+// countedUsage logs a response the provider reported no usage for, along with the
+// gateway's own count, and checks the trace reads the count back
+func countedUsage(ctx context.Context, db *postgres.DB, request audit.Request) {
+	requestID, err := audit.LogRequest(ctx, request, db, audit.Options{})
+	if err != nil {
+		log.Fatal("Failed to log request:", err)
+	}
+
+	err = audit.LogResponse(ctx, audit.Response{
+		RequestID:    requestID,
+		Response:     map[string]interface{}{"choices": []interface{}{map[string]interface{}{"message": map[string]interface{}{"content": "Fire is hot."}}}},
+		LatencyMs:    150,
+		CountedUsage: &audit.TokenUsage{InputTokens: 14, OutputTokens: 4, TotalTokens: 18},
+	}, db)
+	if err != nil {
+		log.Fatal("Failed to log response:", err)
+	}
+
+	trace, err := audit.GetTrace(ctx, requestID, db)
+	if err != nil {
+		log.Fatalf("Failed to get trace %s: %v", requestID, err)
+	}
+
+	fmt.Printf("\nCounted usage: %d in, %d out, %d total\n", trace.InputTokens, trace.OutputTokens, trace.TotalTokens)
+	if trace.InputTokens != 14 || trace.OutputTokens != 4 || trace.TotalTokens != 18 {
+		log.Fatalf("Trace has %d/%d/%d tokens, expected the counted 14/4/18", trace.InputTokens, trace.OutputTokens, trace.TotalTokens)
+	}
+}
+
+// sizeStore is an in-memory ObjectStore that remembers the size of the last upload
+type sizeStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	last    int
+}
+
+func (s *sizeStore) UploadObject(bucketName, objectName string, data []byte, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucketName+"/"+objectName] = data
+	s.last = len(data)
+	return nil
+}
+
+func (s *sizeStore) DownloadObject(bucketName, objectName string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[bucketName+"/"+objectName]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return data, nil
+}
+
+// archiveCompression benchmarks archiving one trace with and without gzip, reporting
+// the size of each archive, and checks the gzipped archive is smaller and restores
+func archiveCompression(ctx context.Context, db *postgres.DB, request audit.Request, response audit.Response) {
+	// A long conversation, like the traces worth archiving
+	request.Inputs = nil
+	for i := 0; i < 50; i++ {
+		request.Inputs = append(request.Inputs, map[string]interface{}{"role": "user", "content": strings.Repeat("Tell me something cool. ", 20)})
+	}
+	requestID, err := audit.LogRequest(ctx, request, db, audit.Options{})
+	if err != nil {
+		log.Fatal("Failed to log request:", err)
+	}
+	response.RequestID = requestID
+	if err := audit.LogResponse(ctx, response, db); err != nil {
+		log.Fatal("Failed to log response:", err)
+	}
+
+	compression := audit.ArchiveCompression
+	defer func() { audit.ArchiveCompression = compression }()
+
+	store := &sizeStore{objects: map[string][]byte{}}
+	sizes := map[audit.Compression]int{}
+	for _, c := range []audit.Compression{audit.CompressionNone, audit.CompressionGzip} {
+		audit.ArchiveCompression = c
+		result := testing.Benchmark(func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := audit.ArchiveTrace(ctx, requestID, db, store); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(store.last), "bytes/archive")
+		})
+		sizes[c] = store.last
+		fmt.Printf("\nArchive (%s): %s\n", c, result)
+	}
+
+	if sizes[audit.CompressionGzip] >= sizes[audit.CompressionNone] {
+		log.Fatalf("Gzipped archive is %d bytes, not smaller than the raw %d", sizes[audit.CompressionGzip], sizes[audit.CompressionNone])
+	}
+	fmt.Printf("Gzip saves %.0f%% (%d -> %d bytes)\n",
+		100*(1-float64(sizes[audit.CompressionGzip])/float64(sizes[audit.CompressionNone])),
+		sizes[audit.CompressionNone], sizes[audit.CompressionGzip])
+
+	// The latest archive is gzipped and must read back as the same trace
+	trace, err := audit.RestoreTrace(ctx, requestID, db, store, false)
+	if err != nil {
+		log.Fatalf("Failed to restore gzipped archive: %v", err)
+	}
+	if len(trace.Inputs) != len(request.Inputs) {
+		log.Fatalf("Restored trace has %d inputs, expected %d", len(trace.Inputs), len(request.Inputs))
+	}
+}
+
+// traceJoin logs two responses and two firewall events for one request and checks the
+// trace, read alone and in a batch, holds each event once rather than once per response
+func traceJoin(ctx context.Context, db *postgres.DB, request audit.Request, response audit.Response) {
+	requestID, err := audit.LogRequest(ctx, request, db, audit.Options{})
+	if err != nil {
+		log.Fatal("Failed to log request:", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := response
+		resp.RequestID = requestID
+		resp.LatencyMs = int64(100 * (i + 1))
+		if err := audit.LogResponse(ctx, resp, db); err != nil {
+			log.Fatalf("Failed to log response %d: %v", i+1, err)
+		}
+	}
+	for _, firewallID := range []string{"NO_HATE_SPEECH", "NO_PII"} {
+		_, err := audit.LogFirewallEvent(ctx, audit.FirewallEvent{
+			RequestID:    requestID,
+			FirewallID:   firewallID,
+			FirewallType: "triggered",
+			RiskScore:    0.5,
+		}, db)
+		if err != nil {
+			log.Fatalf("Failed to log firewall event %s: %v", firewallID, err)
+		}
+	}
+
+	trace, err := audit.GetTrace(ctx, requestID, db)
+	if err != nil {
+		log.Fatalf("Failed to get trace %s: %v", requestID, err)
+	}
+	traces, err := audit.GetTraces(ctx, []string{requestID}, db)
+	if err != nil {
+		log.Fatalf("Failed to get traces: %v", err)
+	}
+
+	fmt.Printf("\nTrace join: %d events alone, %d in a batch\n", len(trace.FirewallInfo), len(traces[requestID].FirewallInfo))
+	for _, t := range []audit.Trace{trace, traces[requestID]} {
+		if len(t.FirewallInfo) != 2 {
+			log.Fatalf("Trace has %d firewall events, expected 2: %+v", len(t.FirewallInfo), t.FirewallInfo)
+		}
+		if t.FirewallInfo[0].FirewallID == t.FirewallInfo[1].FirewallID {
+			log.Fatalf("Trace repeats firewall event %s", t.FirewallInfo[0].FirewallID)
+		}
+		if t.LatencyMs != 200 {
+			log.Fatalf("Trace has latency %dms, expected the second response's 200ms", t.LatencyMs)
+		}
+	}
+}
+
+// malformedIDs logs requests whose user or API key ID isn't a UUID and checks each is
+// rejected, as is one without a user ID, while a missing API key ID is still accepted
+func malformedIDs(ctx context.Context, db *postgres.DB, request audit.Request) {
+	malformed := []struct {
+		userID   string
+		apiKeyID string
+	}{
+		{"not-a-uuid", request.APIKeyID},
+		{request.UserID, "12345"},
+		{"user-42", "key-42"},
+		{request.UserID + "0", request.APIKeyID},
+	}
+	for _, tc := range malformed {
+		bad := request
+		bad.UserID, bad.APIKeyID = tc.userID, tc.apiKeyID
+		if requestID, err := audit.LogRequest(ctx, bad, db, audit.Options{}); err == nil {
+			log.Fatalf("Logged request %s with user ID %q and API key ID %q", requestID, tc.userID, tc.apiKeyID)
+		}
+	}
+
+	noUser := request
+	noUser.UserID = ""
+	if requestID, err := audit.LogRequest(ctx, noUser, db, audit.Options{}); err == nil {
+		log.Fatalf("Logged request %s without a user ID", requestID)
+	}
+
+	noKey := request
+	noKey.APIKeyID = ""
+	if _, err := audit.LogRequest(ctx, noKey, db, audit.Options{}); err != nil {
+		log.Fatalf("Failed to log request without an API key ID: %v", err)
+	}
+
+	fmt.Printf("\nMalformed IDs: %d rejected\n", len(malformed)+1)
+}
+
+// riskScorePrecision logs firewall events with scores needing more than two decimal
+// places and checks the trace reads every one back unchanged
+func riskScorePrecision(ctx context.Context, db *postgres.DB, request audit.Request) {
+	requestID, err := audit.LogRequest(ctx, request, db, audit.Options{})
+	if err != nil {
+		log.Fatal("Failed to log request:", err)
+	}
+
+	scores := map[string]float64{
+		"SMALL":   0.0001234,
+		"PRECISE": 0.987654321,
+		"TINY":    1e-9,
+		"WHOLE":   1,
+	}
+	for firewallID, score := range scores {
+		_, err := audit.LogFirewallEvent(ctx, audit.FirewallEvent{
+			RequestID:    requestID,
+			FirewallID:   firewallID,
+			FirewallType: "triggered",
+			RiskScore:    score,
+		}, db)
+		if err != nil {
+			log.Fatalf("Failed to log firewall event with score %v: %v", score, err)
+		}
+	}
+
+	trace, err := audit.GetTrace(ctx, requestID, db)
+	if err != nil {
+		log.Fatalf("Failed to get trace %s: %v", requestID, err)
+	}
+
+	fmt.Printf("\nRisk score precision: %d events read back\n", len(trace.FirewallInfo))
+	if len(trace.FirewallInfo) != len(scores) {
+		log.Fatalf("Trace has %d firewall events, expected %d", len(trace.FirewallInfo), len(scores))
+	}
+	for _, event := range trace.FirewallInfo {
+		if want := scores[event.FirewallID]; event.RiskScore != want {
+			log.Fatalf("Firewall %s risk score read back as %v, expected %v", event.FirewallID, event.RiskScore, want)
+		}
+	}
+}
+
+// duplicateLogResponse logs two responses for one request, as a retry after a timeout
+// that actually succeeded would, and checks the trace holds only the second
+func duplicateLogResponse(ctx context.Context, db *postgres.DB, request audit.Request, response audit.Response) {
+	requestID, err := audit.LogRequest(ctx, request, db, audit.Options{})
+	if err != nil {
+		log.Fatal("Failed to log request:", err)
+	}
+
+	first := response
+	first.RequestID = requestID
+	if err := audit.LogResponse(ctx, first, db); err != nil {
+		log.Fatal("Failed to log first response:", err)
+	}
+
+	second := response
+	second.RequestID = requestID
+	second.Response = map[string]interface{}{"content": "Retried", "usage": map[string]interface{}{"prompt_tokens": 8, "completion_tokens": 1}}
+	second.LatencyMs = 300
+	if err := audit.LogResponse(ctx, second, db); err != nil {
+		log.Fatalf("Second LogResponse failed instead of replacing the first: %v", err)
+	}
+
+	trace, err := audit.GetTrace(ctx, requestID, db)
+	if err != nil {
+		log.Fatalf("Failed to get trace %s: %v", requestID, err)
+	}
+
+	fmt.Printf("\nDuplicate LogResponse: response %v, latency %dms\n", trace.Response["content"], trace.LatencyMs)
+	if trace.Response["content"] != "Retried" || trace.LatencyMs != 300 || trace.OutputTokens != 1 {
+		log.Fatal("Trace does not hold the second response")
+	}
+}
+
+// cancelledLogRequest checks LogRequest returns the context error immediately
+func cancelledLogRequest(ctx context.Context, db *postgres.DB, request audit.Request) {
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	start := time.Now()
+	_, err := audit.LogRequest(cancelled, request, db, audit.Options{})
+	elapsed := time.Since(start)
+
+	fmt.Printf("\nCancelled LogRequest: returned %v in %s\n", err, elapsed)
+	if !errors.Is(err, context.Canceled) {
+		log.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed > 10*time.Millisecond {
+		log.Fatalf("Cancelled LogRequest took %s", elapsed)
+	}
+}
+
+// concurrentLogRequests logs n requests (and their responses) in parallel and checks every one got its own row
+func concurrentLogRequests(ctx context.Context, db *postgres.DB, request audit.Request, response audit.Response, n int) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ids := make(map[string]struct{}, n)
+	errs := 0
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			requestID, err := audit.LogRequest(ctx, request, db, audit.Options{})
+			if err == nil {
+				resp := response
+				resp.RequestID = requestID
+				err = audit.LogResponse(ctx, resp, db)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs++
+				return
+			}
+			ids[requestID] = struct{}{}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	fmt.Printf("\nConcurrent LogRequest: %d calls in %s (%d errors, %d unique IDs)\n", n, elapsed, errs, len(ids))
+	if errs > 0 || len(ids) != n {
+		log.Fatal("Concurrent logging produced missing or duplicate rows")
+	}
+
+	// Every ID must resolve to a readable trace
+	for requestID := range ids {
+		trace, err := audit.GetTrace(ctx, requestID, db)
+		if err != nil {
+			log.Fatalf("Failed to get trace %s: %v", requestID, err)
+		}
+		if trace.Model != request.Model {
+			log.Fatalf("Trace %s has model %q, expected %q", requestID, trace.Model, request.Model)
+		}
+	}
+}
+
+// concurrentRegistry registers and unregisters n models while other goroutines read
+// them, and checks every read sees a whole model
+func concurrentRegistry(n int) {
+	registry := register.NewModelRegistry()
+	provider, err := types.NewModelProvider("openai")
+	if err != nil {
+		log.Fatal("Failed to create provider:", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	errs := 0
+	fail := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs++
+		log.Printf(format, args...)
+	}
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("model-%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			modelName, _ := types.NewName(name)
+			modelID, _ := types.NewModelID(name)
+			if err := registry.Register(user.Model{Name: modelName, Model: modelID, Provider: provider}); err != nil {
+				fail("Failed to register %s: %v", name, err)
+				return
+			}
+			if i%2 == 0 {
+				if err := registry.Unregister(name); err != nil {
+					fail("Failed to unregister %s: %v", name, err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if model, ok := registry.GetInfo(name); ok && model.Model.String() != name {
+				fail("Read a torn model %s: %+v", name, model)
+			}
+			for _, model := range registry.List() {
+				if model.Name.String() != model.Model.String() {
+					fail("Listed a torn model: %+v", model)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	listed := len(registry.List())
+	fmt.Printf("\nConcurrent registry: %d registrations (%d errors, %d models left)\n", n, errs, listed)
+	if errs > 0 || listed != n/2 {
+		log.Fatal("Concurrent registration left the registry inconsistent")
+	}
+}
+
+// modelNames checks the whitespace and casing clients have sent model names with, both
+// when parsing a name and when looking it up in a registry with each case policy
+func modelNames() {
+	parsed := []struct {
+		value    string
+		nameCase types.NameCase
+		want     string // Empty if the name is invalid
+	}{
+		{" gpt-4 ", types.PreserveCase, "gpt-4"},
+		{"gpt-4\n", types.PreserveCase, "gpt-4"},
+		{"\tgpt-4", types.PreserveCase, "gpt-4"},
+		{"GPT-4", types.PreserveCase, "GPT-4"},
+		{"GPT-4", types.FoldCase, "gpt-4"},
+		{" Claude-3.5-Sonnet ", types.FoldCase, "claude-3.5-sonnet"},
+		{"", types.PreserveCase, ""},
+		{"   ", types.PreserveCase, ""},
+		{"gpt 4", types.PreserveCase, ""},
+		{"gpt-4/turbo", types.FoldCase, ""},
+	}
+	for _, tc := range parsed {
+		name, err := types.NewNameWithCase(tc.value, tc.nameCase)
+		if tc.want == "" {
+			var nameErr *types.NameError
+			if !errors.As(err, &nameErr) {
+				log.Fatalf("NewName(%q) = %q, %v; expected a *types.NameError", tc.value, name.String(), err)
+			}
+			continue
+		}
+		if err != nil || name.String() != tc.want {
+			log.Fatalf("NewName(%q) = %q, %v; expected %q", tc.value, name.String(), err, tc.want)
+		}
+	}
+
+	provider, err := types.NewModelProvider("openai")
+	if err != nil {
+		log.Fatal("Failed to create provider:", err)
+	}
+	modelID, _ := types.NewModelID("gpt-4-0613")
+
+	lookups := []struct {
+		nameCase types.NameCase
+		lookup   string
+		found    bool
+	}{
+		{types.PreserveCase, "gpt-4", true},
+		{types.PreserveCase, " gpt-4 ", true},
+		{types.PreserveCase, "GPT-4", false},
+		{types.FoldCase, "GPT-4", true},
+		{types.FoldCase, " Gpt-4\t", true},
+		{types.FoldCase, "gpt-3.5", false},
+	}
+	for _, tc := range lookups {
+		registry := register.NewModelRegistry()
+		registry.NameCase = tc.nameCase
+		name, _ := types.NewName("gpt-4")
+		if err := registry.Register(user.Model{Name: name, Model: modelID, Provider: provider}); err != nil {
+			log.Fatal("Failed to register gpt-4:", err)
+		}
+		if _, found := registry.GetInfo(tc.lookup); found != tc.found {
+			log.Fatalf("GetInfo(%q) with case policy %d found %v, expected %v", tc.lookup, tc.nameCase, found, tc.found)
+		}
+	}
+
+	// A model registered with capitals is stored, and listed, by its folded name
+	registry := register.NewModelRegistry()
+	registry.NameCase = types.FoldCase
+	name, _ := types.NewName("GPT-4")
+	if err := registry.Register(user.Model{Name: name, Model: modelID, Provider: provider}); err != nil {
+		log.Fatal("Failed to register GPT-4:", err)
+	}
+	if err := registry.Register(user.Model{Name: name, Model: modelID, Provider: provider}); err == nil {
+		log.Fatal("Registered GPT-4 twice under a case-insensitive registry")
+	}
+	if listed := registry.List(); len(listed) != 1 || listed[0].Name.String() != "gpt-4" {
+		log.Fatalf("Listed %+v, expected only gpt-4", listed)
+	}
+
+	fmt.Printf("\nModel names: %d parsed, %d looked up\n", len(parsed), len(lookups))
 }